@@ -0,0 +1,59 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// FromAccount returns the url of the avatar for the given fediverse
+// handle, like "@user@example.social", "user@example.social" or
+// "acct:user@example.social". Handles are hashed like emails, and
+// federated on their instance domain, unless the instance advertises
+// an avatar through WebFinger (see SetWebFinger). Malformed handles are
+// rejected with ErrInvalidEmail.
+func (v *Libravatar) FromAccount(handle string) (string, error) {
+	addr, err := parseAccount(handle)
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	if v.webFinger {
+		if link, ok := v.webFingerAvatar(ctx, addr, v.useHTTPS); ok {
+			return link, nil
+		}
+	}
+	return v.process(ctx, addr, nil, v.params())
+}
+
+// parseAccount normalizes a fediverse handle into an address
+func parseAccount(handle string) (*mail.Address, error) {
+	if blank(handle) {
+		return nil, &LookupError{Stage: StageParse, Err: fmt.Errorf("%w %q: %w", ErrInvalidEmail, handle, ErrInvalidInput)}
+	}
+	h := strings.TrimSpace(handle)
+	if len(h) >= len("acct:") && strings.EqualFold(h[:len("acct:")], "acct:") {
+		h = h[len("acct:"):]
+	}
+	h = strings.TrimPrefix(h, "@")
+
+	user, host, found := strings.Cut(h, "@")
+	var err error
+	switch {
+	case !found || host == "":
+		err = fmt.Errorf("%w %q: missing host", ErrInvalidEmail, handle)
+	case user == "":
+		err = fmt.Errorf("%w %q: missing user", ErrInvalidEmail, handle)
+	case strings.ContainsAny(host, "@/?#: \t"):
+		err = fmt.Errorf("%w %q: invalid host", ErrInvalidEmail, handle)
+	}
+	if err != nil {
+		return nil, &LookupError{Domain: host, Stage: StageParse, Err: err}
+	}
+	return &mail.Address{Address: user + "@" + strings.ToLower(host)}, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestFromAccount(t *testing.T) {
+
+	var looked []string
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		looked = append(looked, name)
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+
+	want, err := avt.FromEmail("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"@alice@example.org", "alice@example.org", "acct:alice@example.org", "ACCT:alice@Example.ORG", " @alice@example.org "} {
+		looked = nil
+		avt.nameCache.purge()
+		got, err := avt.FromAccount(h)
+		if err != nil {
+			t.Errorf("FromAccount(%q): unexpected error %v", h, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("FromAccount(%q) == %s, expected %s", h, got, want)
+		}
+		if len(looked) != 1 || looked[0] != "example.org" {
+			t.Errorf("FromAccount(%q) looked up %v, expected example.org", h, looked)
+		}
+	}
+
+	for _, h := range []string{"", "@", "alice", "@alice", "acct:alice@", "@@example.org", "acct:@example.org", "alice@example.org@other.org", "alice@example.org/path"} {
+		if got, err := avt.FromAccount(h); err == nil {
+			t.Errorf("FromAccount(%q) == %s, expected an error", h, got)
+		}
+	}
+}
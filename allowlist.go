@@ -0,0 +1,71 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrDefaultURLNotAllowed is returned when setting a default image URL
+// whose host is not in the list set by SetDefaultURLAllowlist
+var ErrDefaultURLNotAllowed = errors.New("libravatar: default image URL not allowed")
+
+// SetDefaultURLAllowlist restricts default images given as URLs to
+// the given hosts and their subdomains, so that avatar URLs cannot
+// redirect anywhere. Matching is case-insensitive. Keywords like
+// IdentIcon are always allowed. Calling it without hosts removes
+// the restriction.
+//
+// Disallowed URLs are rejected by SetDefaultImage; one set before
+// the allowlist is not emitted in avatar URLs, or fails them with
+// ErrDefaultURLNotAllowed in strict mode.
+func (v *Libravatar) SetDefaultURLAllowlist(hosts ...string) {
+	if len(hosts) == 0 {
+		v.defaultURLAllowlist = nil
+	} else {
+		v.defaultURLAllowlist = make(map[string]bool, 2*len(hosts))
+		for _, h := range hosts {
+			h = strings.TrimPrefix(strings.ToLower(h), ".")
+			v.defaultURLAllowlist[h] = true
+			v.defaultURLAllowlist["."+h] = true
+		}
+	}
+	v.urlCache.purge()
+}
+
+// defaultURLAllowed tells whether defURL is a keyword or an URL
+// allowed by the list set by SetDefaultURLAllowlist
+func (v *Libravatar) defaultURLAllowed(defURL string) bool {
+	if v.defaultURLAllowlist == nil || defURL == "" || v.knownDefault(defURL) {
+		return true
+	}
+	// browsers take backslashes for slashes, making userinfo
+	// tricks like https://evil.com\@good.com/ point to evil.com
+	if strings.ContainsRune(defURL, '\\') {
+		return false
+	}
+	u, err := url.Parse(defURL)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, k := range domainKeys(u.Hostname()) {
+		if v.defaultURLAllowlist[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDefaultURLAllowed checks defURL is allowed by the list set by
+// SetDefaultURLAllowlist
+func (v *Libravatar) checkDefaultURLAllowed(defURL string) error {
+	if !v.defaultURLAllowed(defURL) {
+		return fmt.Errorf("%w: %w: %q", ErrInvalidConfig, ErrDefaultURLNotAllowed, defURL)
+	}
+	return nil
+}
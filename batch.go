@@ -0,0 +1,136 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"sync"
+)
+
+// domainMemo records the SRV targets found during a batch call, so
+// that each domain is resolved once per call, whether lookups are
+// cached or not
+type domainMemo struct {
+	mu sync.Mutex
+	m  map[domainMemoKey]*domainState
+}
+
+// domainMemoKey identifies a target recorded in a domainMemo
+type domainMemoKey struct {
+	host   string
+	secure bool
+}
+
+// domainState is a target recorded in a domainMemo, available once
+// done is closed
+type domainState struct {
+	done chan struct{}
+	rr   *net.SRV
+	err  error
+}
+
+// domainMemoCtxKey is the context key of the domainMemo of a batch call
+type domainMemoCtxKey struct{}
+
+// withDomainMemo returns a copy of ctx recording the targets found
+func withDomainMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, domainMemoCtxKey{}, &domainMemo{m: make(map[domainMemoKey]*domainState)})
+}
+
+// target returns the target recorded for host, calling find only the
+// first time it is asked for
+func (m *domainMemo) target(ctx context.Context, host string, secure bool, find func(context.Context, string, bool) (*net.SRV, error)) (*net.SRV, error) {
+	key := domainMemoKey{host, secure}
+	m.mu.Lock()
+	s, ok := m.m[key]
+	if !ok {
+		s = &domainState{done: make(chan struct{})}
+		m.m[key] = s
+	}
+	m.mu.Unlock()
+	if !ok {
+		s.rr, s.err = find(ctx, host, secure)
+		close(s.done)
+	}
+	select {
+	case <-s.done:
+		return s.rr, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// FromEmails returns the avatar URLs for the given emails, in the same
+// order. Each domain is resolved once, concurrently with the others,
+// up to the limit set by SetMaxConcurrentLookups, even if the SRV
+// cache is disabled.
+// Failures for single emails are reported in their Result; the
+// returned error is only set if ctx is done before completion.
+func (v *Libravatar) FromEmails(ctx context.Context, emails []string) ([]Result, error) {
+	ctx = withDomainMemo(ctx)
+	results := make([]Result, len(emails))
+	addrs := make(map[string]*mail.Address, len(emails))
+	seen := make(map[string]bool)
+	var domains []string
+	for i, e := range emails {
+		results[i].Email = e
+		if _, ok := addrs[e]; ok {
+			continue
+		}
+		addr, err := parseEmail(e)
+		if err != nil {
+			results[i].Err = err
+			addrs[e] = nil
+			continue
+		}
+		d, err := v.getDomain(addr, nil)
+		if err != nil {
+			results[i].Err = err
+			addrs[e] = nil
+			continue
+		}
+		addrs[e] = addr
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		if v.lookupNeeded(d) {
+			domains = append(domains, d)
+		}
+	}
+
+	failed := v.resolveDomains(ctx, domains)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p := v.params()
+	done := make(map[string]int, len(addrs))
+	for i, e := range emails {
+		if j, ok := done[e]; ok {
+			results[i] = results[j]
+			continue
+		}
+		done[e] = i
+		addr := addrs[e]
+		if addr == nil {
+			continue
+		}
+		d, err := v.getDomain(addr, nil)
+		if err == nil {
+			err = failed[d]
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		r, err := v.result(ctx, addr, nil, p)
+		r.Email, r.Err = e, err
+		results[i] = r
+	}
+	return results, nil
+}
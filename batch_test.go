@@ -0,0 +1,96 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFromEmails(t *testing.T) {
+
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		lookups[name]++
+		mu.Unlock()
+		if strings.HasPrefix(name, "broken") {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return "", []*net.SRV{{Target: "avatars." + name + ".", Port: 80}}, nil
+	}
+	avt.SetMaxConcurrentLookups(2)
+
+	emails := []string{
+		"one@a.example.org",
+		"not an email",
+		"two@b.example.org",
+		"one@a.example.org",
+		"three@a.example.org",
+		"user@broken.example.org",
+		"four@c.example.org",
+	}
+	results, err := avt.FromEmails(context.Background(), emails)
+	if err != nil {
+		t.Fatalf("FromEmails: unexpected error %v", err)
+	}
+	if len(results) != len(emails) {
+		t.Fatalf("FromEmails returned %d results, expected %d", len(results), len(emails))
+	}
+
+	for i, r := range results {
+		if r.Email != emails[i] {
+			t.Errorf("result %d is for %q, expected %q", i, r.Email, emails[i])
+		}
+		switch r.Email {
+		case "not an email", "user@broken.example.org":
+			if r.Err == nil || r.URL != "" {
+				t.Errorf("result for %q == %q, %v, expected an error", r.Email, r.URL, r.Err)
+			}
+		default:
+			want, err := avt.FromEmail(r.Email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Err != nil || r.URL != want {
+				t.Errorf("result for %q == %q, %v, expected %q", r.Email, r.URL, r.Err, want)
+			}
+		}
+	}
+
+	for _, d := range []string{"a.example.org", "b.example.org", "c.example.org", "broken.example.org"} {
+		if lookups[d] != 1 {
+			t.Errorf("%d lookups for %s, expected exactly one", lookups[d], d)
+		}
+	}
+	if len(lookups) != 4 {
+		t.Errorf("unexpected lookups %v", lookups)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := avt.FromEmails(ctx, []string{"user@d.example.org"}); err != context.Canceled {
+		t.Errorf("FromEmails with cancelled context: unexpected error %v", err)
+	}
+
+	// domains are resolved once per call even if lookups are not cached
+	for _, d := range []time.Duration{0, -1} {
+		avt.SetCacheDuration(d)
+		lookups = make(map[string]int)
+		results, err := avt.FromEmails(context.Background(), emails)
+		if err != nil || len(results) != len(emails) || results[0].URL == "" {
+			t.Fatalf("FromEmails with cache duration %v returned %v, %v", d, results, err)
+		}
+		if lookups["a.example.org"] != 1 || len(lookups) != 4 {
+			t.Errorf("lookups with cache duration %v: %v, expected one per domain", d, lookups)
+		}
+	}
+}
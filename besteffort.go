@@ -0,0 +1,62 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net/mail"
+	"net/url"
+)
+
+// FromEmailBestEffort returns the url of the avatar for the given
+// email, never failing. If the lookup fails, the URL of the avatar on
+// the fallback host is returned. If email cannot be parsed, the URL of
+// the default image on the fallback host is returned, forced with
+// f=y and using a hash of all zeros, so that every invalid email gets
+// the same URL.
+// Failures are reported to Metrics as ErrorKindBestEffort, besides
+// the usual lookup hooks and metrics.
+func (v *Libravatar) FromEmailBestEffort(email string) string {
+	p := v.params()
+	addr, err := parseEmail(email)
+	if err != nil {
+		return v.bestEffortDefault(p)
+	}
+	return v.bestEffortURL(addr, nil, p)
+}
+
+// FromURLBestEffort is like FromEmailBestEffort, for the given url
+// (typically for OpenID)
+func (v *Libravatar) FromURLBestEffort(openid string) string {
+	p := v.params()
+	ourl, err := parseOpenID(openid)
+	if err != nil || v.gravatarMode {
+		return v.bestEffortDefault(p)
+	}
+	return v.bestEffortURL(nil, ourl, p)
+}
+
+// bestEffortURL returns the avatar URL for email or openid, or the
+// one on the fallback host if the lookup fails
+func (v *Libravatar) bestEffortURL(email *mail.Address, openid *url.URL, p params) string {
+	r, err := v.result(context.Background(), email, openid, p)
+	if err == nil {
+		return r.URL
+	}
+	hash, err := v.hash(email, openid)
+	if err != nil {
+		return v.bestEffortDefault(p)
+	}
+	v.metrics.IncError(ErrorKindBestEffort)
+	return buildURL(v.fallbackBaseURL(p.secure), hash, p)
+}
+
+// bestEffortDefault returns the URL of the default image on the
+// fallback host
+func (v *Libravatar) bestEffortDefault(p params) string {
+	v.metrics.IncError(ErrorKindBestEffort)
+	p.force = true
+	return buildURL(v.fallbackBaseURL(p.secure), probeHash, p)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestBestEffort(t *testing.T) {
+
+	const invalid = "http://cdn.libravatar.org/avatar/00000000000000000000000000000000?d=identicon&f=y"
+	metrics := &recordingMetrics{}
+	avt := New()
+	avt.SetMetrics(metrics)
+	if err := avt.SetDefaultImage(IdentIcon); err != nil {
+		t.Fatal(err)
+	}
+	avt.SetDNSErrorPolicy(DNSErrorFail)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		switch name {
+		case "example.org":
+			return srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})(ctx, service, proto, name)
+		case "broken.example.org":
+			return "", nil, &net.DNSError{Err: "server misbehaving", Name: name}
+		}
+		return srvResponder()(ctx, service, proto, name)
+	}
+
+	cases := []struct {
+		email string
+		want  string
+		fails bool
+	}{
+		{"user@example.org", "http://avatars.example.org/avatar/" + hashOf("user@example.org") + "?d=identicon", false},
+		{"user@other.example.org", "http://cdn.libravatar.org/avatar/" + hashOf("user@other.example.org") + "?d=identicon", false},
+		{"user@broken.example.org", "http://cdn.libravatar.org/avatar/" + hashOf("user@broken.example.org") + "?d=identicon", true},
+		{"", invalid, true},
+		{"   ", invalid, true},
+		{"not an email", invalid, true},
+		{"@example.org", invalid, true},
+		{"user@", invalid, true},
+		{"<user@example.org", invalid, true},
+		{"\x00\xff", invalid, true},
+		{"user@exa mple.org", invalid, true},
+	}
+	for _, c := range cases {
+		got := avt.FromEmailBestEffort(c.email)
+		if got != c.want {
+			t.Errorf("FromEmailBestEffort(%q) == %q, expected %q", c.email, got, c.want)
+		}
+		if _, err := url.Parse(got); err != nil {
+			t.Errorf("FromEmailBestEffort(%q) == %q: %v", c.email, got, err)
+		}
+		if failed := slices.Contains(metrics.take(), "error "+ErrorKindBestEffort); failed != c.fails {
+			t.Errorf("FromEmailBestEffort(%q) reported failure %v, expected %v", c.email, failed, c.fails)
+		}
+	}
+
+	openids := []struct {
+		openid string
+		want   string
+	}{
+		{"https://example.org/user", "http://avatars.example.org/avatar/afd0bdb71652165892a3f7c119d235f3914090a6cf2bdf9232e6bb6c51786855?d=identicon"},
+		{"https://broken.example.org/user", "http://cdn.libravatar.org/avatar/20272edd1a2d337c41a2d3c4666e32e6be0e07ccf95b9a119cb3a497b4590aab?d=identicon"},
+		{"", invalid},
+		{"example.org/user", invalid},
+		{"ftp://example.org/user", invalid},
+		{"https://exa mple.org/", invalid},
+	}
+	for _, c := range openids {
+		if got := avt.FromURLBestEffort(c.openid); got != c.want {
+			t.Errorf("FromURLBestEffort(%q) == %q, expected %q", c.openid, got, c.want)
+		}
+	}
+
+	avt.SetGravatarMode(true)
+	if got := avt.FromURLBestEffort("https://example.org/user"); got == "" {
+		t.Errorf("FromURLBestEffort in Gravatar mode returned an empty string")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Cache stores SRV lookup results, so that they can be shared, for
+// example by the replicas of a service through Redis or memcached.
+// Keys are the names queried, like _avatars._tcp.example.org, and
+// values are opaque. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored for key, if any
+	Get(key string) ([]byte, bool)
+	// Set stores value for key, for at least ttl
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete removes the value stored for key, if any
+	Delete(key string)
+}
+
+// SetCache sets where SRV lookups are cached (nil, the default, for an
+// in-memory cache). The limits set by SetCacheMaxEntries only apply to
+// the in-memory cache. Failing over to backup SRV targets works with
+// any Cache, the lookups of failed targets being found through an index
+// kept in memory. The in-memory and URL caches are purged.
+func (v *Libravatar) SetCache(c Cache) {
+	v.sharedCache = c
+	v.nameCache.purge()
+	v.urlCache.purge()
+}
+
+// cacheRecord is a cacheValue as stored in a Cache
+type cacheRecord struct {
+	Target    *net.SRV      `json:"target,omitempty"`
+	Backups   []*net.SRV    `json:"backups,omitempty"`
+	Reason    string        `json:"reason"`
+	CheckedAt time.Time     `json:"checked_at"`
+	TTL       time.Duration `json:"ttl"`
+}
+
+// name returns the name queried for key, used as the key of a Cache
+func (key cacheKey) name() string {
+	return "_" + key.service + "._tcp." + key.domain
+}
+
+// getCache returns the SRV lookup cached for key, if any
+func (v *Libravatar) getCache(key cacheKey) (cacheValue, bool) {
+	if v.sharedCache == nil {
+		return v.nameCache.get(key)
+	}
+	b, found := v.sharedCache.Get(key.name())
+	if !found {
+		return cacheValue{}, false
+	}
+	var rec cacheRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		v.sharedCache.Delete(key.name())
+		return cacheValue{}, false
+	}
+	return cacheValue{
+		target:    rec.Target,
+		backups:   rec.Backups,
+		reason:    rec.Reason,
+		checkedAt: rec.CheckedAt,
+		ttl:       rec.TTL,
+	}, true
+}
+
+// setCache stores val in the SRV cache, unless disabled or val is
+// not to be cached
+func (v *Libravatar) setCache(key cacheKey, val cacheValue) {
+	if v.nameCacheDuration <= 0 || val.ttl <= 0 {
+		return
+	}
+	v.indexTarget(key, val)
+	if v.sharedCache == nil {
+		v.nameCache.set(key, val)
+		return
+	}
+	b, err := json.Marshal(cacheRecord{val.target, val.backups, val.reason, val.checkedAt, val.ttl})
+	if err != nil {
+		return
+	}
+	v.sharedCache.Set(key.name(), b, val.ttl)
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapCache is a Cache keeping values in a map
+type mapCache struct {
+	mu   sync.Mutex
+	m    map[string][]byte
+	ttls map[string]time.Duration
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{m: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (c *mapCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.m[key]
+	return b, ok
+}
+
+func (c *mapCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key], c.ttls[key] = value, ttl
+}
+
+func (c *mapCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, key)
+}
+
+func TestSharedCache(t *testing.T) {
+
+	shared := newMapCache()
+	r := &ttlResponder{ttl: 5 * time.Minute}
+	replicas := make([]*Libravatar, 2)
+	for i := range replicas {
+		replicas[i] = New()
+		replicas[i].SetTTLLookuper(r)
+		replicas[i].SetCache(shared)
+	}
+
+	want := "http://avatars.example.org/avatar/" + hashOf("user@example.org")
+	for i, avt := range replicas {
+		got, err := avt.FromEmail("user@example.org")
+		if err != nil || got != want {
+			t.Errorf("replica %d: FromEmail returned %q, %v, expected %q", i, got, err, want)
+		}
+		if n := avt.nameCache.len(); n != 0 {
+			t.Errorf("replica %d: %d in-memory cache entries, expected none", i, n)
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("%d lookups, expected replicas to share one", r.lookups)
+	}
+	if ttl := shared.ttls["_avatars._tcp.example.org"]; ttl != 5*time.Minute {
+		t.Errorf("lookup cached for %v, expected the record TTL", ttl)
+	}
+
+	// malformed values are dropped
+	shared.Set("_avatars._tcp.example.org", []byte("{"), time.Hour)
+	if _, err := replicas[0].FromEmail("user@example.org"); err != nil {
+		t.Errorf("FromEmail with a malformed cached value: unexpected error %v", err)
+	}
+	if r.lookups != 2 {
+		t.Errorf("%d lookups, expected a malformed value to be looked up again", r.lookups)
+	}
+	if _, ok := replicas[1].getCache(cacheKey{"avatars", "example.org"}); !ok {
+		t.Errorf("lookup not cached again after a malformed value")
+	}
+
+	// back to the in-memory cache
+	replicas[0].SetCache(nil)
+	replicas[0].FromEmail("user@example.org")
+	if n := replicas[0].nameCache.len(); n != 1 || r.lookups != 3 {
+		t.Errorf("%d lookups and %d in-memory cache entries, expected 3 and 1", r.lookups, n)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "context"
+
+// Candidate labels, see FromEmailAll
+const (
+	CandidateFederated = "federated" // the server found for the email domain
+	CandidateCDN       = "cdn"       // the fallback host
+	CandidateGravatar  = "gravatar"  // Gravatar, see SetGravatarCandidate
+)
+
+// Candidate is an URL the avatar of an identity can be fetched from
+type Candidate struct {
+	URL   string
+	Label string // CandidateFederated, CandidateCDN or CandidateGravatar
+}
+
+// SetGravatarCandidate sets whether FromEmailAll also returns the
+// Gravatar URL of avatars
+func (v *Libravatar) SetGravatarCandidate(include bool) {
+	v.gravatarCandidate = include
+}
+
+// FromEmailAll returns the URLs the avatar for the given email can be
+// fetched from, in order of preference, for clients to try in turn:
+// the server found for the email domain, if any, the fallback host,
+// then Gravatar if enabled by SetGravatarCandidate.
+// In Gravatar mode, only the Gravatar URL is returned.
+func (v *Libravatar) FromEmailAll(ctx context.Context, email string) ([]Candidate, error) {
+	r, err := v.emailResult(ctx, email, v.params())
+	if err != nil {
+		return nil, err
+	}
+	if v.gravatarMode {
+		return []Candidate{{r.URL, CandidateGravatar}}, nil
+	}
+
+	var candidates []Candidate
+	p := v.params()
+	cdn := buildURL(v.fallbackBaseURL(p.secure), r.Hash, p)
+	if r.URL != cdn {
+		candidates = append(candidates, Candidate{r.URL, CandidateFederated})
+	}
+	candidates = append(candidates, Candidate{cdn, CandidateCDN})
+	if v.gravatarCandidate {
+		host := gravatarHost
+		if p.secure {
+			host = gravatarSecureHost
+		}
+		p.gravatarDefault = ""
+		candidates = append(candidates, Candidate{buildURL(gravatarDefaultScheme(p.secure)+"://"+host, r.Hash, p), CandidateGravatar})
+	}
+	return candidates, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFromEmailAll(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "federated.org" {
+			return srvResponder(&net.SRV{Target: "avatars.federated.org.", Port: 80})(ctx, service, proto, name)
+		}
+		return srvResponder()(ctx, service, proto, name)
+	}
+	avt.SetAvatarSize(48)
+	avt.SetDefaultImage(IdentIcon)
+
+	fed := hashOf("user@federated.org")
+	cases := []struct {
+		email    string
+		gravatar bool
+		want     []Candidate
+	}{
+		{"user@federated.org", false, []Candidate{
+			{"http://avatars.federated.org/avatar/" + fed + "?d=identicon&s=48", CandidateFederated},
+			{"http://cdn.libravatar.org/avatar/" + fed + "?d=identicon&s=48", CandidateCDN},
+		}},
+		{"user@example.org", false, []Candidate{
+			{"http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27?d=identicon&s=48", CandidateCDN},
+		}},
+		{"user@example.org", true, []Candidate{
+			{"http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27?d=identicon&s=48", CandidateCDN},
+			{"http://www.gravatar.com/avatar/572c3489ea700045927076136a969e27?d=identicon&s=48", CandidateGravatar},
+		}},
+	}
+	for _, c := range cases {
+		avt.SetGravatarCandidate(c.gravatar)
+		got, err := avt.FromEmailAll(context.Background(), c.email)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("FromEmailAll(%s) with gravatar %v == %v, %v, expected %v", c.email, c.gravatar, got, err, c.want)
+		}
+	}
+
+	avt.SetGravatarMode(true)
+	got, err := avt.FromEmailAll(context.Background(), "user@federated.org")
+	want := []Candidate{{"http://www.gravatar.com/avatar/" + fed + "?d=identicon&s=48", CandidateGravatar}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("FromEmailAll in Gravatar mode == %v, %v, expected %v", got, err, want)
+	}
+
+	if _, err := avt.FromEmailAll(context.Background(), "not an email"); err == nil {
+		t.Errorf("FromEmailAll of an invalid email: expected an error")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// probeHash is the hash requested when probing avatar servers
+const probeHash = "00000000000000000000000000000000"
+
+// DomainReport describes the avatar federation setup of a domain,
+// see CheckDomain
+type DomainReport struct {
+	Domain   string
+	Plain    ServiceReport // for http
+	Secure   ServiceReport // for https
+	Duration time.Duration // total time taken by the check
+}
+
+// ServiceReport describes the SRV records of a service and the server
+// they point to
+type ServiceReport struct {
+	Service     string     // the SRV service queried
+	Records     []*net.SRV // all the records found
+	Rejected    []*net.SRV // records with an invalid target or port
+	Err         error      // the DNS error met, nil if none or if there are no records
+	Selected    *net.SRV   // the record avatars would be fetched from, nil for the fallback host
+	Reason      string     // why Selected was chosen
+	ProbeURL    string     // URL requested to check the server, empty if not probed
+	ProbeStatus int        // HTTP status of the probe, 0 if the server did not answer
+	ProbeErr    error      // why the server did not answer
+}
+
+// Exists tells whether the service has a record
+func (r ServiceReport) Exists() bool {
+	return len(r.Records) > 0
+}
+
+// CheckDomain checks the avatar federation setup of domain: the SRV
+// records for both http and https, which target would be selected and
+// whether it answers avatar requests.
+// The cache is neither used nor updated.
+func (v *Libravatar) CheckDomain(ctx context.Context, domain string) (*DomainReport, error) {
+	domain, err := canonicalDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	report := &DomainReport{
+		Domain: domain,
+		Plain:  v.checkService(ctx, v.serviceBase, domain, "http", 80),
+		Secure: v.checkService(ctx, v.secureServiceBase, domain, "https", 443),
+	}
+	report.Duration = time.Since(start)
+	return report, ctx.Err()
+}
+
+// checkService checks the records of service at domain
+func (v *Libravatar) checkService(ctx context.Context, service, domain, scheme string, defaultPort uint16) ServiceReport {
+	r := ServiceReport{Service: service}
+
+	addrs, _, err := v.querySRV(ctx, service, domain)
+	if err != nil && !isNotFound(err) {
+		r.Err = err
+	}
+	r.Records = addrs
+
+	valid := validSRVRecords(addrs)
+	for _, rr := range addrs {
+		if !validSRVTarget(rr.Target, int(rr.Port)) {
+			r.Rejected = append(r.Rejected, rr)
+		}
+	}
+
+	switch {
+	case len(addrs) == 0:
+		r.Reason = "no records, the fallback host would be used"
+		return r
+	case len(valid) == 0:
+		r.Reason = "no valid records, the fallback host would be used"
+		return r
+	}
+	r.Selected = v.selectSRV(valid)
+	r.Reason = selectionReason(valid, r.Selected)
+
+	r.ProbeURL = fmt.Sprintf("%s://%s/avatar/%s?d=%s", scheme, srvHost(r.Selected, defaultPort), probeHash, HTTP404)
+	resp, err := v.send(ctx, http.MethodGet, r.ProbeURL, nil)
+	if err != nil {
+		r.ProbeErr = err
+		return r
+	}
+	resp.Body.Close()
+	r.ProbeStatus = resp.StatusCode
+	return r
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckDomain(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/avatar/"+probeHash || r.URL.Query().Get("d") != HTTP404 {
+			t.Errorf("unexpected probe %s", r.URL)
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	healthy := serverResponder(t, srv)
+	broken := serverResponder(t, dead)
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service != "avatars" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		switch name {
+		case "healthy.example.org":
+			return healthy(ctx, service, proto, name)
+		case "dead.example.org":
+			return broken(ctx, service, proto, name)
+		case "priority.example.org":
+			return srvResponder(
+				&net.SRV{Target: "primary.example.org.", Port: 80, Priority: 0, Weight: 1},
+				&net.SRV{Target: "backup.example.org.", Port: 80, Priority: 10, Weight: 1},
+			)(ctx, service, proto, name)
+		}
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	r, err := avt.CheckDomain(context.Background(), "healthy.example.org")
+	if err != nil {
+		t.Fatalf("CheckDomain: unexpected error %v", err)
+	}
+	if !r.Plain.Exists() || r.Plain.Selected == nil || r.Plain.ProbeStatus != http.StatusNotFound || r.Plain.ProbeErr != nil {
+		t.Errorf("healthy domain plain report: %+v", r.Plain)
+	}
+	if r.Secure.Exists() || r.Secure.Selected != nil || r.Secure.ProbeURL != "" || r.Secure.Err != nil {
+		t.Errorf("healthy domain secure report: %+v", r.Secure)
+	}
+
+	r, _ = avt.CheckDomain(context.Background(), "dead.example.org")
+	if !r.Plain.Exists() || r.Plain.ProbeStatus != 0 || r.Plain.ProbeErr == nil {
+		t.Errorf("dead domain plain report: %+v", r.Plain)
+	}
+
+	// the reason given agrees with the lookup
+	r, _ = avt.CheckDomain(context.Background(), "priority.example.org")
+	d, err := avt.LookupDetails(context.Background(), "user@priority.example.org")
+	if err != nil || r.Plain.Reason != d.SelectionReason || r.Plain.Reason != "only valid record of the lowest priority 0" {
+		t.Errorf("single top-priority record selected because %q, lookup says %q, %v", r.Plain.Reason, d.SelectionReason, err)
+	}
+	avt.nameCache.purge()
+
+	r, _ = avt.CheckDomain(context.Background(), "none.example.org")
+	if r.Plain.Exists() || r.Secure.Exists() || r.Plain.Reason == "" {
+		t.Errorf("domain without records report: %+v", r)
+	}
+
+	if avt.nameCache.len() != 0 {
+		t.Errorf("CheckDomain created %d cache entries, expected none", avt.nameCache.len())
+	}
+	if _, err := avt.CheckDomain(context.Background(), ""); err == nil {
+		t.Errorf("CheckDomain with empty domain: expected an error")
+	}
+}
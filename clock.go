@@ -0,0 +1,30 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "time"
+
+// Clock tells the time used for cache expiry and scheduling
+type Clock interface {
+	Now() time.Time
+	// After is like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock sets the clock used to expire cached lookups, URLs, images
+// and failures, and to schedule prefetching (nil for the system clock,
+// the default). It is mostly useful for tests.
+func (v *Libravatar) SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	v.clock = c
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock only moving forward when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration // receives the durations passed to After
+}
+
+// fakeTimer is a channel returned by fakeClock.After
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC),
+		waiting: make(chan time.Duration, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	}
+	select {
+	case c.waiting <- d:
+	default:
+	}
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the timers due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestClockLookupExpiry(t *testing.T) {
+
+	lookups := 0
+	clock := newFakeClock()
+	avt := New()
+	avt.SetClock(clock)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})(ctx, service, proto, name)
+	}
+
+	steps := []struct {
+		advance time.Duration
+		lookups int
+	}{
+		{0, 1},
+		{avt.nameCacheDuration - time.Nanosecond, 1}, // just before expiry
+		{time.Nanosecond, 1},                         // at expiry
+		{time.Nanosecond, 2},                         // just after
+		{time.Hour, 2},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		if _, err := avt.FromEmail("user@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		if lookups != s.lookups {
+			t.Errorf("step %d: %d lookups, expected %d", i, lookups, s.lookups)
+		}
+	}
+}
+
+func TestClockNotFoundExpiry(t *testing.T) {
+
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	clock := newFakeClock()
+	avt := New()
+	avt.SetClock(clock)
+	avt.lookupSRV = srvResponder()
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+
+	steps := []struct {
+		advance time.Duration
+		hits    int
+	}{
+		{0, 1},
+		{defaultNotFoundCacheTTL - time.Nanosecond, 1},
+		{2 * time.Nanosecond, 2},
+		{time.Minute, 2},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		avt.GetAvatar(context.Background(), "user@example.org")
+		if hits != s.hits {
+			t.Errorf("step %d: %d upstream requests, expected %d", i, hits, s.hits)
+		}
+	}
+}
+
+func TestClockPrefetcher(t *testing.T) {
+
+	clock := newFakeClock()
+	events := make(chan PrefetchEvent, 10)
+	avt := New()
+	avt.SetClock(clock)
+	avt.lookupSRV = srvResponder()
+	avt.SetPrefetchHook(func(ev PrefetchEvent) { events <- ev })
+	avt.Watch("a@example.org", "b@example.org")
+	avt.StartPrefetcher(context.Background(), time.Hour)
+	defer avt.Close()
+
+	for _, email := range []string{"a@example.org", "b@example.org", "a@example.org"} {
+		select {
+		case ev := <-events:
+			if ev.Email != email {
+				t.Errorf("prefetched %s, expected %s", ev.Email, email)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not prefetched", email)
+		}
+		// the prefetcher waits for half the interval between emails
+		if d := <-clock.waiting; d != 30*time.Minute {
+			t.Errorf("prefetcher waiting for %v, expected 30m", d)
+		}
+		select {
+		case ev := <-events:
+			t.Errorf("%s prefetched before the clock advanced", ev.Email)
+		default:
+		}
+		clock.Advance(30 * time.Minute)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// conditionalUpstream serves testPNG honoring validators, counting
+// the body bytes it sends
+type conditionalUpstream struct {
+	etag         string // empty for no validators
+	lastModified string
+	sent         int
+}
+
+func (u *conditionalUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.etag != "" {
+		w.Header().Set("ETag", u.etag)
+		w.Header().Set("Last-Modified", u.lastModified)
+		if r.Header.Get("If-None-Match") == u.etag || r.Header.Get("If-Modified-Since") == u.lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	n, _ := w.Write(testPNG)
+	u.sent += n
+}
+
+func TestConditionalGetAvatar(t *testing.T) {
+
+	up := &conditionalUpstream{etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	srv := httptest.NewServer(up)
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatalf("GetAvatar: unexpected error %v", err)
+	}
+	if a.ETag != up.etag || a.LastModified != up.lastModified || a.NotModified {
+		t.Errorf("GetAvatar == %+v, expected validators to be reported", a)
+	}
+
+	up.sent = 0
+	b, err := avt.GetAvatarIfModified(context.Background(), "user@example.org", a)
+	if err != nil {
+		t.Fatalf("GetAvatarIfModified: unexpected error %v", err)
+	}
+	if !b.NotModified || !bytes.Equal(b.Data, testPNG) || up.sent != 0 {
+		t.Errorf("GetAvatarIfModified == %+v, with %d bytes sent, expected not modified", b, up.sent)
+	}
+
+	// changed upstream
+	up.etag = `"v2"`
+	up.lastModified = "Tue, 03 Jan 2006 15:04:05 GMT"
+	b, err = avt.GetAvatarIfModified(context.Background(), "user@example.org", a)
+	if err != nil || b.NotModified || b.ETag != `"v2"` {
+		t.Errorf("GetAvatarIfModified after change == %+v, %v", b, err)
+	}
+
+	// no validators upstream
+	up.etag = ""
+	b, err = avt.GetAvatarIfModified(context.Background(), "user@example.org", a)
+	if err != nil || b.NotModified || !bytes.Equal(b.Data, testPNG) {
+		t.Errorf("GetAvatarIfModified without validators == %+v, %v", b, err)
+	}
+}
+
+func TestConditionalHandler(t *testing.T) {
+
+	up := &conditionalUpstream{etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	upstream := httptest.NewServer(up)
+	defer upstream.Close()
+
+	avt := New()
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+	srv := httptest.NewServer(avt.Handler())
+	defer srv.Close()
+
+	link := srv.URL + "/avatars/572c3489ea700045927076136a969e27"
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("ETag") != up.etag || resp.Header.Get("Last-Modified") != up.lastModified {
+		t.Errorf("validators not passed through: %v", resp.Header)
+	}
+
+	for _, hdr := range [][2]string{{"If-None-Match", `"v1"`}, {"If-Modified-Since", up.lastModified}} {
+		up.sent = 0
+		req, _ := http.NewRequest(http.MethodGet, link, nil)
+		req.Header.Set(hdr[0], hdr[1])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified || len(body) != 0 || up.sent != 0 {
+			t.Errorf("%s: status %d, %d bytes received, %d sent upstream, expected a bodyless 304", hdr[0], resp.StatusCode, len(body), up.sent)
+		}
+	}
+
+	up.etag = ""
+	req, _ := http.NewRequest(http.MethodGet, link, nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, testPNG) {
+		t.Errorf("without upstream validators: status %d, body %q, expected the full image", resp.StatusCode, body)
+	}
+}
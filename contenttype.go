@@ -0,0 +1,105 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrContentTypeNotAllowed is returned when a server sends an avatar
+// of a content type not allowed by SetAllowedContentTypes, or whose
+// content does not match the declared type.
+// For types which are not images, the error also matches ErrNotAnImage.
+var ErrContentTypeNotAllowed = errors.New("libravatar: content type not allowed")
+
+// defaultAllowedTypes are the content types allowed by default
+var defaultAllowedTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// sniffLen is the number of bytes used to detect content types
+const sniffLen = 512
+
+// SetAllowedContentTypes sets the content types accepted from avatar
+// servers: by default PNG, JPEG, GIF and WebP images.
+// The content of the images must match the declared type.
+// Calling it with no types accepts anything.
+func (v *Libravatar) SetAllowedContentTypes(types ...string) {
+	if len(types) == 0 {
+		v.allowedTypes = nil
+		return
+	}
+	v.allowedTypes = typeSet(types)
+}
+
+// typeSet returns the set of the media types in types
+func typeSet(types []string) map[string]bool {
+	set := make(map[string]bool, len(types))
+	for _, t := range types {
+		set[strings.ToLower(t)] = true
+	}
+	return set
+}
+
+// checkContentType checks the declared content type of an avatar
+// is allowed and matches its first bytes, in head (nil to skip that)
+func (v *Libravatar) checkContentType(declared string, head []byte) error {
+	err := v.contentTypeError(declared, head)
+	if err != nil {
+		v.metrics.IncError(ErrorKindContentType)
+	}
+	return err
+}
+
+// contentTypeError implements checkContentType
+func (v *Libravatar) contentTypeError(declared string, head []byte) error {
+	if v.allowedTypes == nil {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil || !v.allowedTypes[mediaType] {
+		if !strings.HasPrefix(mediaType, "image/") {
+			return fmt.Errorf("%w: %w: %q", ErrContentTypeNotAllowed, ErrNotAnImage, declared)
+		}
+		return fmt.Errorf("%w: %q", ErrContentTypeNotAllowed, declared)
+	}
+	if head == nil {
+		return nil
+	}
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if mediaType == "image/svg+xml" && (sniffed == "text/xml" || sniffed == "text/plain") {
+		// content sniffing does not recognize SVG
+		sniffed = mediaType
+	}
+	if sniffed != mediaType {
+		return fmt.Errorf("%w: %q declared, %q found", ErrContentTypeNotAllowed, mediaType, sniffed)
+	}
+	return nil
+}
+
+// checkedBody returns the (size limited) body of resp, after checking
+// its content type
+func (v *Libravatar) checkedBody(resp *http.Response) (io.Reader, error) {
+	body := limitBody(resp.Body, v.maxBodySize)
+	if v.allowedTypes == nil {
+		return body, nil
+	}
+	br := bufio.NewReaderSize(body, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && len(head) == 0 {
+		return nil, err
+	}
+	if err := v.checkContentType(resp.Header.Get("Content-Type"), head); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
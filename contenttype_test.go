@@ -0,0 +1,95 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedContentTypes(t *testing.T) {
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	type body struct {
+		ctype string
+		data  []byte
+	}
+	bodies := map[string]body{
+		hashOf("png@example.org"):  {"image/png", testPNG},
+		hashOf("svg@example.org"):  {"image/svg+xml", svg},
+		hashOf("fake@example.org"): {"image/png", svg},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := bodies[r.URL.Path[len("/avatar/"):]]
+		w.Header().Set("Content-Type", b.ctype)
+		w.Write(b.data)
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	ctx := context.Background()
+
+	hsrv := httptest.NewServer(avt.Handler(HandlerAllowEmail(), HandlerBlockPrivateTargets(false)))
+	defer hsrv.Close()
+
+	cases := []struct {
+		email   string
+		allowed bool
+	}{
+		{"png@example.org", true},
+		{"svg@example.org", false},
+		{"fake@example.org", false},
+	}
+	for _, c := range cases {
+		_, err := avt.GetAvatar(ctx, c.email)
+		if c.allowed != (err == nil) || (err != nil && !errors.Is(err, ErrContentTypeNotAllowed)) {
+			t.Errorf("GetAvatar(%s): unexpected error %v", c.email, err)
+		}
+
+		var w bytes.Buffer
+		_, _, err = avt.WriteAvatar(ctx, &w, c.email)
+		if c.allowed != (err == nil) || (err != nil && (!errors.Is(err, ErrContentTypeNotAllowed) || w.Len() != 0)) {
+			t.Errorf("WriteAvatar(%s): unexpected error %v, wrote %d bytes", c.email, err, w.Len())
+		}
+
+		resp, err := http.Get(hsrv.URL + "/" + c.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		status := http.StatusOK
+		if !c.allowed {
+			status = http.StatusBadGateway
+		}
+		if resp.StatusCode != status {
+			t.Errorf("handler for %s: status %d, expected %d", c.email, resp.StatusCode, status)
+		}
+		if h := resp.Header.Get("X-Content-Type-Options"); h != "nosniff" {
+			t.Errorf("handler for %s: X-Content-Type-Options %q, expected nosniff", c.email, h)
+		}
+		if h := resp.Header.Get("Content-Disposition"); h != `inline; filename="`+hashOf(c.email)+`"` {
+			t.Errorf("handler for %s: unexpected Content-Disposition %q", c.email, h)
+		}
+	}
+
+	// SVG can be explicitly allowed, but must still be what it claims
+	avt.SetAllowedContentTypes("image/png", "image/svg+xml")
+	if _, err := avt.GetAvatar(ctx, "fake@example.org"); !errors.Is(err, ErrContentTypeNotAllowed) {
+		t.Errorf("GetAvatar of mislabeled SVG: unexpected error %v", err)
+	}
+	if _, err := avt.GetAvatar(ctx, "svg@example.org"); err != nil {
+		t.Errorf("GetAvatar of allowed SVG: unexpected error %v", err)
+	}
+
+	avt.SetAllowedContentTypes()
+	if _, err := avt.GetAvatar(ctx, "svg@example.org"); err != nil {
+		t.Errorf("GetAvatar of SVG with no allowlist: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// customAvatarSize is the size of the images compared by
+// HasCustomAvatar, small to keep downloads cheap
+const customAvatarSize = 16
+
+// HasCustomAvatar tells whether an avatar was uploaded for the given
+// email, even on servers serving generated default images rather
+// than 404 errors. The avatar is compared with the default image,
+// requested with SetForceDefault semantics: if both have strong
+// ETags, those are compared without downloading the default image.
+func (v *Libravatar) HasCustomAvatar(ctx context.Context, email string) (bool, error) {
+	p := v.params()
+	p.size = v.clampSize(customAvatarSize)
+	p.force = false
+	// a Gravatar default would be served instead of the default image
+	p.gravatarDefault = ""
+	link, err := v.emailURL(ctx, email, p)
+	if err != nil {
+		return false, err
+	}
+	p.force = true
+	defLink, err := v.emailURL(ctx, email, p)
+	if err != nil {
+		return false, err
+	}
+
+	avatar, etag, err := v.fetchBody(ctx, http.MethodGet, link)
+	if errors.Is(err, ErrNoAvatar) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if etag != "" {
+		_, defETag, err := v.fetchBody(ctx, http.MethodHead, defLink)
+		if errors.Is(err, ErrNoAvatar) {
+			return true, nil
+		}
+		if err == nil && defETag != "" {
+			return etag != defETag, nil
+		}
+		// compare bodies, also if servers do not support HEAD
+	}
+
+	def, _, err := v.fetchBody(ctx, http.MethodGet, defLink)
+	if errors.Is(err, ErrNoAvatar) {
+		// no default image to be confused with, as with HTTP404
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(avatar, def), nil
+}
+
+// fetchBody fetches link, returning the body (unless method is HEAD)
+// and the strong ETag, if any
+func (v *Libravatar) fetchBody(ctx context.Context, method, link string) ([]byte, string, error) {
+	resp, err := v.fetch(ctx, method, link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		etag = ""
+	}
+	if method == http.MethodHead {
+		return nil, etag, nil
+	}
+	data, err := io.ReadAll(limitBody(resp.Body, v.maxBodySize))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, etag, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHasCustomAvatar(t *testing.T) {
+
+	custom := hashOf("custom@example.org")
+	etagged := hashOf("etagged@example.org")
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		requests = append(requests, r.Method+" f="+q.Get("f"))
+		if strings.Contains(q.Get("d"), "gravatar") {
+			t.Errorf("request for %s, expected no Gravatar default", r.URL)
+		}
+		if q.Get("s") != "16" {
+			t.Errorf("request for %s, expected size 16", r.URL)
+		}
+		hash := r.URL.Path[len("/avatar/"):]
+		forced := q.Get("f") == "y"
+		w.Header().Set("Content-Type", "image/png")
+		switch {
+		case hash == etagged && forced:
+			w.Header().Set("ETag", `"identicon"`)
+		case hash == etagged:
+			w.Header().Set("ETag", `"uploaded"`)
+		case hash == custom && !forced:
+			w.Write(pngLike([]byte("uploaded")))
+			return
+		}
+		if r.Method == http.MethodGet {
+			w.Write(pngLike([]byte("identicon")))
+		}
+	}))
+	defer upstream.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, upstream)
+
+	cases := []struct {
+		email    string
+		want     bool
+		requests []string
+	}{
+		{"stranger@example.org", false, []string{"GET f=", "GET f=y"}},
+		{"custom@example.org", true, []string{"GET f=", "GET f=y"}},
+		{"etagged@example.org", true, []string{"GET f=", "HEAD f=y"}},
+	}
+	for i, c := range append(cases, cases...) {
+		// also with Gravatar defaults, which must not be requested
+		avt.SetGravatarDefault(i >= len(cases))
+		requests = nil
+		got, err := avt.HasCustomAvatar(context.Background(), c.email)
+		if err != nil || got != c.want {
+			t.Errorf("HasCustomAvatar(%s) == %v, %v, expected %v", c.email, got, err, c.want)
+		}
+		if len(requests) != len(c.requests) {
+			t.Errorf("HasCustomAvatar(%s) sent %v, expected %v", c.email, requests, c.requests)
+			continue
+		}
+		for i := range requests {
+			if requests[i] != c.requests[i] {
+				t.Errorf("HasCustomAvatar(%s) sent %v, expected %v", c.email, requests, c.requests)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"encoding/base64"
+	"mime"
+	"strings"
+)
+
+// SetMaxDataURISize sets the length of the longest data URI returned
+// by DataURI (0 for no limit other than the one set by SetMaxBodySize)
+func (v *Libravatar) SetMaxDataURISize(size int) {
+	v.maxDataURISize = size
+}
+
+// DataURI returns the avatar image for the given email, inlined as
+// a base64 data URI
+func (v *Libravatar) DataURI(ctx context.Context, email string) (string, error) {
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return "", err
+	}
+
+	maxSize := v.maxBodySize
+	if v.maxDataURISize > 0 {
+		// no point in downloading what cannot be encoded
+		decoded := int64(base64.StdEncoding.DecodedLen(v.maxDataURISize))
+		if maxSize <= 0 || decoded < maxSize {
+			maxSize = decoded
+		}
+	}
+
+	a, err := v.getAvatar(ctx, link, maxSize, nil)
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, _, err := mime.ParseMediaType(a.ContentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return "", ErrNotAnImage
+	}
+
+	var b strings.Builder
+	b.Grow(len("data:;base64,") + len(mediaType) + base64.StdEncoding.EncodedLen(len(a.Data)))
+	b.WriteString("data:")
+	b.WriteString(mediaType)
+	b.WriteString(";base64,")
+	b.WriteString(base64.StdEncoding.EncodeToString(a.Data))
+	if v.maxDataURISize > 0 && b.Len() > v.maxDataURISize {
+		return "", ErrBodyTooLarge
+	}
+	return b.String(), nil
+}
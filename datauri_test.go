@@ -0,0 +1,68 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDataURI(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("d") == HTTP404:
+			http.NotFound(w, r)
+		case strings.HasSuffix(r.URL.Path, "/572c3489ea700045927076136a969e27"):
+			w.Header().Set("Content-Type", "image/png; charset=binary")
+			w.Write(testPNG)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>oops</html>"))
+		}
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+
+	got, err := avt.DataURI(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatalf("DataURI: unexpected error %v", err)
+	}
+	const prefix = "data:image/png;base64,"
+	if !strings.HasPrefix(got, prefix) {
+		t.Fatalf("DataURI == %q, expected prefix %q", got, prefix)
+	}
+	data, err := base64.StdEncoding.DecodeString(got[len(prefix):])
+	if err != nil || !bytes.Equal(data, testPNG) {
+		t.Errorf("DataURI payload decodes to %q, %v", data, err)
+	}
+
+	if _, err := avt.DataURI(context.Background(), "other@example.org"); !errors.Is(err, ErrNotAnImage) {
+		t.Errorf("DataURI for HTML returned %v, expected ErrNotAnImage", err)
+	}
+
+	avt.SetMaxDataURISize(len(got))
+	if _, err := avt.DataURI(context.Background(), "user@example.org"); err != nil {
+		t.Errorf("DataURI at the size limit: unexpected error %v", err)
+	}
+	avt.SetMaxDataURISize(len(got) - 1)
+	if _, err := avt.DataURI(context.Background(), "user@example.org"); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("DataURI over the size limit returned %v, expected ErrBodyTooLarge", err)
+	}
+
+	avt.SetMaxDataURISize(0)
+	avt.SetDefaultImage(HTTP404)
+	if _, err := avt.DataURI(context.Background(), "user@example.org"); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("DataURI with d=404 returned %v, expected ErrNoAvatar", err)
+	}
+}
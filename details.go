@@ -0,0 +1,127 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Reasons for using the fallback host, reported in
+// Details.FallbackReason
+const (
+	FallbackNoRecords      = "no SRV records"
+	FallbackInvalidRecords = "all SRV records invalid"
+	FallbackDNSError       = "SRV lookup failed"
+	FallbackTimeout        = "SRV lookup timed out"
+	FallbackUnreachable    = "SRV target unreachable"
+	FallbackSkipped        = "SRV lookups disabled for the domain"
+)
+
+// Details is the trail of the decisions taken resolving the avatar
+// URL of an email, see LookupDetails
+type Details struct {
+	Address  string     // the normalized address
+	Hash     string     // the hash of Address
+	Domain   string     // the domain looked up
+	Service  string     // the SRV service last queried, if any
+	CacheHit bool       // whether the SRV lookup was answered by the cache
+	Records  []*net.SRV // the records of the SRV answer, nil on cache hits
+	Rejected []*net.SRV // the records of Records discarded as invalid
+	Selected *net.SRV   // the record whose target serves the avatar, if any
+	// why Selected was chosen, or the host serving the avatar when
+	// it was not found with an SRV lookup
+	SelectionReason string
+	Fallback        bool   // whether the fallback host serves the avatar
+	FallbackReason  string // one of the Fallback constants
+	Err             error  // the DNS or probe error met, if any
+	URL             string // the avatar URL
+}
+
+// detailsKey is the context key of the Details being gathered
+type detailsKey struct{}
+
+// LookupDetails resolves the avatar URL of email like FromEmailContext,
+// reporting how it was found. The URL cache is not used, so that the
+// SRV lookup is always traced. On errors, the details gathered so far
+// are returned along with the error.
+func (v *Libravatar) LookupDetails(ctx context.Context, email string) (*Details, error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	d := &Details{}
+	ctx = context.WithValue(ctx, detailsKey{}, d)
+	r, err := v.addressResult(ctx, email, addr, v.params())
+	if err != nil {
+		d.Address = addr.Address
+		d.Domain, _ = v.getDomain(addr, nil)
+		return d, err
+	}
+	d.Address, d.Hash, d.Domain, d.URL = addr.Address, r.Hash, r.Domain, r.URL
+	return d, nil
+}
+
+// detailsFrom returns the Details being gathered for ctx, if any
+func detailsFrom(ctx context.Context) *Details {
+	d, _ := ctx.Value(detailsKey{}).(*Details)
+	return d
+}
+
+// noteDecision records in the Details gathered for ctx, if any, that
+// the avatar host was chosen without SRV lookup, for reason
+func noteDecision(ctx context.Context, fallback bool, reason string) {
+	if d := detailsFrom(ctx); d != nil {
+		if fallback {
+			d.Fallback, d.FallbackReason = true, reason
+		} else {
+			d.SelectionReason = reason
+		}
+	}
+}
+
+// noteLookup records res, the outcome of the lookup of service, in
+// the Details gathered for ctx, if any
+func noteLookup(ctx context.Context, service string, res lookupResult) {
+	d := detailsFrom(ctx)
+	if d == nil {
+		return
+	}
+	d.Service, d.CacheHit, d.Records, d.Rejected = service, res.cacheHit, res.records, nil
+	for _, rr := range res.records {
+		if !validSRVTarget(rr.Target, int(rr.Port)) {
+			d.Rejected = append(d.Rejected, rr)
+		}
+	}
+	d.Selected, d.Err = res.target, res.dnsErr
+	if res.probeErr != nil {
+		d.Err = res.probeErr
+	}
+	d.SelectionReason, d.Fallback, d.FallbackReason = "", false, ""
+	if res.target != nil {
+		d.SelectionReason = res.reason
+	} else if !res.fatal {
+		d.Fallback, d.FallbackReason = true, res.reason
+	}
+}
+
+// selectionReason tells why target was selected out of the valid
+// records addrs
+func selectionReason(addrs []*net.SRV, target *net.SRV) string {
+	if len(addrs) == 1 {
+		return "only valid record"
+	}
+	n := 0
+	for _, rr := range addrs {
+		if rr.Priority == target.Priority {
+			n++
+		}
+	}
+	if n == 1 {
+		return fmt.Sprintf("only valid record of the lowest priority %d", target.Priority)
+	}
+	return fmt.Sprintf("picked by weight out of %d valid records of the lowest priority %d", n, target.Priority)
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestLookupDetails(t *testing.T) {
+
+	timeout := &net.DNSError{Err: "i/o timeout", Name: "slow.example.org", IsTimeout: true}
+	records := map[string][]*net.SRV{
+		"example.org": {
+			{Target: "avatars.example.org.", Port: 0, Priority: 0},
+			{Target: "primary.example.org.", Port: 8080, Priority: 10, Weight: 5},
+			{Target: "backup.example.org.", Port: 80, Priority: 20},
+		},
+		"invalid.example.org": {{Target: "bad_host!.", Port: 80}},
+	}
+	ctx := context.Background()
+	avt := New()
+	avt.SetSkipDomains("skipped.example.org")
+	avt.SetTimeoutPolicy(TimeoutFallback)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "slow.example.org" {
+			return "", nil, timeout
+		}
+		if addrs, ok := records[name]; ok {
+			return "", addrs, nil
+		}
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	d, err := avt.LookupDetails(ctx, " User@Example.org ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address != "user@example.org" || d.Hash != hashOf("user@example.org") || d.Domain != "example.org" || d.Service != "avatars" {
+		t.Errorf("federated: identity %+v", d)
+	}
+	if d.CacheHit || len(d.Records) != 3 || len(d.Rejected) != 1 || d.Rejected[0] != records["example.org"][0] {
+		t.Errorf("federated: records %v, rejected %v, cache hit %v", d.Records, d.Rejected, d.CacheHit)
+	}
+	if d.Selected != records["example.org"][1] || d.SelectionReason != "only valid record of the lowest priority 10" || d.Fallback {
+		t.Errorf("federated: selected %v because %q, fallback %v", d.Selected, d.SelectionReason, d.Fallback)
+	}
+	if want := "http://primary.example.org:8080/avatar/" + hashOf("user@example.org"); d.URL != want {
+		t.Errorf("federated: URL %s, expected %s", d.URL, want)
+	}
+
+	d, err = avt.LookupDetails(ctx, "user@example.org")
+	if err != nil || !d.CacheHit || d.Records != nil || d.Selected != records["example.org"][1] || d.SelectionReason != "only valid record of the lowest priority 10" {
+		t.Errorf("cached: %+v, %v", d, err)
+	}
+
+	fallbacks := []struct {
+		email  string
+		reason string
+		err    error
+	}{
+		{"user@missing.example.org", FallbackNoRecords, nil},
+		{"user@invalid.example.org", FallbackInvalidRecords, nil},
+		{"user@slow.example.org", FallbackTimeout, timeout},
+		{"user@skipped.example.org", FallbackSkipped, nil},
+	}
+	for _, c := range fallbacks {
+		d, err := avt.LookupDetails(ctx, c.email)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.email, err)
+			continue
+		}
+		if !d.Fallback || d.FallbackReason != c.reason || d.Selected != nil || !errors.Is(d.Err, c.err) || c.err == nil && d.Err != nil {
+			t.Errorf("%s: fallback %v because %q, selected %v, error %v, expected fallback because %q", c.email, d.Fallback, d.FallbackReason, d.Selected, d.Err, c.reason)
+		}
+		if want := "http://cdn.libravatar.org/avatar/" + hashOf(c.email); d.URL != want {
+			t.Errorf("%s: URL %s, expected %s", c.email, d.URL, want)
+		}
+		if c.reason == FallbackInvalidRecords && len(d.Rejected) != 1 {
+			t.Errorf("%s: rejected %v, expected the only record", c.email, d.Rejected)
+		}
+	}
+
+	// timeouts are returned with the default policy
+	lookupSRV := avt.lookupSRV
+	avt = New()
+	avt.lookupSRV = lookupSRV
+	d, err = avt.LookupDetails(ctx, "user@slow.example.org")
+	if !errors.Is(err, ErrDNSTimeout) {
+		t.Errorf("timeout: error %v, expected ErrDNSTimeout", err)
+	}
+	if d == nil || d.Domain != "slow.example.org" || d.Fallback || !errors.Is(d.Err, timeout) || d.URL != "" {
+		t.Errorf("timeout: details %+v", d)
+	}
+}
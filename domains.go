@@ -0,0 +1,145 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SetDomainOverride makes avatars for domain be served by target
+// (a host, with optional port) without any DNS lookup.
+// A domain starting with a dot (like ".example.com") matches all
+// of its subdomains. Matching is case-insensitive.
+// Overrides take precedence over SetDisableSRV.
+func (v *Libravatar) SetDomainOverride(domain, target string) {
+	if v.domainOverrides == nil {
+		v.domainOverrides = make(map[string]string)
+	}
+	v.domainOverrides[strings.ToLower(domain)] = target
+	v.urlCache.purge()
+}
+
+// RemoveDomainOverride removes an override set with SetDomainOverride
+func (v *Libravatar) RemoveDomainOverride(domain string) {
+	delete(v.domainOverrides, strings.ToLower(domain))
+	v.urlCache.purge()
+}
+
+// domainOverride returns the target configured for host, if any
+func (v *Libravatar) domainOverride(host string) (string, bool) {
+	if len(v.domainOverrides) == 0 {
+		return "", false
+	}
+	for _, k := range domainKeys(host) {
+		if target, ok := v.domainOverrides[k]; ok {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// SetSkipDomains sets a list of domains for which no lookup is ever
+// performed, always using the fallback hosts. A domain starting with
+// a dot (like ".example.com") matches all of its subdomains.
+// Matching is case-insensitive.
+func (v *Libravatar) SetSkipDomains(domains ...string) {
+	v.skipDomains = make(map[string]bool, len(domains))
+	for _, d := range domains {
+		v.skipDomains[strings.ToLower(d)] = true
+	}
+	v.urlCache.purge()
+}
+
+// skipDomain tells whether host is in the list set by SetSkipDomains
+func (v *Libravatar) skipDomain(host string) bool {
+	if len(v.skipDomains) == 0 {
+		return false
+	}
+	for _, k := range domainKeys(host) {
+		if v.skipDomains[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// domainKeys returns the keys host may be configured with: the
+// lowercased host itself followed by its dot-prefixed suffixes,
+// longest first
+func domainKeys(host string) []string {
+	host = strings.ToLower(host)
+	keys := []string{host}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		keys = append(keys, host[i:])
+		j := strings.IndexByte(host[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return keys
+}
+
+// canonicalDomain returns domain as used for SRV queries and cache
+// keys: lowercased, without surrounding white space nor a single
+// trailing dot, so that all its spellings share one cache entry
+func canonicalDomain(domain string) (string, error) {
+	d := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if d == "" {
+		return "", fmt.Errorf("%w: empty domain %q", ErrInvalidInput, domain)
+	}
+	return d, nil
+}
+
+// lookupNeeded tells whether the avatar server for host is to be
+// found with SRV lookups, rather than by configuration
+func (v *Libravatar) lookupNeeded(host string) bool {
+	if _, ok := v.domainOverride(host); ok {
+		return false
+	}
+	return !v.disableSRV && !v.gravatarMode && !v.skipDomain(host)
+}
+
+// SetServiceBase sets the label of the SRV records looked up for
+// avatar servers over http, like "intavatars" for
+// _intavatars._tcp.example.org. The default is "avatars".
+func (v *Libravatar) SetServiceBase(name string) error {
+	name, err := serviceLabel(name)
+	if err != nil {
+		return err
+	}
+	v.serviceBase = name
+	v.urlCache.purge()
+	return nil
+}
+
+// SetSecureServiceBase is like SetServiceBase, for the records looked
+// up for avatar servers over https. The default is "avatars-sec".
+func (v *Libravatar) SetSecureServiceBase(name string) error {
+	name, err := serviceLabel(name)
+	if err != nil {
+		return err
+	}
+	v.secureServiceBase = name
+	v.urlCache.purge()
+	return nil
+}
+
+// serviceLabel returns name, without any leading underscore, if it is
+// a valid SRV service label
+func serviceLabel(name string) (string, error) {
+	label := strings.TrimPrefix(name, "_")
+	valid := label != "" && len(label) <= 63 && label[0] != '-' && label[len(label)-1] != '-'
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			valid = false
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("%w: invalid SRV service name %q", ErrInvalidConfig, name)
+	}
+	return label, nil
+}
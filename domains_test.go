@@ -0,0 +1,193 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDomainOverride(t *testing.T) {
+
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups[name]++
+		return "", []*net.SRV{{Target: "avatars." + name + ".", Port: 80}}, nil
+	}
+	avt.SetDomainOverride("Corp.Example.com", "avatars.corp.internal:8443")
+	avt.SetDomainOverride(".branch.example.com", "avatars.branch.internal")
+
+	cases := []struct {
+		email string
+		https bool
+		want  string
+	}{
+		{"user@corp.example.com", false, "http://avatars.corp.internal:8443/avatar/"},
+		{"user@CORP.EXAMPLE.COM", false, "http://avatars.corp.internal:8443/avatar/"},
+		{"user@corp.example.com", true, "https://avatars.corp.internal:8443/avatar/"},
+		{"user@sub.corp.example.com", false, "http://avatars.sub.corp.example.com/avatar/"},
+		{"user@a.branch.example.com", false, "http://avatars.branch.internal/avatar/"},
+		{"user@a.b.branch.example.com", true, "https://avatars.branch.internal/avatar/"},
+		{"user@example.org", false, "http://avatars.example.org/avatar/"},
+	}
+
+	for _, c := range cases {
+		avt.SetUseHTTPS(c.https)
+		got, err := avt.FromEmail(c.email)
+		if err != nil {
+			t.Errorf("FromEmail(%q): unexpected error %v", c.email, err)
+			continue
+		}
+		if !strings.HasPrefix(got, c.want) {
+			t.Errorf("FromEmail(%q) (https=%v) == %q, expected prefix %q", c.email, c.https, got, c.want)
+		}
+	}
+
+	for _, d := range []string{"corp.example.com", "a.branch.example.com", "a.b.branch.example.com"} {
+		if lookups[d] != 0 {
+			t.Errorf("%d lookups for overridden domain %q, expected none", lookups[d], d)
+		}
+	}
+	avt.nameCache.each(func(k cacheKey, _ cacheValue) bool {
+		if strings.HasSuffix(k.domain, "branch.example.com") || k.domain == "corp.example.com" {
+			t.Errorf("cache entry %v created for overridden domain", k)
+		}
+		return true
+	})
+
+	avt.RemoveDomainOverride("CORP.example.com")
+	avt.SetUseHTTPS(false)
+	got, _ := avt.FromEmail("user@corp.example.com")
+	if want := "http://avatars.corp.example.com/avatar/"; !strings.HasPrefix(got, want) {
+		t.Errorf("FromEmail after RemoveDomainOverride == %q, expected prefix %q", got, want)
+	}
+}
+
+func TestSkipDomains(t *testing.T) {
+
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups[name]++
+		return "", []*net.SRV{{Target: "avatars." + name + ".", Port: 80}}, nil
+	}
+	avt.SetSkipDomains("gmail.com", "Outlook.com", ".yahoo.com")
+
+	cases := []struct {
+		email string
+		want  string
+	}{
+		{"user@gmail.com", "http://cdn.libravatar.org/avatar/"},
+		{"user@OUTLOOK.com", "http://cdn.libravatar.org/avatar/"},
+		{"user@mail.yahoo.com", "http://cdn.libravatar.org/avatar/"},
+		{"user@sub.gmail.com", "http://avatars.sub.gmail.com/avatar/"},
+		{"user@example.org", "http://avatars.example.org/avatar/"},
+	}
+
+	for _, c := range cases {
+		got, err := avt.FromEmail(c.email)
+		if err != nil {
+			t.Errorf("FromEmail(%q): unexpected error %v", c.email, err)
+			continue
+		}
+		if !strings.HasPrefix(got, c.want) {
+			t.Errorf("FromEmail(%q) == %q, expected prefix %q", c.email, got, c.want)
+		}
+	}
+
+	for _, d := range []string{"gmail.com", "outlook.com", "OUTLOOK.com", "mail.yahoo.com"} {
+		if lookups[d] != 0 {
+			t.Errorf("%d lookups for skipped domain %q, expected none", lookups[d], d)
+		}
+	}
+	if lookups["example.org"] != 1 || lookups["sub.gmail.com"] != 1 {
+		t.Errorf("lookups %v, expected one for each non skipped domain", lookups)
+	}
+	if avt.nameCache.len() != 2 {
+		t.Errorf("%d cache entries, expected only non skipped domains to be cached", avt.nameCache.len())
+	}
+}
+
+func TestCanonicalDomain(t *testing.T) {
+
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups[name]++
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+
+	want := "http://avatars.example.org/avatar/" + hashOf("user@example.org")
+	for _, email := range []string{"User@EXAMPLE.ORG.", "user@example.org", " user@Example.org "} {
+		got, err := avt.FromEmail(email)
+		if err != nil {
+			t.Errorf("FromEmail(%q): unexpected error %v", email, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("FromEmail(%q) == %q, expected %q", email, got, want)
+		}
+	}
+	if _, err := avt.FromURL("https://EXAMPLE.org./user"); err != nil {
+		t.Errorf("FromURL: unexpected error %v", err)
+	}
+
+	if len(lookups) != 1 || lookups["example.org"] != 1 {
+		t.Errorf("lookups %v, expected one for example.org", lookups)
+	}
+	if avt.nameCache.len() != 1 {
+		t.Errorf("%d cache entries, expected one", avt.nameCache.len())
+	}
+
+	for _, d := range []string{"", " ", "."} {
+		if _, err := canonicalDomain(d); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("canonicalDomain(%q) returned %v, expected ErrInvalidInput", d, err)
+		}
+	}
+}
+
+func TestServiceBase(t *testing.T) {
+
+	var queried []string
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		queried = append(queried, "_"+service+"._"+proto+"."+name)
+		return "", []*net.SRV{{Target: service + ".example.org.", Port: 80}}, nil
+	}
+	if err := avt.SetServiceBase("_intavatars"); err != nil {
+		t.Fatal(err)
+	}
+	if err := avt.SetSecureServiceBase("intavatars-sec"); err != nil {
+		t.Fatal(err)
+	}
+	hash := hashOf("user@example.org")
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != "http://intavatars.example.org/avatar/"+hash {
+		t.Errorf("FromEmail with a custom service == %s, %v", got, err)
+	}
+	avt.SetUseHTTPS(true)
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != "https://intavatars-sec.example.org:80/avatar/"+hash {
+		t.Errorf("FromEmail with a custom secure service == %s, %v", got, err)
+	}
+	want := []string{"_intavatars._tcp.example.org", "_intavatars-sec._tcp.example.org"}
+	if len(queried) != len(want) || queried[0] != want[0] || queried[1] != want[1] {
+		t.Errorf("queried %v, expected %v", queried, want)
+	}
+
+	for _, name := range []string{"", "_", "-avatars", "avatars-", "av.atars", "av atars", strings.Repeat("a", 64)} {
+		if err := avt.SetServiceBase(name); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetServiceBase(%q) == %v, expected ErrInvalidConfig", name, err)
+		}
+		if err := avt.SetSecureServiceBase(name); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetSecureServiceBase(%q) == %v, expected ErrInvalidConfig", name, err)
+		}
+	}
+	if avt.serviceBase != "intavatars" || avt.secureServiceBase != "intavatars-sec" {
+		t.Errorf("invalid names changed the services to %q and %q", avt.serviceBase, avt.secureServiceBase)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "fmt"
+
+// SetEmailHash sets the digest used to hash emails, either HashMD5
+// (the default) or HashSHA256, which libravatar servers also accept,
+// so that MD5 digests of emails do not appear in avatar URLs.
+// SetGravatarDefault only applies to MD5 digests.
+func (v *Libravatar) SetEmailHash(algorithm string) error {
+	switch algorithm {
+	case HashMD5, HashSHA256:
+	default:
+		return fmt.Errorf("%w: unknown email hash %q, expected %s or %s", ErrInvalidConfig, algorithm, HashMD5, HashSHA256)
+	}
+	v.emailSHA256 = algorithm == HashSHA256
+	v.urlCache.purge()
+	return nil
+}
+
+// emailHashAlgorithm returns the digest used to hash emails
+func (v *Libravatar) emailHashAlgorithm() string {
+	switch {
+	case v.hashFunc != nil:
+		return HashCustom
+	case v.emailSHA256:
+		return HashSHA256
+	}
+	return HashMD5
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// Errors returned by this package wrap one of the sentinel errors
+// below, or the ones declared next to the functions returning them,
+// and their underlying cause, like a *net.DNSError, if any.
+// Use errors.Is and errors.As to tell them apart: error messages are
+// meant for humans and may change between versions.
+var (
+	// ErrInvalidInput is returned when an exported function is passed
+	// a nil pointer or an empty or blank string it cannot do without,
+	// wrapped together with a more specific error if any
+	ErrInvalidInput = errors.New("libravatar: invalid input")
+	// ErrInvalidEmail is returned for malformed emails
+	ErrInvalidEmail = errors.New("libravatar: invalid email")
+	// ErrInvalidOpenID is returned for malformed OpenID URLs
+	ErrInvalidOpenID = errors.New("libravatar: invalid OpenID")
+	// ErrDNSTimeout is returned when an SRV lookup times out
+	ErrDNSTimeout = errors.New("libravatar: SRV lookup timed out")
+	// ErrDNS is returned when an SRV lookup fails for reasons other
+	// than a timeout or a missing record, see SetDNSErrorPolicy
+	ErrDNS = errors.New("libravatar: SRV lookup failed")
+	// ErrNoService is wrapped by lookup errors due to a domain not
+	// having the avatar SRV record. Lookups of such domains only fail
+	// with SetRequireService, using the fallback host otherwise.
+	ErrNoService = errors.New("libravatar: no avatar service")
+	// ErrUnexpectedStatus is returned when an avatar server answers
+	// with an unexpected HTTP status
+	ErrUnexpectedStatus = errors.New("libravatar: unexpected HTTP status")
+)
+
+// Stages of a lookup, see LookupError
+const (
+	StageParse = "parse" // parsing the email or OpenID
+	StageDNS   = "dns"   // looking up SRV records
+)
+
+// LookupError describes a failure to find the avatar URL of an
+// identity. It wraps the matching sentinel error.
+type LookupError struct {
+	Domain  string // the domain being resolved, if known
+	Service string // the SRV service queried, if any
+	Stage   string // where the lookup failed, StageParse or StageDNS
+	Err     error  // the cause
+}
+
+func (e *LookupError) Error() string {
+	if e.Stage != StageDNS {
+		return e.Err.Error()
+	}
+	name := "_" + e.Service + "._tcp." + e.Domain
+	if errors.Is(e.Err, ErrDNSTimeout) {
+		return "libravatar: srv lookup for " + name + " timed out"
+	}
+	cause := e.Err
+	var dnsErr *net.DNSError
+	if errors.As(e.Err, &dnsErr) {
+		cause = dnsErr
+	}
+	return "libravatar: srv lookup for " + name + " failed: " + cause.Error()
+}
+
+func (e *LookupError) Unwrap() error {
+	return e.Err
+}
+
+// parseEmail parses an email address
+func parseEmail(email string) (*mail.Address, error) {
+	if blank(email) {
+		return nil, &LookupError{Stage: StageParse, Err: fmt.Errorf("%w %q: %w", ErrInvalidEmail, email, ErrInvalidInput)}
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil && strings.HasSuffix(strings.TrimSpace(email), ".") {
+		// net/mail rejects fully qualified domains, with a trailing
+		// dot, which some address books use
+		if a, err2 := mail.ParseAddress(strings.TrimSuffix(strings.TrimSpace(email), ".")); err2 == nil {
+			addr, err = a, nil
+		}
+	}
+	if err != nil {
+		return nil, &LookupError{Stage: StageParse, Err: fmt.Errorf("%w %q: %w", ErrInvalidEmail, email, err)}
+	}
+	return addr, nil
+}
+
+// parseOpenID parses an OpenID, which must be an absolute http(s) URL
+func parseOpenID(openid string) (*url.URL, error) {
+	if blank(openid) {
+		return nil, &LookupError{Stage: StageParse, Err: fmt.Errorf("%w %q: %w", ErrInvalidOpenID, openid, ErrInvalidInput)}
+	}
+	ourl, err := url.Parse(openid)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrInvalidOpenID, err)
+	} else if !ourl.IsAbs() {
+		err = fmt.Errorf("%w %q: not an absolute URL", ErrInvalidOpenID, openid)
+	} else if ourl.Scheme != "http" && ourl.Scheme != "https" {
+		err = fmt.Errorf("%w %q: invalid protocol %s", ErrInvalidOpenID, openid, ourl.Scheme)
+	}
+	if err != nil {
+		return nil, &LookupError{Stage: StageParse, Err: err}
+	}
+	return ourl, nil
+}
+
+// errNoIdentity is returned by the functions needing either an email
+// or an OpenID when given neither
+var errNoIdentity = fmt.Errorf("%w: neither email nor OpenID set", ErrInvalidInput)
+
+// blank tells whether s is empty or only made of white space
+func blank(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+// lookupError returns the error to report for err, met looking up
+// the SRV records of service at domain
+func lookupError(service, domain string, err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			err = fmt.Errorf("%w: %w", ErrDNSTimeout, err)
+		} else if dnsErr.IsNotFound {
+			err = fmt.Errorf("%w: %w", ErrNoService, err)
+		} else {
+			err = fmt.Errorf("%w: %w", ErrDNS, err)
+		}
+	}
+	return &LookupError{Domain: domain, Service: service, Stage: StageDNS, Err: err}
+}
@@ -0,0 +1,300 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestErrors(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/avatar/") {
+		case hashOf("gone@example.org"):
+			http.NotFound(w, r)
+		case hashOf("broken@example.org"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngLike(make([]byte, 1000)))
+		}
+	}))
+	defer srv.Close()
+
+	responder := serverResponder(t, srv)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		switch name {
+		case "slow.example.org":
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		case "servfail.example.org":
+			return "", nil, &net.DNSError{Err: "server misbehaving", Name: name}
+		}
+		return responder(ctx, service, proto, name)
+	}
+	avt.SetDNSErrorPolicy(DNSErrorFail)
+	ctx := context.Background()
+
+	avt.SetMaxBodySize(100)
+	tooLarge := errOf(avt.GetAvatar(ctx, "user@example.org"))
+	avt.SetMaxBodySize(5 << 20)
+
+	cases := []struct {
+		name   string
+		err    error
+		is     error
+		dnsErr bool
+	}{
+		{"invalid email", errOf(avt.FromEmail("invalid")), ErrInvalidEmail, false},
+		{"invalid account", errOf(avt.FromAccount("@alice")), ErrInvalidEmail, false},
+		{"relative OpenID", errOf(avt.FromURL("invalid")), ErrInvalidOpenID, false},
+		{"ssh OpenID", errOf(avt.FromURL("ssh://user@nothttp/")), ErrInvalidOpenID, false},
+		{"DNS timeout", errOf(avt.FromEmail("user@slow.example.org")), ErrDNSTimeout, true},
+		{"DNS failure", errOf(avt.FromEmail("user@servfail.example.org")), ErrDNS, true},
+		{"no avatar", errOf(avt.GetAvatar(ctx, "gone@example.org")), ErrNoAvatar, false},
+		{"server error", errOf(avt.GetAvatar(ctx, "broken@example.org")), ErrUnexpectedStatus, false},
+		{"too large", tooLarge, ErrBodyTooLarge, false},
+	}
+
+	var dnsErr *net.DNSError
+	for _, c := range cases {
+		if !errors.Is(c.err, c.is) {
+			t.Errorf("%s: error %v is not %v", c.name, c.err, c.is)
+		}
+		if errors.As(c.err, &dnsErr) != c.dnsErr {
+			t.Errorf("%s: error %v wrapping a *net.DNSError: %v, expected %v", c.name, c.err, !c.dnsErr, c.dnsErr)
+		}
+	}
+}
+
+// errOf returns the error of a two results call
+func errOf[T any](_ T, err error) error {
+	return err
+}
+
+func TestLookupError(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "slow.example.org" {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: "_" + service + "._tcp." + name, IsTimeout: true}
+		}
+		return "", nil, &net.DNSError{Err: "server misbehaving", Name: "_" + service + "._tcp." + name}
+	}
+	avt.SetDNSErrorPolicy(DNSErrorFail)
+	avt.SetUseHTTPS(true)
+
+	cases := []struct {
+		email   string
+		domain  string
+		service string
+		stage   string
+		is      error
+		msg     string
+	}{
+		{"user@slow.example.org", "slow.example.org", "avatars-sec", StageDNS, ErrDNSTimeout,
+			"libravatar: srv lookup for _avatars-sec._tcp.slow.example.org timed out"},
+		{"user@servfail.example.org", "servfail.example.org", "avatars-sec", StageDNS, ErrDNS,
+			"libravatar: srv lookup for _avatars-sec._tcp.servfail.example.org failed: lookup _avatars-sec._tcp.servfail.example.org: server misbehaving"},
+		{"not an email", "", "", StageParse, ErrInvalidEmail, ""},
+	}
+	for _, c := range cases {
+		_, err := avt.FromEmail(c.email)
+		var lerr *LookupError
+		if !errors.As(err, &lerr) {
+			t.Errorf("FromEmail(%q): error %v is not a *LookupError", c.email, err)
+			continue
+		}
+		if lerr.Domain != c.domain || lerr.Service != c.service || lerr.Stage != c.stage {
+			t.Errorf("FromEmail(%q): unexpected error fields %+v", c.email, lerr)
+		}
+		if !errors.Is(err, c.is) {
+			t.Errorf("FromEmail(%q): error %v is not %v", c.email, err, c.is)
+		}
+		if c.msg != "" && err.Error() != c.msg {
+			t.Errorf("FromEmail(%q): error %q, expected %q", c.email, err, c.msg)
+		}
+	}
+
+	_, err := avt.FromURL("ssh://user@nothttp/")
+	var lerr *LookupError
+	if !errors.As(err, &lerr) || lerr.Stage != StageParse || !errors.Is(err, ErrInvalidOpenID) {
+		t.Errorf("FromURL of invalid OpenID: unexpected error %v", err)
+	}
+}
+
+func TestRequireService(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		switch {
+		case name == "nxdomain.example.org":
+			return "", nil, &net.DNSError{Err: "no such host", Name: "_" + service + "._tcp." + name, IsNotFound: true}
+		case name == "plain.example.org" && service == "avatars":
+			return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+		case name == "federated.example.org":
+			return "", []*net.SRV{{Target: "avatars.example.org.", Port: 443}}, nil
+		}
+		return "", nil, nil
+	}
+
+	// normally the fallback host is used
+	if _, err := avt.FromEmail("user@norecords.example.org"); err != nil {
+		t.Errorf("FromEmail of a domain without service: unexpected error %v", err)
+	}
+
+	avt.SetRequireService(true)
+	for _, email := range []string{"user@norecords.example.org", "user@nxdomain.example.org"} {
+		_, err := avt.FromEmail(email)
+		var lerr *LookupError
+		if !errors.Is(err, ErrNoService) || errors.Is(err, ErrDNS) || !errors.As(err, &lerr) || lerr.Stage != StageDNS {
+			t.Errorf("FromEmail(%q) with SetRequireService: error %v is not ErrNoService", email, err)
+		}
+		// also once cached
+		if _, err := avt.FromEmail(email); !errors.Is(err, ErrNoService) {
+			t.Errorf("FromEmail(%q) with SetRequireService, cached: error %v is not ErrNoService", email, err)
+		}
+	}
+	if _, err := avt.FromEmail("user@federated.example.org"); err != nil {
+		t.Errorf("FromEmail of a federated domain with SetRequireService: unexpected error %v", err)
+	}
+
+	// the plain record is tried before failing
+	avt.SetUseHTTPS(true)
+	avt.SetSecureFallbackToPlainSRV(true)
+	if _, err := avt.FromEmail("user@plain.example.org"); err != nil {
+		t.Errorf("FromEmail with a plain record and SetSecureFallbackToPlainSRV: unexpected error %v", err)
+	}
+	if _, err := avt.FromEmail("user@norecords.example.org"); !errors.Is(err, ErrNoService) {
+		t.Errorf("FromEmail with no record and SetSecureFallbackToPlainSRV: error %v is not ErrNoService", err)
+	}
+}
+
+func TestInvalidInput(t *testing.T) {
+
+	ctx := context.Background()
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request for %s", req.URL)
+		return nil, errors.New("unexpected request")
+	})})
+	grv := New()
+	grv.SetGravatarMode(true)
+	static := NewStaticSource("https://example.org/%s", 80)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// calls taking an email, OpenID, handle or domain, which must be
+	// rejected when empty or blank
+	calls := map[string]func(s string) error{
+		"FromEmail":            func(s string) error { return errOf(avt.FromEmail(s)) },
+		"FromEmailContext":     func(s string) error { return errOf(avt.FromEmailContext(ctx, s)) },
+		"FromEmailBoth":        func(s string) error { _, _, err := avt.FromEmailBoth(s); return err },
+		"FromEmailAll":         func(s string) error { return errOf(avt.FromEmailAll(ctx, s)) },
+		"FromURL":              func(s string) error { return errOf(avt.FromURL(s)) },
+		"FromURLContext":       func(s string) error { return errOf(avt.FromURLContext(ctx, s)) },
+		"FromAccount":          func(s string) error { return errOf(avt.FromAccount(s)) },
+		"Lookup":               func(s string) error { return errOf(avt.Lookup(s)) },
+		"LookupURL":            func(s string) error { return errOf(avt.LookupURL(s)) },
+		"GetAvatar":            func(s string) error { return errOf(avt.GetAvatar(ctx, s)) },
+		"GetAvatarIfModified":  func(s string) error { return errOf(avt.GetAvatarIfModified(ctx, s, nil)) },
+		"GetAvatarFromURL":     func(s string) error { return errOf(avt.GetAvatarFromURL(ctx, s)) },
+		"GetAvatarSizes":       func(s string) error { return errOf(avt.GetAvatarSizes(ctx, s, nil)) },
+		"WriteAvatar":          func(s string) error { _, _, err := avt.WriteAvatar(ctx, io.Discard, s); return err },
+		"Exists":               func(s string) error { return errOf(avt.Exists(ctx, s)) },
+		"HasCustomAvatar":      func(s string) error { return errOf(avt.HasCustomAvatar(ctx, s)) },
+		"DataURI":              func(s string) error { return errOf(avt.DataURI(ctx, s)) },
+		"ResolveFinalURL":      func(s string) error { _, _, err := avt.ResolveFinalURL(ctx, s); return err },
+		"ImgTag":               func(s string) error { return errOf(avt.ImgTag(s)) },
+		"MarkdownImage":        func(s string) error { return errOf(avt.MarkdownImage(s, "", 0)) },
+		"MarkdownImageFromURL": func(s string) error { return errOf(avt.MarkdownImageFromURL(s, "", 0)) },
+		"SrcSet":               func(s string) error { _, _, err := avt.SrcSet(s, 80); return err },
+		"SrcSetFromURL":        func(s string) error { _, _, err := avt.SrcSetFromURL(s, 80); return err },
+		"CheckDomain":          func(s string) error { return errOf(avt.CheckDomain(ctx, s)) },
+		"GravatarProfile":      func(s string) error { return errOf(grv.GravatarProfile(ctx, s)) },
+		"StaticSource.FromEmailContext": func(s string) error {
+			return errOf(static.FromEmailContext(ctx, s))
+		},
+		"StaticSource.FromURLContext": func(s string) error {
+			return errOf(static.FromURLContext(ctx, s))
+		},
+		"strict Redirect": func(s string) error {
+			strict := New()
+			strict.SetStrict(true)
+			return strict.Redirect(rec, req, s)
+		},
+	}
+	for name, call := range calls {
+		for _, s := range []string{"", " ", "\t\r\n"} {
+			if err := call(s); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("%s(%q) returned %v, expected ErrInvalidInput", name, s, err)
+			}
+		}
+	}
+
+	// calls taking nil pointers, channels or interfaces
+	nils := map[string]func() error{
+		"Redirect nil writer":  func() error { return avt.Redirect(nil, req, "user@example.org") },
+		"Redirect nil request": func() error { return avt.Redirect(rec, nil, "user@example.org") },
+		"WriteAvatar":          func() error { _, _, err := avt.WriteAvatar(ctx, nil, "user@example.org"); return err },
+		"StreamFromEmails nil input": func() error {
+			return avt.StreamFromEmails(ctx, nil, make(chan Result))
+		},
+		"StreamFromEmails nil output": func() error {
+			return avt.StreamFromEmails(ctx, make(chan string), nil)
+		},
+		"genHash":                            func() error { return errOf(genHash(nil, nil)) },
+		"getDomain":                          func() error { return errOf(avt.getDomain(nil, nil)) },
+		"SetLocalFallbackImageFS nil fs":     func() error { return avt.SetLocalFallbackImageFS(nil, "avatar.png") },
+		"SetLocalFallbackImageFS empty name": func() error { return avt.SetLocalFallbackImageFS(fstest.MapFS{}, "") },
+	}
+	for name, call := range nils {
+		if err := call(); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("%s returned %v, expected ErrInvalidInput", name, err)
+		}
+	}
+
+	// calls for which nil or empty values are valid, which must not
+	// panic
+	results, err := avt.FromEmails(ctx, []string{"", " "})
+	if err != nil || len(results) != 2 || !errors.Is(results[0].Err, ErrInvalidInput) {
+		t.Errorf("FromEmails returned %v, %v", results, err)
+	}
+	if results, err := avt.FromEmails(ctx, nil); err != nil || len(results) != 0 {
+		t.Errorf("FromEmails(nil) returned %v, %v", results, err)
+	}
+	if err := avt.WarmCache(ctx, []string{"", " "}); err != nil {
+		t.Errorf("WarmCache returned %v", err)
+	}
+	if _, err := GenerateIdenticon("", 0); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("GenerateIdenticon returned %v, expected ErrInvalidHash", err)
+	}
+	avt.Watch("", " ")
+	avt.Unwatch("", " ")
+	avt.RemoveDomainOverride("")
+	avt.SetDefaultURLAllowlist()
+	avt.SetLocalFallbackImage(nil, "")
+	avt.SetMetrics(nil)
+	avt.SetClock(nil)
+	avt.SetTraceHooks(nil)
+	avt.SetLookupHook(nil)
+	avt.SetPrefetchHook(nil)
+	avt.SetHTTPClient(nil)
+	if avt.httpClient == nil || avt.httpClient.Timeout != defaultHTTPTimeout {
+		t.Errorf("SetHTTPClient(nil) did not restore the default client")
+	}
+	if _, err := avt.FromEmail("user@example.org"); err != nil {
+		t.Errorf("FromEmail after resetting settings to nil: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// reservedParams are the query parameters set by this package
+var reservedParams = []string{"d", "default", "f", "forcedefault", "r", "rating", "s", "size"}
+
+// SetExtraParams sets query parameters added to all avatar URLs, for
+// servers understanding more than the libravatar API (nil for none).
+// The parameters set by this package, like s or d, cannot be given.
+func (v *Libravatar) SetExtraParams(extra url.Values) error {
+	if err := checkExtraParams(extra); err != nil {
+		return err
+	}
+	v.extraParams = extra.Encode()
+	v.urlCache.purge()
+	return nil
+}
+
+// ParamExtra adds query parameters to the avatar URL of a single call,
+// replacing the ones with the same names set by SetExtraParams
+func ParamExtra(extra url.Values) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		if err := checkExtraParams(extra); err != nil {
+			return err
+		}
+		merged, _ := url.ParseQuery(p.extra)
+		for k, vals := range extra {
+			merged[k] = vals
+		}
+		p.extra = merged.Encode()
+		return nil
+	}
+}
+
+// checkExtraParams checks extra does not set reserved parameters
+func checkExtraParams(extra url.Values) error {
+	for k := range extra {
+		for _, r := range reservedParams {
+			if strings.EqualFold(k, r) {
+				return fmt.Errorf("%w: extra parameter %q is reserved", ErrInvalidConfig, k)
+			}
+		}
+		if k == "" {
+			return fmt.Errorf("%w: empty extra parameter name", ErrInvalidConfig)
+		}
+	}
+	return nil
+}
+
+// withExtra returns link with the encoded query parameters extra
+// added, keeping parameters sorted by key
+func withExtra(link, extra string) string {
+	base, query, _ := strings.Cut(link, "?")
+	q, _ := url.ParseQuery(query)
+	e, _ := url.ParseQuery(extra)
+	for k, vals := range e {
+		q[k] = vals
+	}
+	return base + "?" + q.Encode()
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestExtraParams(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	base := "http://cdn.libravatar.org/avatar/" + hashOf("user@example.org")
+
+	if err := avt.SetExtraParams(url.Values{"format": {"webp"}, "theme": {"dark mode"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != base+"?format=webp&theme=dark+mode" {
+		t.Errorf("FromEmail with extra parameters == %s, %v", got, err)
+	}
+	avt.SetAvatarSize(64)
+	avt.SetDefaultImage("https://example.com/default.png?x=1")
+	want := base + "?d=https%3A%2F%2Fexample.com%2Fdefault.png%3Fx%3D1&format=webp&s=64&theme=dark+mode"
+	if got, _ := avt.FromEmail("user@example.org"); got != want {
+		t.Errorf("FromEmail with extra and standard parameters == %s, expected %s", got, want)
+	}
+
+	// per call parameters replace the configured ones
+	want = base + "?d=https%3A%2F%2Fexample.com%2Fdefault.png%3Fx%3D1&format=png&lang=it&s=64&theme=dark+mode"
+	if got, err := avt.FromEmailWithOptions("user@example.org", ParamExtra(url.Values{"format": {"png"}, "lang": {"it"}})); err != nil || got != want {
+		t.Errorf("FromEmailWithOptions with extra parameters == %s, %v, expected %s", got, err, want)
+	}
+
+	for _, extra := range []url.Values{{"s": {"10"}}, {"D": {"mp"}}, {"forcedefault": {"y"}}, {"": {"x"}}} {
+		if err := avt.SetExtraParams(extra); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetExtraParams(%v) == %v, expected ErrInvalidConfig", extra, err)
+		}
+		if _, err := avt.FromEmailWithOptions("user@example.org", ParamExtra(extra)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("ParamExtra(%v) == %v, expected ErrInvalidConfig", extra, err)
+		}
+	}
+
+	avt.SetExtraParams(nil)
+	avt.SetDefaultImage("")
+	if got, _ := avt.FromEmail("user@example.org"); got != base+"?s=64" {
+		t.Errorf("FromEmail without extra parameters == %s", got)
+	}
+}
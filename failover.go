@@ -0,0 +1,233 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// targetIndexSize is the number of SRV targets with backups
+	// remembered for failing over
+	targetIndexSize = 10000
+	// targetIndexKeys is the number of domains remembered for each of
+	// them, the most recently looked up
+	targetIndexKeys = 16
+)
+
+// SetFailover enables retrying HTTP requests against the fallback hosts
+// when the federated server cannot be reached or answers with a server
+// error. Failing servers are then skipped for a while.
+//
+// Requests to federated servers are always retried against the SRV
+// records of lower priority first, and requests to fallback hosts
+// against the ones following them in the list given to SetFallbackHosts.
+func (v *Libravatar) SetFailover(enable bool) {
+	v.failover = enable
+}
+
+// failed tells whether a request should be retried elsewhere
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// failoverLinks returns the links to be tried in turn for link,
+// skipping hosts which recently failed unless all of them did
+func (v *Libravatar) failoverLinks(link string) []string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return []string{link}
+	}
+
+	hosts := v.fallbackHosts
+	if u.Scheme == "https" {
+		hosts = v.secureFallbackHosts
+	}
+	candidates := []string{u.Host}
+	if i := slices.Index(hosts, u.Host); i >= 0 {
+		candidates = append(candidates, hosts[i+1:]...)
+	} else {
+		candidates = append(candidates, v.srvBackups(u)...)
+		if v.failover {
+			candidates = append(candidates, hosts...)
+		}
+	}
+	if len(candidates) == 1 {
+		return []string{link}
+	}
+
+	alive := make([]string, 0, len(candidates))
+	for _, host := range candidates {
+		if !v.isDead(host) {
+			alive = append(alive, host)
+		}
+	}
+	if len(alive) == 0 {
+		alive = candidates
+	}
+
+	links := make([]string, len(alive))
+	for i, host := range alive {
+		fu := *u
+		fu.Host = host
+		links[i] = fu.String()
+	}
+	return links
+}
+
+// markDead remembers the host of link failed
+func (v *Libravatar) markDead(link string) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	v.deadHostsMu.Lock()
+	if v.deadHosts == nil {
+		v.deadHosts = make(map[string]time.Time)
+	}
+	v.deadHosts[u.Host] = v.clock.Now()
+	v.deadHostsMu.Unlock()
+}
+
+// isDead tells whether host failed recently
+func (v *Libravatar) isDead(host string) bool {
+	v.deadHostsMu.Lock()
+	defer v.deadHostsMu.Unlock()
+	failedAt, ok := v.deadHosts[host]
+	if ok && v.clock.Now().Sub(failedAt) > v.failureCacheDuration {
+		delete(v.deadHosts, host)
+		return false
+	}
+	return ok
+}
+
+// lowerPriority returns the records of addrs with a priority lower
+// than (that is, a value greater than) priority, sorted by priority
+func lowerPriority(addrs []*net.SRV, priority uint16) []*net.SRV {
+	var backups []*net.SRV
+	for _, rr := range addrs {
+		if rr.Priority > priority {
+			backups = append(backups, rr)
+		}
+	}
+	slices.SortStableFunc(backups, func(a, b *net.SRV) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+	return backups
+}
+
+// defaultPort returns the port used by URLs of the given scheme
+func defaultPort(scheme string) uint16 {
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// targetKey returns the key of the target index for host and port
+func targetKey(host string, port uint16) string {
+	return net.JoinHostPort(strings.TrimSuffix(host, "."), strconv.Itoa(int(port)))
+}
+
+// linkTargetKey returns the key of the target index for the server of u
+func linkTargetKey(u *url.URL) string {
+	port := defaultPort(u.Scheme)
+	if p, err := strconv.ParseUint(u.Port(), 10, 16); err == nil {
+		port = uint16(p)
+	}
+	return targetKey(u.Hostname(), port)
+}
+
+// indexTarget remembers that the selected target of key, in val, has
+// backups, so that failing over finds them without scanning the cache
+func (v *Libravatar) indexTarget(key cacheKey, val cacheValue) {
+	if val.target == nil || len(val.backups) == 0 {
+		return
+	}
+	tk := targetKey(val.target.Target, val.target.Port)
+	v.targetsMu.Lock()
+	defer v.targetsMu.Unlock()
+	keys, _ := v.targets.get(tk)
+	if slices.Contains(keys, key) {
+		return
+	}
+	if len(keys) == targetIndexKeys {
+		keys = keys[1:]
+	}
+	v.targets.add(tk, append(slices.Clip(keys), key))
+}
+
+// indexedDomains returns the SRV cache entries, with their keys, whose
+// selected target serves u and has backups
+func (v *Libravatar) indexedDomains(u *url.URL) ([]cacheKey, []cacheValue) {
+	v.targetsMu.Lock()
+	keys, _ := v.targets.get(linkTargetKey(u))
+	v.targetsMu.Unlock()
+
+	port := defaultPort(u.Scheme)
+	var found []cacheKey
+	var vals []cacheValue
+	for _, key := range keys {
+		val, ok := v.getCache(key)
+		if ok && val.target != nil && len(val.backups) > 0 && srvHost(val.target, port) == u.Host {
+			found = append(found, key)
+			vals = append(vals, val)
+		}
+	}
+	return found, vals
+}
+
+// srvBackups returns the hosts of the lower priority SRV records
+// cached for a domain whose selected target serves u
+func (v *Libravatar) srvBackups(u *url.URL) []string {
+	_, vals := v.indexedDomains(u)
+	if len(vals) == 0 {
+		return nil
+	}
+	port := defaultPort(u.Scheme)
+	hosts := make([]string, len(vals[0].backups))
+	for i, rr := range vals[0].backups {
+		hosts[i] = srvHost(rr, port)
+	}
+	return hosts
+}
+
+// promoteTarget makes the SRV record serving the working link the
+// selected target of the domains whose target served the failed one
+func (v *Libravatar) promoteTarget(failed, working string) {
+	fu, err := url.Parse(failed)
+	if err != nil {
+		return
+	}
+	wu, err := url.Parse(working)
+	if err != nil {
+		return
+	}
+	port := defaultPort(fu.Scheme)
+	promoted := false
+	keys, vals := v.indexedDomains(fu)
+	for i, val := range vals {
+		for j, rr := range val.backups {
+			if srvHost(rr, port) == wu.Host {
+				val.target, val.backups = rr, val.backups[j+1:]
+				val.reason = "promoted after the selected target failed"
+				v.setCache(keys[i], val)
+				promoted = true
+				break
+			}
+		}
+	}
+	if promoted {
+		// cached URLs still point to the failed target
+		v.urlCache.purge()
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+
+	var federatedHits, fallbackHits int
+	federated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		federatedHits++
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/572c3489ea700045927076136a969e27"):
+			http.Error(w, "broken", http.StatusBadGateway)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer federated.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackHits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer fallback.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, federated)
+	avt.SetFallbackHost(strings.TrimPrefix(fallback.URL, "http://"))
+
+	// no failover unless asked
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); err == nil {
+		t.Errorf("GetAvatar from failing server without failover: expected an error")
+	}
+
+	avt.SetFailover(true)
+
+	// 4xx do not trigger failover
+	federatedHits, fallbackHits = 0, 0
+	if _, err := avt.GetAvatar(context.Background(), "other@example.org"); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("GetAvatar with 404: returned %v, expected ErrNoAvatar", err)
+	}
+	if federatedHits != 1 || fallbackHits != 0 {
+		t.Errorf("404: %d federated and %d fallback requests, expected 1 and 0", federatedHits, fallbackHits)
+	}
+
+	// 5xx do
+	federatedHits, fallbackHits = 0, 0
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatar with failover returned %v, %v", a, err)
+	}
+	if federatedHits != 1 || fallbackHits != 1 {
+		t.Errorf("5xx: %d federated and %d fallback requests, expected 1 each", federatedHits, fallbackHits)
+	}
+	if avt.Stats().Failovers != 1 {
+		t.Errorf("Stats() == %+v, expected 1 failover", avt.Stats())
+	}
+
+	// the failing server is remembered
+	federatedHits, fallbackHits = 0, 0
+	avt.GetAvatar(context.Background(), "user@example.org")
+	if federatedHits != 0 || fallbackHits != 1 {
+		t.Errorf("after failure: %d federated and %d fallback requests, expected 0 and 1", federatedHits, fallbackHits)
+	}
+
+	// so are dead ones
+	federated.Close()
+	avt.deadHosts = nil
+	fallbackHits = 0
+	ok, err := avt.Exists(context.Background(), "other@example.org")
+	if !ok || err != nil || fallbackHits != 1 {
+		t.Errorf("Exists with federated server down == %v, %v (%d fallback requests)", ok, err, fallbackHits)
+	}
+	w := &countingWriter{}
+	if _, _, err := avt.WriteAvatar(context.Background(), w, "user@example.org"); err != nil || w.n != int64(len(testPNG)) {
+		t.Errorf("WriteAvatar with federated server down: wrote %d bytes, error %v", w.n, err)
+	}
+}
+
+func TestFallbackHosts(t *testing.T) {
+
+	mirror := httptest.NewServer(http.NotFoundHandler())
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	mirror.Close()
+	var cdnHits int
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnHits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer cdn.Close()
+	cdnHost := strings.TrimPrefix(cdn.URL, "http://")
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetFallbackHosts(mirrorHost, cdnHost)
+
+	// URLs are built with the first host
+	link, err := avt.FromEmail("user@example.org")
+	if err != nil || link != "http://"+mirrorHost+"/avatar/572c3489ea700045927076136a969e27" {
+		t.Errorf("FromEmail == %s, %v, expected a link to the first fallback host", link, err)
+	}
+
+	// fetching fails over to the second one, without SetFailover
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatar with first fallback host down returned %v, %v", a, err)
+	}
+	if cdnHits != 1 || avt.Stats().Failovers != 1 {
+		t.Errorf("%d requests to the second host and %d failovers, expected 1 each", cdnHits, avt.Stats().Failovers)
+	}
+
+	// the dead mirror is then skipped
+	ok, err := avt.Exists(context.Background(), "user@example.org")
+	if !ok || err != nil || cdnHits != 2 || avt.Stats().Failovers != 1 {
+		t.Errorf("Exists == %v, %v, with %d requests and %d failovers, expected the dead mirror to be skipped", ok, err, cdnHits, avt.Stats().Failovers)
+	}
+
+	// and so it is by the proxy
+	srv := httptest.NewServer(avt.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/avatar/572c3489ea700045927076136a969e27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || cdnHits != 3 {
+		t.Errorf("proxy answered %s after %d requests to the second host, expected 200 after 3", resp.Status, cdnHits)
+	}
+
+	// unless all hosts are dead
+	avt.markDead("http://" + cdnHost + "/")
+	if links := avt.failoverLinks(link); len(links) != 2 {
+		t.Errorf("failoverLinks with all hosts dead == %v, expected both hosts", links)
+	}
+
+	// single-host setters map onto one-element lists
+	avt.SetFallbackHost("cdn.example.org")
+	if len(avt.fallbackHosts) != 1 || avt.fallbackHost(false) != "cdn.example.org" {
+		t.Errorf("SetFallbackHost: fallback hosts == %v", avt.fallbackHosts)
+	}
+	if links := avt.failoverLinks("http://cdn.example.org/avatar/x"); len(links) != 1 {
+		t.Errorf("failoverLinks with a single fallback host == %v", links)
+	}
+}
+
+func TestSRVPriorityFailover(t *testing.T) {
+
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+	var backupHits int
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupHits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer backup.Close()
+
+	record := func(srv *httptest.Server, priority uint16) *net.SRV {
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return &net.SRV{Target: u.Hostname(), Port: uint16(port), Priority: priority, Weight: 10}
+	}
+	avt := New()
+	avt.lookupSRV = srvResponder(record(backup, 20), record(primary, 10))
+
+	// URLs use the top priority record
+	link, err := avt.FromEmail("user@example.org")
+	if err != nil || !strings.HasPrefix(link, primary.URL+"/") {
+		t.Fatalf("FromEmail == %s, %v, expected a link to %s", link, err, primary.URL)
+	}
+
+	// fetching falls back to the lower priority one, without SetFailover
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) || backupHits != 1 {
+		t.Errorf("GetAvatar with primary target down returned %v, %v after %d backup requests", a, err, backupHits)
+	}
+
+	// which is then remembered
+	link, err = avt.FromEmail("user@example.org")
+	if err != nil || !strings.HasPrefix(link, backup.URL+"/") {
+		t.Errorf("FromEmail after failover == %s, %v, expected a link to %s", link, err, backup.URL)
+	}
+	if ok, err := avt.Exists(context.Background(), "user@example.org"); !ok || err != nil || backupHits != 2 {
+		t.Errorf("Exists after failover == %v, %v after %d backup requests", ok, err, backupHits)
+	}
+	if n := avt.Stats().Failovers; n != 1 {
+		t.Errorf("%d failovers, expected 1", n)
+	}
+
+	// with a shared cache, the replica fetching the avatar may not
+	// have looked the domain up itself
+	shared := newMapCache()
+	replicas := []*Libravatar{New(), New()}
+	for _, r := range replicas {
+		r.SetCache(shared)
+	}
+	replicas[0].lookupSRV = srvResponder(record(backup, 20), record(primary, 10))
+	replicas[1].lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		t.Errorf("unexpected lookup of %s by the second replica", name)
+		return "", nil, nil
+	}
+	if link, err := replicas[0].FromEmail("user@example.org"); err != nil || !strings.HasPrefix(link, primary.URL+"/") {
+		t.Fatalf("FromEmail == %s, %v, expected a link to %s", link, err, primary.URL)
+	}
+	backupHits = 0
+	a, err = replicas[1].GetAvatar(context.Background(), "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) || backupHits != 1 {
+		t.Errorf("GetAvatar with a shared cache returned %v, %v after %d backup requests", a, err, backupHits)
+	}
+	link, err = replicas[0].FromEmail("user@example.org")
+	if err != nil || !strings.HasPrefix(link, backup.URL+"/") {
+		t.Errorf("FromEmail after failover by another replica == %s, %v, expected a link to %s", link, err, backup.URL)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// SetDomainFaviconDefault makes avatar URLs for emails use, as default
+// image, an image for the domain of the email, like its favicon, given
+// by an http(s) URL template with a %s where the domain goes, like
+// "https://%s/favicon.ico" ("" to disable). It is only used when no
+// default image is set, and is skipped for OpenIDs, and for rendered
+// URLs not allowed by SetDefaultURLAllowlist.
+func (v *Libravatar) SetDomainFaviconDefault(urlTemplate string) error {
+	if err := checkFaviconTemplate(urlTemplate); err != nil {
+		return err
+	}
+	v.faviconDefault = urlTemplate
+	v.urlCache.purge()
+	return nil
+}
+
+// ParamDomainFaviconDefault overrides SetDomainFaviconDefault for a
+// single call
+func ParamDomainFaviconDefault(urlTemplate string) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		if err := checkFaviconTemplate(urlTemplate); err != nil {
+			return err
+		}
+		p.favicon = urlTemplate
+		return nil
+	}
+}
+
+// checkFaviconTemplate checks urlTemplate is a valid template for
+// SetDomainFaviconDefault
+func checkFaviconTemplate(urlTemplate string) error {
+	if urlTemplate == "" {
+		return nil
+	}
+	if strings.Count(urlTemplate, "%s") != 1 || !isImageURL(renderFavicon(urlTemplate, "example.org")) {
+		return fmt.Errorf("%w: invalid favicon URL template %q, expected an http(s) URL with one %%s", ErrInvalidConfig, urlTemplate)
+	}
+	return nil
+}
+
+// renderFavicon returns the favicon URL for domain
+func renderFavicon(urlTemplate, domain string) string {
+	return strings.Replace(urlTemplate, "%s", domain, 1)
+}
+
+// withFavicon returns p using, as default image, the favicon of the
+// domain of email, if configured and no other default image is set
+func (v *Libravatar) withFavicon(p params, email *mail.Address) params {
+	if p.favicon == "" || p.defURL != "" || email == nil {
+		return p
+	}
+	domain, err := v.getDomain(email, nil)
+	if err != nil {
+		return p
+	}
+	if link := renderFavicon(p.favicon, domain); v.defaultURLAllowed(link) {
+		p.defURL = link
+	}
+	return p
+}
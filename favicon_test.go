@@ -0,0 +1,79 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDomainFaviconDefault(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	base := "http://cdn.libravatar.org/avatar/"
+	hash := hashOf("user@example.org")
+
+	if err := avt.SetDomainFaviconDefault("https://%s/favicon.ico"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := avt.FromEmail("user@Example.ORG"); err != nil || got != base+hash+"?d=https%3A%2F%2Fexample.org%2Ffavicon.ico" {
+		t.Errorf("FromEmail with the favicon default == %s, %v", got, err)
+	}
+	if err := avt.SetDomainFaviconDefault("https://www.google.com/s2/favicons?domain=%s&sz=64"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != base+hash+"?d=https%3A%2F%2Fwww.google.com%2Fs2%2Ffavicons%3Fdomain%3Dexample.org%26sz%3D64" {
+		t.Errorf("FromEmail with the s2 favicon default == %s, %v", got, err)
+	}
+
+	// OpenIDs have no mail domain
+	if got, err := avt.FromURL("https://example.org/id/user"); err != nil || strings.Contains(got, "?") {
+		t.Errorf("FromURL with the favicon default == %s, %v, expected no default image", got, err)
+	}
+
+	// an explicit default image takes precedence
+	avt.SetDefaultImage(IdentIcon)
+	if got, _ := avt.FromEmail("user@example.org"); got != base+hash+"?d=identicon" {
+		t.Errorf("FromEmail with a default image == %s, expected it to win over the favicon", got)
+	}
+	avt.SetDefaultImage("")
+
+	// per call overrides
+	w := httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamDomainFaviconDefault(""))
+	if got := w.Header().Get("Location"); got != base+hash {
+		t.Errorf("Redirect without the favicon default to %s", got)
+	}
+	w = httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamDomainFaviconDefault("https://icons.example.com/%s.png"))
+	if got := w.Header().Get("Location"); got != base+hash+"?d=https%3A%2F%2Ficons.example.com%2Fexample.org.png" {
+		t.Errorf("Redirect with another favicon default to %s", got)
+	}
+	w = httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamDefault(Retro))
+	if got := w.Header().Get("Location"); got != base+hash+"?d=retro" {
+		t.Errorf("Redirect with a default image to %s", got)
+	}
+
+	// favicons must be allowed
+	avt.SetDomainFaviconDefault("https://%s/favicon.ico")
+	avt.SetDefaultURLAllowlist("example.org")
+	if got, _ := avt.FromEmail("user@example.org"); got != base+hash+"?d=https%3A%2F%2Fexample.org%2Ffavicon.ico" {
+		t.Errorf("FromEmail with an allowed favicon == %s", got)
+	}
+	other := hashOf("user@example.net")
+	if got, _ := avt.FromEmail("user@example.net"); got != base+other {
+		t.Errorf("FromEmail with a disallowed favicon == %s, expected no default image", got)
+	}
+
+	for _, tmpl := range []string{"https://example.org/favicon.ico", "https://%s/%s.ico", "ftp://%s/favicon.ico", "%s"} {
+		if err := avt.SetDomainFaviconDefault(tmpl); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetDomainFaviconDefault(%q) == %v, expected ErrInvalidConfig", tmpl, err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultHTTPTimeout is the timeout of the default http.Client
+const defaultHTTPTimeout = 10 * time.Second
+
+// ErrNoAvatar is returned when the server has no avatar for the
+// requested identity (it answered 404, as requested by HTTP404)
+var ErrNoAvatar = errors.New("libravatar: no avatar")
+
+// ErrBodyTooLarge is returned when an avatar image is larger than
+// allowed by SetMaxBodySize
+var ErrBodyTooLarge = errors.New("libravatar: avatar image too large")
+
+// ErrTooManyRedirects is returned when fetching an avatar image
+// requires following more redirects than allowed by SetMaxRedirects
+var ErrTooManyRedirects = errors.New("libravatar: too many redirects")
+
+// Avatar is an avatar image fetched from a server
+type Avatar struct {
+	Data         []byte // the image
+	ContentType  string // as reported by the server
+	URL          string // where the image was found, after redirects
+	ETag         string // validator reported by the server, if any
+	LastModified string // validator reported by the server, if any
+	NotModified  bool   // whether the server reported the image did not change
+	Degraded     bool   // whether this is the local fallback image, servers being unreachable
+	Format       string // image format ("png", "jpeg", "gif"), only set if validating images
+	Width        int    // only set if validating images
+	Height       int    // only set if validating images
+}
+
+// GetAvatar fetches the avatar image for the given email
+func (v *Libravatar) GetAvatar(ctx context.Context, email string) (*Avatar, error) {
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return nil, err
+	}
+	return v.getAvatar(ctx, link, v.maxBodySize, nil)
+}
+
+// GetAvatarIfModified fetches the avatar image for the given email,
+// unless it did not change since prev was fetched, in which case
+// a copy of prev is returned, with NotModified set, without
+// downloading the image again
+func (v *Libravatar) GetAvatarIfModified(ctx context.Context, email string, prev *Avatar) (*Avatar, error) {
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return nil, err
+	}
+	return v.getAvatar(ctx, link, v.maxBodySize, prev)
+}
+
+// GetAvatarFromURL fetches the avatar image for the given url
+// (typically for OpenID)
+func (v *Libravatar) GetAvatarFromURL(ctx context.Context, openid string) (*Avatar, error) {
+	link, err := v.openidURL(ctx, openid, v.params())
+	if err != nil {
+		return nil, err
+	}
+	return v.getAvatar(ctx, link, v.maxBodySize, nil)
+}
+
+// getAvatar fetches the avatar image at link, failing if larger than
+// maxSize bytes (0 for no limit), unless it did not change since prev
+// (if not nil) was fetched.
+// When prev is nil, the image cache is used, if enabled.
+func (v *Libravatar) getAvatar(ctx context.Context, link string, maxSize int64, prev *Avatar) (*Avatar, error) {
+	var key string
+	revalidating := false
+	if v.imageCacheDir != "" {
+		key = imageCacheKey(link)
+	}
+	if key != "" && prev == nil {
+		// images failing validation are fetched again
+		if a, fresh := v.readImageCache(key); a != nil && v.validateImage(a, link) == nil {
+			if maxSize > 0 && int64(len(a.Data)) > maxSize {
+				return nil, ErrBodyTooLarge
+			}
+			if fresh {
+				return a, nil
+			}
+			prev, revalidating = a, true
+		}
+	}
+
+	var hdr http.Header
+	if prev != nil {
+		hdr = make(http.Header)
+		if prev.ETag != "" {
+			hdr.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			hdr.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := v.fetch(ctx, http.MethodGet, link, hdr)
+	if err != nil {
+		// stale images are served while the server fails, unless the
+		// avatar is gone
+		if revalidating && !errors.Is(err, ErrNoAvatar) && ctx.Err() == nil {
+			return prev, nil
+		}
+		if a := v.localFallback(ctx, link, err); a != nil {
+			return a, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		a := *prev
+		if revalidating {
+			// validated when read from the cache, stored again with
+			// the validators of the response, if any, to be fresh
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				a.ETag = etag
+			}
+			if lm := resp.Header.Get("Last-Modified"); lm != "" {
+				a.LastModified = lm
+			}
+			v.writeImageCache(key, &a)
+		} else {
+			v.validateImage(&a, link)
+			a.NotModified = true
+		}
+		return &a, nil
+	}
+
+	data, err := io.ReadAll(limitBody(resp.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := v.checkContentType(resp.Header.Get("Content-Type"), data); err != nil {
+		return nil, err
+	}
+	a := &Avatar{
+		Data:         data,
+		ContentType:  resp.Header.Get("Content-Type"),
+		URL:          resp.Request.URL.String(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err := v.validateImage(a, link); err != nil {
+		return nil, err
+	}
+	if key != "" {
+		v.writeImageCache(key, a)
+	}
+	return a, nil
+}
+
+// WriteAvatar writes the avatar image for the given email to w,
+// returning the number of bytes written and the image content type.
+// On errors, the number of bytes written so far is returned.
+func (v *Libravatar) WriteAvatar(ctx context.Context, w io.Writer, email string) (int64, string, error) {
+	if w == nil {
+		return 0, "", fmt.Errorf("%w: nil writer", ErrInvalidInput)
+	}
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return 0, "", err
+	}
+
+	if v.buffered() {
+		a, err := v.getAvatar(ctx, link, v.maxBodySize, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		n, err := w.Write(a.Data)
+		return int64(n), a.ContentType, err
+	}
+
+	resp, err := v.fetch(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		if a := v.localFallback(ctx, link, err); a != nil {
+			n, err := w.Write(a.Data)
+			return int64(n), a.ContentType, err
+		}
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	ctype := resp.Header.Get("Content-Type")
+	body, err := v.checkedBody(resp)
+	if err != nil {
+		return 0, "", err
+	}
+	n, err := io.Copy(w, body)
+	return n, ctype, err
+}
+
+// SetHTTPClient sets the client used for all HTTP requests (nil for
+// the default one, which has a timeout of 10 seconds)
+func (v *Libravatar) SetHTTPClient(client *http.Client) {
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	v.httpClient = client
+}
+
+// SetUserAgent sets the User-Agent header sent with all HTTP requests
+func (v *Libravatar) SetUserAgent(ua string) {
+	v.userAgent = ua
+}
+
+// SetMaxBodySize sets the size, in bytes, of the largest avatar image
+// which will be fetched (0 for no limit). The default is 5 MiB.
+func (v *Libravatar) SetMaxBodySize(size int64) {
+	v.maxBodySize = size
+}
+
+// SetMaxRedirects sets the maximum number of redirects followed when
+// fetching avatar images. The default is 5. A negative value leaves
+// the decision to the CheckRedirect policy of the HTTP client.
+func (v *Libravatar) SetMaxRedirects(n int) {
+	v.maxRedirects = n
+}
+
+// client returns the HTTP client to be used for requests made with
+// ctx, enforcing the maximum number of redirects and refusing private
+// addresses if needed
+func (v *Libravatar) client(ctx context.Context) *http.Client {
+	base := v.httpClient
+	if v.blockingPrivate(ctx) {
+		base = v.guardedClient()
+	}
+	if v.maxRedirects < 0 {
+		return base
+	}
+	client := *base
+	check := client.CheckRedirect
+	max := v.maxRedirects
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return ErrTooManyRedirects
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		return nil
+	}
+	return &client
+}
+
+// limitBody returns a reader failing with ErrBodyTooLarge once more
+// than max bytes have been read from r (0 for no limit)
+func limitBody(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &limitReader{r, max}
+}
+
+// limitReader is like io.LimitReader, but fails when its limit is
+// exceeded instead of just stopping
+type limitReader struct {
+	r io.Reader
+	n int64 // bytes left before the limit
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte more than allowed, to find out if there is more
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = -1
+		return n, ErrBodyTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// Exists tells whether there is an avatar for the given email.
+// An error is returned if the server could not tell.
+func (v *Libravatar) Exists(ctx context.Context, email string) (bool, error) {
+	p := v.params()
+	p.defURL, p.gravatarDefault = HTTP404, ""
+	link, err := v.emailURL(ctx, email, p)
+	if err != nil {
+		return false, err
+	}
+	if v.knownNotFound(link) {
+		return false, nil
+	}
+
+	resp, err := v.do(ctx, http.MethodHead, link, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		resp, err = v.do(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+	}
+	v.noteStatus(link, resp.StatusCode)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("%w %s checking %s", ErrUnexpectedStatus, resp.Status, link)
+}
+
+// do sends a request for link, with the additional headers in hdr,
+// failing over to other servers as described by SetFailover
+func (v *Libravatar) do(ctx context.Context, method, link string, hdr http.Header) (*http.Response, error) {
+	links := v.failoverLinks(link)
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i, l := range links {
+		if i > 0 {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			v.markDead(links[i-1])
+			v.stats.failovers.Add(1)
+		}
+		resp, err = v.send(ctx, method, l, hdr)
+		if !failed(resp, err) {
+			if l != link {
+				v.promoteTarget(link, l)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return resp, err
+}
+
+// send sends a request for link, with the additional headers in hdr
+func (v *Libravatar) send(ctx context.Context, method, link string, hdr http.Header) (*http.Response, error) {
+	ctx, sp := v.startSpan(ctx, SpanFetch, "http.method", method, "http.url", link)
+	req, err := http.NewRequestWithContext(ctx, method, link, nil)
+	if err != nil {
+		sp.finish(err)
+		return nil, err
+	}
+	for k, vals := range hdr {
+		req.Header[k] = vals
+	}
+	if v.userAgent != "" {
+		req.Header.Set("User-Agent", v.userAgent)
+	}
+	start := time.Now()
+	resp, err := v.client(ctx).Do(req)
+	if err != nil {
+		v.metrics.IncError(ErrorKindHTTP)
+		sp.finish(err)
+		return nil, err
+	}
+	sp.set("http.status", strconv.Itoa(resp.StatusCode))
+	sp.finish(nil)
+	resp.Body = &meteredBody{ReadCloser: resp.Body, m: v.metrics, status: resp.StatusCode, start: start}
+	return resp, nil
+}
+
+// fetch sends a request for link, with the additional headers in hdr,
+// returning the response if its status is 200 OK or 304 Not Modified,
+// in which case the caller must close its body
+func (v *Libravatar) fetch(ctx context.Context, method, link string, hdr http.Header) (*http.Response, error) {
+	if v.knownNotFound(link) {
+		return nil, ErrNoAvatar
+	}
+	resp, err := v.do(ctx, method, link, hdr)
+	if err != nil {
+		return nil, err
+	}
+	v.noteStatus(link, resp.StatusCode)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotModified:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNoAvatar
+	}
+	resp.Body.Close()
+	v.metrics.IncError(ErrorKindHTTP)
+	return nil, fmt.Errorf("%w %s fetching %s", ErrUnexpectedStatus, resp.Status, link)
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serverResponder returns a lookup function pointing every domain at srv
+func serverResponder(t *testing.T, srv *httptest.Server) func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srvResponder(&net.SRV{Target: u.Hostname(), Port: uint16(port)})
+}
+
+var testPNG = []byte("\x89PNG\r\n\x1a\nfake image data")
+
+func TestGetAvatar(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/avatar/572c3489ea700045927076136a969e27", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("s") != "64" {
+			t.Errorf("request for %s, expected size 64", r.URL)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	})
+	mux.HandleFunc("/avatar/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("d") == HTTP404 {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/avatar/572c3489ea700045927076136a969e27?s=64", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetAvatarSize(64)
+
+	// 200
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatalf("GetAvatar: unexpected error %v", err)
+	}
+	if !bytes.Equal(a.Data, testPNG) || a.ContentType != "image/png" {
+		t.Errorf("GetAvatar returned %q (%s)", a.Data, a.ContentType)
+	}
+	if want := srv.URL + "/avatar/572c3489ea700045927076136a969e27?s=64"; a.URL != want {
+		t.Errorf("GetAvatar URL == %q, expected %q", a.URL, want)
+	}
+
+	// 302 -> 200
+	a, err = avt.GetAvatar(context.Background(), "other@example.org")
+	if err != nil {
+		t.Fatalf("GetAvatar with redirect: unexpected error %v", err)
+	}
+	if !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatar with redirect returned %q", a.Data)
+	}
+	if want := srv.URL + "/avatar/572c3489ea700045927076136a969e27?s=64"; a.URL != want {
+		t.Errorf("GetAvatar with redirect URL == %q, expected %q", a.URL, want)
+	}
+
+	// 404
+	avt.SetDefaultImage(HTTP404)
+	_, err = avt.GetAvatar(context.Background(), "other@example.org")
+	if !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("GetAvatar with d=404 returned %v, expected ErrNoAvatar", err)
+	}
+
+	// OpenID
+	avt.SetDefaultImage("")
+	a, err = avt.GetAvatarFromURL(context.Background(), "https://example.org/openid/")
+	if err != nil || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatarFromURL returned %v, %v", a, err)
+	}
+}
+
+func TestExists(t *testing.T) {
+
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Query().Get("d") != HTTP404 {
+			t.Errorf("request for %s, expected d=404", r.URL)
+		}
+		if r.Method == http.MethodHead && r.URL.Path == "/avatar/33dba230504c2788c74d45c8295a9ae6" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.URL.Path {
+		case "/avatar/572c3489ea700045927076136a969e27", "/avatar/33dba230504c2788c74d45c8295a9ae6":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG)
+		case "/avatar/37f3b83f1820c03432cf486994254113":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetDefaultImage(IdentIcon)
+
+	cases := []struct {
+		email   string
+		want    bool
+		err     bool
+		methods string
+	}{
+		{"user@example.org", true, false, "HEAD"},
+		{"nobody@example.org", false, false, "HEAD"},
+		{"broken@example.org", false, true, "HEAD"},
+		{"nohead@example.org", true, false, "HEAD GET"},
+	}
+
+	for _, c := range cases {
+		methods = nil
+		got, err := avt.Exists(context.Background(), c.email)
+		if (err != nil) != c.err {
+			t.Errorf("Exists(%q): error %v, expected error: %v", c.email, err, c.err)
+		}
+		if got != c.want {
+			t.Errorf("Exists(%q) == %v, expected %v", c.email, got, c.want)
+		}
+		if ms := strings.Join(methods, " "); ms != c.methods {
+			t.Errorf("Exists(%q) sent %s, expected %s", c.email, ms, c.methods)
+		}
+	}
+
+	// a Gravatar default would be served for missing avatars
+	avt.SetGravatarDefault(true)
+	if got, err := avt.Exists(context.Background(), "nobody@example.org"); got || err != nil {
+		t.Errorf("Exists with SetGravatarDefault == %v, %v, expected false", got, err)
+	}
+
+	// network errors are errors, not false
+	srv.Close()
+	if _, err := avt.Exists(context.Background(), "user@example.org"); err == nil {
+		t.Errorf("Exists with server down: expected an error")
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// pngLike returns a copy of data starting with the PNG signature
+func pngLike(data []byte) []byte {
+	b := append([]byte(nil), data...)
+	copy(b, "\x89PNG\r\n\x1a\n")
+	return b
+}
+
+func TestWriteAvatar(t *testing.T) {
+
+	const size = 3 << 20
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		chunk := bytes.Repeat([]byte{0x42}, 1<<16)
+		for i := 0; i < size/len(chunk); i++ {
+			if i == 0 {
+				w.Write(pngLike(chunk))
+				continue
+			}
+			w.Write(chunk)
+		}
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+
+	w := &countingWriter{}
+	n, ctype, err := avt.WriteAvatar(context.Background(), w, "user@example.org")
+	if err != nil {
+		t.Fatalf("WriteAvatar: unexpected error %v", err)
+	}
+	if n != size || w.n != size || ctype != "image/png" {
+		t.Errorf("WriteAvatar == %d, %q, wrote %d, expected %d bytes of image/png", n, ctype, w.n, size)
+	}
+
+	avt.SetMaxBodySize(1 << 20)
+	w = &countingWriter{}
+	n, _, err = avt.WriteAvatar(context.Background(), w, "user@example.org")
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("WriteAvatar over the size limit returned %v, expected ErrBodyTooLarge", err)
+	}
+	if n != w.n || n != 1<<20 {
+		t.Errorf("WriteAvatar over the size limit reported %d bytes, wrote %d, expected %d", n, w.n, 1<<20)
+	}
+
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("GetAvatar over the size limit returned %v, expected ErrBodyTooLarge", err)
+	}
+	avt.SetMaxBodySize(size)
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); err != nil {
+		t.Errorf("GetAvatar at the size limit: unexpected error %v", err)
+	}
+}
+
+// recordingTransport is a RoundTripper recording the requests it sends
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests = append(rt.requests, req)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	if New().httpClient == http.DefaultClient || New().httpClient.Timeout == 0 {
+		t.Errorf("default client has no timeout")
+	}
+
+	rt := &recordingTransport{}
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetHTTPClient(&http.Client{Transport: rt})
+	avt.SetUserAgent("test-agent/1.0")
+
+	ctx := context.Background()
+	avt.GetAvatar(ctx, "user@example.org")
+	avt.WriteAvatar(ctx, &countingWriter{}, "user@example.org")
+	avt.Exists(ctx, "user@example.org")
+	avt.DataURI(ctx, "user@example.org")
+
+	if len(rt.requests) != 4 {
+		t.Errorf("%d requests went through the custom transport, expected 4", len(rt.requests))
+	}
+	for i, ua := range agents {
+		if ua != "test-agent/1.0" {
+			t.Errorf("request %d had User-Agent %q", i, ua)
+		}
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+
+	hops := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/loop"):
+			hops++
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/avatar/572c3489ea700045927076136a969e27"):
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngLike(bytes.Repeat([]byte{0x42}, 6<<20)))
+		}
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+
+	_, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("GetAvatar with redirect loop returned %v, expected ErrTooManyRedirects", err)
+	}
+	if hops != 5 {
+		t.Errorf("%d redirects followed, expected 5", hops)
+	}
+
+	_, err = avt.GetAvatar(context.Background(), "other@example.org")
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("GetAvatar with oversized body returned %v, expected ErrBodyTooLarge", err)
+	}
+
+	hops = 0
+	avt.SetMaxRedirects(1)
+	avt.GetAvatar(context.Background(), "user@example.org")
+	if hops != 1 {
+		t.Errorf("%d redirects followed, expected 1", hops)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrDegraded is reported by FetchAll for avatars which could not be
+// fetched, only the local fallback image being available
+var ErrDegraded = errors.New("libravatar: avatar servers unreachable")
+
+// FetchOutcome tells how the download of an avatar by FetchAll ended
+type FetchOutcome int
+
+const (
+	// FetchDownloaded means the avatar was written to a new file
+	FetchDownloaded FetchOutcome = iota
+	// FetchDuplicate means the avatar was already in a file, written
+	// for another identity or by a previous run
+	FetchDuplicate
+	// FetchNoAvatar means the identity has no avatar
+	FetchNoAvatar
+	// FetchFailed means the avatar could not be resolved, downloaded
+	// or written
+	FetchFailed
+)
+
+func (o FetchOutcome) String() string {
+	switch o {
+	case FetchDownloaded:
+		return "downloaded"
+	case FetchDuplicate:
+		return "duplicate"
+	case FetchNoAvatar:
+		return "no avatar"
+	case FetchFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// FetchResult is the outcome of downloading the avatar of an identity
+type FetchResult struct {
+	Email   string
+	Hash    string // the hash of the identity
+	File    string // the name of the file holding the avatar, if any
+	Outcome FetchOutcome
+	Err     error // the error met, for FetchFailed
+}
+
+// FetchReport describes a FetchAll run
+type FetchReport struct {
+	Results []FetchResult // by email, in the order they were given
+	// number of results by outcome
+	Downloaded, Duplicates, NoAvatar, Failed int
+}
+
+// FetchOption configures FetchAll
+type FetchOption func(*fetchAll)
+
+// FetchConcurrency sets how many avatars are downloaded at once
+// (by default, as many as SRV lookups run at once by WarmCache)
+func FetchConcurrency(n int) FetchOption {
+	return func(f *fetchAll) {
+		if n > 0 {
+			f.workers = n
+		}
+	}
+}
+
+// fetchAll is a FetchAll run
+type fetchAll struct {
+	v       *Libravatar
+	dir     string
+	workers int
+	mu      sync.Mutex
+	files   map[string]bool // files written or being written
+}
+
+// FetchAll downloads the avatars for the given emails to dir, which is
+// created if needed, concurrently. Files are named after the SHA-256
+// hash of their content, with the extension of the image format, so
+// that avatars shared by several identities, or already downloaded,
+// are written only once. Files are written atomically.
+// Failures for single emails do not stop the others, and are reported
+// in the results. If ctx is done, FetchAll returns promptly the
+// report so far, with the emails not processed marked as failed, and
+// ctx.Err().
+func (v *Libravatar) FetchAll(ctx context.Context, emails []string, dir string, opts ...FetchOption) (*FetchReport, error) {
+	f := &fetchAll{v: v, dir: dir, workers: warmCacheWorkers, files: make(map[string]bool)}
+	if v.lookupSem != nil {
+		f.workers = cap(v.lookupSem)
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// each identity is downloaded once, however many times it appears
+	report := &FetchReport{Results: make([]FetchResult, len(emails))}
+	first := make(map[string]int, len(emails))
+	var jobs []int
+	for i, e := range emails {
+		r := &report.Results[i]
+		r.Email = e
+		addr, err := parseEmail(e)
+		if err == nil {
+			r.Hash, err = v.hash(addr, nil)
+		}
+		if err != nil {
+			r.Outcome, r.Err = FetchFailed, err
+			continue
+		}
+		if _, ok := first[r.Hash]; !ok {
+			first[r.Hash] = i
+			jobs = append(jobs, i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for i := 0; i < min(f.workers, len(jobs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				f.fetch(ctx, &report.Results[j])
+			}
+		}()
+	}
+	sent := 0
+	for _, j := range jobs {
+		select {
+		case queue <- j:
+			sent++
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	close(queue)
+	wg.Wait()
+	for _, j := range jobs[sent:] {
+		report.Results[j].Outcome, report.Results[j].Err = FetchFailed, ctx.Err()
+	}
+
+	for i := range report.Results {
+		r := &report.Results[i]
+		if j, ok := first[r.Hash]; ok && j != i {
+			*r = FetchResult{Email: r.Email, Hash: r.Hash, File: report.Results[j].File, Outcome: report.Results[j].Outcome, Err: report.Results[j].Err}
+			if r.Outcome == FetchDownloaded {
+				r.Outcome = FetchDuplicate
+			}
+		}
+		switch r.Outcome {
+		case FetchDownloaded:
+			report.Downloaded++
+		case FetchDuplicate:
+			report.Duplicates++
+		case FetchNoAvatar:
+			report.NoAvatar++
+		default:
+			report.Failed++
+		}
+	}
+	return report, ctx.Err()
+}
+
+// fetch downloads the avatar for r.Email, filling r
+func (f *fetchAll) fetch(ctx context.Context, r *FetchResult) {
+	if err := ctx.Err(); err != nil {
+		r.Outcome, r.Err = FetchFailed, err
+		return
+	}
+	link, err := f.v.emailURL(ctx, r.Email, f.v.params())
+	var a *Avatar
+	if err == nil {
+		a, err = f.v.getAvatar(ctx, link, f.v.maxBodySize, nil)
+	}
+	if errors.Is(err, ErrNoAvatar) {
+		r.Outcome = FetchNoAvatar
+		return
+	} else if err == nil && a.Degraded {
+		err = ErrDegraded
+	}
+	if err == nil {
+		r.File, r.Outcome, err = f.write(a.Data)
+	}
+	if err != nil {
+		r.Outcome, r.Err = FetchFailed, err
+	}
+}
+
+// write writes the image data to its file, unless already there
+func (f *fetchAll) write(data []byte) (string, FetchOutcome, error) {
+	ext := imageExt(data)
+	if ext == "" {
+		return "", FetchFailed, ErrNotAnImage
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:]) + ext
+
+	f.mu.Lock()
+	claimed := f.files[name]
+	f.files[name] = true
+	f.mu.Unlock()
+	if claimed {
+		return name, FetchDuplicate, nil
+	}
+	if _, err := os.Stat(filepath.Join(f.dir, name)); err == nil {
+		return name, FetchDuplicate, nil
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".fetch-*")
+	if err != nil {
+		return "", FetchFailed, err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(f.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		f.mu.Lock()
+		delete(f.files, name)
+		f.mu.Unlock()
+		return "", FetchFailed, err
+	}
+	return name, FetchDownloaded, nil
+}
+
+// imageExt returns the file extension for the image data, "" if it is
+// not an image
+func imageExt(data []byte) string {
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		switch format {
+		case "jpeg":
+			return ".jpg"
+		case "png", "gif":
+			return "." + format
+		}
+	}
+	switch http.DetectContentType(data) {
+	case "image/webp":
+		return ".webp"
+	case "image/bmp":
+		return ".bmp"
+	case "image/x-icon":
+		return ".ico"
+	}
+	return ""
+}
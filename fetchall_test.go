@@ -0,0 +1,144 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchAll(t *testing.T) {
+
+	fixtures := placeholderFixtures(t)
+	shared := fixtures["quadrants@example.org"]
+	byHash := map[string][]byte{
+		hashOf("a@example.org"): shared,
+		hashOf("b@example.org"): shared,
+		hashOf("c@example.org"): fixtures["gif@example.org"],
+	}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		data, ok := byHash[strings.TrimPrefix(r.URL.Path, "/avatar/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	dir := filepath.Join(t.TempDir(), "avatars")
+	emails := []string{"a@example.org", "b@example.org", "c@example.org", "missing@example.org", "a@example.org", "not an email"}
+	report, err := avt.FetchAll(context.Background(), emails, dir, FetchConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 4 {
+		t.Errorf("FetchAll made %d requests, expected 4", requests)
+	}
+
+	sum := sha256.Sum256(shared)
+	sharedFile := hex.EncodeToString(sum[:]) + ".png"
+	sum = sha256.Sum256(fixtures["gif@example.org"])
+	gifFile := hex.EncodeToString(sum[:]) + ".gif"
+	expected := []struct {
+		file    string
+		outcome FetchOutcome
+	}{
+		{sharedFile, FetchDownloaded},
+		{sharedFile, FetchDuplicate},
+		{gifFile, FetchDownloaded},
+		{"", FetchNoAvatar},
+		{sharedFile, FetchDuplicate},
+		{"", FetchFailed},
+	}
+	// a and b race for the shared file
+	if r := report.Results; r[0].Outcome == FetchDuplicate && r[1].Outcome == FetchDownloaded {
+		expected[0].outcome, expected[1].outcome = FetchDuplicate, FetchDownloaded
+	}
+	for i, r := range report.Results {
+		if r.Email != emails[i] || r.File != expected[i].file || r.Outcome != expected[i].outcome {
+			t.Errorf("result %d == %+v, expected %s in %q", i, r, expected[i].outcome, expected[i].file)
+		}
+	}
+	if r := report.Results[5]; !errors.Is(r.Err, ErrInvalidEmail) {
+		t.Errorf("result for an invalid email has error %v, expected ErrInvalidEmail", r.Err)
+	}
+	if report.Downloaded != 2 || report.Duplicates != 2 || report.NoAvatar != 1 || report.Failed != 1 {
+		t.Errorf("report counts %d/%d/%d/%d, expected 2/2/1/1", report.Downloaded, report.Duplicates, report.NoAvatar, report.Failed)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("FetchAll wrote %v (%v), expected 2 files", entries, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, gifFile)); err != nil || string(data) != string(fixtures["gif@example.org"]) {
+		t.Errorf("unexpected content of %s: %v", gifFile, err)
+	}
+
+	// files from a previous run are not written again
+	report, err = avt.FetchAll(context.Background(), emails[2:3], dir)
+	if err != nil || report.Results[0].Outcome != FetchDuplicate || report.Duplicates != 1 {
+		t.Errorf("FetchAll of a downloaded avatar: %+v, %v", report, err)
+	}
+}
+
+func TestFetchAllCancel(t *testing.T) {
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	emails := []string{"a@example.org", "b@example.org", "c@example.org", "d@example.org"}
+	done := make(chan struct{})
+	var report *FetchReport
+	var err error
+	go func() {
+		report, err = avt.FetchAll(ctx, emails, t.TempDir(), FetchConcurrency(1))
+		close(done)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FetchAll did not stop on cancellation")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("FetchAll returned %v, expected context.Canceled", err)
+	}
+	if report == nil || len(report.Results) != len(emails) || report.Failed != len(emails) {
+		t.Fatalf("FetchAll report after cancellation: %+v", report)
+	}
+	for _, r := range report.Results {
+		if r.Outcome != FetchFailed || r.Err == nil {
+			t.Errorf("result after cancellation: %+v", r)
+		}
+	}
+}
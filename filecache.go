@@ -0,0 +1,134 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileCache is a Cache kept in a JSON file, so that short-lived
+// processes, like command line tools, do not look up SRV records on
+// every run. The file is rewritten on every change, atomically, after
+// reading it again: processes sharing it may lose some of each other's
+// changes, but never see a partially written file.
+type FileCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]fileCacheEntry
+	clock   Clock
+}
+
+// fileCacheEntry is a value stored in a FileCache
+type fileCacheEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewFileCache returns a FileCache kept in the file at path, with the
+// entries stored there if it exists. A file which cannot be parsed is
+// ignored, and replaced on the first change.
+func NewFileCache(path string) (*FileCache, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	entries := parseFileCache(b)
+	if entries == nil {
+		entries = make(map[string]fileCacheEntry)
+	}
+	return &FileCache{path: path, entries: entries, clock: systemClock{}}, nil
+}
+
+// SetClock sets the clock used to expire entries (nil for the system
+// clock, the default)
+func (c *FileCache) SetClock(clock Clock) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// Get returns the value stored for key, if any and not expired
+func (c *FileCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[key]
+	if !found || c.clock.Now().After(e.Expires) {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// Set stores value for key, for ttl
+func (c *FileCache) Set(key string, value []byte, ttl time.Duration) {
+	c.update(func(entries map[string]fileCacheEntry) {
+		entries[key] = fileCacheEntry{value, c.clock.Now().Add(ttl)}
+	})
+}
+
+// Delete removes the value stored for key, if any
+func (c *FileCache) Delete(key string) {
+	c.update(func(entries map[string]fileCacheEntry) {
+		delete(entries, key)
+	})
+}
+
+// parseFileCache returns the entries stored in b, or nil if it cannot
+// be parsed
+func parseFileCache(b []byte) map[string]fileCacheEntry {
+	var entries map[string]fileCacheEntry
+	if json.Unmarshal(b, &entries) != nil {
+		return nil
+	}
+	return entries
+}
+
+// update applies f to the entries stored in the file, or to the ones
+// in memory if it cannot be read, dropping the expired ones, and
+// writes them back. Write failures are ignored, as the cache is just
+// an optimization.
+func (c *FileCache) update(f func(map[string]fileCacheEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, err := os.ReadFile(c.path); err == nil {
+		if entries := parseFileCache(b); entries != nil {
+			c.entries = entries
+		}
+	}
+	f(c.entries)
+	now := c.clock.Now()
+	for key, e := range c.entries {
+		if now.After(e.Expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+"-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
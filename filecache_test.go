@@ -0,0 +1,93 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "srv.json")
+	r := &ttlResponder{ttl: time.Hour}
+
+	// successive runs of a command
+	for run := 0; run < 2; run++ {
+		c, err := NewFileCache(path)
+		if err != nil {
+			t.Fatalf("NewFileCache: unexpected error %v", err)
+		}
+		avt := New()
+		avt.SetTTLLookuper(r)
+		avt.SetCache(c)
+		if _, err := avt.FromEmail("user@example.org"); err != nil {
+			t.Fatalf("FromEmail: unexpected error %v", err)
+		}
+	}
+	if r.lookups != 1 {
+		t.Errorf("%d lookups, expected the second run to use the file", r.lookups)
+	}
+
+	// changes by other processes are kept
+	a, _ := NewFileCache(path)
+	b, _ := NewFileCache(path)
+	a.Set("a", []byte("1"), time.Hour)
+	b.Set("b", []byte("2"), time.Hour)
+	b.Set("expired", []byte("3"), -time.Second)
+	c, _ := NewFileCache(path)
+	for _, key := range []string{"a", "b"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s not found in the file", key)
+		}
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Errorf("expired entry found in the file")
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("deleted entry found in the cache")
+	}
+
+	// entries expire by the clock set
+	clock := newFakeClock()
+	c.SetClock(clock)
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("c"); !ok {
+		t.Errorf("entry not found before expiry")
+	}
+	clock.Advance(2 * time.Minute)
+	if _, ok := c.Get("c"); ok {
+		t.Errorf("entry found after expiry by the clock set")
+	}
+
+	// unparsable files are replaced
+	if err := os.WriteFile(path, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewFileCache(path)
+	if err != nil {
+		t.Fatalf("NewFileCache with a garbage file: unexpected error %v", err)
+	}
+	c.Set("a", []byte("1"), time.Hour)
+	if v, ok := parseFileCache(readFile(t, path))["a"]; !ok || string(v.Value) != "1" {
+		t.Errorf("garbage file not replaced")
+	}
+
+	if _, err := NewFileCache(t.TempDir()); err == nil {
+		t.Errorf("NewFileCache with a directory: expected an error")
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
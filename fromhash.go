@@ -0,0 +1,90 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// FromHash returns the url of the avatar with the given hash, the hex
+// MD5 or SHA-256 digest of a normalized email or OpenID, as computed
+// by HashEmail and HashOpenID. Without the domain of the identity,
+// there is no federation: the URL points to the fallback host (or to
+// Gravatar in Gravatar mode).
+func (v *Libravatar) FromHash(hash string) (string, error) {
+	return v.hashURL(context.Background(), hash, "")
+}
+
+// FromHashForDomain is like FromHash, for an identity of domain,
+// whose avatar server is looked up like FromEmail does
+func (v *Libravatar) FromHashForDomain(hash, domain string) (string, error) {
+	domain, err := canonicalDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	return v.hashURL(context.Background(), hash, domain)
+}
+
+// hashURL returns the url of the avatar with the given hash, for an
+// identity of domain, if not empty
+func (v *Libravatar) hashURL(ctx context.Context, hash, domain string) (string, error) {
+	if !isHash(hash) {
+		return "", fmt.Errorf("%w %q: %w", ErrInvalidHash, hash, ErrInvalidInput)
+	}
+	if v.strict {
+		if err := v.validate(v.params()); err != nil {
+			return "", err
+		}
+	}
+	var base string
+	switch {
+	case domain != "":
+		var err error
+		if base, err = v.hostBaseURL(ctx, domain, v.useHTTPS); err != nil {
+			return "", err
+		}
+	case v.relativeURLs:
+	case v.gravatarMode:
+		base = "http://" + gravatarHost
+		if v.useHTTPS {
+			base = "https://" + gravatarSecureHost
+		}
+	default:
+		base = v.fallbackBaseURL(v.useHTTPS)
+	}
+	return buildURL(base, strings.ToLower(hash), v.params()), nil
+}
+
+// HashEmail returns the hash of the given email, as used in avatar
+// URLs, according to SetEmailHash and SetHashFunc
+func (v *Libravatar) HashEmail(email string) (string, error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return "", err
+	}
+	return v.hash(addr, nil)
+}
+
+// HashOpenID returns the hash of the given OpenID URL, as used in
+// avatar URLs, according to SetHashFunc
+func (v *Libravatar) HashOpenID(openid string) (string, error) {
+	ourl, err := parseOpenID(openid)
+	if err != nil {
+		return "", err
+	}
+	return v.hash(nil, ourl)
+}
+
+// HashEmail is the object-less call to DefaultLibravatar for an email
+func HashEmail(email string) (string, error) {
+	return DefaultLibravatar.HashEmail(email)
+}
+
+// HashOpenID is the object-less call to DefaultLibravatar for a URL
+func HashOpenID(openid string) (string, error) {
+	return DefaultLibravatar.HashOpenID(openid)
+}
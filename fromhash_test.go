@@ -0,0 +1,97 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFromHash(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	md5Hash := hashOf("user@example.org")
+	sha256Hash := "7b6f1a2ff4b2a9b3b6a49c3a3b7b06d4a7c2bbf2b5ec2b2b2e0e4a0d5e3c3f2a"
+
+	for _, h := range []string{md5Hash, sha256Hash, strings.ToUpper(md5Hash)} {
+		want := "http://cdn.libravatar.org/avatar/" + strings.ToLower(h)
+		if got, err := avt.FromHash(h); err != nil || got != want {
+			t.Errorf("FromHash(%s) == %s, %v, expected %s", h, got, err, want)
+		}
+	}
+
+	// with the domain, the avatar server is looked up
+	want, err := avt.FromEmail("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := avt.FromHashForDomain(md5Hash, "Example.ORG."); err != nil || got != want {
+		t.Errorf("FromHashForDomain == %s, %v, expected %s", got, err, want)
+	}
+
+	avt.SetAvatarSize(64)
+	avt.SetDefaultImage(IdentIcon)
+	if got, _ := avt.FromHash(md5Hash); got != "http://cdn.libravatar.org/avatar/"+md5Hash+"?d=identicon&s=64" {
+		t.Errorf("FromHash with parameters == %s", got)
+	}
+	avt.SetGravatarMode(true)
+	avt.SetUseHTTPS(true)
+	if got, _ := avt.FromHash(md5Hash); got != "https://secure.gravatar.com/avatar/"+md5Hash+"?d=identicon&s=64" {
+		t.Errorf("FromHash in Gravatar mode == %s", got)
+	}
+
+	for _, h := range []string{"", "abc", md5Hash + "0", strings.Repeat("g", 32), "../" + md5Hash[3:]} {
+		if _, err := avt.FromHash(h); !errors.Is(err, ErrInvalidHash) || !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("FromHash(%q): error %v, expected ErrInvalidHash", h, err)
+		}
+	}
+	if _, err := avt.FromHashForDomain(md5Hash, " "); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("FromHashForDomain with a blank domain: error %v, expected ErrInvalidInput", err)
+	}
+}
+
+func TestHashEmail(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	check := func(what, hash string, err error, link string) {
+		t.Helper()
+		if err != nil || !strings.HasSuffix(link, "/avatar/"+hash) {
+			t.Errorf("%s == %s, %v, expected the hash in %s", what, hash, err, link)
+		}
+	}
+	for _, email := range []string{"user@example.org", " User@Example.ORG ", "Joe <joe@example.org>"} {
+		hash, err := HashEmail(email)
+		link, _ := avt.FromEmail(email)
+		check("HashEmail("+email+")", hash, err, link)
+	}
+	if hash, _ := HashEmail("User@Example.ORG"); hash != hashOf("user@example.org") {
+		t.Errorf("HashEmail == %s, expected the MD5 of the lowercased email", hash)
+	}
+	for _, openid := range []string{"https://example.org/id/user", "HTTPS://Example.ORG/id/user"} {
+		hash, err := HashOpenID(openid)
+		link, _ := avt.FromURL(openid)
+		check("HashOpenID("+openid+")", hash, err, link)
+	}
+
+	// hashes follow the configuration
+	avt.SetEmailHash(HashSHA256)
+	hash, err := avt.HashEmail("user@example.org")
+	link, _ := avt.FromEmail("user@example.org")
+	check("HashEmail with SHA-256", hash, err, link)
+	if link, _ := avt.FromHash(hash); !strings.HasSuffix(link, "/avatar/"+hash) {
+		t.Errorf("FromHash of a SHA-256 email hash == %s", link)
+	}
+
+	if _, err := HashEmail("not an email"); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("HashEmail of an invalid email: %v, expected ErrInvalidEmail", err)
+	}
+	if _, err := HashOpenID("example.org/id"); !errors.Is(err, ErrInvalidOpenID) {
+		t.Errorf("HashOpenID of an invalid OpenID: %v, expected ErrInvalidOpenID", err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"html/template"
+)
+
+// FuncMap returns template functions using v:
+//
+//	avatarURL email              the avatar URL for email
+//	avatarURLSize email size     the same, at the given size
+//	avatarImg email size alt     an img element showing the avatar
+//
+// Rather than failing template execution, on errors the functions
+// return the URL of the default image on the fallback host.
+func (v *Libravatar) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"avatarURL": func(email string) string {
+			return v.templateURL(email, v.params())
+		},
+		"avatarURLSize": func(email string, size int) string {
+			return v.templateURL(email, v.templateParams(size))
+		},
+		"avatarImg": func(email string, size int, alt string) template.HTML {
+			p := v.templateParams(size)
+			t := &imgTag{size: p.size, alt: alt}
+			if t.size == 0 {
+				t.size = defaultAvatarSize
+			}
+			p.size = t.size
+			return t.render(v.templateURL(email, p), "")
+		},
+	}
+}
+
+// templateParams returns the URL parameters for templates requesting
+// the given size (0 or less for the default one)
+func (v *Libravatar) templateParams(size int) params {
+	p := v.params()
+	if size > 0 {
+		p.size = v.clampSize(uint(size))
+	}
+	return p
+}
+
+// templateURL returns the avatar URL for email, or the default image
+// on the fallback host if that fails
+func (v *Libravatar) templateURL(email string, p params) string {
+	link, err := v.emailURL(context.Background(), email, p)
+	if err != nil {
+		return buildURL(v.fallbackBaseURL(p.secure), probeHash, p)
+	}
+	return link
+}
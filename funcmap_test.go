@@ -0,0 +1,47 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net"
+	"os"
+	"testing"
+)
+
+func ExampleLibravatar_FuncMap() {
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+
+	tmpl := template.Must(template.New("").Funcs(avt.FuncMap()).Parse(
+		`<a href="{{avatarURL .}}">{{avatarImg . 48 "Avatar of <user>"}}</a>`))
+	tmpl.Execute(os.Stdout, "user@example.org")
+	// Output: <a href="http://avatars.example.org/avatar/572c3489ea700045927076136a969e27"><img src="http://avatars.example.org/avatar/572c3489ea700045927076136a969e27?s=48" width="48" height="48" alt="Avatar of &lt;user&gt;" loading="lazy"></a>
+}
+
+func TestFuncMap(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	avt.SetDefaultImage(IdentIcon)
+
+	tmpl := template.Must(template.New("").Funcs(avt.FuncMap()).Parse(
+		`{{avatarURL .}} {{avatarURLSize . 1000}} {{avatarImg . 0 ""}}`))
+	for _, email := range []string{"user@example.org", "not an email"} {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, email); err != nil {
+			t.Fatalf("template execution for %q: unexpected error %v", email, err)
+		}
+		const link = "http://cdn.libravatar.org/avatar/00000000000000000000000000000000?d=identicon"
+		want := link + " " + link + "&amp;s=512 " + `<img src="` + link + `&amp;s=80" width="80" height="80" alt="" loading="lazy">`
+		if b.String() != want {
+			t.Errorf("template output for %q ==\n%s\nexpected\n%s", email, b.String(), want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Gravatar hosts, used in Gravatar mode
+const (
+	gravatarHost       = "www.gravatar.com"
+	gravatarSecureHost = "secure.gravatar.com"
+)
+
+// Gravatar ratings, see SetRating
+const (
+	// suitable for display on all websites with any audience type
+	RatingG = "g"
+	// may contain rude gestures, provocatively dressed individuals,
+	// the lesser swear words, or mild violence
+	RatingPG = "pg"
+	// may contain such things as harsh profanity, intense violence,
+	// nudity, or hard drug use
+	RatingR = "r"
+	// may contain hardcore sexual imagery or extremely disturbing violence
+	RatingX = "x"
+)
+
+// ErrGravatarOpenID is returned for OpenID avatars in Gravatar mode,
+// as Gravatar only supports emails
+var ErrGravatarOpenID = errors.New("libravatar: OpenID not supported by Gravatar")
+
+// SetGravatarMode makes v produce Gravatar URLs: no SRV lookup is
+// performed and avatars are always served by the Gravatar hosts,
+// regardless of the fallback hosts and domain overrides
+func (v *Libravatar) SetGravatarMode(enable bool) {
+	v.gravatarMode = enable
+	v.urlCache.purge()
+}
+
+// SetRating sets the maximum rating of the avatars returned: one of
+// RatingG, RatingPG, RatingR, RatingX, or "" for the server default.
+// It is passed as the r parameter, which Gravatar and Gravatar
+// compatible servers honor, and libravatar servers ignore.
+func (v *Libravatar) SetRating(rating string) error {
+	switch rating {
+	case "", RatingG, RatingPG, RatingR, RatingX:
+		v.rating = rating
+		return nil
+	}
+	return fmt.Errorf("libravatar: invalid rating %q, expected one of %q, %q, %q, %q",
+		rating, RatingG, RatingPG, RatingR, RatingX)
+}
+
+// SetGravatarDefault makes avatar URLs for emails use, as default
+// image, the Gravatar avatar for the same email, at the same size,
+// so that libravatar servers redirect to Gravatar for identities
+// they do not know. It replaces the image set by SetDefaultImage
+// for emails, and is ignored in Gravatar mode.
+func (v *Libravatar) SetGravatarDefault(enable bool) {
+	v.gravatarDefault = enable
+}
+
+// ParamGravatarDefault overrides SetGravatarDefault for a single call
+func ParamGravatarDefault(enable bool) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		p.gravatarDefault = ""
+		if enable && !v.gravatarMode {
+			p.gravatarDefault = gravatarDefaultScheme(p.secure)
+		}
+		return nil
+	}
+}
+
+// gravatarDefaultScheme returns the scheme of Gravatar default images,
+// https if secure is set
+func gravatarDefaultScheme(secure bool) string {
+	if secure {
+		return "https"
+	}
+	return "http"
+}
+
+// gravatarDefaultURL returns the URL of the Gravatar avatar with the
+// given MD5 hash, used as default image with the parameters in p
+func gravatarDefaultURL(hash string, p params) string {
+	host := gravatarHost
+	if p.gravatarDefault == "https" {
+		host = gravatarSecureHost
+	}
+	return buildURL(p.gravatarDefault+"://"+host, hash, params{size: p.size})
+}
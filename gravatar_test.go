@@ -0,0 +1,141 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGravatarMode(t *testing.T) {
+
+	lookups := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return "", []*net.SRV{{Target: "avatars.example.com.", Port: 80}}, nil
+	}
+	avt.SetDomainOverride("example.org", "avatars.example.org")
+
+	if err := avt.SetRating(RatingPG); err != nil {
+		t.Fatalf("SetRating: unexpected error %v", err)
+	}
+	if err := avt.SetRating("nc-17"); err == nil {
+		t.Errorf("SetRating with invalid rating: expected an error")
+	}
+
+	// ratings are also passed to federated servers
+	const email = " MyEmailAddress@example.com "
+	link, err := avt.FromEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://avatars.example.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346?r=pg"; link != want {
+		t.Errorf("FromEmail == %s, expected %s", link, want)
+	}
+
+	avt.SetGravatarMode(true)
+	lookups = 0
+	cases := []struct {
+		https       bool
+		defURL      string
+		size        uint
+		email, want string
+	}{
+		{false, "", 0, email, "http://www.gravatar.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346?r=pg"},
+		{true, IdentIcon, 64, email, "https://secure.gravatar.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346?d=identicon&r=pg&s=64"},
+		{true, "", 0, "user@example.org", "https://secure.gravatar.com/avatar/572c3489ea700045927076136a969e27?r=pg"},
+	}
+	for _, c := range cases {
+		avt.SetUseHTTPS(c.https)
+		avt.SetDefaultImage(c.defURL)
+		avt.SetAvatarSize(c.size)
+		link, err := avt.FromEmail(c.email)
+		if err != nil {
+			t.Errorf("FromEmail(%q): unexpected error %v", c.email, err)
+			continue
+		}
+		if link != c.want {
+			t.Errorf("FromEmail(%q) == %s, expected %s", c.email, link, c.want)
+		}
+	}
+	if lookups != 0 {
+		t.Errorf("%d lookups in Gravatar mode, expected none", lookups)
+	}
+
+	if _, err := avt.FromURL("https://openid.example.org/user"); !errors.Is(err, ErrGravatarOpenID) {
+		t.Errorf("FromURL in Gravatar mode: unexpected error %v", err)
+	}
+}
+
+func TestGravatarDefault(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetDefaultImage(IdentIcon)
+	avt.SetGravatarDefault(true)
+	avt.SetAvatarSize(64)
+	avt.SetForceDefault(true)
+
+	check := func(name, link, scheme, size string) {
+		t.Helper()
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		q := u.Query()
+		if q.Get("s") != size || q.Get("f") != "y" {
+			t.Errorf("%s: %s lost size or force parameters", name, link)
+		}
+		if strings.Contains(u.RawQuery, "d=https://") || strings.Contains(u.RawQuery, "d=http://") {
+			t.Errorf("%s: %s has an unescaped default", name, link)
+		}
+		d, err := url.Parse(q.Get("d"))
+		if err != nil {
+			t.Fatalf("%s: default %q: %v", name, q.Get("d"), err)
+		}
+		host := map[string]string{"https": "secure.gravatar.com", "http": "www.gravatar.com"}[scheme]
+		if d.Scheme != scheme || d.Host != host || d.Path != "/avatar/572c3489ea700045927076136a969e27" || d.Query().Get("s") != size || len(d.Query()) != 1 {
+			t.Errorf("%s: unexpected default %s", name, d)
+		}
+	}
+
+	link, err := avt.FromEmail("User@Example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("FromEmail", link, "http", "64")
+
+	avt.SetUseHTTPS(true)
+	link, _ = avt.FromEmail("user@example.org")
+	check("FromEmail over https", link, "https", "64")
+
+	// per call options
+	w := httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamSize(32))
+	check("Redirect with size", w.Header().Get("Location"), "https", "32")
+
+	w = httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamGravatarDefault(false))
+	if u, _ := url.Parse(w.Header().Get("Location")); u.Query().Get("d") != IdentIcon {
+		t.Errorf("Redirect without Gravatar default to %s, expected the configured default", u)
+	}
+	w = httptest.NewRecorder()
+	avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", ParamDefault(Retro))
+	if u, _ := url.Parse(w.Header().Get("Location")); u.Query().Get("d") != Retro {
+		t.Errorf("Redirect with default to %s, expected %s", u, Retro)
+	}
+
+	// OpenIDs have no Gravatar
+	link, _ = avt.FromURL("https://example.org/user")
+	if u, _ := url.Parse(link); u.Query().Get("d") != IdentIcon {
+		t.Errorf("FromURL == %s, expected the configured default", link)
+	}
+}
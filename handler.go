@@ -0,0 +1,374 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultCacheControl is the Cache-Control header set by default on
+// avatars served by Handler, whose URLs are keyed on the hash
+const defaultCacheControl = "public, max-age=86400, immutable"
+
+// userCacheControl is the Cache-Control header set by default on
+// avatars served by UserHandler, whose keys may map to other emails
+const userCacheControl = "public, max-age=86400"
+
+// DegradedHeader is the header set on responses of the handler serving
+// the local fallback image, because avatar servers could not be reached
+const DegradedHeader = "X-Avatar-Degraded"
+
+// HandlerOption configures the handler returned by Handler
+type HandlerOption func(*handler)
+
+// HandlerCacheControl sets the Cache-Control header of the responses
+// ("" for none)
+func HandlerCacheControl(value string) HandlerOption {
+	return func(h *handler) {
+		h.cacheControl = value
+	}
+}
+
+// HandlerAllowEmail makes the handler accept email addresses, not just
+// hashes, as the last path segment
+func HandlerAllowEmail() HandlerOption {
+	return func(h *handler) {
+		h.allowEmail = true
+	}
+}
+
+// HandlerBlockPrivateTargets sets whether the handler refuses to
+// fetch avatars from private addresses (the default), regardless of
+// SetBlockPrivateTargets
+func HandlerBlockPrivateTargets(block bool) HandlerOption {
+	return func(h *handler) {
+		h.blockPrivate = block
+	}
+}
+
+// ErrUnknownUser is to be returned, possibly wrapped, by the
+// functions passed to UserHandler for keys matching no user
+var ErrUnknownUser = errors.New("libravatar: unknown user")
+
+// HandlerAllowOrigins makes the handler answer cross-origin requests
+// from the given origins, like "https://app.example.org", setting the
+// CORS headers. The origin "*" allows any origin.
+func HandlerAllowOrigins(origins ...string) HandlerOption {
+	return func(h *handler) {
+		h.origins = make(map[string]bool, len(origins))
+		for _, o := range origins {
+			h.origins[o] = true
+		}
+	}
+}
+
+// handler serves avatars fetched from their servers
+type handler struct {
+	v            *Libravatar
+	cacheControl string
+	allowEmail   bool
+	blockPrivate bool
+	origins      map[string]bool // origins allowed by CORS
+	// maps the last path segment to an email, if set
+	resolve func(ctx context.Context, key string) (email string, err error)
+}
+
+// Handler returns an http.Handler serving avatars by proxying requests
+// to avatar servers, so that hashes and client addresses are not
+// disclosed to them.
+// The last segment of the request path is the avatar hash (or, if
+// allowed, the email address) and the "s" query parameter, if any,
+// is the requested size.
+// Hashes are served from the fallback host, as they carry no domain.
+// Malformed identifiers are answered with 400 Bad Request, emails
+// whose domain cannot be resolved with 502 Bad Gateway.
+// Responses are marked nosniff and inline, named after the avatar
+// hash; OPTIONS requests are answered without contacting servers.
+func (v *Libravatar) Handler(opts ...HandlerOption) http.Handler {
+	h := &handler{v: v, cacheControl: defaultCacheControl, blockPrivate: true}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// UserHandler is like Handler, for requests whose last path segment
+// is an application specific key, like a user name, mapped to an
+// email by resolve, so that neither hashes nor emails appear in URLs.
+// Keys for which resolve returns ErrUnknownUser are answered with 404
+// Not Found, other errors with 502 Bad Gateway.
+func (v *Libravatar) UserHandler(resolve func(ctx context.Context, key string) (email string, err error), opts ...HandlerOption) http.Handler {
+	h := v.Handler(append([]HandlerOption{HandlerCacheControl(userCacheControl)}, opts...)...).(*handler)
+	h.resolve = resolve
+	return h
+}
+
+// NewUserHandler is the object-less call to DefaultLibravatar for
+// UserHandler
+func NewUserHandler(resolve func(ctx context.Context, key string) (email string, err error), opts ...HandlerOption) http.Handler {
+	return DefaultLibravatar.UserHandler(resolve, opts...)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", `inline; filename="avatar"`)
+	cors := h.setCORS(w, r)
+
+	if r.Method == http.MethodOptions {
+		// preflight requests are answered here, without upstream
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		if cors && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			w.Header().Set("Access-Control-Allow-Headers", "If-None-Match, If-Modified-Since")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	r = r.WithContext(withBlockPrivate(r.Context(), h.blockPrivate))
+
+	p := h.v.params()
+	if s := r.URL.Query().Get("s"); s != "" {
+		size, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		p.size = h.v.clampSize(uint(size))
+	}
+
+	id := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+	var link string
+	var err error
+	if h.resolve == nil {
+		if link, err = h.link(r.Context(), id, p); invalidIdentifier(err) {
+			http.Error(w, "invalid avatar identifier", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			h.v.metrics.IncError(ErrorKindHandler)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if name := linkHash(link); name != "" {
+			w.Header().Set("Content-Disposition", `inline; filename="`+name+`"`)
+		}
+	} else if link, err = h.userLink(r.Context(), id, p); errors.Is(err, ErrUnknownUser) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.v.metrics.IncError(ErrorKindHandler)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if h.v.buffered() {
+		h.serveCached(w, r, link)
+		return
+	}
+
+	hdr := make(http.Header)
+	for _, k := range []string{"If-None-Match", "If-Modified-Since"} {
+		if val := r.Header.Get(k); val != "" {
+			hdr.Set(k, val)
+		}
+	}
+
+	resp, err := h.v.fetch(r.Context(), r.Method, link, hdr)
+	if errors.Is(err, ErrNoAvatar) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		if a := h.v.localFallback(r.Context(), link, err); a != nil {
+			h.serveAvatar(w, r, a)
+			return
+		}
+		h.v.metrics.IncError(ErrorKindHandler)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	if r.Method == http.MethodHead {
+		err = h.v.checkContentType(resp.Header.Get("Content-Type"), nil)
+	} else if resp.StatusCode == http.StatusOK {
+		body, err = h.v.checkedBody(resp)
+	}
+	if err != nil {
+		h.v.metrics.IncError(ErrorKindHandler)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	for _, k := range []string{"ETag", "Last-Modified"} {
+		if val := resp.Header.Get(k); val != "" {
+			w.Header().Set(k, val)
+		}
+	}
+	if h.cacheControl != "" {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+}
+
+// setCORS sets the CORS headers of the response to r, telling whether
+// its origin is allowed
+func (h *handler) setCORS(w http.ResponseWriter, r *http.Request) bool {
+	if len(h.origins) == 0 {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if h.origins["*"] {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// the response depends on the origin, even when not allowed
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !h.origins[origin] {
+			return false
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, "+DegradedHeader)
+	return origin != ""
+}
+
+// serveCached serves the avatar at link through the image cache and
+// image validation, if enabled
+func (h *handler) serveCached(w http.ResponseWriter, r *http.Request, link string) {
+	a, err := h.v.getAvatar(r.Context(), link, h.v.maxBodySize, nil)
+	if errors.Is(err, ErrNoAvatar) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.v.metrics.IncError(ErrorKindHandler)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	h.serveAvatar(w, r, a)
+}
+
+// serveAvatar serves a fetched avatar
+func (h *handler) serveAvatar(w http.ResponseWriter, r *http.Request, a *Avatar) {
+	if a.Degraded {
+		w.Header().Set(DegradedHeader, "1")
+		w.Header().Set("Cache-Control", "no-store")
+	} else if h.cacheControl != "" {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if a.ETag != "" {
+		w.Header().Set("ETag", a.ETag)
+	}
+	if a.LastModified != "" {
+		w.Header().Set("Last-Modified", a.LastModified)
+	}
+	if a.ETag != "" && r.Header.Get("If-None-Match") == a.ETag ||
+		a.LastModified != "" && r.Header.Get("If-Modified-Since") == a.LastModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if a.ContentType != "" {
+		w.Header().Set("Content-Type", a.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(a.Data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(a.Data)
+	}
+}
+
+// link returns the upstream URL for the avatar identified by id
+func (h *handler) link(ctx context.Context, id string, p params) (string, error) {
+	if isHash(id) {
+		return buildURL(h.v.fallbackBaseURL(p.secure), strings.ToLower(id), p), nil
+	}
+	if h.allowEmail && strings.Contains(id, "@") {
+		return h.v.emailURL(ctx, id, p)
+	}
+	return "", fmt.Errorf("%w: invalid avatar identifier %q", ErrInvalidInput, id)
+}
+
+// invalidIdentifier tells whether err is due to the avatar identifier
+// requested, rather than to resolving it
+func invalidIdentifier(err error) bool {
+	return errors.Is(err, ErrInvalidInput) || errors.Is(err, ErrInvalidEmail)
+}
+
+// userLink returns the upstream URL for the avatar of the user
+// identified by key
+func (h *handler) userLink(ctx context.Context, key string, p params) (string, error) {
+	if key == "" {
+		return "", ErrUnknownUser
+	}
+	email, err := h.resolve(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return h.v.emailURL(ctx, email, p)
+}
+
+// linkHash returns the hash in the avatar URL link, if it is made only
+// of letters and digits, so that it can be used as a file name
+func linkHash(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	hash := path.Base(u.Path)
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return ""
+		}
+	}
+	return hash
+}
+
+// isHash tells whether s looks like an MD5 or SHA-256 hex digest
+func isHash(s string) bool {
+	if len(s) != 32 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// clampSize returns size bounded by the allowed image dimensions
+func (v *Libravatar) clampSize(size uint) uint {
+	if size < v.minSize {
+		return v.minSize
+	}
+	if size > v.maxSize {
+		return v.maxSize
+	}
+	return size
+}
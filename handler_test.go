@@ -0,0 +1,267 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		if strings.HasPrefix(r.URL.Path, "/avatar/00000000") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer upstream.Close()
+
+	avt := New()
+	responder := serverResponder(t, upstream)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "broken.example.org" {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return responder(ctx, service, proto, name)
+	}
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+
+	mux := http.NewServeMux()
+	mux.Handle("/avatars/", avt.Handler())
+	mux.Handle("/private/", avt.Handler(HandlerAllowEmail(), HandlerCacheControl("private, max-age=60")))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cases := []struct {
+		path         string
+		status       int
+		upstream     string
+		cacheControl string
+	}{
+		{"/avatars/572c3489ea700045927076136a969e27", 200, "/avatar/572c3489ea700045927076136a969e27", defaultCacheControl},
+		{"/avatars/572C3489EA700045927076136A969E27?s=64", 200, "/avatar/572c3489ea700045927076136a969e27?s=64", defaultCacheControl},
+		{"/avatars/572c3489ea700045927076136a969e27?s=100000", 200, "/avatar/572c3489ea700045927076136a969e27?s=512", defaultCacheControl},
+		{"/avatars/572c3489ea700045927076136a969e27?s=big", 400, "", ""},
+		{"/avatars/00000000000000000000000000000000", 404, "/avatar/00000000000000000000000000000000", ""},
+		{"/avatars/572c3489ea700045927076136a969zzz", 400, "", ""},
+		{"/avatars/user@example.org", 400, "", ""},
+		{"/private/user@example.org", 200, "/avatar/572c3489ea700045927076136a969e27", "private, max-age=60"},
+		{"/private/user@@example.org", 400, "", ""},
+		{"/private/user@broken.example.org", 502, "", ""},
+	}
+
+	for _, c := range cases {
+		requests = nil
+		resp, err := http.Get(srv.URL + c.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", c.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("GET %s: status %d, expected %d", c.path, resp.StatusCode, c.status)
+			continue
+		}
+		if c.upstream == "" && len(requests) != 0 || c.upstream != "" && (len(requests) != 1 || requests[0] != c.upstream) {
+			t.Errorf("GET %s: upstream requests %v, expected %q", c.path, requests, c.upstream)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != c.cacheControl {
+			t.Errorf("GET %s: Cache-Control %q, expected %q", c.path, cc, c.cacheControl)
+		}
+		if c.status == 200 && (string(body) != string(testPNG) || resp.Header.Get("Content-Type") != "image/png") {
+			t.Errorf("GET %s: got %q (%s)", c.path, body, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestUserHandler(t *testing.T) {
+
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.String())
+		if r.URL.Path == "/avatar/"+hashOf("gone@example.org") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer upstream.Close()
+
+	users := map[string]string{
+		"alice": "user@example.org",
+		"bob":   "gone@example.org",
+	}
+	resolve := func(ctx context.Context, key string) (string, error) {
+		if key == "broken" {
+			return "", errors.New("connecting to db with password hunter2: refused")
+		}
+		email, ok := users[key]
+		if !ok {
+			return "", fmt.Errorf("user %s: %w", key, ErrUnknownUser)
+		}
+		return email, nil
+	}
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, upstream)
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+	srv := httptest.NewServer(avt.UserHandler(resolve))
+	defer srv.Close()
+
+	cases := []struct {
+		path     string
+		status   int
+		upstream string
+	}{
+		{"/avatars/alice", 200, "/avatar/572c3489ea700045927076136a969e27"},
+		{"/avatars/alice?s=64", 200, "/avatar/572c3489ea700045927076136a969e27?s=64"},
+		{"/avatars/alice?s=100000", 200, "/avatar/572c3489ea700045927076136a969e27?s=512"},
+		{"/avatars/alice?s=big", 400, ""},
+		{"/avatars/bob", 404, "/avatar/" + hashOf("gone@example.org")},
+		{"/avatars/carol", 404, ""},
+		{"/avatars/", 404, ""},
+		{"/avatars/broken", 502, ""},
+		{"/avatars/572c3489ea700045927076136a969e27", 404, ""},
+	}
+	for _, c := range cases {
+		requests = nil
+		resp, err := http.Get(srv.URL + c.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", c.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("GET %s: status %d, expected %d", c.path, resp.StatusCode, c.status)
+		}
+		if c.upstream == "" && len(requests) != 0 || c.upstream != "" && (len(requests) != 1 || requests[0] != c.upstream) {
+			t.Errorf("GET %s: upstream requests %v, expected %q", c.path, requests, c.upstream)
+		}
+		if c.status == 200 && string(body) != string(testPNG) {
+			t.Errorf("GET %s: got %q", c.path, body)
+		}
+		if cc := resp.Header.Get("Cache-Control"); c.status == 200 && cc != userCacheControl {
+			t.Errorf("GET %s: Cache-Control %q, expected %q", c.path, cc, userCacheControl)
+		}
+		if strings.Contains(string(body), "hunter2") || strings.Contains(string(body), "user@example.org") {
+			t.Errorf("GET %s: response leaks details: %q", c.path, body)
+		}
+	}
+}
+
+func TestHandlerCORS(t *testing.T) {
+
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer upstream.Close()
+
+	avt := New()
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+	mux := http.NewServeMux()
+	mux.Handle("/avatars/", avt.Handler(HandlerAllowOrigins("https://app.example.org", "https://crop.example.org")))
+	mux.Handle("/public/", avt.Handler(HandlerAllowOrigins("*"), HandlerCacheControl("public, max-age=60")))
+	mux.Handle("/plain/", avt.Handler())
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	const hash = "572c3489ea700045927076136a969e27"
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		origin   string
+		status   int
+		upstream bool
+		headers  map[string]string // "" for absent
+	}{
+		{"allowed origin", http.MethodGet, "/avatars/" + hash, "https://crop.example.org", 200, true, map[string]string{
+			"Access-Control-Allow-Origin":   "https://crop.example.org",
+			"Access-Control-Expose-Headers": "ETag, " + DegradedHeader,
+			"Vary":                          "Origin",
+			"Cache-Control":                 defaultCacheControl,
+			"Content-Disposition":           `inline; filename="` + hash + `"`,
+			"X-Content-Type-Options":        "nosniff",
+		}},
+		{"disallowed origin", http.MethodGet, "/avatars/" + hash, "https://evil.example.org", 200, true, map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Vary":                        "Origin",
+			"X-Content-Type-Options":      "nosniff",
+		}},
+		{"no origin", http.MethodGet, "/avatars/" + hash, "", 200, true, map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Vary":                        "Origin",
+		}},
+		{"any origin", http.MethodGet, "/public/" + hash, "https://evil.example.org", 200, true, map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Vary":                        "",
+			"Cache-Control":               "public, max-age=60",
+		}},
+		{"CORS not enabled", http.MethodGet, "/plain/" + hash, "https://app.example.org", 200, true, map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Vary":                        "",
+		}},
+		{"preflight", http.MethodOptions, "/avatars/" + hash, "https://app.example.org", 204, false, map[string]string{
+			"Access-Control-Allow-Origin":  "https://app.example.org",
+			"Access-Control-Allow-Methods": "GET, HEAD",
+			"Access-Control-Allow-Headers": "If-None-Match, If-Modified-Since",
+			"Access-Control-Max-Age":       "86400",
+			"Allow":                        "GET, HEAD, OPTIONS",
+		}},
+		{"disallowed preflight", http.MethodOptions, "/avatars/" + hash, "https://evil.example.org", 204, false, map[string]string{
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+			"Vary":                         "Origin",
+		}},
+		{"POST", http.MethodPost, "/avatars/" + hash, "https://app.example.org", 405, false, map[string]string{
+			"Allow": "GET, HEAD, OPTIONS",
+		}},
+	}
+	for _, c := range cases {
+		requests = nil
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, nil)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if c.method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, expected %d", c.name, resp.StatusCode, c.status)
+		}
+		if c.upstream != (len(requests) != 0) {
+			t.Errorf("%s: upstream requests %v", c.name, requests)
+		}
+		for k, want := range c.headers {
+			if got := resp.Header.Get(k); got != want {
+				t.Errorf("%s: %s %q, expected %q", c.name, k, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"net"
+	"time"
+)
+
+// LookupOutcome tells how a lookup ended
+type LookupOutcome int
+
+const (
+	// OutcomeFederated means an SRV target was found
+	OutcomeFederated LookupOutcome = iota
+	// OutcomeFallback means the fallback host is to be used
+	OutcomeFallback
+	// OutcomeError means the lookup failed
+	OutcomeError
+)
+
+func (o LookupOutcome) String() string {
+	switch o {
+	case OutcomeFederated:
+		return "federated"
+	case OutcomeFallback:
+		return "fallback"
+	case OutcomeError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// LookupEvent describes a single SRV lookup, see SetLookupHook
+type LookupEvent struct {
+	Domain   string        // the domain looked up
+	Service  string        // the SRV service queried
+	CacheHit bool          // whether the result came from the cache
+	Outcome  LookupOutcome // how the lookup ended
+	Target   *net.SRV      // the selected record, nil if none
+	Err      error         // the DNS error met, even if it was recovered from by falling back
+	ProbeErr error         // the error met verifying the target, see SetVerifyTarget and SetVerifyTargetResolves
+	Duration time.Duration // time spent in the lookup
+}
+
+// SetLookupHook sets a function to be called after every SRV lookup,
+// including the ones answered by the cache. Panics in the hook are
+// recovered from and ignored.
+func (v *Libravatar) SetLookupHook(hook func(LookupEvent)) {
+	v.lookupHook = hook
+}
+
+// emitLookup calls the lookup hook with ev
+func (v *Libravatar) emitLookup(ev LookupEvent) {
+	defer func() { recover() }()
+	v.lookupHook(ev)
+}
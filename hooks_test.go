@@ -0,0 +1,77 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestLookupHook(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "slow.example.org" {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+
+	// a nil hook is fine
+	avt.FromEmail("user@example.org")
+
+	var events []LookupEvent
+	avt.SetLookupHook(func(ev LookupEvent) {
+		events = append(events, ev)
+	})
+	avt.nameCache.purge()
+
+	avt.FromEmail("user@example.org")
+	avt.FromEmail("user@example.org")
+	avt.FromEmail("user@slow.example.org")
+
+	want := []struct {
+		domain   string
+		cacheHit bool
+		outcome  LookupOutcome
+		err      bool
+	}{
+		{"example.org", false, OutcomeFederated, false},
+		{"example.org", true, OutcomeFederated, false},
+		{"slow.example.org", false, OutcomeError, true},
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("%d events recorded, expected %d", len(events), len(want))
+	}
+	for i, w := range want {
+		ev := events[i]
+		if ev.Domain != w.domain || ev.Service != "avatars" || ev.CacheHit != w.cacheHit ||
+			ev.Outcome != w.outcome || (ev.Err != nil) != w.err {
+			t.Errorf("event %d == %+v, expected %+v", i, ev, w)
+		}
+		if w.outcome == OutcomeFederated && (ev.Target == nil || ev.Target.Target != "avatars.example.org.") {
+			t.Errorf("event %d has target %v", i, ev.Target)
+		}
+		if ev.Duration < 0 {
+			t.Errorf("event %d has negative duration %v", i, ev.Duration)
+		}
+	}
+
+	// fallback on timeout still reports the error
+	events = nil
+	avt.SetTimeoutPolicy(TimeoutFallback)
+	avt.FromEmail("user@slow.example.org")
+	if len(events) != 1 || events[0].Outcome != OutcomeFallback || events[0].Err == nil {
+		t.Errorf("events %+v, expected a fallback with an error", events)
+	}
+
+	// panics in the hook do not break lookups
+	avt.SetLookupHook(func(ev LookupEvent) { panic("boom") })
+	if _, err := avt.FromEmail("user@example.org"); err != nil {
+		t.Errorf("FromEmail with panicking hook: unexpected error %v", err)
+	}
+}
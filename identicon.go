@@ -0,0 +1,111 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// ErrInvalidHash is returned by GenerateIdenticon and FromHash for
+// hashes which are not hexadecimal MD5 or SHA-256 digests
+var ErrInvalidHash = errors.New("libravatar: invalid hash")
+
+// OfflineDefault is an image synthesized locally when avatar servers
+// cannot be reached, see SetOfflineDefault
+type OfflineDefault int
+
+const (
+	// OfflineNone disables local images (default)
+	OfflineNone OfflineDefault = iota
+	// OfflineIdenticon generates images with GenerateIdenticon
+	OfflineIdenticon
+)
+
+// identiconGrid is the number of blocks per side of identicons
+const identiconGrid = 5
+
+// identiconBackground is the color of unset identicon blocks
+var identiconBackground = color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// SetOfflineDefault sets the image generated for the requested
+// identity by GetAvatar, WriteAvatar and Handler when avatar servers
+// cannot be reached. Such results are flagged as Degraded, and take
+// precedence over the image set by SetLocalFallbackImage.
+func (v *Libravatar) SetOfflineDefault(def OfflineDefault) {
+	v.offlineDefault = def
+}
+
+// GenerateIdenticon returns a size by size symmetric block identicon
+// for the given avatar hash, the same hash and size always producing
+// the same image
+func GenerateIdenticon(hash string, size int) (image.Image, error) {
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != 16 && len(sum) != 32 {
+		return nil, fmt.Errorf("%w %q", ErrInvalidHash, hash)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("size %d: %w", size, ErrInvalidSize)
+	}
+
+	// the color comes from the first bytes, keeping it dark enough
+	// to stand out on the background
+	fg := color.NRGBA{sum[0] / 2, sum[1] / 2, sum[2] / 2, 0xff}
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(identiconBackground), image.Point{}, draw.Src)
+
+	// the following bits tell which blocks of the left half (and
+	// middle column) are set, the right half mirroring them
+	half := (identiconGrid + 1) / 2
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < half; col++ {
+			bit := row*half + col
+			if sum[3+bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			x0, x1 := col*size/identiconGrid, (col+1)*size/identiconGrid
+			y0, y1 := row*size/identiconGrid, (row+1)*size/identiconGrid
+			// mirror pixels rather than blocks, for sizes which are
+			// not multiples of the grid
+			draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(fg), image.Point{}, draw.Src)
+			draw.Draw(img, image.Rect(size-x1, y0, size-x0, y1), image.NewUniform(fg), image.Point{}, draw.Src)
+		}
+	}
+	return img, nil
+}
+
+// offlineImage returns the image generated for the avatar at link,
+// or nil if none is configured or link is not an avatar URL
+func (v *Libravatar) offlineImage(link string) *Avatar {
+	if v.offlineDefault != OfflineIdenticon {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil
+	}
+	size := defaultAvatarSize
+	if s, err := strconv.Atoi(u.Query().Get("s")); err == nil {
+		size = s
+	}
+	img, err := GenerateIdenticon(path.Base(u.Path), size)
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return &Avatar{Data: buf.Bytes(), ContentType: "image/png", URL: link, Degraded: true}
+}
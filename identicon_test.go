@@ -0,0 +1,108 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pixelSum returns a checksum of the pixels of img
+func pixelSum(img image.Image) string {
+	sum := sha256.Sum256(img.(*image.NRGBA).Pix)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGenerateIdenticon(t *testing.T) {
+
+	cases := []struct {
+		hash string
+		size int
+		sum  string
+	}{
+		{"572c3489ea700045927076136a969e27", 80, "501bff517f3a15975ff1097155459b18bda149f37c9470e82c531c11c9f59dce"},
+		{"572c3489ea700045927076136a969e27", 17, "8dbb68e0c58f11a318a89e79371ccfa8f76c64b05624d4fe8d2fb7455997650a"},
+		{"00000000000000000000000000000000", 5, "9fcc6fe0a2b33f4f9deb0dd3b33cce17a0ae8a34a00ae3bb7a0edcf69087a957"},
+		{"a9c4a36f3ec4ed9e2e9a91d6d5b1a8d3ffd8dd7c0d3a1f72d6d4c1c1ddcb7b47", 32, "1a98b111edb3a43b6fbe50ba89b9eb9d1de6ab60ca11e263959a487b8495805d"},
+	}
+	for _, c := range cases {
+		img, err := GenerateIdenticon(c.hash, c.size)
+		if err != nil {
+			t.Errorf("GenerateIdenticon(%s, %d): unexpected error %v", c.hash, c.size, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != c.size || b.Dy() != c.size {
+			t.Errorf("GenerateIdenticon(%s, %d) has bounds %v", c.hash, c.size, b)
+		}
+		if sum := pixelSum(img); sum != c.sum {
+			t.Errorf("GenerateIdenticon(%s, %d) has pixel checksum %s, expected %s", c.hash, c.size, sum, c.sum)
+		}
+		// identicons are symmetric
+		for y := 0; y < c.size; y++ {
+			for x := 0; x < c.size/2; x++ {
+				if img.At(x, y) != img.At(c.size-1-x, y) {
+					t.Errorf("GenerateIdenticon(%s, %d) is not symmetric at %d,%d", c.hash, c.size, x, y)
+				}
+			}
+		}
+	}
+
+	for _, hash := range []string{"", "572c3489", "not hexadecimal at all, but 32 ch"} {
+		if _, err := GenerateIdenticon(hash, 80); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("GenerateIdenticon(%q): unexpected error %v", hash, err)
+		}
+	}
+	if _, err := GenerateIdenticon("572c3489ea700045927076136a969e27", 0); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("GenerateIdenticon with size 0: unexpected error %v", err)
+	}
+}
+
+func TestOfflineDefault(t *testing.T) {
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, dead)
+	avt.SetAvatarSize(40)
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); err == nil {
+		t.Fatalf("GetAvatar from dead server without offline default: expected an error")
+	}
+
+	avt.SetOfflineDefault(OfflineIdenticon)
+	a, err := avt.GetAvatar(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatalf("GetAvatar with offline default: unexpected error %v", err)
+	}
+	if !a.Degraded || a.ContentType != "image/png" {
+		t.Errorf("GetAvatar with offline default returned %+v", a)
+	}
+	want, _ := GenerateIdenticon("572c3489ea700045927076136a969e27", 40)
+	var wantPNG bytes.Buffer
+	png.Encode(&wantPNG, want)
+	if !bytes.Equal(a.Data, wantPNG.Bytes()) {
+		t.Errorf("GetAvatar with offline default did not return the identicon for the email")
+	}
+
+	// through the handler too
+	srv := httptest.NewServer(avt.Handler(HandlerAllowEmail(), HandlerBlockPrivateTargets(false)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/avatar/user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(DegradedHeader) != "1" || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("handler with offline default answered %s, %v", resp.Status, resp.Header)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	imageCacheExt    = ".avatar"
+	imageCacheTmp    = ".tmp-"
+	imageCacheTmpAge = time.Minute // age after which temporary files are considered leftovers
+)
+
+// SetImageCacheDir enables caching fetched avatar images in dir
+// ("" to disable, the default). Each image is stored in its own file,
+// keyed by hash and query parameters, preceded by a line of metadata.
+func (v *Libravatar) SetImageCacheDir(dir string) {
+	v.imageCacheMu.Lock()
+	v.imageCacheDir = dir
+	v.imageCacheSize = -1
+	v.imageCacheMu.Unlock()
+}
+
+// SetImageCacheTTL sets for how long cached images are used before
+// asking the server again (one hour by default). Expired images are
+// still used if the server cannot be reached or fails.
+func (v *Libravatar) SetImageCacheTTL(ttl time.Duration) {
+	v.imageCacheTTL = ttl
+}
+
+// SetImageCacheMaxBytes sets the size of the image cache, in bytes
+// (0 for no limit, the default). Oldest images are evicted first, once
+// the cache grows over the limit, until it is 10% below it. The size
+// of the cache is tracked in memory between evictions, ignoring
+// changes by other processes.
+func (v *Libravatar) SetImageCacheMaxBytes(size int64) {
+	v.imageCacheMaxBytes = size
+}
+
+// cachedImage is the metadata stored with cached images
+type cachedImage struct {
+	ContentType  string    `json:"content_type"`
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// imageCacheKey returns the image cache key for link, which does not
+// depend on the host serving it
+func imageCacheKey(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(u.RequestURI()))
+	return hex.EncodeToString(sum[:])
+}
+
+// readImageCache returns the image cached for key, if any, and whether
+// it is still fresh
+func (v *Libravatar) readImageCache(key string) (*Avatar, bool) {
+	f, err := os.Open(filepath.Join(v.imageCacheDir, key+imageCacheExt))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, false
+	}
+	var meta cachedImage
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, false
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+
+	return &Avatar{
+		Data:         data,
+		ContentType:  meta.ContentType,
+		URL:          meta.URL,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+	}, v.clock.Now().Sub(meta.FetchedAt) <= v.imageCacheTTL
+}
+
+// writeImageCache stores a in the image cache under key, atomically.
+// Failures are ignored, as the cache is just an optimization.
+func (v *Libravatar) writeImageCache(key string, a *Avatar) {
+	meta, err := json.Marshal(cachedImage{
+		ContentType:  a.ContentType,
+		URL:          a.URL,
+		ETag:         a.ETag,
+		LastModified: a.LastModified,
+		FetchedAt:    v.clock.Now(),
+	})
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(v.imageCacheDir, imageCacheTmp+"*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(append(meta, '\n'))
+	if err == nil {
+		_, err = io.Copy(f, bytes.NewReader(a.Data))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	path := filepath.Join(v.imageCacheDir, key+imageCacheExt)
+	var replaced int64
+	if info, err := os.Stat(path); err == nil {
+		replaced = info.Size()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	if v.imageCacheMaxBytes > 0 {
+		v.growImageCache(int64(len(meta)+1+len(a.Data)) - replaced)
+	}
+}
+
+// growImageCache records the image cache grew by delta bytes, evicting
+// images if it is now over its size limit, or if its size is unknown
+func (v *Libravatar) growImageCache(delta int64) {
+	v.imageCacheMu.Lock()
+	defer v.imageCacheMu.Unlock()
+	if v.imageCacheSize >= 0 {
+		v.imageCacheSize += delta
+		if v.imageCacheSize <= v.imageCacheMaxBytes {
+			return
+		}
+	}
+	v.evictImageCache()
+}
+
+// evictImageCache removes the oldest cached images until the cache
+// is 10% below its size limit, and leftover temporary files, updating
+// the tracked size of the cache. imageCacheMu must be held.
+func (v *Libravatar) evictImageCache() {
+	v.imageCacheSize = -1
+	entries, err := os.ReadDir(v.imageCacheDir)
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var (
+		files []file
+		total int64
+	)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(v.imageCacheDir, e.Name())
+		if strings.HasPrefix(e.Name(), imageCacheTmp) {
+			if v.clock.Now().Sub(info.ModTime()) > imageCacheTmpAge {
+				os.Remove(path)
+			}
+			continue
+		}
+		if !strings.HasSuffix(e.Name(), imageCacheExt) {
+			continue
+		}
+		files = append(files, file{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	target := v.imageCacheMaxBytes
+	if total > target {
+		target -= target / 10
+	}
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+	v.imageCacheSize = total
+}
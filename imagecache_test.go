@@ -0,0 +1,337 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImageCache(t *testing.T) {
+
+	up := &conditionalUpstream{etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	var requests int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		up.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(dir)
+	ctx := context.Background()
+
+	// miss
+	a, err := avt.GetAvatar(ctx, "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) || requests != 1 {
+		t.Fatalf("GetAvatar (miss) == %v, %v after %d requests", a, err, requests)
+	}
+
+	// hit
+	a, err = avt.GetAvatar(ctx, "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) || a.ContentType != "image/png" || a.ETag != `"v1"` || requests != 1 {
+		t.Errorf("GetAvatar (hit) == %+v, %v after %d requests", a, err, requests)
+	}
+	w := &countingWriter{}
+	if _, _, err := avt.WriteAvatar(ctx, w, "user@example.org"); err != nil || w.n != int64(len(testPNG)) || requests != 1 {
+		t.Errorf("WriteAvatar (hit) wrote %d bytes, error %v after %d requests", w.n, err, requests)
+	}
+
+	// other parameters are other entries
+	avt.SetAvatarSize(32)
+	avt.GetAvatar(ctx, "user@example.org")
+	if requests != 2 {
+		t.Errorf("%d requests after changing size, expected 2", requests)
+	}
+	avt.SetAvatarSize(0)
+
+	// expiry, with revalidation
+	avt.SetImageCacheTTL(0)
+	up.sent = 0
+	a, err = avt.GetAvatar(ctx, "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, testPNG) || a.NotModified || requests != 3 || up.sent != 0 {
+		t.Errorf("GetAvatar (expired) == %+v, %v after %d requests, %d bytes sent", a, err, requests, up.sent)
+	}
+	up.etag = ""
+	avt.GetAvatar(ctx, "user@example.org")
+	if requests != 4 || up.sent != len(testPNG) {
+		t.Errorf("GetAvatar (expired, changed): %d requests, %d bytes sent", requests, up.sent)
+	}
+	avt.SetImageCacheTTL(time.Hour)
+
+	// concurrent access to the same entry
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0700)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := avt.GetAvatar(ctx, "user@example.org")
+			if err != nil || !bytes.Equal(a.Data, testPNG) {
+				t.Errorf("concurrent GetAvatar == %v, %v", a, err)
+			}
+		}()
+	}
+	wg.Wait()
+	a, fresh := avt.readImageCache(imageCacheKey(srv.URL + "/avatar/572c3489ea700045927076136a969e27"))
+	if a == nil || !fresh || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("cache entry after concurrent access: %v", a)
+	}
+}
+
+func TestImageCacheRevalidation(t *testing.T) {
+
+	var status int
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case status != 0:
+			w.WriteHeader(status)
+		case r.Header.Get("If-None-Match") != "":
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG)
+		}
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetClock(clock)
+	avt.SetImageCacheDir(t.TempDir())
+	ctx := context.Background()
+	key := imageCacheKey(srv.URL + "/avatar/" + hashOf("user@example.org"))
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// stale images are served while the server fails
+	clock.Advance(2 * time.Hour)
+	for _, status = range []int{http.StatusInternalServerError, http.StatusBadGateway} {
+		if a, err := avt.GetAvatar(ctx, "user@example.org"); err != nil || !bytes.Equal(a.Data, testPNG) {
+			t.Errorf("GetAvatar with expired entry and status %d == %v, %v, expected the stale image", status, a, err)
+		}
+	}
+
+	// validators and expiry are refreshed on 304
+	status, etag = 0, `"v2"`
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if a, fresh := avt.readImageCache(key); a == nil || !fresh || a.ETag != `"v2"` {
+		t.Errorf("cache entry after 304: %+v, fresh %v, expected a fresh one with the new ETag", a, fresh)
+	}
+
+	// gone avatars are not served stale
+	clock.Advance(2 * time.Hour)
+	status = http.StatusNotFound
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("GetAvatar with expired entry of a gone avatar: unexpected error %v", err)
+	}
+}
+
+func TestImageCacheEviction(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngLike(bytes.Repeat([]byte{1}, 1000)))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(dir)
+	avt.SetImageCacheMaxBytes(2600) // two entries, within the 10% margin
+
+	// a leftover of a crash while writing
+	leftover := filepath.Join(dir, imageCacheTmp+"crashed")
+	os.WriteFile(leftover, []byte(`{"content_type":"ima`), 0600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(leftover, old, old)
+
+	for i := 0; i < 3; i++ {
+		if _, err := avt.GetAvatar(context.Background(), fmt.Sprintf("user%d@example.org", i)); err != nil {
+			t.Fatalf("GetAvatar: unexpected error %v", err)
+		}
+		// make sure modification times differ
+		for _, e := range mustReadDir(t, dir) {
+			p := filepath.Join(dir, e)
+			info, _ := os.Stat(p)
+			mt := info.ModTime().Add(-time.Minute)
+			os.Chtimes(p, mt, mt)
+		}
+	}
+
+	files := mustReadDir(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("cache holds %v, expected 2 entries", files)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f, imageCacheTmp) {
+			t.Errorf("leftover temporary file %s was not removed", f)
+		}
+	}
+	key := imageCacheKey(srv.URL + "/avatar/" + hashOf("user0@example.org"))
+	if a, _ := avt.readImageCache(key); a != nil {
+		t.Errorf("oldest entry was not evicted")
+	}
+}
+
+func mustReadDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// hashOf returns the MD5 hash of email, as used in avatar URLs
+func hashOf(email string) string {
+	sum := md5.Sum([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImageCacheHandler(t *testing.T) {
+
+	up := &conditionalUpstream{etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	upstream := httptest.NewServer(up)
+	defer upstream.Close()
+
+	avt := New()
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+	avt.SetImageCacheDir(t.TempDir())
+	srv := httptest.NewServer(avt.Handler())
+	defer srv.Close()
+
+	link := srv.URL + "/avatars/572c3489ea700045927076136a969e27"
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"v1"` {
+			t.Errorf("GET %d: status %d, headers %v", i, resp.StatusCode, resp.Header)
+		}
+	}
+	if up.sent != len(testPNG) {
+		t.Errorf("%d bytes sent upstream, expected the image to be fetched once", up.sent)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, link, nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional GET: status %d, expected 304", resp.StatusCode)
+	}
+}
+
+func TestImageCacheSize(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngLike(bytes.Repeat([]byte{1}, 1000)))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	clock := newFakeClock()
+	avt := New()
+	avt.SetClock(clock)
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(dir)
+	avt.SetImageCacheMaxBytes(1 << 20)
+
+	// temporary files are aged according to the clock
+	leftover := filepath.Join(dir, imageCacheTmp+"crashed")
+	os.WriteFile(leftover, []byte(`{"content_type":"ima`), 0600)
+	os.Chtimes(leftover, clock.Now(), clock.Now())
+	clock.Advance(2 * imageCacheTmpAge)
+
+	for i := 0; i < 3; i++ {
+		if _, err := avt.GetAvatar(context.Background(), fmt.Sprintf("user%d@example.org", i)); err != nil {
+			t.Fatalf("GetAvatar: unexpected error %v", err)
+		}
+	}
+	if _, err := os.Stat(leftover); err == nil {
+		t.Errorf("leftover temporary file was not removed")
+	}
+
+	// the size is tracked without reading the directory again
+	var total int64
+	for _, name := range mustReadDir(t, dir) {
+		info, _ := os.Stat(filepath.Join(dir, name))
+		total += info.Size()
+	}
+	if avt.imageCacheSize != total {
+		t.Errorf("tracked image cache size %d, expected %d", avt.imageCacheSize, total)
+	}
+}
+
+func TestImageCacheInvalid(t *testing.T) {
+
+	valid := encodedImage(t, 80, func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) })
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(valid)
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(t.TempDir())
+	avt.SetValidateImages(true)
+	ctx := context.Background()
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err != nil {
+		t.Fatalf("GetAvatar: unexpected error %v", err)
+	}
+
+	// corrupt the cached image
+	link, _ := avt.FromEmail("user@example.org")
+	key := imageCacheKey(link)
+	cached, _ := avt.readImageCache(key)
+	cached.Data = []byte("garbage")
+	avt.writeImageCache(key, cached)
+
+	a, err := avt.GetAvatar(ctx, "user@example.org")
+	if err != nil || !bytes.Equal(a.Data, valid) || requests != 2 {
+		t.Errorf("GetAvatar with a corrupt cached image returned %v after %d requests, expected it to be fetched again", err, requests)
+	}
+}
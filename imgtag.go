@@ -0,0 +1,122 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"html"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// ImgOption configures the element returned by ImgTag
+type ImgOption func(*imgTag)
+
+// ImgAlt sets the alt attribute of the element (empty by default)
+func ImgAlt(alt string) ImgOption {
+	return func(t *imgTag) {
+		t.alt = alt
+	}
+}
+
+// ImgClass sets the class attribute of the element
+func ImgClass(class string) ImgOption {
+	return func(t *imgTag) {
+		t.class = class
+	}
+}
+
+// ImgSize sets the size of the avatar, and the width and height of
+// the element (by default, the size set by SetAvatarSize)
+func ImgSize(size uint) ImgOption {
+	return func(t *imgTag) {
+		t.size = size
+	}
+}
+
+// ImgEager makes the image load eagerly, rather than lazily
+func ImgEager() ImgOption {
+	return func(t *imgTag) {
+		t.eager = true
+	}
+}
+
+// ImgDensities adds a srcset attribute to the element, with the given
+// pixel densities, see SrcSet
+func ImgDensities(densities ...float64) ImgOption {
+	return func(t *imgTag) {
+		t.densities = densities
+	}
+}
+
+// imgTag holds the attributes of the element returned by ImgTag
+type imgTag struct {
+	alt       string
+	class     string
+	size      uint
+	eager     bool
+	densities []float64
+}
+
+// ImgTag returns an img element showing the avatar for the given
+// email. Attribute values are escaped, so the result can be used
+// as is in html/template.
+func (v *Libravatar) ImgTag(email string, opts ...ImgOption) (template.HTML, error) {
+	t := &imgTag{size: v.size}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.size == 0 {
+		t.size = defaultAvatarSize
+	}
+
+	addr, err := parseEmail(email)
+	if err != nil {
+		return "", err
+	}
+	srcset, src, err := v.srcSet(context.Background(), addr, nil, t.size, t.densities)
+	if err != nil {
+		return "", err
+	}
+
+	if len(t.densities) == 0 {
+		srcset = ""
+	}
+	return t.render(src, srcset), nil
+}
+
+// render returns the img element with the given src and srcset
+// attributes (the latter being omitted if empty)
+func (t *imgTag) render(src, srcset string) template.HTML {
+	var b strings.Builder
+	attr := func(name, value string) {
+		b.WriteByte(' ')
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(html.EscapeString(value))
+		b.WriteByte('"')
+	}
+	size := strconv.FormatUint(uint64(t.size), 10)
+
+	b.WriteString("<img")
+	attr("src", src)
+	if srcset != "" {
+		attr("srcset", srcset)
+	}
+	attr("width", size)
+	attr("height", size)
+	attr("alt", t.alt)
+	if t.class != "" {
+		attr("class", t.class)
+	}
+	if t.eager {
+		attr("loading", "eager")
+	} else {
+		attr("loading", "lazy")
+	}
+	b.WriteString(">")
+	return template.HTML(b.String())
+}
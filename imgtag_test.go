@@ -0,0 +1,63 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"html/template"
+	"net"
+	"testing"
+)
+
+func TestImgTag(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.SetDefaultImage("https://example.org/default.png?a=1&b=2")
+	const src = "http://avatars.example.org/avatar/572c3489ea700045927076136a969e27?d=https%3A%2F%2Fexample.org%2Fdefault.png%3Fa%3D1%26b%3D2&amp;s="
+
+	cases := []struct {
+		opts []ImgOption
+		want template.HTML
+	}{
+		{nil, `<img src="` + src + `80" width="80" height="80" alt="" loading="lazy">`},
+		{
+			[]ImgOption{ImgAlt(`"><script>alert('x')</script>`), ImgClass("avatar round"), ImgSize(32), ImgEager()},
+			`<img src="` + src + `32" width="32" height="32" alt="&#34;&gt;&lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt;" class="avatar round" loading="eager">`,
+		},
+		{
+			[]ImgOption{ImgSize(64), ImgDensities(1, 2)},
+			`<img src="` + src + `64" srcset="` + src + `64 1x, ` + src + `128 2x" width="64" height="64" alt="" loading="lazy">`,
+		},
+	}
+	for _, c := range cases {
+		got, err := avt.ImgTag("user@example.org", c.opts...)
+		if err != nil {
+			t.Errorf("ImgTag: unexpected error %v", err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ImgTag ==\n%s\nexpected\n%s", got, c.want)
+		}
+	}
+
+	// not escaped again by html/template
+	tag, err := avt.ImgTag("user@example.org", ImgAlt("<b>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	tmpl := template.Must(template.New("").Parse(`<p>{{.}}</p>`))
+	if err := tmpl.Execute(&b, tag); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "<p>"+string(tag)+"</p>" {
+		t.Errorf("template output %s", b.String())
+	}
+
+	if _, err := avt.ImgTag("not an email"); err == nil {
+		t.Errorf("ImgTag of invalid email: expected an error")
+	}
+}
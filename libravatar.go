@@ -8,14 +8,19 @@
 package libravatar // import "strk.kbt.io/projects/go/libravatar"
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
-	"fmt"
+	"encoding/hex"
+	"errors"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/mail"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +40,34 @@ const (
 	Wavatar = "wavatar"
 	// awesome generated, 8-bit arcade-style pixelated faces
 	Retro = "retro"
+	// generated robots with different colors, faces, etc
+	RoboHash = "robohash"
+	// generated "paganized" faces, not supported by Gravatar
+	Pagan = "pagan"
+	// a transparent image
+	Blank = "blank"
+)
+
+// TimeoutPolicy tells what to do when an SRV lookup times out
+type TimeoutPolicy int
+
+const (
+	// TimeoutError makes lookups fail with the DNS error (default)
+	TimeoutError TimeoutPolicy = iota
+	// TimeoutFallback makes lookups use the fallback host, remembering
+	// the failure for a short time to avoid timing out on every call
+	TimeoutFallback
+)
+
+// DNSErrorPolicy tells what to do when an SRV lookup fails for reasons
+// other than a timeout or a missing record
+type DNSErrorPolicy int
+
+const (
+	// DNSErrorFallback makes lookups use the fallback host (default)
+	DNSErrorFallback DNSErrorPolicy = iota
+	// DNSErrorFail makes lookups fail with the DNS error
+	DNSErrorFail
 )
 
 var (
@@ -50,24 +83,105 @@ type cacheKey struct {
 }
 
 type cacheValue struct {
-	target    string
+	target    *net.SRV   // nil if there is no record
+	backups   []*net.SRV // records of lower priority than target, in order
+	reason    string     // why target was selected, or why there is none
 	checkedAt time.Time
+	ttl       time.Duration
 }
 
 // Libravatar is an opaque structure holding service configuration
 type Libravatar struct {
-	defURL             string // default url
-	picSize            int    // picture size
-	fallbackHost       string // default fallback URL
-	secureFallbackHost string // default fallback URL for secure connections
-	useHTTPS           bool
-	nameCache          map[cacheKey]cacheValue
-	nameCacheDuration  time.Duration
-	minSize            uint   // smallest image dimension allowed
-	maxSize            uint   // largest image dimension allowed
-	size               uint   // what dimension should be used
-	serviceBase        string // SRV record to be queried for federation
-	secureServiceBase  string // SRV record to be queried for federation with secure servers
+	defURL                   string   // default url
+	picSize                  int      // picture size
+	fallbackHosts            []string // fallback hosts, in order of preference
+	secureFallbackHosts      []string // fallback hosts for secure connections, in order of preference
+	useHTTPS                 bool
+	nameCache                srvCache // SRV lookups, by service and domain
+	sharedCache              Cache    // used instead of nameCache, if not nil
+	nameCacheDuration        time.Duration
+	timeoutPolicy            TimeoutPolicy
+	dnsErrorPolicy           DNSErrorPolicy
+	failureCacheDuration     time.Duration // how long to remember a failed lookup
+	negativeCacheDuration    time.Duration // how long to remember a domain has no SRV record, 0 for nameCacheDuration
+	stats                    stats
+	rand                     *rand.Rand        // used for weighted SRV selection
+	randMu                   sync.Mutex        // guards rand
+	minSize                  uint              // smallest image dimension allowed
+	maxSize                  uint              // largest image dimension allowed
+	size                     uint              // what dimension should be used
+	serviceBase              string            // SRV record to be queried for federation
+	secureServiceBase        string            // SRV record to be queried for federation with secure servers
+	disableSRV               bool              // never query DNS, always use fallback hosts
+	secureFallbackToPlainSRV bool              // with useHTTPS, try serviceBase when secureServiceBase is missing
+	requireService           bool              // fail lookups of domains without SRV record
+	domainOverrides          map[string]string // domain (or .suffix) to host[:port]
+	skipDomains              map[string]bool   // domains (or .suffixes) never looked up
+	lookupSem                chan struct{}     // limits concurrent SRV lookups, if not nil
+	lookupRate               *rateLimiter      // limits SRV lookups per second, if not nil
+	lookupSRV                func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	ttlLookuper              TTLLookuper // used instead of lookupSRV, if not nil
+	ttlPolicy                TTLPolicy
+	minTTL                   time.Duration // shortest record TTL honored
+	maxTTL                   time.Duration // longest record TTL honored, 0 for no limit
+	lookupHook               func(LookupEvent)
+	httpClient               *http.Client         // used to fetch avatars
+	userAgent                string               // sent with every request, if not empty
+	maxBodySize              int64                // largest avatar image accepted, 0 for no limit
+	maxRedirects             int                  // redirects followed, negative to leave it to httpClient
+	failover                 bool                 // retry failed requests against the fallback host
+	deadHosts                map[string]time.Time // hosts which recently failed, with the time they did
+	deadHostsMu              sync.Mutex           // guards deadHosts
+	maxDataURISize           int                  // largest data URI returned by DataURI, 0 for no limit
+	imageCacheDir            string               // where to cache fetched images, empty to disable
+	imageCacheTTL            time.Duration        // how long cached images are used without revalidation
+	imageCacheMaxBytes       int64                // size of the image cache, 0 for no limit
+	imageCacheMu             sync.Mutex           // guards imageCacheSize, serializes image cache evictions
+	imageCacheSize           int64                // size of the image cache in bytes, -1 if unknown
+	localImage               *Avatar              // served when servers cannot be reached, if not nil
+	validateImages           bool                 // decode fetched images to check they are valid
+	allowedTypes             map[string]bool      // content types accepted from servers, nil for any
+	verifyTarget             bool                 // probe SRV targets before using them
+	dialProbe                func(ctx context.Context, network, addr string) (net.Conn, error)
+	verifyResolves           bool // check SRV targets have addresses before using them
+	lookupHost               func(ctx context.Context, host string) ([]string, error)
+	watched                  map[string]bool // identities kept warm by the prefetcher
+	watchMu                  sync.Mutex
+	prefetchHook             func(PrefetchEvent)
+	prefetchers              sync.WaitGroup
+	closed                   chan struct{} // closed by Close
+	closeOnce                sync.Once
+	closeMu                  sync.Mutex // orders StartPrefetcher and Close
+	urlCache                 *urlCache  // nil if disabled
+	gravatarMode             bool       // produce Gravatar URLs
+	rating                   string     // maximum avatar rating, empty for the server default
+	forceDefault             bool       // always use the default image
+	metrics                  Metrics
+	strict                   bool                         // validate the configuration before building URLs
+	defaultURLAllowlist      map[string]bool              // hosts (and .suffixes) allowed in default image URLs, nil for any
+	redirectStatus           int                          // status of Redirect responses, 0 for http.StatusFound
+	redirectCacheControl     string                       // Cache-Control of Redirect responses, if not empty
+	blockPrivate             bool                         // refuse connecting to private addresses
+	guarded                  *http.Client                 // httpClient refusing private addresses, built on demand
+	guardedFrom              *http.Client                 // the httpClient guarded was built from
+	guardMu                  sync.Mutex                   // guards guarded and guardedFrom
+	offlineDefault           OfflineDefault               // generated when servers cannot be reached
+	gravatarDefault          bool                         // use the Gravatar avatar as default image
+	gravatarCandidate        bool                         // return Gravatar URLs from FromEmailAll
+	notFound                 *lru[notFoundKey, time.Time] // missing avatars, with the time they expire
+	notFoundTTL              time.Duration                // how long missing avatars are remembered
+	clock                    Clock
+	trace                    TraceHooks
+	hashFunc                 func(normalizedInput string, isOpenID bool) string
+	relativeURLs             bool
+	faviconDefault           string                       // default image URL template for email domains, see SetDomainFaviconDefault
+	emailSHA256              bool                         // hash emails with SHA-256 instead of MD5
+	extraParams              string                       // query parameters added to avatar URLs, encoded
+	webFinger                bool                         // ask WebFinger for account avatars
+	webFingerCache           *lru[string, webFingerEntry] // WebFinger answers, by account
+	targets                  *lru[string, []cacheKey]     // SRV entries whose target has backups, by target
+	targetsMu                sync.Mutex                   // guards updates of targets entries
+	webFingerTTL             time.Duration                // how long WebFinger answers are remembered
 }
 
 // New instanciates a new Libravatar object (handle)
@@ -75,196 +189,800 @@ func New() *Libravatar {
 	// According to https://wiki.libravatar.org/running_your_own/
 	// the time-to-live (cache expiry) should be set to at least 1 day.
 	return &Libravatar{
-		fallbackHost:       `cdn.libravatar.org`,
-		secureFallbackHost: `seccdn.libravatar.org`,
-		minSize:            1,
-		maxSize:            512,
-		size:               0, // unset, defaults to 80
-		serviceBase:        `avatars`,
-		secureServiceBase:  `avatars-sec`,
-		nameCache:          make(map[cacheKey]cacheValue),
-		nameCacheDuration:  24 * time.Hour,
+		fallbackHosts:        []string{`cdn.libravatar.org`},
+		secureFallbackHosts:  []string{`seccdn.libravatar.org`},
+		minSize:              1,
+		maxSize:              512,
+		size:                 0, // unset, defaults to 80
+		serviceBase:          `avatars`,
+		secureServiceBase:    `avatars-sec`,
+		nameCacheDuration:    24 * time.Hour,
+		failureCacheDuration: time.Minute,
+		lookupSRV:            net.DefaultResolver.LookupSRV,
+		httpClient:           &http.Client{Timeout: defaultHTTPTimeout},
+		maxBodySize:          5 << 20,
+		maxRedirects:         5,
+		imageCacheTTL:        time.Hour,
+		imageCacheSize:       -1,
+		allowedTypes:         typeSet(defaultAllowedTypes),
+		dialProbe:            (&net.Dialer{}).DialContext,
+		lookupHost:           net.DefaultResolver.LookupHost,
+		metrics:              noMetrics{},
+		watched:              make(map[string]bool),
+		closed:               make(chan struct{}),
+		clock:                systemClock{},
+		notFound:             newLRU[notFoundKey, time.Time](notFoundCacheSize),
+		notFoundTTL:          defaultNotFoundCacheTTL,
+		webFingerCache:       newLRU[string, webFingerEntry](webFingerCacheSize),
+		webFingerTTL:         defaultWebFingerCacheTTL,
+		targets:              newLRU[string, []cacheKey](targetIndexSize),
+		rand:                 rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 // SetFallbackHost sets the hostname for fallbacks in case no avatar
 // service is defined for a domain
 func (v *Libravatar) SetFallbackHost(host string) {
-	v.fallbackHost = host
+	v.SetFallbackHosts(host)
+}
+
+// SetFallbackHosts sets the hostnames for fallbacks in case no avatar
+// service is defined for a domain, in order of preference. URLs are
+// built with the first one, the others being tried in turn when
+// fetching avatars fails with a transport error or a server error.
+func (v *Libravatar) SetFallbackHosts(hosts ...string) {
+	v.fallbackHosts = append([]string(nil), hosts...)
+	v.urlCache.purge()
 }
 
 // SetSecureFallbackHost sets the hostname for fallbacks in case no
 // avatar service is defined for a domain, when requiring secure domains
 func (v *Libravatar) SetSecureFallbackHost(host string) {
-	v.secureFallbackHost = host
+	v.SetSecureFallbackHosts(host)
+}
+
+// SetSecureFallbackHosts is like SetFallbackHosts, for the hostnames
+// used when requiring secure domains
+func (v *Libravatar) SetSecureFallbackHosts(hosts ...string) {
+	v.secureFallbackHosts = append([]string(nil), hosts...)
+	v.urlCache.purge()
+}
+
+// fallbackHost returns the preferred fallback host, over https if
+// secure is set
+func (v *Libravatar) fallbackHost(secure bool) string {
+	hosts := v.fallbackHosts
+	if secure {
+		hosts = v.secureFallbackHosts
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	return hosts[0]
 }
 
 // SetUseHTTPS sets flag requesting use of https for fetching avatars
 func (v *Libravatar) SetUseHTTPS(use bool) {
 	v.useHTTPS = use
+	v.urlCache.purge()
+}
+
+// SetDisableSRV disables federation: when set, no SRV lookup is
+// performed and avatars are always served by the fallback hosts
+func (v *Libravatar) SetDisableSRV(disable bool) {
+	v.disableSRV = disable
+	v.urlCache.purge()
+}
+
+// SetSecureFallbackToPlainSRV makes secure lookups for domains with no
+// secure service record use the target of the plain service record,
+// over https. A port of 80 in the plain record is taken to mean the
+// standard https port, any other port is kept as is.
+func (v *Libravatar) SetSecureFallbackToPlainSRV(enable bool) {
+	v.secureFallbackToPlainSRV = enable
+	v.urlCache.purge()
+}
+
+// SetRequireService makes lookups of domains without the avatar SRV
+// record fail with an error wrapping ErrNoService, instead of using the
+// fallback host. Domains which are not looked up, see SetDisableSRV
+// and SetSkipDomains, are not affected.
+func (v *Libravatar) SetRequireService(enable bool) {
+	v.requireService = enable
+	v.urlCache.purge()
+}
+
+// SetTimeoutPolicy sets what to do when an SRV lookup times out,
+// either TimeoutError (the default) or TimeoutFallback
+func (v *Libravatar) SetTimeoutPolicy(policy TimeoutPolicy) {
+	v.timeoutPolicy = policy
+}
+
+// SetDNSErrorPolicy sets what to do when an SRV lookup fails for
+// reasons other than a timeout or a missing record, either
+// DNSErrorFallback (the default) or DNSErrorFail.
+// Failures are counted in Stats regardless of the policy.
+func (v *Libravatar) SetDNSErrorPolicy(policy DNSErrorPolicy) {
+	v.dnsErrorPolicy = policy
+}
+
+// SetRandSource sets the source of randomness used to pick among
+// SRV records of equal priority, making the selection reproducible
+// (nil for the default source, seeded with the current time)
+func (v *Libravatar) SetRandSource(src rand.Source) {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	v.randMu.Lock()
+	v.rand = rand.New(src)
+	v.randMu.Unlock()
+}
+
+// SetDefaultImage sets the image to be used for identities having no
+// avatar: either an http(s) URL or one of the keywords returned by
+// KnownDefaults ("" for the server default)
+func (v *Libravatar) SetDefaultImage(defURL string) error {
+	if err := v.checkDefaultImage(defURL); err != nil {
+		return err
+	}
+	v.defURL = defURL
+	return nil
+}
+
+// KnownDefaults returns the keywords accepted by SetDefaultImage,
+// which depend on the Gravatar mode
+func (v *Libravatar) KnownDefaults() []string {
+	if v.gravatarMode {
+		return []string{HTTP404, MysteryMan, IdentIcon, MonsterID, Wavatar, Retro, RoboHash, Blank}
+	}
+	return []string{HTTP404, MysteryMan, IdentIcon, MonsterID, Wavatar, Retro, RoboHash, Pagan, Blank}
+}
+
+// knownDefault tells whether keyword is one of KnownDefaults
+func (v *Libravatar) knownDefault(keyword string) bool {
+	for _, k := range v.KnownDefaults() {
+		if k == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageURL tells whether s is an absolute http(s) URL
+func isImageURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
 }
 
-// SetAvatarSize sets avatars image dimension (0 for default)
-func (v *Libravatar) SetAvatarSize(size uint) {
-	v.size = size
+// SetForceDefault makes URLs request the default image even for
+// identities having an avatar
+func (v *Libravatar) SetForceDefault(force bool) {
+	v.forceDefault = force
 }
 
 // generate hash, either with email address or OpenID
-func (v *Libravatar) genHash(email *mail.Address, openid *url.URL) string {
+func genHash(email *mail.Address, openid *url.URL) (string, error) {
+	input, isOpenID, err := hashInput(email, openid)
+	if err != nil {
+		return "", err
+	}
+	if isOpenID {
+		sum := sha256.Sum256([]byte(input))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	sum := md5.Sum([]byte(input))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashInput normalizes email or openid, returning the string to be
+// hashed and whether it is an OpenID
+func hashInput(email *mail.Address, openid *url.URL) (string, bool, error) {
 	if email != nil {
 		email.Address = strings.ToLower(strings.TrimSpace(email.Address))
-		sum := md5.Sum([]byte(email.Address))
-		return fmt.Sprintf("%x", sum)
+		return email.Address, false, nil
 	} else if openid != nil {
 		openid.Scheme = strings.ToLower(openid.Scheme)
 		openid.Host = strings.ToLower(openid.Host)
-		sum := sha256.Sum256([]byte(openid.String()))
-		return fmt.Sprintf("%x", sum)
+		return openid.String(), true, nil
 	}
-	// panic, because this should not be reachable
-	panic("Neither Email or OpenID set")
+	return "", false, errNoIdentity
+}
+
+// SetHashFunc sets a function computing the hashes of identities in
+// place of the MD5 (emails) and SHA-256 (OpenIDs) digests, for
+// self-hosted servers keying avatars differently (nil for the
+// standard digests, the default).
+// The function is passed the normalized email or OpenID, and whether
+// it is an OpenID; its result is used as is in avatar URLs.
+// Custom hashes are incompatible with the public libravatar and
+// Gravatar networks, which will not find any avatar by them, and with
+// SetGravatarDefault.
+func (v *Libravatar) SetHashFunc(f func(normalizedInput string, isOpenID bool) string) {
+	v.hashFunc = f
+	v.urlCache.purge()
+}
+
+// hash returns the hash of email or openid, as set by SetHashFunc
+// and SetEmailHash
+func (v *Libravatar) hash(email *mail.Address, openid *url.URL) (string, error) {
+	if v.hashFunc == nil && !v.emailSHA256 {
+		return genHash(email, openid)
+	}
+	input, isOpenID, err := hashInput(email, openid)
+	if err != nil {
+		return "", err
+	}
+	if v.hashFunc != nil {
+		return v.hashFunc(input, isOpenID), nil
+	}
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:]), nil
 }
 
 // Gets domain out of email or openid (for openid to be parsed, email has to be nil)
-func (v *Libravatar) getDomain(email *mail.Address, openid *url.URL) string {
+func (v *Libravatar) getDomain(email *mail.Address, openid *url.URL) (string, error) {
 	if email != nil {
 		u, err := url.Parse("//" + email.Address)
 		if err != nil {
-			if v.useHTTPS && v.secureFallbackHost != "" {
-				return v.secureFallbackHost
+			if v.useHTTPS && v.fallbackHost(true) != "" {
+				return v.fallbackHost(true), nil
 			}
-			return v.fallbackHost
+			return v.fallbackHost(false), nil
 		}
-		return u.Host
+		return canonicalDomain(u.Host)
 	} else if openid != nil {
-		return openid.Host
+		return canonicalDomain(openid.Host)
+	}
+	return "", errNoIdentity
+}
+
+// params holds the query parameters of avatar URLs
+type params struct {
+	defURL string // default url
+	size   uint   // picture size
+	rating string // maximum avatar rating
+	force  bool   // force the default image
+	secure bool   // use https
+	extra  string // additional query parameters, encoded
+	// scheme of the Gravatar avatar used as default image for
+	// emails, if not empty
+	gravatarDefault string
+	// URL template of the domain image used as default image for
+	// emails, if not empty and defURL is empty
+	favicon string
+}
+
+// params returns the query parameters configured for the object
+func (v *Libravatar) params() params {
+	p := params{defURL: v.defURL, size: v.size, force: v.forceDefault, secure: v.useHTTPS, extra: v.extraParams, favicon: v.faviconDefault}
+	if !v.strict && !v.defaultURLAllowed(p.defURL) {
+		// dropped rather than failing, see SetDefaultURLAllowlist
+		p.defURL = ""
 	}
-	// panic, because this should not be reachable
-	panic("Neither Email or OpenID set")
+	p.rating = v.rating
+	if !v.gravatarMode && v.gravatarDefault {
+		p.gravatarDefault = gravatarDefaultScheme(p.secure)
+	}
+	return p
 }
 
 // Processes email or openid (for openid to be processed, email has to be nil)
-func (v *Libravatar) process(email *mail.Address, openid *url.URL) (string, error) {
-	URL, err := v.baseURL(email, openid)
-	if err != nil {
-		return "", err
+func (v *Libravatar) process(ctx context.Context, email *mail.Address, openid *url.URL, p params) (string, error) {
+	r, err := v.result(ctx, email, openid, p)
+	return r.URL, err
+}
+
+// buildURL returns the URL of the avatar with the given hash on the
+// server at base
+func buildURL(base, hash string, p params) string {
+	var def, rating, size string
+	if p.gravatarDefault != "" && len(hash) == md5.Size*2 {
+		def = url.QueryEscape(gravatarDefaultURL(hash, p))
+	} else if p.defURL != "" {
+		def = url.QueryEscape(p.defURL)
+	}
+	if p.rating != "" {
+		rating = url.QueryEscape(p.rating)
+	}
+	if p.size > 0 {
+		size = strconv.FormatUint(uint64(p.size), 10)
 	}
-	res := fmt.Sprintf("%s/avatar/%s", URL, v.genHash(email, openid))
 
-	values := make(url.Values)
-	if v.defURL != "" {
-		values.Add("d", v.defURL)
+	var b strings.Builder
+	b.Grow(len(base) + len("/avatar/") + len(hash) + len("?d=") + len(def) + len("&f=y") + len("&r=") + len(rating) + len("&s=") + len(size))
+	b.WriteString(base)
+	b.WriteString("/avatar/")
+	b.WriteString(hash)
+	// parameters sorted by key, as url.Values.Encode would do
+	sep := byte('?')
+	if def != "" {
+		b.WriteByte(sep)
+		b.WriteString("d=")
+		b.WriteString(def)
+		sep = '&'
 	}
-	if v.size > 0 {
-		values.Add("s", fmt.Sprintf("%d", v.size))
+	if p.force {
+		b.WriteByte(sep)
+		b.WriteString("f=y")
+		sep = '&'
 	}
+	if rating != "" {
+		b.WriteByte(sep)
+		b.WriteString("r=")
+		b.WriteString(rating)
+		sep = '&'
+	}
+	if size != "" {
+		b.WriteByte(sep)
+		b.WriteString("s=")
+		b.WriteString(size)
+	}
+	if p.extra != "" {
+		return withExtra(b.String(), p.extra)
+	}
+	return b.String()
+}
 
-	if len(values) > 0 {
-		return fmt.Sprintf("%s?%s", res, values.Encode()), nil
+// fallbackBaseURL returns the URL of the fallback host, over https if
+// secure is set
+func (v *Libravatar) fallbackBaseURL(secure bool) string {
+	if secure {
+		return "https://" + v.fallbackHost(true)
 	}
-	return res, nil
+	return "http://" + v.fallbackHost(false)
 }
 
 // Finds or defaults a URL for Federation (for openid to be used, email has to be nil)
-func (v *Libravatar) baseURL(email *mail.Address, openid *url.URL) (string, error) {
-	var service, protocol, domain string
+func (v *Libravatar) baseURL(ctx context.Context, email *mail.Address, openid *url.URL) (string, error) {
+	domain, err := v.getDomain(email, openid)
+	if err != nil {
+		return "", err
+	}
+	return v.hostBaseURL(ctx, domain, v.useHTTPS)
+}
 
-	if v.useHTTPS {
-		protocol = "https://"
-		service = v.secureServiceBase
-		domain = v.secureFallbackHost
+// hostBaseURL finds or defaults the URL serving avatars for host,
+// over https if secure is set
+func (v *Libravatar) hostBaseURL(ctx context.Context, host string, secure bool) (string, error) {
+	protocol, target, _, err := v.hostTarget(ctx, host, secure)
+	if err != nil {
+		return "", err
+	}
+	return protocol + target, nil
+}
+
+// hostTarget finds or defaults the protocol and the host[:port]
+// serving avatars for host, over https if secure is set, and tells
+// whether it was found through federation
+func (v *Libravatar) hostTarget(ctx context.Context, host string, secure bool) (protocol, target string, federated bool, err error) {
+	var defaultPort uint16
 
+	if secure {
+		protocol = "https://"
+		target = v.fallbackHost(true)
+		defaultPort = 443
 	} else {
 		protocol = "http://"
-		service = v.serviceBase
-		domain = v.fallbackHost
+		target = v.fallbackHost(false)
+		defaultPort = 80
+	}
+
+	if v.relativeURLs {
+		noteDecision(ctx, false, "relative URLs")
+		return "", "", false, nil
+	}
+
+	if v.gravatarMode {
+		noteDecision(ctx, false, "Gravatar mode")
+		if secure {
+			return protocol, gravatarSecureHost, false, nil
+		}
+		return protocol, gravatarHost, false, nil
+	}
+
+	if override, ok := v.domainOverride(host); ok {
+		noteDecision(ctx, false, "domain override")
+		return protocol, override, false, nil
+	}
+
+	if !v.lookupNeeded(host) {
+		noteDecision(ctx, true, FallbackSkipped)
+		return protocol, target, false, nil
+	}
+
+	rr, err := v.serviceTarget(ctx, host, secure)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if rr != nil {
+		return protocol, srvHost(rr, defaultPort), true, nil
+	}
+	return protocol, target, false, nil
+}
+
+// srvTarget returns the SRV record to be used for host according to
+// the configured protocol, or nil if the fallback host should be used
+func (v *Libravatar) srvTarget(ctx context.Context, host string) (*net.SRV, error) {
+	return v.serviceTarget(ctx, host, v.useHTTPS)
+}
+
+// serviceTarget is like srvTarget, for https if secure is set
+func (v *Libravatar) serviceTarget(ctx context.Context, host string, secure bool) (*net.SRV, error) {
+	if m, ok := ctx.Value(domainMemoCtxKey{}).(*domainMemo); ok {
+		return m.target(ctx, host, secure, v.findServiceTarget)
+	}
+	return v.findServiceTarget(ctx, host, secure)
+}
+
+// findServiceTarget implements serviceTarget
+func (v *Libravatar) findServiceTarget(ctx context.Context, host string, secure bool) (*net.SRV, error) {
+	service := v.serviceBase
+	if secure {
+		service = v.secureServiceBase
 	}
 
-	host := v.getDomain(email, openid)
+	rr, err := v.lookup(ctx, service, host)
+	plainFallback := secure && v.secureFallbackToPlainSRV
+	if err != nil && !(plainFallback && errors.Is(err, ErrNoService)) {
+		return nil, err
+	}
+
+	if rr == nil && plainFallback {
+		rr, err = v.lookup(ctx, v.serviceBase, host)
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil && rr.Port == 80 {
+			// assume the server speaks TLS on the standard port
+			sec := *rr
+			sec.Port = 443
+			rr = &sec
+		}
+	}
+	return rr, nil
+}
+
+// lookup returns the SRV record to be used for service at host,
+// or nil if there is none or it could not be found and the
+// configured policies allow falling back
+func (v *Libravatar) lookup(ctx context.Context, service, host string) (*net.SRV, error) {
+	start := time.Now()
+	ctx, sp := v.startSpan(ctx, SpanLookup, "domain", host, "service", service)
+	res := v.cachedLookup(ctx, service, host)
+	if v.requireService && !res.fatal && res.target == nil && res.reason == FallbackNoRecords {
+		res.fatal = true
+		if res.dnsErr == nil {
+			res.dnsErr = ErrNoService
+		}
+	}
+	noteLookup(ctx, service, res)
+	sp.set("cache_hit", strconv.FormatBool(res.cacheHit))
+	outcome := OutcomeFallback
+	if res.fatal {
+		outcome = OutcomeError
+	} else if res.target != nil {
+		outcome = OutcomeFederated
+	}
+	v.metrics.ObserveLookup(host, res.cacheHit, outcome.String(), time.Since(start))
+	if v.lookupHook != nil {
+		v.emitLookup(LookupEvent{
+			Domain:   host,
+			Service:  service,
+			CacheHit: res.cacheHit,
+			Outcome:  outcome,
+			Target:   res.target,
+			Err:      res.dnsErr,
+			ProbeErr: res.probeErr,
+			Duration: time.Since(start),
+		})
+	}
+	if res.fatal {
+		err := lookupError(service, host, res.dnsErr)
+		sp.finish(err)
+		return nil, err
+	}
+	sp.finish(nil)
+	return res.target, nil
+}
+
+// lookupResult is the outcome of cachedLookup
+type lookupResult struct {
+	target   *net.SRV   // nil if the fallback host should be used
+	reason   string     // why target was selected, or why there is none
+	records  []*net.SRV // the records of the SRV answer, nil on cache hits
+	cacheHit bool
+	dnsErr   error // the error met, if any
+	fatal    bool  // whether dnsErr should be returned to the caller
+	probeErr error // the error met probing the target, if any
+}
+
+// cachedLookup looks up service at host, through the cache
+func (v *Libravatar) cachedLookup(ctx context.Context, service, host string) lookupResult {
 	key := cacheKey{service, host}
-	now := time.Now()
-	val, found := v.nameCache[key]
-	if found && now.Sub(val.checkedAt) <= v.nameCacheDuration {
-		return protocol + val.target, nil
+	now := v.clock.Now()
+	val, found := v.getCache(key)
+	if found && now.Sub(val.checkedAt) <= val.ttl {
+		v.stats.cacheHits.Add(1)
+		if v.sharedCache != nil {
+			// the lookup may have been cached by another process
+			v.indexTarget(key, val)
+		}
+		return lookupResult{target: val.target, reason: val.reason, cacheHit: true}
 	}
 
-	_, addrs, err := net.LookupSRV(service, "tcp", host)
-	if err != nil && err.(*net.DNSError).IsTimeout {
-		return "", err
+	release, err := v.acquireLookup(ctx)
+	if err != nil {
+		return lookupResult{reason: FallbackTimeout, dnsErr: err, fatal: v.timeoutPolicy != TimeoutFallback}
+	}
+	v.stats.lookups.Add(1)
+	addrs, ttl, err := v.querySRV(ctx, service, host)
+	release()
+	if err != nil && !isNotFound(err) {
+		timeout := isTimeout(err)
+		if timeout {
+			v.stats.timeouts.Add(1)
+			v.metrics.IncError(ErrorKindDNSTimeout)
+		} else {
+			v.stats.dnsErrors.Add(1)
+			v.metrics.IncError(ErrorKindDNS)
+		}
+		reason := FallbackDNSError
+		if timeout {
+			reason = FallbackTimeout
+		}
+		if timeout && v.timeoutPolicy != TimeoutFallback ||
+			!timeout && v.dnsErrorPolicy == DNSErrorFail {
+			return lookupResult{reason: reason, records: addrs, dnsErr: err, fatal: true}
+		}
+		v.setCache(key, cacheValue{checkedAt: now, reason: reason, ttl: v.failureCacheDuration})
+		return lookupResult{reason: reason, records: addrs, dnsErr: err}
 	}
 
-	if len(addrs) == 1 {
-		// select only record, if only one is available
-		domain = strings.TrimSuffix(addrs[0].Target, ".")
-	} else if len(addrs) > 1 {
-		// Select first record according to RFC2782 weight
-		// ordering algorithm (page 3)
-
-		type record struct {
-			srv    *net.SRV
-			weight uint16
+	var target *net.SRV
+	var backups []*net.SRV
+	reason := FallbackNoRecords
+	if valid := validSRVRecords(addrs); len(valid) > 0 {
+		target = v.selectSRV(valid)
+		backups = lowerPriority(valid, target.Priority)
+		reason = selectionReason(valid, target)
+	} else if len(addrs) > 0 {
+		reason = FallbackInvalidRecords
+	}
+
+	var probeErr error
+	if target != nil && v.verifyResolves {
+		if probeErr = v.resolveTarget(ctx, target); probeErr != nil {
+			target, backups, reason = nil, nil, FallbackUnreachable
+		}
+	}
+	if target != nil && v.verifyTarget {
+		if probeErr = v.probeTarget(ctx, target); probeErr != nil {
+			target, backups, reason = nil, nil, FallbackUnreachable
 		}
+	}
 
-		var (
-			totalWeight uint16
-			records     []record
-			topPriority = addrs[0].Priority
-			topRecord   *net.SRV
-		)
-
-		for _, rr := range addrs {
-			if rr.Priority > topPriority {
-				continue
-			} else if rr.Priority < topPriority {
-				// won't happen, because net sorts
-				// by priority, but just in case
-				totalWeight = 0
-				records = nil
-				topPriority = rr.Priority
-			}
+	val = cacheValue{checkedAt: now, target: target, backups: backups, reason: reason, ttl: v.cacheTTL(ttl)}
+	if reason == FallbackNoRecords && v.negativeCacheDuration != 0 {
+		val.ttl = v.negativeCacheDuration
+	}
+	v.setCache(key, val)
+	return lookupResult{target: target, reason: reason, records: addrs, probeErr: probeErr}
+}
+
+// selectSRV picks a record out of the non-empty addrs, according to
+// the RFC2782 weight ordering algorithm (page 3)
+func (v *Libravatar) selectSRV(addrs []*net.SRV) *net.SRV {
+	if len(addrs) == 1 {
+		// select only record, if only one is available
+		return addrs[0]
+	}
 
-			totalWeight += rr.Weight
+	var (
+		totalWeight int
+		records     []*net.SRV
+		topPriority = addrs[0].Priority
+	)
 
-			if rr.Weight > 0 {
-				records = append(records, record{rr, totalWeight})
-			} else if rr.Weight == 0 {
-				records = append([]record{record{srv: rr, weight: totalWeight}}, records...)
-			}
+	for _, rr := range addrs {
+		if rr.Priority > topPriority {
+			continue
+		} else if rr.Priority < topPriority {
+			// won't happen, because net sorts
+			// by priority, but just in case
+			totalWeight = 0
+			records = nil
+			topPriority = rr.Priority
 		}
 
-		if len(records) == 1 {
-			topRecord = records[0].srv
+		totalWeight += int(rr.Weight)
+
+		// records with weight 0 go first
+		if rr.Weight > 0 {
+			records = append(records, rr)
 		} else {
-			randnum := uint16(rand.Intn(int(totalWeight)))
+			records = append([]*net.SRV{rr}, records...)
+		}
+	}
 
-			for _, rr := range records {
-				if rr.weight >= randnum {
-					topRecord = rr.srv
-					break
-				}
-			}
+	if len(records) == 1 {
+		return records[0]
+	}
+
+	// pick the first record whose running sum of weights is
+	// greater than or equal to a random number in [0, totalWeight]
+	v.randMu.Lock()
+	randnum := v.rand.Intn(totalWeight + 1)
+	v.randMu.Unlock()
+
+	sum := 0
+	for _, rr := range records {
+		sum += int(rr.Weight)
+		if sum >= randnum {
+			return rr
 		}
+	}
+	// not reachable, as the last running sum is totalWeight
+	return records[len(records)-1]
+}
+
+// isTimeout tells whether err is a DNS timeout
+func isTimeout(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsTimeout
+}
+
+// isNotFound tells whether err means the SRV record does not exist
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
 
-		domain = fmt.Sprintf("%s:%d", topRecord.Target, topRecord.Port)
+// srvHost returns the URL host (with port, unless it is defaultPort)
+// pointed to by an SRV record
+func srvHost(rr *net.SRV, defaultPort uint16) string {
+	host := strings.TrimSuffix(rr.Target, ".")
+	if rr.Port != defaultPort {
+		return net.JoinHostPort(host, strconv.Itoa(int(rr.Port)))
 	}
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		return "[" + host + "]"
+	}
+	return host
+}
 
-	v.nameCache[key] = cacheValue{checkedAt: now, target: domain}
-	return protocol + domain, nil
+// validSRVRecords returns the records of addrs which are safe to be
+// used for building an URL, in the same order.
+// Records with an invalid port or target are skipped.
+func validSRVRecords(addrs []*net.SRV) []*net.SRV {
+	var valid []*net.SRV
+	for _, rr := range addrs {
+		if validSRVTarget(rr.Target, int(rr.Port)) {
+			valid = append(valid, rr)
+		}
+	}
+	return valid
+}
+
+// validSRVTarget checks that target is a syntactically valid hostname
+// (as returned by DNS, possibly with a trailing dot) or IP address and
+// port is within the 1-65535 range.
+func validSRVTarget(target string, port int) bool {
+	if port < 1 || port > 65535 {
+		return false
+	}
+	target = strings.TrimSuffix(target, ".")
+	if strings.Contains(target, ":") {
+		ip := net.ParseIP(target)
+		return ip != nil && ip.To4() == nil
+	}
+	if target == "" || len(target) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(target, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			case c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // FromEmail returns the url of the avatar for the given email
 func (v *Libravatar) FromEmail(email string) (string, error) {
-	addr, err := mail.ParseAddress(email)
+	return v.emailURL(context.Background(), email, v.params())
+}
+
+// FromEmailBoth returns both the http and the https url of the avatar
+// for the given email, regardless of SetUseHTTPS
+func (v *Libravatar) FromEmailBoth(email string) (insecure, secure string, err error) {
+	addr, err := parseEmail(email)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	ctx := context.Background()
+	host, err := v.getDomain(addr, nil)
+	if err != nil {
+		return "", "", err
+	}
+	plainBase, err := v.hostBaseURL(ctx, host, false)
+	if err != nil {
+		return "", "", err
 	}
+	secureBase, err := v.hostBaseURL(ctx, host, true)
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := v.hash(addr, nil)
+	if err != nil {
+		return "", "", err
+	}
+	p := v.withFavicon(v.params(), addr)
+	return buildURL(plainBase, hash, p), buildURL(secureBase, hash, p), nil
+}
 
-	link, err := v.process(addr, nil)
+// emailURL returns the url of the avatar for the given email
+func (v *Libravatar) emailURL(ctx context.Context, email string, p params) (string, error) {
+	r, err := v.emailResult(ctx, email, p)
 	if err != nil {
 		return "", err
 	}
+	return r.URL, nil
+}
 
-	return link, nil
+// emailResult resolves the avatar for the given email
+func (v *Libravatar) emailResult(ctx context.Context, email string, p params) (*Result, error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	c := v.urlCache
+	if c == nil {
+		return v.addressResult(ctx, email, addr, p)
+	}
+
+	key := urlKey{strings.ToLower(strings.TrimSpace(addr.Address)), p.defURL, p.size, p.rating, p.force, p.gravatarDefault, p.favicon, p.extra, p.secure}
+	if r, ok := c.get(key, v.urlDepsValid); ok {
+		r.Email = email
+		return &r, nil
+	}
+	host, err := v.getDomain(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	before, ok := v.urlDeps(host, p.secure)
+	r, err := v.addressResult(ctx, email, addr, p)
+	if err != nil {
+		return nil, err
+	}
+	// only cache links computed from SRV cache entries which did not
+	// change meanwhile
+	if after, _ := v.urlDeps(host, p.secure); ok && sameDeps(before, after) {
+		c.add(key, *r, after)
+	}
+	return r, nil
+}
+
+// addressResult resolves the avatar for addr, parsed from email
+func (v *Libravatar) addressResult(ctx context.Context, email string, addr *mail.Address, p params) (*Result, error) {
+	r, err := v.result(ctx, addr, nil, p)
+	if err != nil {
+		return nil, err
+	}
+	r.Email = email
+	return &r, nil
 }
 
 // FromEmail is the object-less call to DefaultLibravatar for an email adders
@@ -275,23 +993,39 @@ func FromEmail(email string) (string, error) {
 // FromURL returns the url of the avatar for the given url (typically
 // for OpenID)
 func (v *Libravatar) FromURL(openid string) (string, error) {
-	ourl, err := url.Parse(openid)
+	return v.openidURL(context.Background(), openid, v.params())
+}
+
+// FromEmailContext is like FromEmail, with ctx bounding the lookup
+func (v *Libravatar) FromEmailContext(ctx context.Context, email string) (string, error) {
+	return v.emailURL(ctx, email, v.params())
+}
+
+// FromURLContext is like FromURL, with ctx bounding the lookup
+func (v *Libravatar) FromURLContext(ctx context.Context, openid string) (string, error) {
+	return v.openidURL(ctx, openid, v.params())
+}
+
+// openidURL returns the url of the avatar for the given OpenID url
+func (v *Libravatar) openidURL(ctx context.Context, openid string, p params) (string, error) {
+	r, err := v.openidResult(ctx, openid, p)
 	if err != nil {
 		return "", err
 	}
+	return r.URL, nil
+}
 
-	if !ourl.IsAbs() {
-		return "", fmt.Errorf("Is not an absolute URL")
-	} else if ourl.Scheme != "http" && ourl.Scheme != "https" {
-		return "", fmt.Errorf("Invalid protocol: %s", ourl.Scheme)
+// openidResult resolves the avatar for the given OpenID url
+func (v *Libravatar) openidResult(ctx context.Context, openid string, p params) (*Result, error) {
+	ourl, err := parseOpenID(openid)
+	if err != nil {
+		return nil, err
 	}
-
-	link, err := v.process(nil, ourl)
+	r, err := v.result(ctx, nil, ourl, p)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	return link, nil
+	return &r, nil
 }
 
 // FromURL is the object-less call to DefaultLibravatar for a URL
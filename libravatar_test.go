@@ -4,7 +4,18 @@
 
 package libravatar
 
-import "testing"
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base32"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestFromEmail(t *testing.T) {
 
@@ -16,9 +27,9 @@ func TestFromEmail(t *testing.T) {
 		{"strk@kbt.io", "http://avatars.kbt.io/avatar/fe2a9e759730ee64c44bf8901bf4ccc3"},
 		{"strk@keybit.net", "http://cdn.libravatar.org/avatar/34bafd290f6f39380f5f87e0122daf83"},
 		{"strk@nonexistent.domain", "http://cdn.libravatar.org/avatar/3f30177111597990b15f8421eaf736c7"},
-		{"invalid", "mail: missing phrase"},
-		{"invalid@", "mail: no angle-addr"},
-		{"@invalid", "mail: missing word in phrase: mail: invalid string"},
+		{"invalid", `libravatar: invalid email "invalid": mail: missing phrase`},
+		{"invalid@", `libravatar: invalid email "invalid@": mail: no angle-addr`},
+		{"@invalid", `libravatar: invalid email "@invalid": mail: missing word in phrase: mail: invalid string`},
 	}
 
 	for _, c := range cases {
@@ -37,8 +48,8 @@ func TestFromEmail(t *testing.T) {
 
 	cases = []struct{ in, want string }{
 		{"https://strk.kbt.io/openid/", "http://cdn.libravatar.org/avatar/1eaf3174c95d0df02f177f7f6a1df5125ad3d6603fbd062defecd30810a0463c"},
-		{"invalid", "Is not an absolute URL"},
-		{"ssh://user@nothttp/", "Invalid protocol: ssh"},
+		{"invalid", `libravatar: invalid OpenID "invalid": not an absolute URL`},
+		{"ssh://user@nothttp/", `libravatar: invalid OpenID "ssh://user@nothttp/": invalid protocol ssh`},
 	}
 
 	for _, c := range cases {
@@ -54,3 +65,600 @@ func TestFromEmail(t *testing.T) {
 	// TODO: test parameters
 
 }
+
+// srvResponder returns a lookup function always answering with addrs
+func srvResponder(addrs ...*net.SRV) func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", addrs, nil
+	}
+}
+
+func TestSRVValidation(t *testing.T) {
+
+	cases := []struct {
+		addrs []*net.SRV
+		want  string
+	}{
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 80}}, "http://avatars.example.org/avatar/"},
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 0}}, "http://cdn.libravatar.org/avatar/"},
+		{[]*net.SRV{{Target: "evil.org/path.", Port: 80}}, "http://cdn.libravatar.org/avatar/"},
+		{[]*net.SRV{{Target: "evil org.", Port: 80}}, "http://cdn.libravatar.org/avatar/"},
+		{[]*net.SRV{{Target: "evil\x00.org.", Port: 80}}, "http://cdn.libravatar.org/avatar/"},
+		{[]*net.SRV{
+			{Target: "evil.org/path.", Port: 8080, Priority: 10, Weight: 10},
+			{Target: "avatars.example.org.", Port: 0, Priority: 10, Weight: 10},
+			{Target: "good.example.org.", Port: 8080, Priority: 10, Weight: 10},
+		}, "http://good.example.org:8080/avatar/"},
+	}
+
+	for _, c := range cases {
+		avt := New()
+		avt.lookupSRV = srvResponder(c.addrs...)
+		got, err := avt.FromEmail("user@example.org")
+		if err != nil {
+			t.Errorf("FromEmail with %v: unexpected error %v", c.addrs, err)
+			continue
+		}
+		if !strings.HasPrefix(got, c.want) {
+			t.Errorf("FromEmail with %v == %q, expected prefix %q", c.addrs, got, c.want)
+		}
+	}
+
+	targets := []struct {
+		target string
+		port   int
+		want   bool
+	}{
+		{"avatars.example.org.", 80, true},
+		{"avatars.example.org", 65535, true},
+		{"avatars.example.org.", 0, false},
+		{"avatars.example.org.", 70000, false},
+		{"avatars.example.org/x.", 80, false},
+		{"", 80, false},
+		{".", 80, false},
+		{"a..b", 80, false},
+		{"-a.b", 80, false},
+		{strings.Repeat("a", 64) + ".org", 80, false},
+		{strings.Repeat("a.", 127) + "org", 80, false},
+	}
+
+	for _, c := range targets {
+		if got := validSRVTarget(c.target, c.port); got != c.want {
+			t.Errorf("validSRVTarget(%q, %d) == %v, expected %v", c.target, c.port, got, c.want)
+		}
+	}
+}
+
+func TestDisableSRV(t *testing.T) {
+
+	lookups := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+	avt.SetDisableSRV(true)
+
+	cases := []struct {
+		https bool
+		want  string
+	}{
+		{false, "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"},
+		{true, "https://seccdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"},
+	}
+
+	for _, c := range cases {
+		avt.SetUseHTTPS(c.https)
+		got, err := avt.FromEmail("user@example.org")
+		if err != nil {
+			t.Fatalf("FromEmail: unexpected error %v", err)
+		}
+		if got != c.want {
+			t.Errorf("FromEmail (https=%v) == %q, expected %q", c.https, got, c.want)
+		}
+	}
+
+	if lookups != 0 {
+		t.Errorf("%d SRV lookups performed, expected none", lookups)
+	}
+	if avt.nameCache.len() != 0 {
+		t.Errorf("%d cache entries created, expected none", avt.nameCache.len())
+	}
+}
+
+func TestTimeoutPolicy(t *testing.T) {
+
+	lookups := 0
+	timeout := func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+
+	avt := New()
+	avt.lookupSRV = timeout
+	if _, err := avt.FromEmail("user@example.org"); err == nil {
+		t.Errorf("FromEmail with TimeoutError policy: expected an error")
+	}
+
+	avt = New()
+	avt.lookupSRV = timeout
+	avt.SetTimeoutPolicy(TimeoutFallback)
+	lookups = 0
+	want := "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"
+	for i := 0; i < 2; i++ {
+		got, err := avt.FromEmail("user@example.org")
+		if err != nil {
+			t.Fatalf("FromEmail with TimeoutFallback policy: unexpected error %v", err)
+		}
+		if got != want {
+			t.Errorf("FromEmail with TimeoutFallback policy == %q, expected %q", got, want)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("%d SRV lookups performed, expected the timeout to be cached", lookups)
+	}
+
+	// the timeout is only remembered for a short while
+	key := cacheKey{"avatars", "example.org"}
+	val, _ := avt.nameCache.get(key)
+	val.checkedAt = val.checkedAt.Add(-2 * avt.failureCacheDuration)
+	avt.nameCache.set(key, val)
+	avt.FromEmail("user@example.org")
+	if lookups != 2 {
+		t.Errorf("%d SRV lookups performed, expected the cached timeout to expire", lookups)
+	}
+}
+
+func TestDNSErrorPolicy(t *testing.T) {
+
+	servfail := func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	nxdomain := func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	want := "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"
+
+	cases := []struct {
+		lookup    func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+		policy    DNSErrorPolicy
+		fail      bool
+		dnsErrors uint64
+	}{
+		{servfail, DNSErrorFallback, false, 1},
+		{servfail, DNSErrorFail, true, 1},
+		{nxdomain, DNSErrorFallback, false, 0},
+		{nxdomain, DNSErrorFail, false, 0},
+	}
+
+	for i, c := range cases {
+		avt := New()
+		avt.lookupSRV = c.lookup
+		avt.SetDNSErrorPolicy(c.policy)
+		got, err := avt.FromEmail("user@example.org")
+		if c.fail {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got %q", i, got)
+			}
+		} else if err != nil {
+			t.Errorf("case %d: unexpected error %v", i, err)
+		} else if got != want {
+			t.Errorf("case %d: FromEmail == %q, expected %q", i, got, want)
+		}
+		st := avt.Stats()
+		if st.DNSErrors != c.dnsErrors || st.Lookups != 1 || st.Timeouts != 0 {
+			t.Errorf("case %d: Stats() == %+v, expected %d DNS errors out of 1 lookup", i, st, c.dnsErrors)
+		}
+	}
+}
+
+func TestSRVHostPort(t *testing.T) {
+
+	cases := []struct {
+		addrs    []*net.SRV
+		https    bool
+		wantHost string
+	}{
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 80}}, false, "avatars.example.org"},
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 8080}}, false, "avatars.example.org:8080"},
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 443}}, true, "avatars.example.org"},
+		{[]*net.SRV{{Target: "avatars.example.org.", Port: 80}}, true, "avatars.example.org:80"},
+		{[]*net.SRV{{Target: "fe80::1", Port: 5070}}, false, "[fe80::1]:5070"},
+		{[]*net.SRV{{Target: "fe80::1", Port: 80}}, false, "[fe80::1]"},
+		{[]*net.SRV{{Target: "2001:db8::2.", Port: 443}}, true, "[2001:db8::2]"},
+		{[]*net.SRV{
+			{Target: "fe80::1", Port: 5070, Priority: 10, Weight: 0},
+			{Target: "fe80::1", Port: 5070, Priority: 20, Weight: 0},
+		}, false, "[fe80::1]:5070"},
+	}
+
+	for _, c := range cases {
+		avt := New()
+		avt.lookupSRV = srvResponder(c.addrs...)
+		avt.SetUseHTTPS(c.https)
+		got, err := avt.FromEmail("user@example.org")
+		if err != nil {
+			t.Errorf("FromEmail with %v: unexpected error %v", c.addrs, err)
+			continue
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Errorf("FromEmail with %v == %q, which does not parse: %v", c.addrs, got, err)
+			continue
+		}
+		if u.Host != c.wantHost {
+			t.Errorf("FromEmail with %v has host %q, expected %q", c.addrs, u.Host, c.wantHost)
+		}
+	}
+}
+
+// fixedSource is a rand.Source making Intn(n) return the source value
+// for any n greater than it
+type fixedSource int64
+
+func (s fixedSource) Int63() int64 { return int64(s) << 32 }
+func (s fixedSource) Seed(int64)   {}
+
+func TestSelectSRV(t *testing.T) {
+
+	addrs := []*net.SRV{
+		{Target: "b.example.org.", Port: 80, Priority: 10, Weight: 10},
+		{Target: "a.example.org.", Port: 80, Priority: 10, Weight: 0},
+		{Target: "c.example.org.", Port: 80, Priority: 10, Weight: 20},
+		{Target: "d.example.org.", Port: 80, Priority: 20, Weight: 100},
+	}
+
+	cases := []struct {
+		random int64
+		want   string
+	}{
+		{0, "a.example.org."},
+		{1, "b.example.org."},
+		{10, "b.example.org."},
+		{11, "c.example.org."},
+		{30, "c.example.org."},
+	}
+
+	for _, c := range cases {
+		avt := New()
+		avt.SetRandSource(fixedSource(c.random))
+		if got := avt.selectSRV(addrs).Target; got != c.want {
+			t.Errorf("selectSRV with random %d == %q, expected %q", c.random, got, c.want)
+		}
+	}
+
+	// same seed, same choices
+	avt1, avt2 := New(), New()
+	avt1.SetRandSource(rand.NewSource(42))
+	avt2.SetRandSource(rand.NewSource(42))
+	for i := 0; i < 20; i++ {
+		got1, got2 := avt1.selectSRV(addrs), avt2.selectSRV(addrs)
+		if got1 != got2 {
+			t.Fatalf("selection %d differs with the same seed: %q vs %q", i, got1.Target, got2.Target)
+		}
+	}
+
+	// nil restores the default source
+	avt1.SetRandSource(nil)
+	if got := avt1.selectSRV(addrs); got == nil {
+		t.Errorf("selectSRV after SetRandSource(nil) == nil")
+	}
+}
+
+func TestSecureFallbackToPlainSRV(t *testing.T) {
+
+	records := map[string][]*net.SRV{
+		"avatars":     {{Target: "plain.example.org.", Port: 80}},
+		"avatars-sec": {{Target: "secure.example.org.", Port: 443}},
+	}
+
+	cases := []struct {
+		plain, secure bool
+		want          string
+	}{
+		{true, true, "https://secure.example.org/avatar/"},
+		{false, true, "https://secure.example.org/avatar/"},
+		{true, false, "https://plain.example.org/avatar/"},
+		{false, false, "https://seccdn.libravatar.org/avatar/"},
+	}
+
+	for _, c := range cases {
+		queries := make(map[string]int)
+		avt := New()
+		avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			queries[service]++
+			if service == "avatars" && c.plain || service == "avatars-sec" && c.secure {
+				return "", records[service], nil
+			}
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		avt.SetUseHTTPS(true)
+		avt.SetSecureFallbackToPlainSRV(true)
+
+		for i := 0; i < 2; i++ {
+			got, err := avt.FromEmail("user@example.org")
+			if err != nil {
+				t.Fatalf("FromEmail (plain=%v, secure=%v): unexpected error %v", c.plain, c.secure, err)
+			}
+			if !strings.HasPrefix(got, c.want) {
+				t.Errorf("FromEmail (plain=%v, secure=%v) == %q, expected prefix %q", c.plain, c.secure, got, c.want)
+			}
+		}
+
+		wantPlain := 1
+		if c.secure {
+			wantPlain = 0
+		}
+		if queries["avatars-sec"] != 1 || queries["avatars"] != wantPlain {
+			t.Errorf("(plain=%v, secure=%v): queries %v, expected both lookups to be cached", c.plain, c.secure, queries)
+		}
+	}
+
+	// non standard ports are kept
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service == "avatars" {
+			return "", []*net.SRV{{Target: "plain.example.org.", Port: 8443}}, nil
+		}
+		return "", nil, nil
+	}
+	avt.SetUseHTTPS(true)
+	avt.SetSecureFallbackToPlainSRV(true)
+	got, _ := avt.FromEmail("user@example.org")
+	if want := "https://plain.example.org:8443/avatar/"; !strings.HasPrefix(got, want) {
+		t.Errorf("FromEmail with plain record on port 8443 == %q, expected prefix %q", got, want)
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+
+	for _, def := range []string{"", HTTP404, "https://example.org/a b.png?x=1&y=ü"} {
+		for _, size := range []uint{0, 1, 512} {
+			for _, rating := range []string{"", RatingPG} {
+				for _, force := range []bool{false, true} {
+					values := make(url.Values)
+					if def != "" {
+						values.Add("d", def)
+					}
+					if force {
+						values.Add("f", "y")
+					}
+					if rating != "" {
+						values.Add("r", rating)
+					}
+					if size > 0 {
+						values.Add("s", strconv.FormatUint(uint64(size), 10))
+					}
+					want := "http://example.org/avatar/hash"
+					if len(values) > 0 {
+						want += "?" + values.Encode()
+					}
+					p := params{defURL: def, size: size, rating: rating, force: force}
+					if got := buildURL("http://example.org", "hash", p); got != want {
+						t.Errorf("buildURL with %+v == %q, expected %q", p, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestForceDefault(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	const link = "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"
+
+	avt.SetForceDefault(true)
+	cases := []struct {
+		defURL string
+		size   uint
+		want   string
+	}{
+		{"", 0, link + "?f=y"},
+		{IdentIcon, 0, link + "?d=identicon&f=y"},
+		{"", 64, link + "?f=y&s=64"},
+		{"https://example.org/default.png", 64, link + "?d=https%3A%2F%2Fexample.org%2Fdefault.png&f=y&s=64"},
+	}
+	for _, c := range cases {
+		avt.SetDefaultImage(c.defURL)
+		avt.SetAvatarSize(c.size)
+		if got, err := avt.FromEmail("user@example.org"); err != nil || got != c.want {
+			t.Errorf("FromEmail with d=%q s=%d == %s, %v, expected %s", c.defURL, c.size, got, err, c.want)
+		}
+	}
+
+	avt.SetForceDefault(false)
+	if got, _ := avt.FromEmail("user@example.org"); got != link+"?d=https%3A%2F%2Fexample.org%2Fdefault.png&s=64" {
+		t.Errorf("FromEmail without forcing the default == %s", got)
+	}
+}
+
+func BenchmarkFromEmail(b *testing.B) {
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.SetDefaultImage("https://example.org/default.png")
+	avt.SetAvatarSize(64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := avt.FromEmail("user@example.org"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFromURL(b *testing.B) {
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := avt.FromURL("https://openid.example.org/user"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFromEmailBoth(t *testing.T) {
+
+	records := map[string]*net.SRV{
+		"avatars/both.example.org":     {Target: "plain.both.example.org.", Port: 80},
+		"avatars-sec/both.example.org": {Target: "secure.both.example.org.", Port: 443},
+		"avatars/plain.example.org":    {Target: "avatars.plain.example.org.", Port: 8080},
+		"avatars-sec/sec.example.org":  {Target: "avatars.sec.example.org.", Port: 443},
+	}
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups[service+"/"+name]++
+		if rr, ok := records[service+"/"+name]; ok {
+			return "", []*net.SRV{rr}, nil
+		}
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	cases := []struct {
+		domain, insecure, secure string
+	}{
+		{"both.example.org", "http://plain.both.example.org", "https://secure.both.example.org"},
+		{"plain.example.org", "http://avatars.plain.example.org:8080", "https://seccdn.libravatar.org"},
+		{"sec.example.org", "http://cdn.libravatar.org", "https://avatars.sec.example.org"},
+		{"none.example.org", "http://cdn.libravatar.org", "https://seccdn.libravatar.org"},
+	}
+	for _, c := range cases {
+		email := "user@" + c.domain
+		hash := "/avatar/" + hashOf(email)
+		for i := 0; i < 2; i++ {
+			insecure, secure, err := avt.FromEmailBoth(email)
+			if err != nil {
+				t.Errorf("FromEmailBoth(%s): unexpected error %v", email, err)
+				continue
+			}
+			if insecure != c.insecure+hash || secure != c.secure+hash {
+				t.Errorf("FromEmailBoth(%s) == %s, %s, expected %s, %s", email, insecure, secure, c.insecure+hash, c.secure+hash)
+			}
+		}
+		for _, service := range []string{"avatars/", "avatars-sec/"} {
+			if n := lookups[service+c.domain]; n != 1 {
+				t.Errorf("%d lookups of %s%s, expected 1", n, service, c.domain)
+			}
+		}
+	}
+	if avt.useHTTPS {
+		t.Errorf("FromEmailBoth changed the protocol setting")
+	}
+}
+
+func TestDefaultImageKeywords(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	const link = "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"
+
+	for _, k := range []string{HTTP404, MysteryMan, IdentIcon, MonsterID, Wavatar, Retro, RoboHash, Pagan, Blank} {
+		if err := avt.SetDefaultImage(k); err != nil {
+			t.Errorf("SetDefaultImage(%q): unexpected error %v", k, err)
+			continue
+		}
+		if got, _ := avt.FromEmail("user@example.org"); got != link+"?d="+k {
+			t.Errorf("FromEmail with default %q == %s", k, got)
+		}
+	}
+
+	err := avt.SetDefaultImage("unicorn")
+	if err == nil || !strings.Contains(err.Error(), "robohash") {
+		t.Errorf("SetDefaultImage with unknown keyword: unexpected error %v", err)
+	}
+	if avt.defURL != Blank {
+		t.Errorf("SetDefaultImage with unknown keyword changed the default to %q", avt.defURL)
+	}
+	if err := avt.SetDefaultImage("ftp://example.org/default.png"); err == nil {
+		t.Errorf("SetDefaultImage with ftp URL: expected an error")
+	}
+
+	avt.SetGravatarMode(true)
+	if err := avt.SetDefaultImage(Pagan); err == nil {
+		t.Errorf("SetDefaultImage(%q) in Gravatar mode: expected an error", Pagan)
+	}
+	if err := avt.SetDefaultImage(Blank); err != nil {
+		t.Errorf("SetDefaultImage(%q) in Gravatar mode: unexpected error %v", Blank, err)
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+
+	type call struct {
+		input    string
+		isOpenID bool
+	}
+	var calls []call
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.SetHashFunc(func(input string, isOpenID bool) string {
+		calls = append(calls, call{input, isOpenID})
+		sum := sha512.Sum512([]byte(input))
+		return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:]))[:20]
+	})
+
+	link, err := avt.FromEmail(" User@Example.org ")
+	if want := "http://avatars.example.org/avatar/3ofx2xvprnto75lzwzk7"; err != nil || link != want {
+		t.Errorf("FromEmail == %s, %v, expected %s", link, err, want)
+	}
+	link, err = avt.FromURL("https://OpenID.example.org/user")
+	if want := "http://avatars.example.org/avatar/u6pitod4w5jtv6ybbael"; err != nil || link != want {
+		t.Errorf("FromURL == %s, %v, expected %s", link, err, want)
+	}
+	r, err := avt.Lookup("user@example.org")
+	if err != nil || r.Hash != "3ofx2xvprnto75lzwzk7" || r.HashAlgorithm != HashCustom {
+		t.Errorf("Lookup == %+v, %v, expected the custom hash", r, err)
+	}
+
+	want := []call{
+		{"user@example.org", false},
+		{"https://openid.example.org/user", true},
+		{"user@example.org", false},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("hash function called %d times, expected %d", len(calls), len(want))
+	}
+	for i, c := range want {
+		if calls[i] != c {
+			t.Errorf("call %d: %+v, expected %+v", i, calls[i], c)
+		}
+	}
+
+	avt.SetHashFunc(nil)
+	if link, _ := avt.FromEmail("user@example.org"); link != "http://avatars.example.org/avatar/"+hashOf("user@example.org") {
+		t.Errorf("FromEmail without hash function == %s, expected the MD5 hash", link)
+	}
+}
+
+func TestEmailHash(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	if err := avt.SetEmailHash(HashSHA256); err != nil {
+		t.Fatal(err)
+	}
+	sha := "d159ef624ed86697b4f1f3ff086aacddfdfd42d463a8003694f775e1e2d95e2c"
+	if link, err := avt.FromEmail(" User@Example.ORG "); err != nil || link != "http://avatars.example.org/avatar/"+sha {
+		t.Errorf("FromEmail with SHA-256 == %s, %v", link, err)
+	}
+	r, err := avt.Lookup("user@example.org")
+	if err != nil || r.Hash != sha || r.HashAlgorithm != HashSHA256 {
+		t.Errorf("Lookup with SHA-256 == %+v, %v", r, err)
+	}
+	plain := New()
+	plain.lookupSRV = avt.lookupSRV
+	want, _ := plain.FromURL("https://openid.example.org/user")
+	if link, _ := avt.FromURL("https://openid.example.org/user"); link != want {
+		t.Errorf("FromURL with SHA-256 emails == %s, expected it unchanged", link)
+	}
+
+	if err := avt.SetEmailHash("sha1"); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("SetEmailHash(sha1) == %v, expected ErrInvalidConfig", err)
+	}
+	avt.SetEmailHash(HashMD5)
+	if r, _ := avt.Lookup("user@example.org"); r.Hash != hashOf("user@example.org") || r.HashAlgorithm != HashMD5 {
+		t.Errorf("Lookup with MD5 == %+v", r)
+	}
+}
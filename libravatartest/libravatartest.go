@@ -0,0 +1,211 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package libravatartest provides a fake avatar server, and the SRV
+// lookups pointing at it, for testing code using libravatar.
+package libravatartest // import "strk.kbt.io/projects/go/libravatar/libravatartest"
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"strk.kbt.io/projects/go/libravatar"
+)
+
+// defaultSize is the size of images when none is requested
+const defaultSize = 80
+
+// Failure is a failure scripted with FailDomain or FailHash
+type Failure int
+
+const (
+	// Timeout makes SRV lookups for a domain time out, or the server
+	// never answer requests for a hash
+	Timeout Failure = iota + 1
+	// ServerError makes SRV lookups for a domain fail, or the server
+	// answer 500 Internal Server Error for a hash
+	ServerError
+	// NotFound makes SRV lookups for a domain find no record, or the
+	// server answer 404 Not Found for a hash
+	NotFound
+)
+
+// Option configures a Server
+type Option func(*Server)
+
+// Domains makes SRV lookups for the given email domains point at the
+// server. Other domains have no SRV record, so their avatars are
+// served by the fallback host, which is the server too.
+func Domains(domains ...string) Option {
+	return func(s *Server) {
+		for _, d := range domains {
+			s.domains[strings.ToLower(d)] = true
+		}
+	}
+}
+
+// FailDomain makes SRV lookups for domain fail with f
+func FailDomain(domain string, f Failure) Option {
+	return func(s *Server) {
+		s.failDomains[strings.ToLower(domain)] = f
+	}
+}
+
+// FailHash makes requests for the avatar with the given hash fail
+// with f
+func FailHash(hash string, f Failure) Option {
+	return func(s *Server) {
+		s.failHashes[strings.ToLower(hash)] = f
+	}
+}
+
+// Server is a fake avatar server, serving for every hash a PNG image
+// of the requested size, filled with a color derived from the hash
+type Server struct {
+	*httptest.Server
+
+	domains     map[string]bool
+	failDomains map[string]Failure
+	failHashes  map[string]Failure
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// NewServer starts a Server, closed when the test ends
+func NewServer(t testing.TB, opts ...Option) *Server {
+	s := &Server{
+		domains:     make(map[string]bool),
+		failDomains: make(map[string]Failure),
+		failHashes:  make(map[string]Failure),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveAvatar))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Libravatar returns a Libravatar object using the server, both as
+// fallback host and as target of the SRV records of its domains
+func (s *Server) Libravatar() *libravatar.Libravatar {
+	avt := libravatar.New()
+	avt.SetTTLLookuper(s)
+	avt.SetFallbackHost(s.Listener.Addr().String())
+	avt.SetHTTPClient(s.Client())
+	return avt
+}
+
+var _ libravatar.TTLLookuper = (*Server)(nil)
+
+// LookupSRVTTL answers SRV lookups as scripted by the options of the
+// server, implementing libravatar.TTLLookuper
+func (s *Server) LookupSRVTTL(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch s.failDomains[name] {
+	case Timeout:
+		<-ctx.Done()
+		return nil, 0, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	case ServerError:
+		return nil, 0, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	case NotFound:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if !s.domains[name] || service != "avatars" {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	addr := s.Listener.Addr().(*net.TCPAddr)
+	return []*net.SRV{{Target: addr.IP.String(), Port: uint16(addr.Port)}}, 0, nil
+}
+
+// Requests returns the URIs requested to the server so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Image returns the image served for hash at the given size
+// (0 for the default size)
+func Image(hash string, size uint) []byte {
+	if size == 0 {
+		size = defaultSize
+	}
+	sum, _ := hex.DecodeString(hash)
+	sum = append(sum, 0, 0, 0)
+	img := image.NewNRGBA(image.Rect(0, 0, int(size), int(size)))
+	c := color.NRGBA{sum[0], sum[1], sum[2], 0xff}
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
+
+// Hash returns the hash of email, as used in avatar URLs
+func Hash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) serveAvatar(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	s.mu.Unlock()
+
+	hash, ok := strings.CutPrefix(r.URL.Path, "/avatar/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch s.failHashes[strings.ToLower(hash)] {
+	case Timeout:
+		<-r.Context().Done()
+		return
+	case ServerError:
+		http.Error(w, "scripted failure", http.StatusInternalServerError)
+		return
+	case NotFound:
+		s.serveDefault(w, r)
+		return
+	}
+
+	var size uint64 = defaultSize
+	if v := r.URL.Query().Get("s"); v != "" {
+		var err error
+		if size, err = strconv.ParseUint(v, 10, 16); err != nil || size == 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(Image(hash, uint(size)))
+}
+
+// serveDefault answers requests for avatars not found, according to
+// their d parameter
+func (s *Server) serveDefault(w http.ResponseWriter, r *http.Request) {
+	def := r.URL.Query().Get("d")
+	if u, err := url.Parse(def); err == nil && u.IsAbs() {
+		http.Redirect(w, r, def, http.StatusFound)
+		return
+	}
+	http.NotFound(w, r)
+}
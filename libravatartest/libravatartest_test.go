@@ -0,0 +1,73 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatartest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+
+	srv := NewServer(t,
+		Domains("example.org"),
+		FailDomain("slow.example.org", Timeout),
+		FailHash(Hash("gone@example.org"), NotFound),
+		FailHash(Hash("broken@example.org"), ServerError),
+	)
+	avt := srv.Libravatar()
+	avt.SetAvatarSize(32)
+	ctx := context.Background()
+
+	link, err := avt.FromEmail("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link, srv.URL+"/avatar/"+Hash("user@example.org")) {
+		t.Errorf("FromEmail == %s, expected the server", link)
+	}
+
+	a, err := avt.GetAvatar(ctx, "user@example.org")
+	if err != nil {
+		t.Fatalf("GetAvatar: unexpected error %v", err)
+	}
+	if !bytes.Equal(a.Data, Image(Hash("user@example.org"), 32)) {
+		t.Errorf("GetAvatar returned an unexpected image")
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(a.Data))
+	if err != nil || cfg.Width != 32 || cfg.Height != 32 {
+		t.Errorf("GetAvatar returned a %dx%d image (%v), expected 32x32", cfg.Width, cfg.Height, err)
+	}
+
+	// domains with no record are served by the fallback host
+	if _, err := avt.GetAvatar(ctx, "user@other.example.com"); err != nil {
+		t.Errorf("GetAvatar from the fallback host: unexpected error %v", err)
+	}
+
+	if ok, err := avt.Exists(ctx, "gone@example.org"); ok || err != nil {
+		t.Errorf("Exists(gone@example.org) == %v, %v, expected false", ok, err)
+	}
+	if _, err := avt.GetAvatar(ctx, "broken@example.org"); err == nil {
+		t.Errorf("GetAvatar(broken@example.org): expected an error")
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = avt.FromEmailContext(tctx, "user@slow.example.org")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Errorf("FromEmailContext(user@slow.example.org): unexpected error %v", err)
+	}
+
+	if n := len(srv.Requests()); n != 4 {
+		t.Errorf("server got %d requests, expected 4: %v", n, srv.Requests())
+	}
+}
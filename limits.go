@@ -0,0 +1,105 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLookupThrottled is returned when an SRV lookup could not be
+// started before the context was done, because of the limits set by
+// SetMaxConcurrentLookups or SetLookupRateLimit.
+// With the TimeoutFallback policy the fallback host is used instead.
+var ErrLookupThrottled = errors.New("libravatar: SRV lookup throttled")
+
+// SetMaxConcurrentLookups limits the number of SRV queries in flight
+// at any time (0, the default, for no limit)
+func (v *Libravatar) SetMaxConcurrentLookups(n int) {
+	if n <= 0 {
+		v.lookupSem = nil
+		return
+	}
+	v.lookupSem = make(chan struct{}, n)
+}
+
+// SetLookupRateLimit limits the number of SRV queries sent per second
+// (0, the default, for no limit)
+func (v *Libravatar) SetLookupRateLimit(perSecond float64) {
+	if perSecond <= 0 {
+		v.lookupRate = nil
+		return
+	}
+	v.lookupRate = newRateLimiter(perSecond)
+}
+
+// acquireLookup waits for the configured limits to allow an SRV query,
+// returning a function to be called once the query is done
+func (v *Libravatar) acquireLookup(ctx context.Context) (func(), error) {
+	if v.lookupRate != nil {
+		if err := v.lookupRate.wait(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLookupThrottled, err)
+		}
+	}
+	sem := v.lookupSem
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrLookupThrottled, ctx.Err())
+	}
+}
+
+// rateLimiter is a token bucket allowing a burst of at most one
+// second worth of events
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	burst := perSecond
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: perSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until a token is available or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentLookups(t *testing.T) {
+
+	var inFlight, maxInFlight atomic.Int32
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		n := inFlight.Add(1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		inFlight.Add(-1)
+		return "", nil, nil
+	}
+	avt.SetMaxConcurrentLookups(3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := avt.FromEmail(fmt.Sprintf("user@domain%d.example.org", i)); err != nil {
+				t.Errorf("FromEmail: unexpected error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if m := maxInFlight.Load(); m > 3 || m < 1 {
+		t.Errorf("%d lookups in flight at most, expected 1 to 3", m)
+	}
+
+	// a lookup which cannot start before the deadline
+	avt.lookupSem <- struct{}{}
+	avt.lookupSem <- struct{}{}
+	avt.lookupSem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := avt.lookup(ctx, "avatars", "blocked.example.org")
+	if !errors.Is(err, ErrLookupThrottled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked lookup returned %v, expected ErrLookupThrottled", err)
+	}
+
+	avt.SetTimeoutPolicy(TimeoutFallback)
+	rr, err := avt.lookup(ctx, "avatars", "blocked.example.org")
+	if rr != nil || err != nil {
+		t.Errorf("blocked lookup with TimeoutFallback returned %v, %v, expected fallback", rr, err)
+	}
+}
+
+func TestLookupRateLimit(t *testing.T) {
+
+	lookups := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return "", nil, nil
+	}
+	avt.SetLookupRateLimit(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := avt.lookup(ctx, "avatars", "a.example.org"); err != nil {
+		t.Fatalf("first lookup: unexpected error %v", err)
+	}
+	_, err := avt.lookup(ctx, "avatars", "b.example.org")
+	if !errors.Is(err, ErrLookupThrottled) {
+		t.Errorf("second lookup returned %v, expected ErrLookupThrottled", err)
+	}
+	if lookups != 1 {
+		t.Errorf("%d lookups performed, expected 1", lookups)
+	}
+
+	avt.SetLookupRateLimit(1000)
+	start := time.Now()
+	for i := 0; i < 1100; i++ {
+		if _, err := avt.lookup(context.Background(), "avatars", fmt.Sprintf("%d.example.org", i)); err != nil {
+			t.Fatalf("lookup: unexpected error %v", err)
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("1100 lookups at 1000/s took %v, expected rate limiting to kick in", d)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// SetLocalFallbackImage sets an image to be returned by GetAvatar,
+// WriteAvatar and Handler when avatar servers cannot be reached
+// (nil data to disable). Such results are flagged as Degraded.
+func (v *Libravatar) SetLocalFallbackImage(data []byte, contentType string) {
+	if data == nil {
+		v.localImage = nil
+		return
+	}
+	v.localImage = &Avatar{Data: data, ContentType: contentType, Degraded: true}
+}
+
+// SetLocalFallbackImageFS is like SetLocalFallbackImage, reading the
+// image from name in fsys (which may be an embed.FS).
+// The content type is guessed from the file extension or contents.
+func (v *Libravatar) SetLocalFallbackImageFS(fsys fs.FS, name string) error {
+	if fsys == nil {
+		return fmt.Errorf("%w: nil file system", ErrInvalidInput)
+	}
+	if name == "" {
+		return fmt.Errorf("%w: empty file name", ErrInvalidInput)
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	v.SetLocalFallbackImage(data, contentType)
+	return nil
+}
+
+// localFallback returns the local image to be used instead of failing
+// with err to fetch the avatar at link, if any
+func (v *Libravatar) localFallback(ctx context.Context, link string, err error) *Avatar {
+	if ctx.Err() != nil || errors.Is(err, ErrNoAvatar) {
+		return nil
+	}
+	if a := v.offlineImage(link); a != nil {
+		return a
+	}
+	if v.localImage == nil {
+		return nil
+	}
+	a := *v.localImage
+	return &a
+}
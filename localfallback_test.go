@@ -0,0 +1,67 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLocalFallbackImage(t *testing.T) {
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	gif := []byte("GIF89a local placeholder")
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, down)
+	avt.SetFallbackHost(strings.TrimPrefix(down.URL, "http://"))
+	avt.SetFailover(true)
+	ctx := context.Background()
+
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err == nil {
+		t.Errorf("GetAvatar with servers down and no local image: expected an error")
+	}
+
+	err := avt.SetLocalFallbackImageFS(fstest.MapFS{"img/default.gif": {Data: gif}}, "img/default.gif")
+	if err != nil {
+		t.Fatalf("SetLocalFallbackImageFS: %v", err)
+	}
+
+	a, err := avt.GetAvatar(ctx, "user@example.org")
+	if err != nil || !a.Degraded || !bytes.Equal(a.Data, gif) || a.ContentType != "image/gif" {
+		t.Errorf("GetAvatar with servers down == %+v, %v", a, err)
+	}
+
+	w := &bytes.Buffer{}
+	n, ctype, err := avt.WriteAvatar(ctx, w, "user@example.org")
+	if err != nil || n != int64(len(gif)) || ctype != "image/gif" || !bytes.Equal(w.Bytes(), gif) {
+		t.Errorf("WriteAvatar with servers down == %d, %q, %v", n, ctype, err)
+	}
+
+	srv := httptest.NewServer(avt.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/avatars/572c3489ea700045927076136a969e27")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, gif) ||
+		resp.Header.Get("Content-Type") != "image/gif" || resp.Header.Get(DegradedHeader) == "" {
+		t.Errorf("Handler with servers down: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	avt.SetLocalFallbackImage(nil, "")
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err == nil {
+		t.Errorf("GetAvatar after removing the local image: expected an error")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a bounded cache evicting least recently used entries first,
+// safe for concurrent use
+type lru[K comparable, V any] struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List // most recently used first
+	items map[K]*list.Element
+}
+
+// lruEntry is an entry of an lru
+type lruEntry[K comparable, V any] struct {
+	key K
+	val V
+}
+
+// newLRU returns an lru holding up to max entries
+func newLRU[K comparable, V any](max int) *lru[K, V] {
+	return &lru[K, V]{max: max, ll: list.New(), items: make(map[K]*list.Element)}
+}
+
+// get returns the value cached for key, if any
+func (c *lru[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).val, true
+}
+
+// add caches val for key, evicting the least recently used entry
+// if the cache is full
+func (c *lru[K, V]) add(key K, val V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value = &lruEntry[K, V]{key, val}
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key, val})
+	if c.ll.Len() > c.max {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// remove drops the entry for key, if any
+func (c *lru[K, V]) remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// purge drops all entries, it is a no-op on a nil cache
+func (c *lru[K, V]) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[K]*list.Element)
+	c.mu.Unlock()
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// markdownAltEscaper backslash-escapes the characters having a meaning
+// in Markdown inline content
+var markdownAltEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `!`, `\!`, `&`, `\&`,
+	"\n", " ", "\r", " ",
+)
+
+// markdownURLEscaper percent-escapes the characters which could end
+// a Markdown link destination
+var markdownURLEscaper = strings.NewReplacer(
+	`(`, `%28`, `)`, `%29`, ` `, `%20`, `<`, `%3C`, `>`, `%3E`, `\`, `%5C`,
+)
+
+// MarkdownImage returns a Markdown image showing the avatar for the
+// given email, at the given size (0 for the one set by SetAvatarSize),
+// with the given alternative text
+func (v *Libravatar) MarkdownImage(email, alt string, size uint) (string, error) {
+	p, err := v.markdownParams(size)
+	if err != nil {
+		return "", err
+	}
+	link, err := v.emailURL(context.Background(), email, p)
+	if err != nil {
+		return "", err
+	}
+	return markdownImage(link, alt), nil
+}
+
+// MarkdownImageFromURL is like MarkdownImage, for an OpenID URL
+func (v *Libravatar) MarkdownImageFromURL(openid, alt string, size uint) (string, error) {
+	p, err := v.markdownParams(size)
+	if err != nil {
+		return "", err
+	}
+	link, err := v.openidURL(context.Background(), openid, p)
+	if err != nil {
+		return "", err
+	}
+	return markdownImage(link, alt), nil
+}
+
+// markdownParams returns the URL parameters for Markdown images of
+// the given size
+func (v *Libravatar) markdownParams(size uint) (params, error) {
+	p := v.params()
+	if size == 0 {
+		return p, nil
+	}
+	if size < v.minSize || size > v.maxSize {
+		return p, fmt.Errorf("size %d: %w", size, ErrInvalidSize)
+	}
+	p.size = size
+	return p, nil
+}
+
+// markdownImage returns a Markdown image of link, with the given
+// alternative text
+func markdownImage(link, alt string) string {
+	return "![" + markdownAltEscaper.Replace(alt) + "](" + markdownURLEscaper.Replace(link) + ")"
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMarkdownImage(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	const link = "http://avatars.example.org/avatar/572c3489ea700045927076136a969e27"
+
+	cases := []struct {
+		alt    string
+		size   uint
+		defURL string
+		want   string
+	}{
+		{"User", 0, "", "![User](" + link + ")"},
+		{"[evil](http://evil.example.org) *x*", 64, "", `![\[evil\](http://evil.example.org) \*x\*](` + link + "?s=64)"},
+		{`back\slash]`, 0, "https://example.org/face_(1).png", `![back\\slash\]](` + link + "?d=https%3A%2F%2Fexample.org%2Fface_%281%29.png)"},
+		{"multi\nline", 0, "", "![multi line](" + link + ")"},
+	}
+	for _, c := range cases {
+		avt.SetDefaultImage(c.defURL)
+		got, err := avt.MarkdownImage("user@example.org", c.alt, c.size)
+		if err != nil {
+			t.Errorf("MarkdownImage(%q): unexpected error %v", c.alt, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("MarkdownImage(%q) == %s, expected %s", c.alt, got, c.want)
+		}
+	}
+	avt.SetDefaultImage("")
+
+	// parentheses in the host part, set by an override
+	avt.SetDomainOverride("example.net", "avatars.example.net/(x)")
+	got, err := avt.MarkdownImage("user@example.net", "x", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "![x](http://avatars.example.net/%28x%29/avatar/" + hashOf("user@example.net") + ")"; got != want {
+		t.Errorf("MarkdownImage == %s, expected %s", got, want)
+	}
+
+	if _, err := avt.MarkdownImage("user@example.org", "x", 1000); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("MarkdownImage with size over the cap: unexpected error %v", err)
+	}
+
+	got, err = avt.MarkdownImageFromURL("https://openid.example.org/user", "OpenID user", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openid, _ := avt.FromURL("https://openid.example.org/user")
+	if want := "![OpenID user](" + openid + "?s=32)"; got != want {
+		t.Errorf("MarkdownImageFromURL == %s, expected %s", got, want)
+	}
+}
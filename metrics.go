@@ -0,0 +1,77 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Error kinds reported to Metrics.IncError
+const (
+	ErrorKindDNSTimeout   = "dns_timeout"   // an SRV query timed out
+	ErrorKindDNS          = "dns"           // an SRV query failed otherwise
+	ErrorKindHTTP         = "http"          // an HTTP request failed, or got an unexpected status
+	ErrorKindContentType  = "content_type"  // an avatar had a content type not allowed
+	ErrorKindInvalidImage = "invalid_image" // an avatar could not be decoded
+	ErrorKindHandler      = "handler"       // the handler could not serve an avatar
+	ErrorKindBestEffort   = "best_effort"   // a best-effort function returned a fallback URL
+)
+
+// Metrics receives observations about the operations performed by
+// a Libravatar object, see SetMetrics.
+// Methods are called synchronously, so they must be cheap and never
+// block, for example by just updating counters.
+type Metrics interface {
+	// ObserveLookup is called after every SRV lookup, including the
+	// ones answered by the cache, with the outcome as reported by
+	// LookupOutcome.String
+	ObserveLookup(domain string, cacheHit bool, outcome string, d time.Duration)
+	// ObserveFetch is called after every HTTP response is consumed,
+	// with the number of bytes of the body read
+	ObserveFetch(status int, bytes int64, d time.Duration)
+	// IncError is called on failures, with one of the ErrorKind
+	// constants
+	IncError(kind string)
+}
+
+// SetMetrics sets the sink of operation metrics (nil for none)
+func (v *Libravatar) SetMetrics(m Metrics) {
+	if m == nil {
+		m = noMetrics{}
+	}
+	v.metrics = m
+}
+
+// noMetrics is the default, no-op, Metrics
+type noMetrics struct{}
+
+func (noMetrics) ObserveLookup(string, bool, string, time.Duration) {}
+func (noMetrics) ObserveFetch(int, int64, time.Duration)            {}
+func (noMetrics) IncError(string)                                   {}
+
+// meteredBody is a response body reporting to Metrics once closed
+type meteredBody struct {
+	io.ReadCloser
+	m      Metrics
+	status int
+	start  time.Time
+	n      int64
+	once   sync.Once
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	b.once.Do(func() {
+		b.m.ObserveFetch(b.status, b.n, time.Since(b.start))
+	})
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records observations, ignoring durations
+type recordingMetrics struct {
+	mu  sync.Mutex
+	obs []string
+}
+
+func (m *recordingMetrics) record(format string, args ...interface{}) {
+	m.mu.Lock()
+	m.obs = append(m.obs, fmt.Sprintf(format, args...))
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) ObserveLookup(domain string, cacheHit bool, outcome string, d time.Duration) {
+	m.record("lookup %s hit=%v %s", domain, cacheHit, outcome)
+}
+
+func (m *recordingMetrics) ObserveFetch(status int, bytes int64, d time.Duration) {
+	m.record("fetch %d %d", status, bytes)
+}
+
+func (m *recordingMetrics) IncError(kind string) {
+	m.record("error %s", kind)
+}
+
+func (m *recordingMetrics) take() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obs := m.obs
+	m.obs = nil
+	return obs
+}
+
+func TestMetrics(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/avatar/") {
+		case hashOf("gone@example.org"):
+			http.NotFound(w, r)
+		case hashOf("broken@example.org"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case hashOf("html@example.org"):
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG)
+		}
+	}))
+	defer srv.Close()
+
+	m := &recordingMetrics{}
+	avt := New()
+	responder := serverResponder(t, srv)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "slow.example.org" {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return responder(ctx, service, proto, name)
+	}
+	avt.SetMetrics(m)
+	ctx := context.Background()
+
+	hsrv := httptest.NewServer(avt.Handler(HandlerAllowEmail(), HandlerBlockPrivateTargets(false)))
+	defer hsrv.Close()
+
+	steps := []struct {
+		do   func()
+		want []string
+	}{
+		{
+			func() { avt.GetAvatar(ctx, "user@example.org") },
+			[]string{"lookup example.org hit=false federated", fmt.Sprintf("fetch 200 %d", len(testPNG))},
+		},
+		{
+			func() { avt.FromEmail("user@example.org") },
+			[]string{"lookup example.org hit=true federated"},
+		},
+		{
+			func() { avt.GetAvatar(ctx, "gone@example.org") },
+			[]string{"lookup example.org hit=true federated", "fetch 404 0"},
+		},
+		{
+			func() { avt.GetAvatar(ctx, "broken@example.org") },
+			[]string{"lookup example.org hit=true federated", "fetch 500 0", "error http"},
+		},
+		{
+			func() { avt.GetAvatar(ctx, "html@example.org") },
+			[]string{"lookup example.org hit=true federated", "error content_type", "fetch 200 13"},
+		},
+		{
+			func() { avt.FromEmail("user@slow.example.org") },
+			[]string{"error dns_timeout", "lookup slow.example.org hit=false error"},
+		},
+		{
+			func() {
+				resp, err := http.Get(hsrv.URL + "/broken@example.org")
+				if err == nil {
+					resp.Body.Close()
+				}
+			},
+			[]string{"lookup example.org hit=true federated", "fetch 500 0", "error http", "error handler"},
+		},
+	}
+	for i, s := range steps {
+		s.do()
+		if got := m.take(); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("step %d: observed %q, expected %q", i, got, s.want)
+		}
+	}
+
+	avt.SetMetrics(nil)
+	avt.GetAvatar(ctx, "user@example.org")
+	if got := m.take(); got != nil {
+		t.Errorf("observed %q after removing the sink", got)
+	}
+}
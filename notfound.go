@@ -0,0 +1,85 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+const (
+	// defaultNotFoundCacheTTL is how long missing avatars are
+	// remembered by default
+	defaultNotFoundCacheTTL = 5 * time.Minute
+	// notFoundCacheSize is the number of missing avatars remembered
+	notFoundCacheSize = 10000
+)
+
+// notFoundKey identifies a missing avatar in the not found cache
+type notFoundKey struct {
+	hash   string
+	size   string
+	defURL string // a 404 is only meaningful for the default asked
+}
+
+// SetNotFoundCacheTTL sets how long avatar servers answering that an
+// avatar does not exist are trusted, answering later requests for it
+// without contacting them (0 to disable). The default is 5 minutes.
+func (v *Libravatar) SetNotFoundCacheTTL(ttl time.Duration) {
+	v.notFoundTTL = ttl
+	v.notFound.purge()
+}
+
+// PurgeNotFoundCache forgets all missing avatars, see SetNotFoundCacheTTL
+func (v *Libravatar) PurgeNotFoundCache() {
+	v.notFound.purge()
+}
+
+// notFoundKeyOf returns the not found cache key for the avatar at link
+func notFoundKeyOf(link string) (notFoundKey, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return notFoundKey{}, false
+	}
+	q := u.Query()
+	return notFoundKey{path.Base(u.Path), q.Get("s"), q.Get("d")}, true
+}
+
+// knownNotFound tells whether the avatar at link was recently found
+// not to exist
+func (v *Libravatar) knownNotFound(link string) bool {
+	if v.notFoundTTL <= 0 {
+		return false
+	}
+	key, ok := notFoundKeyOf(link)
+	if !ok {
+		return false
+	}
+	expires, ok := v.notFound.get(key)
+	if ok && v.clock.Now().After(expires) {
+		v.notFound.remove(key)
+		return false
+	}
+	return ok
+}
+
+// noteStatus updates the not found cache with the status of the
+// response to a request for the avatar at link
+func (v *Libravatar) noteStatus(link string, status int) {
+	if v.notFoundTTL <= 0 || status != http.StatusNotFound && status != http.StatusOK {
+		return
+	}
+	key, ok := notFoundKeyOf(link)
+	if !ok {
+		return
+	}
+	if status == http.StatusNotFound {
+		v.notFound.add(key, v.clock.Now().Add(v.notFoundTTL))
+	} else {
+		v.notFound.remove(key)
+	}
+}
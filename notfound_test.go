@@ -0,0 +1,92 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotFoundCache(t *testing.T) {
+
+	var hits int
+	uploaded := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if !uploaded {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer upstream.Close()
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetFallbackHost(strings.TrimPrefix(upstream.URL, "http://"))
+	srv := httptest.NewServer(avt.Handler())
+	defer srv.Close()
+	proxy := func() int {
+		resp, err := http.Get(srv.URL + "/avatar/" + hashOf("user@example.org") + "?s=64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the second request for a missing avatar is answered locally
+	for i := 0; i < 2; i++ {
+		if status := proxy(); status != http.StatusNotFound || hits != 1 {
+			t.Errorf("proxy request %d answered %d after %d upstream requests, expected 404 after 1", i, status, hits)
+		}
+	}
+	// sizes are cached separately
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); !errors.Is(err, ErrNoAvatar) || hits != 2 {
+		t.Errorf("GetAvatar returned %v after %d upstream requests, expected ErrNoAvatar after 2", err, hits)
+	}
+	if ok, err := avt.Exists(context.Background(), "user@example.org"); ok || err != nil || hits != 3 {
+		t.Errorf("Exists == %v, %v after %d upstream requests, expected false after 3", ok, err, hits)
+	}
+	if ok, err := avt.Exists(context.Background(), "user@example.org"); ok || err != nil || hits != 3 {
+		t.Errorf("Exists == %v, %v after %d upstream requests, expected false after 3", ok, err, hits)
+	}
+
+	// entries expire, and are replaced by uploaded avatars
+	uploaded = true
+	for _, el := range avt.notFound.items {
+		el.Value.(*lruEntry[notFoundKey, time.Time]).val = time.Now().Add(-time.Second)
+	}
+	for i := 0; i < 2; i++ {
+		if status := proxy(); status != http.StatusOK || hits != 4+i {
+			t.Errorf("proxy request %d after expiry answered %d after %d upstream requests", i, status, hits)
+		}
+	}
+
+	// purging
+	uploaded = false
+	hits = 0
+	proxy()
+	avt.PurgeNotFoundCache()
+	proxy()
+	if hits != 2 {
+		t.Errorf("%d upstream requests after purge, expected 2", hits)
+	}
+
+	// disabling
+	avt.SetNotFoundCacheTTL(0)
+	hits = 0
+	proxy()
+	proxy()
+	if hits != 2 {
+		t.Errorf("%d upstream requests with cache disabled, expected 2", hits)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+)
+
+// ParamOption overrides an avatar URL parameter for a single call
+type ParamOption func(v *Libravatar, p *params) error
+
+// ParamSize requests avatars of the given size, instead of the one
+// set by SetAvatarSize
+func ParamSize(size uint) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		if size < v.minSize || size > v.maxSize {
+			return fmt.Errorf("size %d: %w", size, ErrInvalidSize)
+		}
+		p.size = size
+		return nil
+	}
+}
+
+// ParamDefault requests the given default image, instead of the one
+// set by SetDefaultImage (or SetGravatarDefault), with the same
+// restrictions
+func ParamDefault(defURL string) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		if err := v.checkDefaultImage(defURL); err != nil {
+			return err
+		}
+		p.defURL, p.gravatarDefault = defURL, ""
+		return nil
+	}
+}
+
+// ParamHTTPS requests https avatar URLs if use is set, http ones
+// otherwise, instead of the scheme set by SetUseHTTPS
+func ParamHTTPS(use bool) ParamOption {
+	return func(v *Libravatar, p *params) error {
+		p.secure = use
+		if p.gravatarDefault != "" {
+			p.gravatarDefault = gravatarDefaultScheme(use)
+		}
+		return nil
+	}
+}
+
+// FromEmailWithOptions is like FromEmail, with opts overriding the
+// configured URL parameters for this call only
+func (v *Libravatar) FromEmailWithOptions(email string, opts ...ParamOption) (string, error) {
+	p, err := v.callParams(opts)
+	if err != nil {
+		return "", err
+	}
+	return v.emailURL(context.Background(), email, p)
+}
+
+// FromURLWithOptions is like FromURL, with opts overriding the
+// configured URL parameters for this call only
+func (v *Libravatar) FromURLWithOptions(openid string, opts ...ParamOption) (string, error) {
+	p, err := v.callParams(opts)
+	if err != nil {
+		return "", err
+	}
+	return v.openidURL(context.Background(), openid, p)
+}
+
+// callParams returns the configured URL parameters, overridden by opts
+func (v *Libravatar) callParams(opts []ParamOption) (params, error) {
+	p := v.params()
+	for _, opt := range opts {
+		if err := opt(v, &p); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
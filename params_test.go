@@ -0,0 +1,81 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFromEmailWithOptions(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service == "avatars-sec" {
+			return "", []*net.SRV{{Target: "secure.example.org.", Port: 443}}, nil
+		}
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+	hash := hashOf("user@example.org")
+
+	cases := []struct {
+		opts []ParamOption
+		want string
+	}{
+		{nil, "http://avatars.example.org/avatar/" + hash},
+		{[]ParamOption{ParamSize(64), ParamDefault(Retro)}, "http://avatars.example.org/avatar/" + hash + "?d=retro&s=64"},
+		{[]ParamOption{ParamHTTPS(true)}, "https://secure.example.org/avatar/" + hash},
+		{[]ParamOption{ParamGravatarDefault(true), ParamHTTPS(true)}, "https://secure.example.org/avatar/" + hash +
+			"?d=https%3A%2F%2Fsecure.gravatar.com%2Favatar%2F" + hash},
+		{[]ParamOption{ParamHTTPS(true), ParamGravatarDefault(true)}, "https://secure.example.org/avatar/" + hash +
+			"?d=https%3A%2F%2Fsecure.gravatar.com%2Favatar%2F" + hash},
+	}
+	for _, c := range cases {
+		if got, err := avt.FromEmailWithOptions("user@example.org", c.opts...); err != nil || got != c.want {
+			t.Errorf("FromEmailWithOptions(%d options) == %s, %v, expected %s", len(c.opts), got, err, c.want)
+		}
+	}
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != cases[0].want {
+		t.Errorf("FromEmail after per call options == %s, %v, expected the configuration unchanged", got, err)
+	}
+
+	// overrides are part of the URL cache key
+	avt.SetUseHTTPS(true)
+	avt.SetURLCache(100)
+	for i := 0; i < 2; i++ {
+		if got, _ := avt.FromEmailWithOptions("user@example.org", ParamHTTPS(false)); got != cases[0].want {
+			t.Errorf("FromEmailWithOptions over http == %s, expected %s", got, cases[0].want)
+		}
+		if got, _ := avt.FromEmail("user@example.org"); got != cases[2].want {
+			t.Errorf("FromEmail over https == %s, expected %s", got, cases[2].want)
+		}
+	}
+	if got, _ := avt.FromURLWithOptions("https://example.org/id", ParamHTTPS(false)); !strings.HasPrefix(got, "http://avatars.example.org/avatar/") {
+		t.Errorf("FromURLWithOptions over http == %s", got)
+	}
+
+	if _, err := avt.FromEmailWithOptions("user@example.org", ParamSize(1000)); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("FromEmailWithOptions with an invalid size: %v, expected ErrInvalidSize", err)
+	}
+
+	// concurrent calls with different sizes do not interfere
+	var wg sync.WaitGroup
+	for s := uint(10); s < 60; s++ {
+		wg.Add(1)
+		go func(s uint) {
+			defer wg.Done()
+			want := "https://secure.example.org/avatar/" + hash + "?s=" + strconv.Itoa(int(s))
+			if got, err := avt.FromEmailWithOptions("user@example.org", ParamSize(s)); err != nil || got != want {
+				t.Errorf("FromEmailWithOptions(ParamSize(%d)) == %s, %v", s, got, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
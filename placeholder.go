@@ -0,0 +1,63 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+)
+
+// placeholderSamples is the number of pixels sampled along each side
+// of avatars to compute their placeholder color
+const placeholderSamples = 32
+
+// AvatarPlaceholder returns the average color of the avatar for the
+// given email, to be shown while the image loads. The avatar is
+// fetched like GetAvatar does, through the image cache if enabled, and
+// must be a PNG, JPEG or GIF image. ErrNoAvatar is returned if there
+// is no avatar, the image is empty or only the local fallback image
+// is available.
+func (v *Libravatar) AvatarPlaceholder(ctx context.Context, email string) (color.RGBA, error) {
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	a, err := v.getAvatar(ctx, link, v.maxBodySize, nil)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	if a.Degraded {
+		return color.RGBA{}, ErrNoAvatar
+	}
+	img, _, err := image.Decode(bytes.NewReader(a.Data))
+	if err != nil {
+		return color.RGBA{}, ErrNotAnImage
+	}
+	return averageColor(img)
+}
+
+// averageColor returns the average color of img, sampling at most
+// placeholderSamples pixels along each side
+func averageColor(img image.Image) (color.RGBA, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return color.RGBA{}, ErrNoAvatar
+	}
+	// sample the center of each cell of an nx by ny grid
+	nx, ny := min(b.Dx(), placeholderSamples), min(b.Dy(), placeholderSamples)
+	var r, g, bl, a, n uint64
+	for i := 0; i < ny; i++ {
+		y := b.Min.Y + (2*i+1)*b.Dy()/(2*ny)
+		for j := 0; j < nx; j++ {
+			x := b.Min.X + (2*j+1)*b.Dx()/(2*nx)
+			// alpha-premultiplied, so transparent pixels weigh nothing
+			pr, pg, pb, pa := img.At(x, y).RGBA()
+			r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+		}
+	}
+	return color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// placeholderFixtures returns small encoded images, by email
+func placeholderFixtures(t *testing.T) map[string][]byte {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+
+	quadrants := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	gradient := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	solid := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	paletted := image.NewPaletted(image.Rect(0, 0, 8, 8), palette.Plan9)
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 255 / 99), uint8(y * 255 / 99), 0x80, 0xff})
+			if x >= 16 || y >= 16 {
+				continue
+			}
+			solid.Set(x, y, color.RGBA{200, 100, 50, 0xff})
+			if x >= 8 || y >= 8 {
+				continue
+			}
+			paletted.Set(x, y, red)
+			if x >= 4 {
+				paletted.Set(x, y, blue)
+			}
+			if x >= 4 || y >= 4 {
+				continue
+			}
+			switch {
+			case x < 2 && y < 2, x >= 2 && y < 2:
+				quadrants.Set(x, y, red)
+			case x < 2:
+				quadrants.Set(x, y, blue)
+			default:
+				quadrants.Set(x, y, white)
+			}
+			if x < 2 {
+				transparent.Set(x, y, red)
+			}
+		}
+	}
+
+	fixtures := make(map[string][]byte)
+	encode := func(email string, f func(*bytes.Buffer) error) {
+		var b bytes.Buffer
+		if err := f(&b); err != nil {
+			t.Fatal(err)
+		}
+		fixtures[email] = b.Bytes()
+	}
+	encode("quadrants@example.org", func(b *bytes.Buffer) error { return png.Encode(b, quadrants) })
+	encode("transparent@example.org", func(b *bytes.Buffer) error { return png.Encode(b, transparent) })
+	encode("gradient@example.org", func(b *bytes.Buffer) error { return png.Encode(b, gradient) })
+	encode("jpeg@example.org", func(b *bytes.Buffer) error { return jpeg.Encode(b, solid, &jpeg.Options{Quality: 90}) })
+	encode("gif@example.org", func(b *bytes.Buffer) error { return gif.Encode(b, paletted, nil) })
+	return fixtures
+}
+
+func TestAvatarPlaceholder(t *testing.T) {
+
+	fixtures := placeholderFixtures(t)
+	byHash := make(map[string][]byte)
+	for email, data := range fixtures {
+		byHash[hashOf(email)] = data
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		data, ok := byHash[strings.TrimPrefix(r.URL.Path, "/avatar/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(t.TempDir())
+
+	cases := []struct {
+		email string
+		want  color.RGBA
+	}{
+		{"quadrants@example.org", color.RGBA{191, 63, 127, 255}},
+		{"transparent@example.org", color.RGBA{127, 0, 0, 127}},
+		{"gradient@example.org", color.RGBA{127, 127, 128, 255}},
+		{"jpeg@example.org", color.RGBA{200, 100, 50, 255}},
+		{"gif@example.org", color.RGBA{127, 0, 127, 255}},
+	}
+	for _, c := range cases {
+		got, err := avt.AvatarPlaceholder(ctx, c.email)
+		if err != nil || got != c.want {
+			t.Errorf("AvatarPlaceholder(%s) == %v, %v, expected %v", c.email, got, err, c.want)
+		}
+	}
+
+	// cached images are not downloaded again
+	requests = 0
+	if _, err := avt.AvatarPlaceholder(ctx, "quadrants@example.org"); err != nil || requests != 0 {
+		t.Errorf("AvatarPlaceholder of a cached image: %v, %d requests", err, requests)
+	}
+	if _, err := avt.GetAvatar(ctx, "gif@example.org"); err != nil || requests != 0 {
+		t.Errorf("GetAvatar after AvatarPlaceholder: %v, %d requests", err, requests)
+	}
+
+	if _, err := avt.AvatarPlaceholder(ctx, "missing@example.org"); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("AvatarPlaceholder of a missing avatar: %v, expected ErrNoAvatar", err)
+	}
+	avt.SetImageCacheDir("")
+	avt.SetLocalFallbackImage(fixtures["quadrants@example.org"], "image/png")
+	srv.Close()
+	if _, err := avt.AvatarPlaceholder(ctx, "gif@example.org"); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("AvatarPlaceholder with servers down: %v, expected ErrNoAvatar", err)
+	}
+	if _, err := averageColor(image.NewRGBA(image.Rectangle{})); !errors.Is(err, ErrNoAvatar) {
+		t.Errorf("averageColor of an empty image: %v, expected ErrNoAvatar", err)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// PrefetchEvent describes the refresh of a watched identity,
+// see SetPrefetchHook
+type PrefetchEvent struct {
+	Email       string        // the watched identity
+	URL         string        // its avatar URL, if it could be resolved
+	NotModified bool          // whether the server reported the image did not change
+	Degraded    bool          // whether the server could not be reached, see SetLocalFallbackImage
+	Err         error         // the error met, if any
+	Duration    time.Duration // time spent refreshing
+}
+
+// Watch adds identities to be kept warm by the prefetcher,
+// see StartPrefetcher
+func (v *Libravatar) Watch(emails ...string) {
+	v.watchMu.Lock()
+	for _, e := range emails {
+		v.watched[e] = true
+	}
+	v.watchMu.Unlock()
+}
+
+// Unwatch removes identities from the ones kept warm by the prefetcher
+func (v *Libravatar) Unwatch(emails ...string) {
+	v.watchMu.Lock()
+	for _, e := range emails {
+		delete(v.watched, e)
+	}
+	v.watchMu.Unlock()
+}
+
+// SetPrefetchHook sets a function to be called after every refresh
+// of a watched identity, successful or not. Panics in the hook are
+// recovered from and ignored.
+func (v *Libravatar) SetPrefetchHook(hook func(PrefetchEvent)) {
+	v.prefetchHook = hook
+}
+
+const (
+	// closeGracePeriod is how long Close lets in-flight refreshes run
+	// before cancelling them
+	closeGracePeriod = 5 * time.Second
+	// defaultPrefetchInterval is the interval used by StartPrefetcher
+	// when none is given
+	defaultPrefetchInterval = time.Hour
+)
+
+// StartPrefetcher starts refreshing the watched identities in the
+// background, each once per interval, spreading the work over it.
+// Identities are resolved, warming the SRV cache, and their images
+// are revalidated with conditional requests if the image cache is
+// enabled. A non-positive interval means one hour. The prefetcher
+// stops when ctx is done or on Close, and is not started at all once v
+// is closed.
+func (v *Libravatar) StartPrefetcher(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultPrefetchInterval
+	}
+	// Close must not be waiting for the prefetchers while they are added
+	v.closeMu.Lock()
+	select {
+	case <-v.closed:
+		v.closeMu.Unlock()
+		return
+	default:
+	}
+	v.prefetchers.Add(2)
+	v.closeMu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer v.prefetchers.Done()
+		select {
+		case <-v.closed:
+			// no refresh starts once closed, the one in flight
+			// is given some time to complete
+			select {
+			case <-v.clock.After(closeGracePeriod):
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer v.prefetchers.Done()
+		defer cancel()
+		for {
+			emails := v.watchedEmails()
+			if len(emails) == 0 {
+				if !v.sleep(ctx, interval) {
+					return
+				}
+				continue
+			}
+			step := interval / time.Duration(len(emails))
+			for _, e := range emails {
+				v.prefetch(ctx, e)
+				if !v.sleep(ctx, step) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background work of v, that is the prefetchers
+// started by StartPrefetcher, waiting for them to return: refreshes
+// in flight are let complete, or cancelled after a grace period of
+// 5 seconds. Avatar images are written to the image cache as soon as
+// they are fetched, so there is nothing left to flush.
+// v remains usable afterwards, without background refreshes:
+// lookups and fetches work as usual, while StartPrefetcher does
+// nothing. Close may be called more than once.
+func (v *Libravatar) Close() error {
+	v.closeMu.Lock()
+	v.closeOnce.Do(func() { close(v.closed) })
+	v.closeMu.Unlock()
+	v.prefetchers.Wait()
+	return nil
+}
+
+// watchedEmails returns the watched identities, sorted
+func (v *Libravatar) watchedEmails() []string {
+	v.watchMu.Lock()
+	emails := make([]string, 0, len(v.watched))
+	for e := range v.watched {
+		emails = append(emails, e)
+	}
+	v.watchMu.Unlock()
+	sort.Strings(emails)
+	return emails
+}
+
+// prefetch refreshes the given watched identity
+func (v *Libravatar) prefetch(ctx context.Context, email string) {
+	start := time.Now()
+	ev := PrefetchEvent{Email: email}
+	ev.URL, ev.Err = v.emailURL(ctx, email, v.params())
+	if ev.Err == nil && v.imageCacheDir != "" {
+		key := imageCacheKey(ev.URL)
+		prev, _ := v.readImageCache(key)
+		var a *Avatar
+		if a, ev.Err = v.getAvatar(ctx, ev.URL, v.maxBodySize, prev); ev.Err == nil {
+			ev.NotModified, ev.Degraded = a.NotModified, a.Degraded
+			if a.NotModified {
+				a.NotModified = false
+				v.writeImageCache(key, a)
+			}
+		}
+	}
+	if ctx.Err() != nil || v.prefetchHook == nil {
+		return
+	}
+	ev.Duration = time.Since(start)
+	func() {
+		defer func() { recover() }()
+		v.prefetchHook(ev)
+	}()
+}
+
+// sleep waits for d, returning false if ctx is done or v is closed
+// before
+func (v *Libravatar) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-v.clock.After(d):
+	case <-v.closed:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	// both may be ready at once
+	select {
+	case <-v.closed:
+		return false
+	default:
+		return ctx.Err() == nil
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefetcher(t *testing.T) {
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	conditional := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, "/avatar/")
+		mu.Lock()
+		requests[hash]++
+		if r.Header.Get("If-None-Match") != "" {
+			conditional[hash]++
+		}
+		mu.Unlock()
+		if hash == hashOf("broken@example.org") {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	var events []PrefetchEvent
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(t.TempDir())
+	avt.SetPrefetchHook(func(ev PrefetchEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	})
+	avt.Watch("user@example.org", "broken@example.org", "other@example.org")
+	avt.Unwatch("other@example.org")
+
+	avt.StartPrefetcher(context.Background(), 20*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := conditional[hashOf("user@example.org")] >= 2 && requests[hashOf("broken@example.org")] >= 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetcher did not refresh the watched identities: %v requests, %v conditional", requests, conditional)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	avt.Close()
+
+	mu.Lock()
+	n := len(events)
+	if requests[hashOf("other@example.org")] != 0 {
+		t.Errorf("unwatched identity was fetched")
+	}
+	var failures, notModified int
+	for _, ev := range events {
+		switch ev.Email {
+		case "broken@example.org":
+			if ev.Err == nil {
+				t.Errorf("prefetch of broken@example.org reported no error")
+			}
+			failures++
+		case "user@example.org":
+			if ev.Err != nil {
+				t.Errorf("prefetch of user@example.org: unexpected error %v", ev.Err)
+			}
+			if ev.NotModified {
+				notModified++
+			}
+		}
+	}
+	mu.Unlock()
+	if failures < 3 || notModified < 2 {
+		t.Errorf("got %d failures and %d revalidations, expected the loop to go on", failures, notModified)
+	}
+
+	// nothing happens after Close
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(events) != n {
+		t.Errorf("prefetcher still running after Close")
+	}
+	mu.Unlock()
+}
+
+func TestPrefetcherCancel(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.Watch("user@example.org")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	avt.StartPrefetcher(ctx, time.Hour)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		avt.prefetchers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetcher did not stop on context cancellation")
+	}
+}
+
+func TestPrefetcherClose(t *testing.T) {
+
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/avatar/") == hashOf("slow@example.org") {
+			started <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	avt := New()
+	avt.SetClock(clock)
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetHTTPClient(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+	avt.SetImageCacheDir(t.TempDir())
+	avt.Watch("fast@example.org", "slow@example.org")
+	before := runtime.NumGoroutine()
+
+	avt.StartPrefetcher(context.Background(), time.Hour)
+	step := <-clock.waiting // fast@example.org refreshed
+	clock.Advance(step)
+	<-started
+
+	closed := make(chan error)
+	go func() { closed <- avt.Close() }()
+	if d := <-clock.waiting; d != closeGracePeriod {
+		t.Fatalf("Close waiting %s, expected the grace period", d)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the grace period")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(closeGracePeriod)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return after the grace period")
+	}
+
+	if n := settleGoroutines(before); n > before {
+		t.Errorf("%d goroutines after Close, expected %d", n, before)
+	}
+	link, err := avt.FromEmail("fast@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := avt.readImageCache(imageCacheKey(link)); a == nil || string(a.Data) != string(testPNG) || a.ETag != `"v1"` {
+		t.Errorf("image cache after Close: %+v, expected the refreshed image", a)
+	}
+
+	// v stays usable, without background work
+	if err := avt.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	avt.StartPrefetcher(context.Background(), time.Hour)
+	if n := settleGoroutines(before); n > before {
+		t.Errorf("%d goroutines after StartPrefetcher on a closed object, expected %d", n, before)
+	}
+	if _, err := avt.GetAvatar(context.Background(), "fast@example.org"); err != nil {
+		t.Errorf("GetAvatar after Close: %v", err)
+	}
+}
+
+func TestPrefetcherInterval(t *testing.T) {
+
+	var mu sync.Mutex
+	refreshes := 0
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetPrefetchHook(func(ev PrefetchEvent) {
+		mu.Lock()
+		refreshes++
+		mu.Unlock()
+	})
+	avt.Watch("user@example.org")
+
+	// a non-positive interval does not refresh continuously
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ctx, cancel := context.WithCancel(context.Background())
+		avt.StartPrefetcher(ctx, interval)
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}
+	avt.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes > 2 {
+		t.Errorf("%d refreshes with non-positive intervals, expected one per prefetcher", refreshes)
+	}
+}
+
+func TestPrefetcherCloseRace(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			avt.StartPrefetcher(ctx, time.Hour)
+		}()
+	}
+	avt.Close()
+	wg.Wait()
+	// prefetchers started after Close returned would be left running
+	avt.Close()
+}
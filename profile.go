@@ -0,0 +1,66 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNoProfile is returned by GravatarProfile for emails
+	// without a Gravatar profile
+	ErrNoProfile = errors.New("libravatar: no profile")
+	// ErrNotGravatarMode is returned by GravatarProfile unless in
+	// Gravatar mode, as libravatar has no profiles
+	ErrNotGravatarMode = errors.New("libravatar: profiles are only available in Gravatar mode")
+)
+
+// Profile is a Gravatar profile
+type Profile struct {
+	DisplayName       string `json:"displayName"`
+	PreferredUsername string `json:"preferredUsername"`
+	ProfileURL        string `json:"profileUrl"`
+	ThumbnailURL      string `json:"thumbnailUrl"`
+}
+
+// GravatarProfile fetches the Gravatar profile for the given email.
+// It is only available in Gravatar mode, see SetGravatarMode.
+func (v *Libravatar) GravatarProfile(ctx context.Context, email string) (*Profile, error) {
+	if !v.gravatarMode {
+		return nil, ErrNotGravatarMode
+	}
+	addr, err := parseEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := v.hash(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	link := "https://" + gravatarHost + "/" + hash + ".json"
+
+	resp, err := v.fetch(ctx, http.MethodGet, link, nil)
+	if errors.Is(err, ErrNoAvatar) {
+		return nil, ErrNoProfile
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		Entry []Profile `json:"entry"`
+	}
+	if err := json.NewDecoder(limitBody(resp.Body, v.maxBodySize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("libravatar: decoding profile from %s: %w", link, err)
+	}
+	if len(doc.Entry) == 0 {
+		return nil, ErrNoProfile
+	}
+	return &doc.Entry[0], nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGravatarProfile(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + hashOf("user@example.org") + ".json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"entry":[{"id":"1","hash":"572c3489ea700045927076136a969e27",
+				"profileUrl":"http://gravatar.com/user","preferredUsername":"user",
+				"thumbnailUrl":"https://secure.gravatar.com/avatar/572c3489ea700045927076136a969e27",
+				"photos":[{"value":"https://secure.gravatar.com/avatar/572c3489ea700045927076136a969e27","type":"thumbnail"}],
+				"displayName":"A User","urls":[]}]}`))
+		case "/" + hashOf("broken@example.org") + ".json":
+			w.Write([]byte(`{"entry":[{"displayName":`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	avt := New()
+	avt.SetHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Scheme != "https" || req.URL.Host != "www.gravatar.com" {
+			t.Errorf("request to %s", req.URL)
+		}
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})})
+
+	if _, err := avt.GravatarProfile(context.Background(), "user@example.org"); !errors.Is(err, ErrNotGravatarMode) {
+		t.Errorf("GravatarProfile out of Gravatar mode: unexpected error %v", err)
+	}
+
+	avt.SetGravatarMode(true)
+	p, err := avt.GravatarProfile(context.Background(), "User@Example.org")
+	want := Profile{
+		DisplayName:       "A User",
+		PreferredUsername: "user",
+		ProfileURL:        "http://gravatar.com/user",
+		ThumbnailURL:      "https://secure.gravatar.com/avatar/572c3489ea700045927076136a969e27",
+	}
+	if err != nil || *p != want {
+		t.Errorf("GravatarProfile == %+v, %v, expected %+v", p, err, want)
+	}
+
+	if _, err := avt.GravatarProfile(context.Background(), "nobody@example.org"); !errors.Is(err, ErrNoProfile) {
+		t.Errorf("GravatarProfile for unknown email: unexpected error %v", err)
+	}
+	if _, err := avt.GravatarProfile(context.Background(), "broken@example.org"); err == nil || errors.Is(err, ErrNoProfile) {
+		t.Errorf("GravatarProfile with malformed JSON: unexpected error %v", err)
+	}
+
+	avt.SetMaxBodySize(16)
+	if _, err := avt.GravatarProfile(context.Background(), "user@example.org"); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("GravatarProfile larger than the body limit: unexpected error %v", err)
+	}
+}
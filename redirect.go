@@ -0,0 +1,60 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SetRedirectStatus sets the status code of the responses written by
+// Redirect, either http.StatusFound (the default) or
+// http.StatusTemporaryRedirect
+func (v *Libravatar) SetRedirectStatus(code int) error {
+	if code != http.StatusFound && code != http.StatusTemporaryRedirect {
+		return fmt.Errorf("libravatar: invalid redirect status %d", code)
+	}
+	v.redirectStatus = code
+	return nil
+}
+
+// SetRedirectCacheControl sets the Cache-Control header of the
+// responses written by Redirect (empty, the default, for none)
+func (v *Libravatar) SetRedirectCacheControl(value string) {
+	v.redirectCacheControl = value
+}
+
+// Redirect answers r with a redirect to the avatar URL for the given
+// email, with opts overriding the configured URL parameters.
+// The lookup is bound to the context of r. If it fails, the response
+// redirects to the default image on the fallback host, unless strict
+// mode is enabled (see SetStrict).
+// Nothing is written to w when an error is returned.
+func (v *Libravatar) Redirect(w http.ResponseWriter, r *http.Request, email string, opts ...ParamOption) error {
+	if w == nil || r == nil {
+		return fmt.Errorf("%w: nil response writer or request", ErrInvalidInput)
+	}
+	p, err := v.callParams(opts)
+	if err != nil {
+		return err
+	}
+	link, err := v.emailURL(r.Context(), email, p)
+	if err != nil {
+		if v.strict {
+			return err
+		}
+		link = buildURL(v.fallbackBaseURL(p.secure), probeHash, p)
+	}
+
+	if v.redirectCacheControl != "" {
+		w.Header().Set("Cache-Control", v.redirectCacheControl)
+	}
+	code := v.redirectStatus
+	if code == 0 {
+		code = http.StatusFound
+	}
+	http.Redirect(w, r, link, code)
+	return nil
+}
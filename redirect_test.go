@@ -0,0 +1,78 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetRedirectCacheControl("public, max-age=3600")
+
+	cases := []struct {
+		email    string
+		opts     []ParamOption
+		location string
+	}{
+		{"user@example.org", nil, "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"},
+		{"user@example.org", []ParamOption{ParamSize(64), ParamDefault(IdentIcon)}, "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27?d=identicon&s=64"},
+		{"not an email", []ParamOption{ParamSize(32)}, "http://cdn.libravatar.org/avatar/00000000000000000000000000000000?s=32"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		if err := avt.Redirect(w, httptest.NewRequest("GET", "/user/1/avatar", nil), c.email, c.opts...); err != nil {
+			t.Errorf("Redirect(%s): unexpected error %v", c.email, err)
+			continue
+		}
+		if w.Code != http.StatusFound || w.Header().Get("Location") != c.location {
+			t.Errorf("Redirect(%s) answered %d to %s, expected 302 to %s", c.email, w.Code, w.Header().Get("Location"), c.location)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=3600" {
+			t.Errorf("Redirect(%s): Cache-Control %q", c.email, cc)
+		}
+	}
+
+	// invalid options
+	for _, opt := range []ParamOption{ParamSize(1000), ParamDefault("unicorn")} {
+		w := httptest.NewRecorder()
+		if err := avt.Redirect(w, httptest.NewRequest("GET", "/", nil), "user@example.org", opt); err == nil || w.Code != http.StatusOK || len(w.Header()) != 0 {
+			t.Errorf("Redirect with an invalid option returned %v, answering %d", err, w.Code)
+		}
+	}
+	if err := avt.SetRedirectStatus(http.StatusMovedPermanently); err == nil {
+		t.Errorf("SetRedirectStatus(301): expected an error")
+	}
+
+	// the request context bounds the lookup
+	avt.SetRedirectStatus(http.StatusTemporaryRedirect)
+	avt.SetDNSErrorPolicy(DNSErrorFail)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		<-ctx.Done()
+		return "", nil, &net.DNSError{Err: "canceled", Name: name}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	if err := avt.Redirect(w, req, "user@example.net"); err != nil || w.Code != http.StatusTemporaryRedirect ||
+		w.Header().Get("Location") != "http://cdn.libravatar.org/avatar/00000000000000000000000000000000" {
+		t.Errorf("Redirect with failing lookup returned %v, answering %d to %s", err, w.Code, w.Header().Get("Location"))
+	}
+
+	// but not in strict mode
+	avt.SetStrict(true)
+	w = httptest.NewRecorder()
+	if err := avt.Redirect(w, req, "user@example.net"); !errors.Is(err, ErrDNS) || w.Code != http.StatusOK {
+		t.Errorf("strict Redirect with failing lookup returned %v, answering %d", err, w.Code)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+// SetRelativeURLs makes v produce avatar URLs made only of path and
+// query, like /avatar/<hash>?s=64, to be resolved against the origin
+// of the page, for applications serving avatars themselves.
+// No SRV lookup is performed and no host is selected; hashes and
+// parameters are the same as for absolute URLs.
+// Functions fetching avatars, like GetAvatar, fail in this mode, as
+// they have no host to send requests to.
+func (v *Libravatar) SetRelativeURLs(enable bool) {
+	v.relativeURLs = enable
+	v.urlCache.purge()
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestRelativeURLs(t *testing.T) {
+
+	avt := New()
+	avt.SetRelativeURLs(true)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		t.Errorf("unexpected SRV lookup for %s", name)
+		return "", nil, nil
+	}
+
+	const (
+		emailPath  = "/avatar/572c3489ea700045927076136a969e27"
+		openidPath = "/avatar/dfa83cb90e89552d3df2bf3a41360b412788667cbc86022632d4102d77280f5e"
+	)
+	cases := []struct {
+		size          uint
+		def           string
+		email, openid string
+	}{
+		{0, "", emailPath, openidPath},
+		{64, "", emailPath + "?s=64", openidPath + "?s=64"},
+		{64, "https://example.org/default.png",
+			emailPath + "?d=https%3A%2F%2Fexample.org%2Fdefault.png&s=64",
+			openidPath + "?d=https%3A%2F%2Fexample.org%2Fdefault.png&s=64"},
+		{0, IdentIcon, emailPath + "?d=identicon", openidPath + "?d=identicon"},
+	}
+	for _, c := range cases {
+		avt.SetAvatarSize(c.size)
+		if err := avt.SetDefaultImage(c.def); err != nil {
+			t.Fatal(err)
+		}
+		if link, err := avt.FromEmail("User@example.org"); err != nil || link != c.email {
+			t.Errorf("FromEmail with size %d and default %q == %q, %v, expected %q", c.size, c.def, link, err, c.email)
+		}
+		if link, err := avt.FromURL("https://openid.example.org/user"); err != nil || link != c.openid {
+			t.Errorf("FromURL with size %d and default %q == %q, %v, expected %q", c.size, c.def, link, err, c.openid)
+		}
+	}
+
+	avt.SetRelativeURLs(false)
+	avt.lookupSRV = srvResponder()
+	if link, _ := avt.FromEmail("user@example.org"); link != "http://cdn.libravatar.org"+emailPath+"?d=identicon" {
+		t.Errorf("FromEmail after disabling relative URLs == %q", link)
+	}
+}
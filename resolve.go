@@ -0,0 +1,61 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrDefaultImage is returned by ResolveFinalURL, together with the
+// resolved URL, when the server redirected to the default image set
+// with SetDefaultImage, meaning the identity has no avatar of its own
+var ErrDefaultImage = errors.New("libravatar: redirected to the default image")
+
+// ResolveFinalURL follows the redirects from the avatar URL for the
+// given email, up to the limit set by SetMaxRedirects, and returns
+// the URL where they end and the status code found there, without
+// downloading the image
+func (v *Libravatar) ResolveFinalURL(ctx context.Context, email string) (string, int, error) {
+	link, err := v.emailURL(ctx, email, v.params())
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := v.do(ctx, http.MethodHead, link, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		resp, err = v.do(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		resp.Body.Close()
+	}
+
+	final := resp.Request.URL
+	if v.isDefaultImage(final) {
+		return final.String(), resp.StatusCode, ErrDefaultImage
+	}
+	return final.String(), resp.StatusCode, nil
+}
+
+// isDefaultImage returns true if u is the default image URL
+// set with SetDefaultImage
+func (v *Libravatar) isDefaultImage(u *url.URL) bool {
+	def, err := url.Parse(v.defURL)
+	if err != nil || def.Host == "" {
+		// not set, or one of the keywords
+		return false
+	}
+	return strings.EqualFold(def.Host, u.Host) &&
+		strings.TrimSuffix(def.Path, "/") == strings.TrimSuffix(u.Path, "/") &&
+		def.RawQuery == u.RawQuery
+}
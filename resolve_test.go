@@ -0,0 +1,73 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveFinalURL(t *testing.T) {
+
+	var downloads int
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mirror":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/final", "/default.png":
+			if r.Method != http.MethodHead {
+				downloads++
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/avatar/"+hashOf("nobody@example.org") {
+			http.Redirect(w, r, r.URL.Query().Get("d"), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, mirror.URL+"/mirror", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetDefaultImage(mirror.URL + "/default.png")
+	ctx := context.Background()
+
+	final, status, err := avt.ResolveFinalURL(ctx, "user@example.org")
+	if err != nil {
+		t.Fatalf("ResolveFinalURL: unexpected error %v", err)
+	}
+	if final != mirror.URL+"/final" || status != http.StatusOK {
+		t.Errorf("ResolveFinalURL == %s, %d, expected %s, 200", final, status, mirror.URL+"/final")
+	}
+	if downloads != 0 {
+		t.Errorf("ResolveFinalURL downloaded the image %d times", downloads)
+	}
+
+	final, status, err = avt.ResolveFinalURL(ctx, "nobody@example.org")
+	if !errors.Is(err, ErrDefaultImage) || final != mirror.URL+"/default.png" || status != http.StatusOK {
+		t.Errorf("ResolveFinalURL to the default image == %s, %d, %v", final, status, err)
+	}
+
+	// two redirects are needed
+	avt.SetMaxRedirects(2)
+	if _, _, err := avt.ResolveFinalURL(ctx, "user@example.org"); err != nil {
+		t.Errorf("ResolveFinalURL with 2 redirects allowed: unexpected error %v", err)
+	}
+	avt.SetMaxRedirects(1)
+	if _, _, err := avt.ResolveFinalURL(ctx, "user@example.org"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("ResolveFinalURL with 1 redirect allowed: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver looks up SRV records, *net.Resolver implements it
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// hostResolver is a Resolver also able to look up host addresses
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// SetResolver sets the resolver used for DNS lookups (nil for the
+// default one). If it also implements TTLLookuper, it is used for SRV
+// lookups as if set by SetTTLLookuper, otherwise a TTLLookuper set
+// before is dropped. If it has a LookupHost method, like
+// *net.Resolver, it is also used for host lookups, like those of
+// SetVerifyTargetResolves. The SRV cache is purged.
+func (v *Libravatar) SetResolver(r Resolver) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	v.lookupSRV = r.LookupSRV
+	v.ttlLookuper, _ = r.(TTLLookuper)
+	if h, ok := r.(hostResolver); ok {
+		v.lookupHost = h.LookupHost
+	} else {
+		v.lookupHost = net.DefaultResolver.LookupHost
+	}
+	v.nameCache.purge()
+	v.urlCache.purge()
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubResolver is a Resolver answering every query with one record
+type stubResolver struct {
+	lookups int
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.lookups++
+	return "", []*net.SRV{{Target: "avatars." + name + ".", Port: 80}}, nil
+}
+
+// ttlResolver is a Resolver also reporting TTLs and resolving hosts
+type ttlResolver struct {
+	stubResolver
+	ttlResponder
+	hosts []string
+}
+
+func (r *ttlResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.hosts = append(r.hosts, host)
+	return []string{"192.0.2.1"}, nil
+}
+
+func TestSetResolver(t *testing.T) {
+
+	avt := New()
+	r := &stubResolver{}
+	avt.SetResolver(r)
+	if got, err := avt.FromEmail("user@example.org"); err != nil || got != "http://avatars.example.org/avatar/"+hashOf("user@example.org") {
+		t.Errorf("FromEmail with a resolver == %s, %v", got, err)
+	}
+	if r.lookups != 1 {
+		t.Errorf("%d lookups through the resolver, expected 1", r.lookups)
+	}
+
+	// resolvers reporting TTLs are used as TTLLookupers, and for
+	// host lookups if they can
+	tr := &ttlResolver{ttlResponder: ttlResponder{ttl: 5 * time.Minute}}
+	avt.SetResolver(tr)
+	avt.SetVerifyTargetResolves(true)
+	if _, err := avt.FromEmail("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.stubResolver.lookups != 0 || tr.ttlResponder.lookups != 1 {
+		t.Errorf("%d plain and %d TTL lookups, expected the cache to be purged and TTLs used", tr.stubResolver.lookups, tr.ttlResponder.lookups)
+	}
+	if val, _ := avt.nameCache.get(cacheKey{"avatars", "example.org"}); val.ttl != 5*time.Minute {
+		t.Errorf("lookup cached for %v, expected the TTL of the record", val.ttl)
+	}
+	if len(tr.hosts) != 1 || tr.hosts[0] != "avatars.example.org" {
+		t.Errorf("hosts looked up through the resolver: %v", tr.hosts)
+	}
+
+	// switching back drops the TTLLookuper
+	avt.SetResolver(r)
+	avt.FromEmail("user@example.org")
+	if r.lookups != 2 || tr.ttlResponder.lookups != 1 {
+		t.Errorf("%d lookups through the resolver after switching back, expected 2", r.lookups)
+	}
+
+	avt.SetResolver(nil)
+	if avt.ttlLookuper != nil {
+		t.Errorf("default resolver set with a TTLLookuper")
+	}
+	var _ Resolver = net.DefaultResolver
+}
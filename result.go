@@ -0,0 +1,90 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net/mail"
+	"net/url"
+)
+
+// Hash algorithms reported in Result.HashAlgorithm
+const (
+	HashMD5    = "md5"    // used for emails, see SetEmailHash
+	HashSHA256 = "sha256" // used for OpenIDs
+	HashCustom = "custom" // computed by the function set by SetHashFunc
+)
+
+// Result is the outcome of resolving the avatar of an identity
+type Result struct {
+	Email         string // as given, empty for OpenIDs
+	URL           string // the avatar URL, if Err is nil
+	Hash          string // the hash of the normalized identity, as found in URL
+	HashAlgorithm string // HashMD5, HashSHA256 or HashCustom
+	Domain        string // the domain of the identity, canonicalized as looked up
+	Federated     bool   // whether Host was found with an SRV lookup
+	Host          string // the host[:port] serving the avatar
+	Err           error  // only set by FromEmails
+}
+
+// Lookup resolves the avatar for the given email, like FromEmail
+// does, also returning its hash and where it is served from
+func (v *Libravatar) Lookup(email string) (*Result, error) {
+	return v.emailResult(context.Background(), email, v.params())
+}
+
+// LookupURL is like Lookup, for the given url (typically for OpenID)
+func (v *Libravatar) LookupURL(openid string) (*Result, error) {
+	return v.openidResult(context.Background(), openid, v.params())
+}
+
+// result resolves the avatar for email or openid (for openid to be
+// used, email has to be nil)
+func (v *Libravatar) result(ctx context.Context, email *mail.Address, openid *url.URL, p params) (Result, error) {
+	r, base, err := v.resolve(ctx, email, openid, p)
+	if err != nil {
+		return Result{}, err
+	}
+	r.URL = buildURL(base, r.Hash, v.withFavicon(p, email))
+	return r, nil
+}
+
+// resolve is like result, returning the base URL of the avatar in
+// place of its URL
+func (v *Libravatar) resolve(ctx context.Context, email *mail.Address, openid *url.URL, p params) (Result, string, error) {
+	if email == nil && v.gravatarMode {
+		return Result{}, "", ErrGravatarOpenID
+	}
+	if v.strict {
+		if err := v.validate(p); err != nil {
+			return Result{}, "", err
+		}
+	}
+	domain, err := v.getDomain(email, openid)
+	if err != nil {
+		return Result{}, "", err
+	}
+	hash, err := v.hash(email, openid)
+	if err != nil {
+		return Result{}, "", err
+	}
+	protocol, host, federated, err := v.hostTarget(ctx, domain, p.secure)
+	if err != nil {
+		return Result{}, "", err
+	}
+	r := Result{
+		Hash:          hash,
+		HashAlgorithm: HashSHA256,
+		Domain:        domain,
+		Federated:     federated,
+		Host:          host,
+	}
+	if email != nil {
+		r.HashAlgorithm = v.emailHashAlgorithm()
+	} else if v.hashFunc != nil {
+		r.HashAlgorithm = HashCustom
+	}
+	return r, protocol + host, nil
+}
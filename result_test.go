@@ -0,0 +1,71 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "federated.org" {
+			return srvResponder(&net.SRV{Target: "avatars.federated.org.", Port: 8080, Priority: 10, Weight: 10})(ctx, service, proto, name)
+		}
+		return srvResponder()(ctx, service, proto, name)
+	}
+	avt.SetAvatarSize(64)
+
+	cases := []struct {
+		email string
+		want  Result
+	}{
+		{"user@federated.org", Result{
+			Email:         "user@federated.org",
+			URL:           "http://avatars.federated.org:8080/avatar/3f86a849ff352de49335a8ac19dd60ba?s=64",
+			Hash:          "3f86a849ff352de49335a8ac19dd60ba",
+			HashAlgorithm: HashMD5,
+			Domain:        "federated.org",
+			Federated:     true,
+			Host:          "avatars.federated.org:8080",
+		}},
+		{"user@example.org", Result{
+			Email:         "user@example.org",
+			URL:           "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27?s=64",
+			Hash:          "572c3489ea700045927076136a969e27",
+			HashAlgorithm: HashMD5,
+			Domain:        "example.org",
+			Host:          "cdn.libravatar.org",
+		}},
+	}
+	for _, c := range cases {
+		r, err := avt.Lookup(c.email)
+		if err != nil {
+			t.Errorf("Lookup(%s): unexpected error %v", c.email, err)
+			continue
+		}
+		if *r != c.want {
+			t.Errorf("Lookup(%s) == %+v, expected %+v", c.email, *r, c.want)
+		}
+		if link, err := avt.FromEmail(c.email); err != nil || link != r.URL {
+			t.Errorf("FromEmail(%s) == %s, %v, expected %s", c.email, link, err, r.URL)
+		}
+	}
+
+	r, err := avt.LookupURL("https://Example.org/user")
+	if err != nil {
+		t.Fatalf("LookupURL: unexpected error %v", err)
+	}
+	if link, _ := avt.FromURL("https://Example.org/user"); r.URL != link || r.HashAlgorithm != HashSHA256 || len(r.Hash) != 64 || r.Domain != "example.org" || r.Federated {
+		t.Errorf("LookupURL == %+v, expected the URL %s", *r, link)
+	}
+
+	if _, err := avt.Lookup("not an email"); err == nil {
+		t.Errorf("Lookup of an invalid email: expected an error")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidSize is returned for avatar sizes out of the allowed range
+var ErrInvalidSize = errors.New("libravatar: avatar size out of range")
+
+// SetAvatarSize sets avatars image dimension (0 for default), which
+// must be within the bounds set by SetSizeBounds, 1 and 512 by default.
+// Out of range sizes are rejected with ErrInvalidSize.
+func (v *Libravatar) SetAvatarSize(size uint) error {
+	if size != 0 && (size < v.minSize || size > v.maxSize) {
+		return fmt.Errorf("size %d out of range [%d, %d]: %w", size, v.minSize, v.maxSize, ErrInvalidSize)
+	}
+	v.size = size
+	return nil
+}
+
+// SetSizeBounds sets the smallest and largest avatar dimensions
+// accepted by SetAvatarSize and per call sizes, 1 and 512 by default.
+// A size set before and out of the new bounds is reported by Validate.
+func (v *Libravatar) SetSizeBounds(min, max uint) error {
+	if min == 0 || min > max {
+		return fmt.Errorf("%w: invalid size bounds [%d, %d]", ErrInvalidConfig, min, max)
+	}
+	v.minSize, v.maxSize = min, max
+	return nil
+}
+
+// avatarSizesWorkers is the number of images fetched concurrently
+// by GetAvatarSizes
+const avatarSizesWorkers = 4
+
+// GetAvatarSizes fetches the avatar image for the given email in each
+// of the given sizes, concurrently, resolving its host only once.
+// Images which could be fetched are returned even if others failed,
+// in which case the returned error tells which sizes did.
+func (v *Libravatar) GetAvatarSizes(ctx context.Context, email string, sizes []uint) (map[uint]*Avatar, error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	base, err := v.baseURL(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := v.hash(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	seen := make(map[uint]bool, len(sizes))
+	var todo []uint
+	for _, s := range sizes {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if s < v.minSize || s > v.maxSize {
+			errs = append(errs, fmt.Errorf("size %d: %w", s, ErrInvalidSize))
+			continue
+		}
+		todo = append(todo, s)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		avatars = make(map[uint]*Avatar, len(todo))
+		sem     = make(chan struct{}, avatarSizesWorkers)
+	)
+	p := v.withFavicon(v.params(), addr)
+	for _, s := range todo {
+		p.size = s
+		link := buildURL(base, hash, p)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(s uint) {
+			defer func() { <-sem; wg.Done() }()
+			a, err := v.getAvatar(ctx, link, v.maxBodySize, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("size %d: %w", s, err))
+				return
+			}
+			avatars[s] = a
+		}(s)
+	}
+	wg.Wait()
+
+	return avatars, errors.Join(errs...)
+}
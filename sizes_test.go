@@ -0,0 +1,120 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetAvatarSizes(t *testing.T) {
+
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Query().Get("s") == "128" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngLike([]byte("0123456789size=" + r.URL.Query().Get("s"))))
+	}))
+	defer srv.Close()
+
+	var lookups atomic.Int32
+	responder := serverResponder(t, srv)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups.Add(1)
+		return responder(ctx, service, proto, name)
+	}
+
+	avatars, err := avt.GetAvatarSizes(context.Background(), "user@example.org", []uint{32, 64, 32, 128, 256, 0, 1024})
+	if err == nil {
+		t.Fatal("GetAvatarSizes: expected errors for sizes 0, 128 and 1024")
+	}
+	if !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("GetAvatarSizes: unexpected error %v", err)
+	}
+	for _, s := range []string{"size 0:", "size 128:", "size 1024:"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("GetAvatarSizes error %q does not mention %q", err, s)
+		}
+	}
+
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, expected 1", n)
+	}
+	if len(requests) != 4 {
+		t.Errorf("requests %v, expected one per valid size", requests)
+	}
+	if len(avatars) != 3 {
+		t.Errorf("got %d avatars, expected 3", len(avatars))
+	}
+	for _, s := range []uint{32, 64, 256} {
+		a := avatars[s]
+		if a == nil || !strings.HasSuffix(string(a.Data), fmt.Sprintf("size=%d", s)) {
+			t.Errorf("avatar for size %d == %+v", s, a)
+		}
+	}
+}
+
+func TestSetAvatarSize(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	link := "http://cdn.libravatar.org/avatar/" + hashOf("user@example.org")
+
+	for _, size := range []uint{0, 1, 80, 512} {
+		if err := avt.SetAvatarSize(size); err != nil {
+			t.Errorf("SetAvatarSize(%d): unexpected error %v", size, err)
+		}
+	}
+	avt.SetAvatarSize(64)
+	if err := avt.SetAvatarSize(513); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("SetAvatarSize(513) == %v, expected ErrInvalidSize", err)
+	}
+	if got, _ := avt.FromEmail("user@example.org"); got != link+"?s=64" {
+		t.Errorf("FromEmail after an invalid size == %s, expected the previous size", got)
+	}
+
+	if err := avt.SetSizeBounds(16, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := avt.SetAvatarSize(1024); err != nil {
+		t.Errorf("SetAvatarSize(1024) within the bounds: %v", err)
+	}
+	for _, size := range []uint{8, 2048} {
+		if err := avt.SetAvatarSize(size); !errors.Is(err, ErrInvalidSize) {
+			t.Errorf("SetAvatarSize(%d) == %v, expected ErrInvalidSize", size, err)
+		}
+		if _, err := avt.FromEmailWithOptions("user@example.org", ParamSize(size)); !errors.Is(err, ErrInvalidSize) {
+			t.Errorf("ParamSize(%d) == %v, expected ErrInvalidSize", size, err)
+		}
+	}
+
+	// sizes out of new bounds are reported
+	avt.SetSizeBounds(16, 256)
+	if err := avt.Validate(); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("Validate with a size out of the bounds: %v, expected ErrInvalidSize", err)
+	}
+
+	for _, b := range [][2]uint{{0, 10}, {20, 10}} {
+		if err := avt.SetSizeBounds(b[0], b[1]); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetSizeBounds(%d, %d) == %v, expected ErrInvalidConfig", b[0], b[1], err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+)
+
+// AvatarSource gives the avatar URLs of identities
+type AvatarSource interface {
+	// FromEmailContext returns the url of the avatar for the given email
+	FromEmailContext(ctx context.Context, email string) (string, error)
+	// FromURLContext returns the url of the avatar for the given OpenID
+	FromURLContext(ctx context.Context, openid string) (string, error)
+}
+
+var (
+	_ AvatarSource = (*Libravatar)(nil)
+	_ AvatarSource = (*StaticSource)(nil)
+)
+
+// StaticSource is an AvatarSource giving URLs built from a template,
+// or the same URL for every identity, without any lookup
+type StaticSource struct {
+	template string
+	size     uint
+	fixed    bool
+}
+
+// NewStaticSource returns a StaticSource giving URLs built from
+// template by fmt.Sprintf, with the identity hash (for %s) and the
+// given size (for %d) as arguments,
+// like "https://placeholder.example/%s/%d"
+func NewStaticSource(template string, size uint) *StaticSource {
+	return &StaticSource{template: template, size: size}
+}
+
+// NewFixedSource returns a StaticSource giving link for every identity
+func NewFixedSource(link string) *StaticSource {
+	return &StaticSource{template: link, fixed: true}
+}
+
+// FromEmailContext returns the url of the avatar for the given email
+func (s *StaticSource) FromEmailContext(ctx context.Context, email string) (string, error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return "", err
+	}
+	hash, err := genHash(addr, nil)
+	if err != nil {
+		return "", err
+	}
+	return s.link(hash), nil
+}
+
+// FromURLContext returns the url of the avatar for the given OpenID
+func (s *StaticSource) FromURLContext(ctx context.Context, openid string) (string, error) {
+	ourl, err := parseOpenID(openid)
+	if err != nil {
+		return "", err
+	}
+	hash, err := genHash(nil, ourl)
+	if err != nil {
+		return "", err
+	}
+	return s.link(hash), nil
+}
+
+// link returns the URL for the given identity hash
+func (s *StaticSource) link(hash string) string {
+	if s.fixed {
+		return s.template
+	}
+	return fmt.Sprintf(s.template, hash, s.size)
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestAvatarSource(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	openidHash, err := genHash(nil, mustParseOpenID(t, "https://openid.example.org/user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		source AvatarSource
+		email  string
+		openid string
+	}{
+		{
+			"libravatar", avt,
+			"http://avatars.example.org/avatar/572c3489ea700045927076136a969e27",
+			"http://avatars.example.org/avatar/" + openidHash,
+		},
+		{
+			"static", NewStaticSource("https://placeholder.example/%s/%d", 64),
+			"https://placeholder.example/572c3489ea700045927076136a969e27/64",
+			"https://placeholder.example/" + openidHash + "/64",
+		},
+		{
+			"fixed", NewFixedSource("https://placeholder.example/%2Fanon.png"),
+			"https://placeholder.example/%2Fanon.png",
+			"https://placeholder.example/%2Fanon.png",
+		},
+	}
+
+	ctx := context.Background()
+	for _, c := range cases {
+		if got, err := c.source.FromEmailContext(ctx, " User@example.org"); err != nil || got != c.email {
+			t.Errorf("%s: FromEmailContext == %s, %v, expected %s", c.name, got, err, c.email)
+		}
+		if got, err := c.source.FromURLContext(ctx, "https://openid.example.org/user"); err != nil || got != c.openid {
+			t.Errorf("%s: FromURLContext == %s, %v, expected %s", c.name, got, err, c.openid)
+		}
+		if _, err := c.source.FromEmailContext(ctx, "not an email"); err == nil {
+			t.Errorf("%s: FromEmailContext of invalid email: expected an error", c.name)
+		}
+		if _, err := c.source.FromURLContext(ctx, "ftp://openid.example.org/user"); err == nil {
+			t.Errorf("%s: FromURLContext of invalid OpenID: expected an error", c.name)
+		}
+	}
+}
+
+func mustParseOpenID(t *testing.T, openid string) *url.URL {
+	u, err := parseOpenID(openid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
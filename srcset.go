@@ -0,0 +1,93 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SrcSet returns the srcset attribute of an img element showing the
+// avatar for the given email at baseSize (0 for the default size)
+// with the given pixel densities (1 if none), along with the URL of
+// the avatar at baseSize, for the src attribute.
+// Densities exceeding the maximum avatar size are left out.
+func (v *Libravatar) SrcSet(email string, baseSize uint, densities ...float64) (srcset, src string, err error) {
+	return v.SrcSetContext(context.Background(), email, baseSize, densities...)
+}
+
+// SrcSetFromURL is like SrcSet, for an OpenID URL
+func (v *Libravatar) SrcSetFromURL(openid string, baseSize uint, densities ...float64) (srcset, src string, err error) {
+	return v.SrcSetFromURLContext(context.Background(), openid, baseSize, densities...)
+}
+
+// SrcSetContext is like SrcSet, with ctx bounding the lookup
+func (v *Libravatar) SrcSetContext(ctx context.Context, email string, baseSize uint, densities ...float64) (srcset, src string, err error) {
+	addr, err := parseEmail(email)
+	if err != nil {
+		return "", "", err
+	}
+	return v.srcSet(ctx, addr, nil, baseSize, densities)
+}
+
+// SrcSetFromURLContext is like SrcSetFromURL, with ctx bounding the
+// lookup
+func (v *Libravatar) SrcSetFromURLContext(ctx context.Context, openid string, baseSize uint, densities ...float64) (srcset, src string, err error) {
+	ourl, err := parseOpenID(openid)
+	if err != nil {
+		return "", "", err
+	}
+	return v.srcSet(ctx, nil, ourl, baseSize, densities)
+}
+
+// srcSet implements SrcSet and SrcSetFromURL
+func (v *Libravatar) srcSet(ctx context.Context, email *mail.Address, openid *url.URL, baseSize uint, densities []float64) (string, string, error) {
+	if baseSize == 0 {
+		baseSize = defaultAvatarSize
+	}
+	if baseSize < v.minSize || baseSize > v.maxSize {
+		return "", "", fmt.Errorf("size %d: %w", baseSize, ErrInvalidSize)
+	}
+	if len(densities) == 0 {
+		densities = []float64{1}
+	}
+
+	p := v.params()
+	r, base, err := v.resolve(ctx, email, openid, p)
+	if err != nil {
+		return "", "", err
+	}
+	hash := r.Hash
+	p = v.withFavicon(p, email)
+
+	var b strings.Builder
+	seen := make(map[uint]bool, len(densities))
+	for _, d := range densities {
+		if d <= 0 || math.IsInf(d, 0) || math.IsNaN(d) {
+			return "", "", fmt.Errorf("libravatar: invalid pixel density %v", d)
+		}
+		size := math.Round(float64(baseSize) * d)
+		if size > float64(v.maxSize) || size < float64(v.minSize) || seen[uint(size)] {
+			continue
+		}
+		seen[uint(size)] = true
+		p.size = uint(size)
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(buildURL(base, hash, p))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(d, 'f', -1, 64))
+		b.WriteByte('x')
+	}
+
+	p.size = baseSize
+	return b.String(), buildURL(base, hash, p), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSrcSet(t *testing.T) {
+
+	lookups := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+	}
+	const hash = "572c3489ea700045927076136a969e27"
+	const base = "http://avatars.example.org/avatar/" + hash
+
+	cases := []struct {
+		size      uint
+		densities []float64
+		srcset    string
+		src       string
+	}{
+		{80, []float64{1, 2}, base + "?s=80 1x, " + base + "?s=160 2x", base + "?s=80"},
+		{0, nil, base + "?s=80 1x", base + "?s=80"},
+		{100, []float64{1.5}, base + "?s=150 1.5x", base + "?s=100"},
+		{33, []float64{1, 1.5, 2}, base + "?s=33 1x, " + base + "?s=50 1.5x, " + base + "?s=66 2x", base + "?s=33"},
+		// over the cap
+		{200, []float64{1, 2, 3}, base + "?s=200 1x, " + base + "?s=400 2x", base + "?s=200"},
+		{512, []float64{2}, "", base + "?s=512"},
+		// rounding to the same size
+		{1, []float64{1, 1.2}, base + "?s=1 1x", base + "?s=1"},
+	}
+	for _, c := range cases {
+		lookups = 0
+		avt.nameCache.purge()
+		srcset, src, err := avt.SrcSet("user@example.org", c.size, c.densities...)
+		if err != nil {
+			t.Errorf("SrcSet(%d, %v): unexpected error %v", c.size, c.densities, err)
+			continue
+		}
+		if srcset != c.srcset || src != c.src {
+			t.Errorf("SrcSet(%d, %v) == %q, %q, expected %q, %q", c.size, c.densities, srcset, src, c.srcset, c.src)
+		}
+		if lookups != 1 {
+			t.Errorf("SrcSet(%d, %v) performed %d lookups, expected 1", c.size, c.densities, lookups)
+		}
+	}
+
+	if _, _, err := avt.SrcSet("user@example.org", 1000); !errors.Is(err, ErrInvalidSize) {
+		t.Errorf("SrcSet with size over the cap: unexpected error %v", err)
+	}
+	if _, _, err := avt.SrcSet("user@example.org", 80, -1); err == nil {
+		t.Errorf("SrcSet with negative density: expected an error")
+	}
+
+	srcset, src, err := avt.SrcSetFromURL("https://openid.example.org/user", 64, 1, 2)
+	if err != nil {
+		t.Fatalf("SrcSetFromURL: unexpected error %v", err)
+	}
+	link, _ := avt.FromURL("https://openid.example.org/user")
+	if src != link+"?s=64" || srcset != link+"?s=64 1x, "+link+"?s=128 2x" {
+		t.Errorf("SrcSetFromURL == %q, %q", srcset, src)
+	}
+	if _, _, err := avt.SrcSetFromURL("openid.example.org/user", 64); err == nil {
+		t.Errorf("SrcSetFromURL with relative URL: expected an error")
+	}
+
+	// the caller context reaches the lookup
+	type ctxKey struct{}
+	var got any
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		got = ctx.Value(ctxKey{})
+		return srvResponder()(ctx, service, proto, name)
+	}
+	avt.nameCache.purge()
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	if _, _, err := avt.SrcSetFromURLContext(ctx, "https://openid.example.org/user", 64); err != nil || got != "caller" {
+		t.Errorf("SrcSetFromURLContext returned %v, lookup with context value %v", err, got)
+	}
+
+	// the checks of FromURL apply
+	avt.SetStrict(true)
+	avt.SetFallbackHost("cdn.example.org/x")
+	if _, _, err := avt.SrcSetFromURL("https://openid.example.org/user", 64); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("strict SrcSetFromURL with invalid configuration: unexpected error %v", err)
+	}
+	avt.SetGravatarMode(true)
+	if _, _, err := avt.SrcSetFromURL("https://openid.example.org/user", 64); !errors.Is(err, ErrGravatarOpenID) {
+		t.Errorf("SrcSetFromURL in Gravatar mode: unexpected error %v", err)
+	}
+}
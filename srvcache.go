@@ -0,0 +1,220 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// srvCacheShards is the number of independently locked parts of
+	// the SRV cache, so that concurrent lookups of different domains
+	// rarely wait for each other
+	srvCacheShards = 32
+	// srvCacheSweepEvery is the number of entries stored in a shard
+	// between removals of its expired entries
+	srvCacheSweepEvery = 256
+	// srvCacheEvictSample is the number of entries among which the
+	// least recently used is evicted when the SRV cache is full
+	srvCacheEvictSample = 8
+)
+
+// SetCacheMaxEntries bounds the number of SRV lookups cached (0, the
+// default, for no limit). Once full, storing a lookup evicts one of
+// the least recently used, approximately: recency is compared among a
+// few entries of the same part of the cache only, so that looking up
+// cached entries never waits for other lookups.
+func (v *Libravatar) SetCacheMaxEntries(max int) {
+	v.nameCache.setMax(max)
+	v.urlCache.purge()
+}
+
+// srvCache caches SRV lookups by service and domain, safe for
+// concurrent use. Its zero value is an empty, unbounded, cache.
+type srvCache struct {
+	shards [srvCacheShards]srvCacheShard
+	max    atomic.Int64 // maximum number of entries, 0 for no limit
+	count  atomic.Int64 // number of entries
+}
+
+// srvCacheShard is a part of an srvCache
+type srvCacheShard struct {
+	mu   sync.RWMutex
+	m    map[cacheKey]*srvCacheEntry
+	tick atomic.Uint64 // incremented on every use of an entry
+	sets int           // entries stored since the last sweep
+}
+
+// srvCacheEntry is an entry of an srvCache
+type srvCacheEntry struct {
+	val  cacheValue
+	used atomic.Uint64 // tick of its shard when last used
+}
+
+// index returns the index of the shard holding key
+func (c *srvCache) index(key cacheKey) int {
+	// FNV-1a of the domain, services of a domain share a shard
+	h := uint32(2166136261)
+	for i := 0; i < len(key.domain); i++ {
+		h ^= uint32(key.domain[i])
+		h *= 16777619
+	}
+	return int(h % srvCacheShards)
+}
+
+// get returns the value cached for key, if any
+func (c *srvCache) get(key cacheKey) (cacheValue, bool) {
+	s := &c.shards[c.index(key)]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, found := s.m[key]
+	if !found {
+		return cacheValue{}, false
+	}
+	if c.max.Load() > 0 {
+		e.used.Store(s.tick.Add(1))
+	}
+	return e.val, true
+}
+
+// set caches val for key, evicting entries if the cache is full, and
+// removing from time to time the expired entries, so that domains not
+// looked up anymore do not stay in the cache forever
+func (c *srvCache) set(key cacheKey, val cacheValue) {
+	i := c.index(key)
+	s := &c.shards[i]
+	s.mu.Lock()
+	if s.m == nil {
+		s.m = make(map[cacheKey]*srvCacheEntry)
+	}
+	e, found := s.m[key]
+	if found {
+		e.val = val
+	} else {
+		e = &srvCacheEntry{val: val}
+		s.m[key] = e
+		c.count.Add(1)
+	}
+	e.used.Store(s.tick.Add(1))
+	if s.sets++; s.sets >= srvCacheSweepEvery {
+		c.sweep(s, val.checkedAt)
+	}
+	s.mu.Unlock()
+	c.evict(i, key)
+}
+
+// evict removes entries while the cache holds more than its maximum,
+// from the shard at index i first, never removing keep
+func (c *srvCache) evict(i int, keep cacheKey) {
+	for empty := 0; empty < srvCacheShards; {
+		if max := c.max.Load(); max <= 0 || c.count.Load() <= max {
+			return
+		}
+		if !c.evictOne(&c.shards[i], keep) {
+			i = (i + 1) % srvCacheShards
+			empty++
+		}
+	}
+}
+
+// evictOne removes from s the least recently used of a sample of its
+// entries other than keep, telling whether there was any
+func (c *srvCache) evictOne(s *srvCacheShard, keep cacheKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		oldest cacheKey
+		used   uint64
+		n      int
+	)
+	// map iteration starts at a random entry
+	for key, e := range s.m {
+		if key == keep {
+			continue
+		}
+		if u := e.used.Load(); n == 0 || u < used {
+			oldest, used = key, u
+		}
+		if n++; n == srvCacheEvictSample {
+			break
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	delete(s.m, oldest)
+	c.count.Add(-1)
+	return true
+}
+
+// sweep removes the entries of s expired at now, s must be locked
+func (c *srvCache) sweep(s *srvCacheShard, now time.Time) {
+	for key, e := range s.m {
+		if now.Sub(e.val.checkedAt) > e.val.ttl {
+			delete(s.m, key)
+			c.count.Add(-1)
+		}
+	}
+	s.sets = 0
+}
+
+// setMax bounds the number of entries to max (0 for no limit),
+// evicting the ones in excess
+func (c *srvCache) setMax(max int) {
+	if max < 0 {
+		max = 0
+	}
+	c.max.Store(int64(max))
+	c.evict(0, cacheKey{})
+}
+
+// each calls f for the cached entries until it returns false.
+// f must not use the cache.
+func (c *srvCache) each(f func(cacheKey, cacheValue) bool) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for key, e := range s.m {
+			if !f(key, e.val) {
+				s.mu.RUnlock()
+				return
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// update replaces the cached entries for which f returns true with
+// the value it returns. f must not use the cache.
+func (c *srvCache) update(f func(cacheKey, cacheValue) (cacheValue, bool)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key, e := range s.m {
+			if val, ok := f(key, e.val); ok {
+				e.val = val
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// len returns the number of cached entries
+func (c *srvCache) len() int {
+	return int(c.count.Load())
+}
+
+// purge drops all entries
+func (c *srvCache) purge() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		c.count.Add(-int64(len(s.m)))
+		s.m = nil
+		s.mu.Unlock()
+	}
+}
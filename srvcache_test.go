@@ -0,0 +1,217 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSRVCacheConcurrent(t *testing.T) {
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	target, _ := url.Parse("http://avatars.example.org/")
+	domains := make([]string, 50)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("d%d.example.org", i)
+	}
+
+	// mixed reads and writes through lookups, expirations and purges
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				email := "user@" + domains[(g*7+i)%len(domains)]
+				if link, err := avt.FromEmail(email); err != nil || link != "http://avatars.example.org/avatar/"+hashOf(email) {
+					t.Errorf("FromEmail(%s) == %s, %v", email, link, err)
+					return
+				}
+				switch {
+				case g == 0 && i%20 == 0:
+					expireCache(avt)
+				case g == 1 && i%50 == 0:
+					avt.nameCache.purge()
+				case g == 2:
+					avt.srvBackups(target)
+					avt.nameCache.len()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := avt.nameCache.len(); n == 0 || n > len(domains) {
+		t.Errorf("%d cache entries, expected up to %d", n, len(domains))
+	}
+	st := avt.Stats()
+	if st.Lookups+st.CacheHits != 8*200 {
+		t.Errorf("%d lookups and %d cache hits, expected %d in total", st.Lookups, st.CacheHits, 8*200)
+	}
+}
+
+func TestSRVCacheSweep(t *testing.T) {
+
+	var c srvCache
+	start := time.Now()
+	for i := 0; i < srvCacheSweepEvery-1; i++ {
+		c.set(cacheKey{fmt.Sprint("s", i), "example.org"}, cacheValue{checkedAt: start, ttl: time.Minute})
+	}
+	c.set(cacheKey{"avatars", "example.net"}, cacheValue{checkedAt: start, ttl: time.Hour})
+	if n := c.len(); n != srvCacheSweepEvery {
+		t.Fatalf("%d cache entries, expected %d", n, srvCacheSweepEvery)
+	}
+
+	// services of a domain share a shard, swept once enough entries
+	// were stored there
+	c.set(cacheKey{"avatars", "example.org"}, cacheValue{checkedAt: start.Add(2 * time.Minute), ttl: time.Minute})
+	if n := c.len(); n != 2 {
+		t.Errorf("%d cache entries after a sweep, expected 2", n)
+	}
+	if _, ok := c.get(cacheKey{"avatars", "example.net"}); !ok {
+		t.Errorf("unexpired entry swept")
+	}
+}
+
+func TestSRVCacheLRU(t *testing.T) {
+
+	key := func(service string) cacheKey {
+		// services of a domain share a shard
+		return cacheKey{service, "example.org"}
+	}
+	val := cacheValue{checkedAt: time.Now(), ttl: time.Hour}
+	var c srvCache
+	for _, s := range []string{"a", "b", "c"} {
+		c.set(key(s), val)
+	}
+
+	c.setMax(2)
+	if n := c.len(); n != 2 {
+		t.Fatalf("%d cache entries after bounding the cache, expected 2", n)
+	}
+	c.purge()
+	c.set(key("a"), val)
+	c.set(key("b"), val)
+	c.get(key("a"))
+	c.set(key("c"), val)
+	if _, ok := c.get(key("b")); ok {
+		t.Errorf("least recently used entry not evicted")
+	}
+	for _, s := range []string{"a", "c"} {
+		if _, ok := c.get(key(s)); !ok {
+			t.Errorf("entry %s evicted, expected it to be kept", s)
+		}
+	}
+	c.set(key("a"), val) // updates do not evict
+	if n := c.len(); n != 2 {
+		t.Errorf("%d cache entries after an update, expected 2", n)
+	}
+
+	c.setMax(0)
+	for _, s := range []string{"d", "e", "f"} {
+		c.set(key(s), val)
+	}
+	if n := c.len(); n != 5 {
+		t.Errorf("%d cache entries without a bound, expected 5", n)
+	}
+
+	// the bound is global, whatever the shards of the keys
+	for _, max := range []int{1, 10, 100} {
+		var c srvCache
+		c.setMax(max)
+		for i := 0; i < 3*max; i++ {
+			c.set(cacheKey{"avatars", fmt.Sprintf("d%d.example.org", i)}, val)
+			if n := c.len(); n > max {
+				t.Fatalf("%d cache entries with a maximum of %d", n, max)
+			}
+		}
+		if n := c.len(); n != max {
+			t.Errorf("%d cache entries with a maximum of %d, expected it to be reached", n, max)
+		}
+		// lowering the bound evicts
+		c.setMax(max / 2)
+		if n := c.len(); n > max/2 && max > 1 {
+			t.Errorf("%d cache entries after lowering the maximum to %d", n, max/2)
+		}
+	}
+
+	// bounding the cache of an object
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.SetCacheMaxEntries(10)
+	for i := 0; i < 100; i++ {
+		avt.FromEmail(fmt.Sprintf("user@d%d.example.org", i))
+	}
+	if n := avt.nameCache.len(); n > 10 {
+		t.Errorf("%d cache entries, expected at most 10", n)
+	}
+}
+
+// mutexCache is an SRV cache guarded by a single mutex, for comparison
+type mutexCache struct {
+	mu sync.Mutex
+	m  map[cacheKey]cacheValue
+}
+
+func (c *mutexCache) get(key cacheKey) (cacheValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, found := c.m[key]
+	return val, found
+}
+
+func (c *mutexCache) set(key cacheKey, val cacheValue) {
+	c.mu.Lock()
+	c.m[key] = val
+	c.mu.Unlock()
+}
+
+// BenchmarkSRVCache compares the SRV cache to a single mutex design
+// under a read-heavy load, run it with -cpu 1,4,16
+func BenchmarkSRVCache(b *testing.B) {
+	keys := make([]cacheKey, 300)
+	for i := range keys {
+		keys[i] = cacheKey{"avatars", fmt.Sprintf("d%d.example.org", i)}
+	}
+	val := cacheValue{checkedAt: time.Now(), ttl: time.Hour}
+
+	bench := func(b *testing.B, get func(cacheKey) (cacheValue, bool), set func(cacheKey, cacheValue)) {
+		for _, k := range keys {
+			set(k, val)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				k := keys[i%len(keys)]
+				// one write every 100 reads
+				if i%100 == 0 {
+					set(k, val)
+				} else if _, ok := get(k); !ok {
+					b.Error("cache miss")
+				}
+				i++
+			}
+		})
+	}
+	b.Run("sharded", func(b *testing.B) {
+		var c srvCache
+		bench(b, c.get, c.set)
+	})
+	b.Run("sharded LRU", func(b *testing.B) {
+		var c srvCache
+		c.setMax(len(keys))
+		bench(b, c.get, c.set)
+	})
+	b.Run("mutex", func(b *testing.B) {
+		c := &mutexCache{m: make(map[cacheKey]cacheValue)}
+		bench(b, c.get, c.set)
+	})
+}
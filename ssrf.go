@@ -0,0 +1,262 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenTarget is returned when fetching from an avatar server
+// resolving only to private addresses, see SetBlockPrivateTargets
+var ErrForbiddenTarget = errors.New("libravatar: refusing to connect to a private address")
+
+// metadataAddrs are addresses of cloud metadata services which are
+// neither loopback, link-local nor private
+var metadataAddrs = []netip.Prefix{
+	netip.MustParsePrefix("100.100.100.200/32"), // Alibaba Cloud
+}
+
+// SetBlockPrivateTargets enables or disables refusing connections to
+// loopback, link-local, private (RFC 1918 and unique local) and cloud
+// metadata addresses when fetching avatars, so that domains cannot
+// publish SRV records making us request internal services. The check
+// is made when connecting, so it also covers redirects and DNS
+// rebinding. Fallback hosts and domain overrides, which are trusted,
+// are not checked.
+//
+// Blocked requests fail with ErrForbiddenTarget, or are retried
+// against the fallback hosts if SetFailover is enabled.
+// It is disabled by default, but enabled for Handler, see
+// HandlerBlockPrivateTargets.
+func (v *Libravatar) SetBlockPrivateTargets(block bool) {
+	v.blockPrivate = block
+}
+
+// blockPrivateKey is the context key overriding SetBlockPrivateTargets
+type blockPrivateKey struct{}
+
+// withBlockPrivate returns a copy of ctx overriding the setting of
+// SetBlockPrivateTargets
+func withBlockPrivate(ctx context.Context, block bool) context.Context {
+	return context.WithValue(ctx, blockPrivateKey{}, block)
+}
+
+// blockingPrivate tells whether requests made with ctx must not
+// connect to private addresses
+func (v *Libravatar) blockingPrivate(ctx context.Context) bool {
+	if block, ok := ctx.Value(blockPrivateKey{}).(bool); ok {
+		return block
+	}
+	return v.blockPrivate
+}
+
+// privateAddr tells whether ip is an address we should not connect to
+func privateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, p := range metadataAddrs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedAddr tells whether addr, a host:port, is configured rather
+// than found through DNS, and can be connected to regardless of its
+// address. Configured hosts without a port are trusted on any port.
+func (v *Libravatar) trustedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	trusted := func(h string) bool {
+		if _, _, err := net.SplitHostPort(h); err == nil {
+			return h == addr
+		}
+		return strings.Trim(h, "[]") == host
+	}
+	for _, hosts := range [][]string{v.fallbackHosts, v.secureFallbackHosts} {
+		for _, h := range hosts {
+			if trusted(h) {
+				return true
+			}
+		}
+	}
+	for _, target := range v.domainOverrides {
+		if trusted(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr is a net.Dialer Control function refusing connections to
+// private addresses
+func checkAddr(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, address)
+	}
+	if privateAddr(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, address)
+	}
+	return nil
+}
+
+// guardedClient returns a copy of the configured HTTP client refusing
+// connections to private addresses
+func (v *Libravatar) guardedClient() *http.Client {
+	v.guardMu.Lock()
+	defer v.guardMu.Unlock()
+	if v.guarded != nil && v.guardedFrom == v.httpClient {
+		return v.guarded
+	}
+
+	client := *v.httpClient
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t, ok := base.(*http.Transport); ok {
+		client.Transport = v.guardTransport(t.Clone())
+	} else {
+		client.Transport = &guardedTransport{v, base}
+	}
+	v.guarded, v.guardedFrom = &client, v.httpClient
+	return v.guarded
+}
+
+// guardTransport makes t, a copy of the configured transport, refuse
+// connections to private addresses. Its dialer, if any, is kept, the
+// address it connected to being checked afterwards. Proxies, which are
+// configured, are trusted: the hosts of the requests sent through them
+// are checked instead, as by guardedTransport.
+func (v *Libravatar) guardTransport(t *http.Transport) *http.Transport {
+	var proxies sync.Map // addresses of the proxies used, which are trusted
+	if proxy := t.Proxy; proxy != nil {
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if err != nil || u == nil {
+				return u, err
+			}
+			if err := v.checkTarget(req.Context(), requestAddr(req)); err != nil {
+				return nil, err
+			}
+			proxies.Store(proxyAddr(u), true)
+			return u, nil
+		}
+	}
+
+	dial := t.DialContext
+	guarded := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkAddr}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, proxied := proxies.Load(addr)
+		trusted := proxied || v.trustedAddr(addr)
+		if dial == nil {
+			if trusted {
+				return (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext(ctx, network, addr)
+			}
+			return guarded.DialContext(ctx, network, addr)
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil || trusted {
+			return conn, err
+		}
+		if err := checkConn(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return t
+}
+
+// proxyAddr returns the host:port of the proxy at u
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkConn refuses conn if it is connected to a private address
+func checkConn(conn net.Conn) error {
+	addr := conn.RemoteAddr().String()
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil || privateAddr(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenTarget, addr)
+	}
+	return nil
+}
+
+// checkTarget refuses addr, a host:port, if it is not trusted and its
+// host only resolves to private addresses
+func (v *Libravatar) checkTarget(ctx context.Context, addr string) error {
+	if v.trustedAddr(addr) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	var addrs []string
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []string{ip.String()}
+	} else if addrs, err = v.lookupHost(ctx, host); err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ip, err := netip.ParseAddr(a); err == nil && !privateAddr(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrForbiddenTarget, host)
+}
+
+// requestAddr returns the host:port req is sent to
+func requestAddr(req *http.Request) string {
+	port := req.URL.Port()
+	if port == "" {
+		port = strconv.Itoa(int(defaultPort(req.URL.Scheme)))
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+// guardedTransport checks the addresses of hosts before sending
+// requests through transports whose dialer cannot be hooked
+type guardedTransport struct {
+	v    *Libravatar
+	base http.RoundTripper
+}
+
+func (t *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.v.checkTarget(req.Context(), requestAddr(req)); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrivateAddr(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1":        true,
+		"10.0.0.5":         true,
+		"172.16.3.4":       true,
+		"192.168.1.1":      true,
+		"169.254.169.254":  true,
+		"100.100.100.200":  true,
+		"0.0.0.0":          true,
+		"::1":              true,
+		"fe80::1":          true,
+		"fd00:ec2::254":    true,
+		"::ffff:127.0.0.1": true,
+		"93.184.216.34":    false,
+		"100.64.0.1":       false,
+		"2606:4700::1111":  false,
+	}
+	for addr, want := range cases {
+		if got := privateAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("privateAddr(%s) == %v, expected %v", addr, got, want)
+		}
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper calling itself
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestBlockPrivateTargets(t *testing.T) {
+
+	var internalHits int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer internal.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer fallback.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, internal)
+	avt.SetFallbackHost(strings.TrimPrefix(fallback.URL, "http://"))
+
+	// off by default
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); err != nil || internalHits != 1 {
+		t.Errorf("GetAvatar without blocking returned %v after %d requests", err, internalHits)
+	}
+
+	avt.SetBlockPrivateTargets(true)
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); !errors.Is(err, ErrForbiddenTarget) {
+		t.Errorf("GetAvatar from loopback target: unexpected error %v", err)
+	}
+	if internalHits != 1 {
+		t.Errorf("%d requests reached the loopback target, expected none", internalHits-1)
+	}
+
+	// the trusted fallback host is used on failover
+	avt.SetFailover(true)
+	if a, err := avt.GetAvatar(context.Background(), "other@example.org"); err != nil || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatar with failover returned %v, %v", a, err)
+	}
+	if internalHits != 1 {
+		t.Errorf("%d requests reached the loopback target, expected none", internalHits-1)
+	}
+
+	// transports whose dialer cannot be hooked check addresses first
+	var sent []string
+	avt = New()
+	avt.SetBlockPrivateTargets(true)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return srvResponder(&net.SRV{Target: "avatars." + name + ".", Port: 80})(ctx, service, proto, name)
+	}
+	avt.SetDomainOverride("internal.org", "127.0.0.1:8080")
+	avt.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "avatars.public.org" {
+			return []string{"10.0.0.1", "93.184.216.34"}, nil
+		}
+		return []string{"10.0.0.1", "::1"}, nil
+	}
+	avt.SetHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.URL.Host)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"image/png"}},
+			Body:       io.NopCloser(bytes.NewReader(testPNG)),
+			Request:    req,
+		}, nil
+	})})
+	for _, c := range []struct {
+		email   string
+		blocked bool
+	}{
+		{"user@public.org", false},
+		{"user@private.org", true},
+		{"user@internal.org", false}, // overrides are trusted
+	} {
+		_, err := avt.GetAvatar(context.Background(), c.email)
+		if c.blocked && !errors.Is(err, ErrForbiddenTarget) || !c.blocked && err != nil {
+			t.Errorf("GetAvatar(%s) through a custom transport: unexpected error %v", c.email, err)
+		}
+	}
+	if len(sent) != 2 || sent[0] != "avatars.public.org" || sent[1] != "127.0.0.1:8080" {
+		t.Errorf("requests sent to %v", sent)
+	}
+}
+
+func TestBlockPrivateTargetsTransport(t *testing.T) {
+
+	var internalHits int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer internal.Close()
+
+	// custom dialers are kept, the addresses they connect to checked
+	var dials int
+	avt := New()
+	avt.SetBlockPrivateTargets(true)
+	avt.lookupSRV = serverResponder(t, internal)
+	avt.SetHTTPClient(&http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}})
+	if _, err := avt.GetAvatar(context.Background(), "user@example.org"); !errors.Is(err, ErrForbiddenTarget) {
+		t.Errorf("GetAvatar from loopback target with a custom dialer: unexpected error %v", err)
+	}
+	if dials != 1 || internalHits != 0 {
+		t.Errorf("%d dials and %d requests to the loopback target, expected 1 and none", dials, internalHits)
+	}
+	avt.SetDomainOverride("internal.org", strings.TrimPrefix(internal.URL, "http://"))
+	if _, err := avt.GetAvatar(context.Background(), "user@internal.org"); err != nil {
+		t.Errorf("GetAvatar from trusted target with a custom dialer: unexpected error %v", err)
+	}
+	if dials != 2 || internalHits != 1 {
+		t.Errorf("%d dials and %d requests to the trusted target, expected 2 and 1", dials, internalHits)
+	}
+
+	// proxies are trusted, the hosts of the requests sent through them checked
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	avt = New()
+	avt.SetBlockPrivateTargets(true)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return srvResponder(&net.SRV{Target: "avatars." + name + ".", Port: 80})(ctx, service, proto, name)
+	}
+	avt.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "avatars.public.org" {
+			return []string{"93.184.216.34"}, nil
+		}
+		return []string{"10.0.0.1"}, nil
+	}
+	avt.SetHTTPClient(&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}})
+	if a, err := avt.GetAvatar(context.Background(), "user@public.org"); err != nil || !bytes.Equal(a.Data, testPNG) {
+		t.Errorf("GetAvatar through a loopback proxy returned %v, %v", a, err)
+	}
+	if _, err := avt.GetAvatar(context.Background(), "user@private.org"); !errors.Is(err, ErrForbiddenTarget) {
+		t.Errorf("GetAvatar from private target through a proxy: unexpected error %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "avatars.public.org" {
+		t.Errorf("requests proxied to %v", proxied)
+	}
+}
+
+func TestHandlerBlocksPrivateTargets(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer upstream.Close()
+
+	avt := New()
+	avt.lookupSRV = serverResponder(t, upstream)
+
+	for _, c := range []struct {
+		opts   []HandlerOption
+		status int
+	}{
+		{[]HandlerOption{HandlerAllowEmail()}, http.StatusBadGateway},
+		{[]HandlerOption{HandlerAllowEmail(), HandlerBlockPrivateTargets(false)}, http.StatusOK},
+	} {
+		srv := httptest.NewServer(avt.Handler(c.opts...))
+		resp, err := http.Get(srv.URL + "/avatar/user@example.org")
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("handler with %d options answered %s, expected %d", len(c.opts), resp.Status, c.status)
+		}
+	}
+}
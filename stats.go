@@ -0,0 +1,45 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "sync/atomic"
+
+// Stats holds counters about the lookups performed by a Libravatar object
+type Stats struct {
+	Lookups   uint64 // SRV queries sent to DNS
+	CacheHits uint64 // lookups answered by the cache
+	Timeouts  uint64 // SRV queries which timed out
+	DNSErrors uint64 // SRV queries which failed for reasons other than timeout or missing record
+	Failovers uint64 // HTTP requests retried against a fallback host
+
+	SizeMismatches uint64 // validated images not matching the requested size
+	ProbeFailures  uint64 // SRV targets found unreachable or without addresses, see SetVerifyTarget
+}
+
+// stats is the internal, concurrency-safe, version of Stats
+type stats struct {
+	lookups   atomic.Uint64
+	cacheHits atomic.Uint64
+	timeouts  atomic.Uint64
+	dnsErrors atomic.Uint64
+	failovers atomic.Uint64
+
+	sizeMismatches atomic.Uint64
+	probeFailures  atomic.Uint64
+}
+
+// Stats returns a snapshot of the lookup counters
+func (v *Libravatar) Stats() Stats {
+	return Stats{
+		Lookups:   v.stats.lookups.Load(),
+		CacheHits: v.stats.cacheHits.Load(),
+		Timeouts:  v.stats.timeouts.Load(),
+		DNSErrors: v.stats.dnsErrors.Load(),
+		Failovers: v.stats.failovers.Load(),
+
+		SizeMismatches: v.stats.sizeMismatches.Load(),
+		ProbeFailures:  v.stats.probeFailures.Load(),
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// StreamFromEmails sends to out the Result for each email received
+// from in, until in is closed or ctx is done, returning ctx.Err() in
+// the latter case. Emails are processed concurrently, bounded like
+// FromEmails, so results are sent in no particular order. Each domain
+// is resolved once, however many emails share it, even if the SRV
+// cache is disabled. out is not closed:
+// once StreamFromEmails returns, nothing more is sent to it.
+func (v *Libravatar) StreamFromEmails(ctx context.Context, in <-chan string, out chan<- Result) error {
+	if in == nil || out == nil {
+		return fmt.Errorf("%w: nil channel", ErrInvalidInput)
+	}
+	workers := warmCacheWorkers
+	if v.lookupSem != nil {
+		workers = cap(v.lookupSem)
+	}
+
+	var wg sync.WaitGroup
+	p := v.params()
+	ctx = withDomainMemo(ctx)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var email string
+				select {
+				case e, ok := <-in:
+					if !ok {
+						return
+					}
+					email = e
+				case <-ctx.Done():
+					return
+				}
+
+				var r Result
+				addr, err := parseEmail(email)
+				if err == nil {
+					r, err = v.result(ctx, addr, nil, p)
+				}
+				r.Email, r.Err = email, err
+				if ctx.Err() != nil {
+					return
+				}
+
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// settleGoroutines waits for the number of goroutines to go back to n,
+// returning the last count seen
+func settleGoroutines(n int) int {
+	var got int
+	for i := 0; i < 100; i++ {
+		if got = runtime.NumGoroutine(); got <= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return got
+}
+
+func TestStreamFromEmails(t *testing.T) {
+
+	const emails = 100000
+	domains := []string{"a.org", "b.org", "c.org", "d.org", "e.org"}
+
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		lookups[name]++
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		if name == "a.org" {
+			return "", []*net.SRV{{Target: "avatars.a.org.", Port: 80}}, nil
+		}
+		return srvResponder()(ctx, service, proto, name)
+	}
+
+	before := runtime.NumGoroutine()
+	in := make(chan string)
+	out := make(chan Result)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- avt.StreamFromEmails(context.Background(), in, out)
+	}()
+	go func() {
+		for i := 0; i < emails; i++ {
+			in <- fmt.Sprintf("user%d@%s", i, domains[i%len(domains)])
+		}
+		in <- "not an email"
+		close(in)
+	}()
+
+	var received, failed, federated int
+	done := false
+	for !done {
+		select {
+		case r := <-out:
+			received++
+			if r.Err != nil {
+				failed++
+			} else if r.Federated {
+				federated++
+			}
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("StreamFromEmails: unexpected error %v", err)
+			}
+			done = true
+		}
+	}
+	if received != emails+1 || failed != 1 || federated != emails/len(domains) {
+		t.Errorf("received %d results, %d failed and %d federated", received, failed, federated)
+	}
+	for _, d := range domains {
+		if lookups[d] != 1 {
+			t.Errorf("%d lookups for %s, expected 1", lookups[d], d)
+		}
+	}
+	if n := settleGoroutines(before); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+
+	// domains are resolved once per call even if lookups are not cached
+	avt.SetCacheDuration(0)
+	lookups = make(map[string]int)
+	in = make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		in <- fmt.Sprintf("user%d@%s", i, domains[i%len(domains)])
+	}
+	close(in)
+	out = make(chan Result, 100)
+	if err := avt.StreamFromEmails(context.Background(), in, out); err != nil {
+		t.Errorf("StreamFromEmails without cache: unexpected error %v", err)
+	}
+	if len(out) != 100 {
+		t.Errorf("StreamFromEmails without cache sent %d results, expected 100", len(out))
+	}
+	for _, d := range domains {
+		if lookups[d] != 1 {
+			t.Errorf("%d lookups for %s without cache, expected 1", lookups[d], d)
+		}
+	}
+}
+
+func TestStreamFromEmailsCancel(t *testing.T) {
+
+	var lookups atomic.Int32
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups.Add(1)
+		return srvResponder()(ctx, service, proto, name)
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan string)
+	out := make(chan Result) // never read: workers block sending
+	errc := make(chan error, 1)
+	go func() {
+		errc <- avt.StreamFromEmails(ctx, in, out)
+	}()
+	for i := 0; i < 20; i++ {
+		select {
+		case in <- fmt.Sprintf("user%d@example.org", i):
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("StreamFromEmails after cancel returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamFromEmails did not stop on cancel")
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, expected 1", n)
+	}
+	if n := settleGoroutines(before); n > before {
+		t.Errorf("%d goroutines left running, %d before", n, before)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalidConfig is returned in strict mode when the configuration
+// of a Libravatar object is not valid, see SetStrict
+var ErrInvalidConfig = errors.New("libravatar: invalid configuration")
+
+// SetStrict makes URL builders check the configuration, as done by
+// Validate, before building anything, failing with ErrInvalidConfig
+// rather than producing broken URLs
+func (v *Libravatar) SetStrict(strict bool) {
+	v.strict = strict
+	v.urlCache.purge()
+}
+
+// Validate checks the configuration is consistent: the avatar size
+// is in the allowed range, the plain and secure fallback hosts are
+// valid hosts, the default image an allowed http(s) URL or one of
+// KnownDefaults, the image cache limits are not negative, and no hash function is
+// set together with Gravatar mode or Gravatar default images.
+// All the problems found are reported together, joined with
+// errors.Join, each wrapping ErrInvalidConfig.
+func (v *Libravatar) Validate() error {
+	p := v.params()
+	p.defURL = v.defURL
+	return v.validate(p)
+}
+
+// validate checks the configuration is valid for building URLs with
+// the parameters in p
+func (v *Libravatar) validate(p params) error {
+	errs := []error{v.checkSize(p.size)}
+	if !v.gravatarMode {
+		errs = append(errs, checkHosts("", v.fallbackHosts), checkHosts("secure ", v.secureFallbackHosts))
+	}
+	errs = append(errs, v.checkDefaultImage(p.defURL))
+	if v.imageCacheDir != "" && (v.imageCacheTTL < 0 || v.imageCacheMaxBytes < 0) {
+		errs = append(errs, fmt.Errorf("%w: negative image cache TTL %s or size %d", ErrInvalidConfig, v.imageCacheTTL, v.imageCacheMaxBytes))
+	}
+	if v.hashFunc != nil && (v.gravatarMode || v.gravatarDefault) {
+		errs = append(errs, fmt.Errorf("%w: custom hash function used with Gravatar", ErrInvalidConfig))
+	}
+	return errors.Join(errs...)
+}
+
+// checkSize checks size (0 for the default) is in the allowed range
+func (v *Libravatar) checkSize(size uint) error {
+	if size != 0 && (size < v.minSize || size > v.maxSize) {
+		return fmt.Errorf("%w: avatar size %d out of range [%d, %d]: %w", ErrInvalidConfig, size, v.minSize, v.maxSize, ErrInvalidSize)
+	}
+	return nil
+}
+
+// checkHosts checks the kind ("" or "secure ") fallback hosts are
+// valid hosts, with optional port
+func checkHosts(kind string, hosts []string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("%w: no %sfallback host", ErrInvalidConfig, kind)
+	}
+	var errs []error
+	for _, host := range hosts {
+		errs = append(errs, checkHost(kind, host))
+	}
+	return errors.Join(errs...)
+}
+
+// checkHost checks host is a valid host, with optional port
+func checkHost(kind, host string) error {
+	if host == "" {
+		return fmt.Errorf("%w: empty %sfallback host", ErrInvalidConfig, kind)
+	}
+	u, err := url.Parse("//" + host)
+	if err != nil || u.Host != host || u.User != nil || strings.ContainsAny(host, " \t") {
+		return fmt.Errorf("%w: invalid %sfallback host %q", ErrInvalidConfig, kind, host)
+	}
+	return nil
+}
+
+// checkDefaultImage checks defURL is empty, an absolute http(s) URL
+// allowed by SetDefaultURLAllowlist or one of KnownDefaults
+func (v *Libravatar) checkDefaultImage(defURL string) error {
+	if defURL != "" && !isImageURL(defURL) && !v.knownDefault(defURL) {
+		return fmt.Errorf("%w: unknown default image %q, expected an URL or one of %s",
+			ErrInvalidConfig, defURL, strings.Join(v.KnownDefaults(), ", "))
+	}
+	return v.checkDefaultURLAllowed(defURL)
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStrict(t *testing.T) {
+
+	cases := []struct {
+		name      string
+		configure func(*Libravatar)
+		lenient   string // URL built in non-strict mode
+	}{
+		{"size too large", func(v *Libravatar) { v.size = 1000 }, "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27?s=1000"},
+		{"empty fallback host", func(v *Libravatar) { v.SetFallbackHost("") }, "http:///avatar/572c3489ea700045927076136a969e27"},
+		{"fallback host with path", func(v *Libravatar) { v.SetFallbackHost("cdn.example.org/x") }, "http://cdn.example.org/x/avatar/572c3489ea700045927076136a969e27"},
+		{"fallback host with userinfo", func(v *Libravatar) { v.SetFallbackHost("user@cdn.example.org") }, "http://user@cdn.example.org/avatar/572c3489ea700045927076136a969e27"},
+		{"empty secure fallback host", func(v *Libravatar) { v.SetUseHTTPS(true); v.SetSecureFallbackHost("") }, "https:///avatar/572c3489ea700045927076136a969e27"},
+		{"secure fallback host with path, over http", func(v *Libravatar) { v.SetSecureFallbackHost("cdn.example.org/x") }, "http://cdn.libravatar.org/avatar/572c3489ea700045927076136a969e27"},
+		{"default not known to Gravatar", func(v *Libravatar) { v.SetDefaultImage(Pagan); v.SetGravatarMode(true) }, "http://www.gravatar.com/avatar/572c3489ea700045927076136a969e27?d=pagan"},
+	}
+
+	for _, c := range cases {
+		avt := New()
+		avt.lookupSRV = srvResponder()
+		c.configure(avt)
+
+		link, err := avt.FromEmail("user@example.org")
+		if err != nil || link != c.lenient {
+			t.Errorf("%s: non-strict FromEmail == %s, %v, expected %s", c.name, link, err, c.lenient)
+		}
+		if err := avt.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: Validate: unexpected error %v", c.name, err)
+		}
+
+		avt.SetStrict(true)
+		if link, err := avt.FromEmail("user@example.org"); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: strict FromEmail == %s, %v, expected an invalid configuration error", c.name, link, err)
+		}
+		if link, err := avt.FromURL("https://openid.example.org/user"); !errors.Is(err, ErrInvalidConfig) && !strings.Contains(c.name, "Gravatar") {
+			t.Errorf("%s: strict FromURL == %s, %v, expected an invalid configuration error", c.name, link, err)
+		}
+	}
+
+	avt := New()
+	avt.lookupSRV = srvResponder()
+	avt.SetStrict(true)
+	avt.SetAvatarSize(512)
+	avt.SetFallbackHost("[::1]:8080")
+	if err := avt.Validate(); err != nil {
+		t.Errorf("Validate of valid configuration: unexpected error %v", err)
+	}
+	if _, err := avt.FromEmail("user@example.org"); err != nil {
+		t.Errorf("strict FromEmail with valid configuration: unexpected error %v", err)
+	}
+	if err := avt.SetDefaultImage("unicorn"); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("SetDefaultImage with unknown keyword: unexpected error %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	upper := func(s string, isOpenID bool) string { return strings.ToUpper(s) }
+	rules := []struct {
+		name      string
+		configure func(*Libravatar)
+	}{
+		{"size too large", func(v *Libravatar) { v.size = 1000 }},
+		{"no fallback host", func(v *Libravatar) { v.SetFallbackHosts() }},
+		{"invalid fallback host", func(v *Libravatar) { v.SetFallbackHosts("cdn.example.org", "cdn.example.org/x") }},
+		{"no secure fallback host", func(v *Libravatar) { v.SetUseHTTPS(true); v.SetSecureFallbackHosts() }},
+		{"unknown default image", func(v *Libravatar) { v.defURL = "unicorn" }},
+		{"default not known to Gravatar", func(v *Libravatar) { v.SetDefaultImage(Pagan); v.SetGravatarMode(true) }},
+		{"default URL not allowed", func(v *Libravatar) {
+			v.SetDefaultImage("https://example.org/default.png")
+			v.SetDefaultURLAllowlist("example.net")
+		}},
+		{"negative image cache TTL", func(v *Libravatar) { v.SetImageCacheDir(t.TempDir()); v.SetImageCacheTTL(-time.Second) }},
+		{"negative image cache size", func(v *Libravatar) { v.SetImageCacheDir(t.TempDir()); v.SetImageCacheMaxBytes(-1) }},
+		{"hash function in Gravatar mode", func(v *Libravatar) { v.SetHashFunc(upper); v.SetGravatarMode(true) }},
+		{"hash function with Gravatar default", func(v *Libravatar) { v.SetHashFunc(upper); v.SetGravatarDefault(true) }},
+	}
+	for _, r := range rules {
+		avt := New()
+		r.configure(avt)
+		err := avt.Validate()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: Validate returned %v, expected ErrInvalidConfig", r.name, err)
+		} else if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 1 {
+			t.Errorf("%s: Validate reported %d problems, expected 1: %v", r.name, n, err)
+		}
+	}
+
+	// all problems are reported together
+	avt := New()
+	for _, i := range []int{0, 2, 4, 7, 10} {
+		rules[i].configure(avt)
+	}
+	err := avt.Validate()
+	if !errors.Is(err, ErrInvalidConfig) || !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("Validate returned %v, expected ErrInvalidConfig and ErrInvalidSize", err)
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 5 {
+		t.Errorf("Validate reported %d problems, expected 5: %v", n, err)
+	}
+	for _, s := range []string{"1000", `"cdn.example.org/x"`, `"unicorn"`, "TTL -1s", "hash function"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Validate error %q does not mention %s", err, s)
+		}
+	}
+
+	// problems with the fallback hosts of both schemes are reported
+	avt = New()
+	avt.SetFallbackHost("cdn.example.org/plain")
+	avt.SetSecureFallbackHost("user@cdn.example.org")
+	err = avt.Validate()
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Validate with invalid plain and secure fallback hosts returned %v", err)
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 2 {
+		t.Errorf("Validate reported %d problems, expected 2: %v", n, err)
+	}
+	for _, s := range []string{`invalid fallback host "cdn.example.org/plain"`, `invalid secure fallback host "user@cdn.example.org"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Validate error %q does not mention %s", err, s)
+		}
+	}
+
+	if err := New().Validate(); err != nil {
+		t.Errorf("Validate of the default configuration: unexpected error %v", err)
+	}
+}
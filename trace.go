@@ -0,0 +1,66 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "context"
+
+// Span names passed to TraceHooks.StartSpan
+const (
+	SpanLookup = "libravatar.lookup" // a cached SRV lookup, attributes domain, service and cache_hit
+	SpanSRV    = "libravatar.srv"    // an SRV query, attributes domain and service
+	SpanFetch  = "libravatar.fetch"  // an HTTP request, attributes http.method, http.url and http.status
+)
+
+// TraceHooks starts spans around the operations performed by a
+// Libravatar object, see SetTraceHooks
+type TraceHooks interface {
+	// StartSpan starts a span called name, child of any span in ctx,
+	// returning the context to be passed to the nested operations
+	// and a function to be called with the outcome of the operation.
+	// Attributes only known once the operation is over, like
+	// cache_hit and http.status, are added to attrs before end is
+	// called.
+	StartSpan(ctx context.Context, name string, attrs map[string]string) (_ context.Context, end func(err error))
+}
+
+// SetTraceHooks sets the hooks used to trace lookups and fetches
+// (nil for none, the default)
+func (v *Libravatar) SetTraceHooks(h TraceHooks) {
+	v.trace = h
+}
+
+// span is an operation being traced, the zero value is a no-op
+type span struct {
+	attrs map[string]string
+	end   func(error)
+}
+
+// set sets the attribute k to val
+func (s span) set(k, val string) {
+	if s.attrs != nil {
+		s.attrs[k] = val
+	}
+}
+
+// finish ends the span with the outcome err
+func (s span) finish(err error) {
+	if s.end != nil {
+		s.end(err)
+	}
+}
+
+// startSpan starts the span name with the attributes in the key and
+// value pairs kv, if tracing is enabled
+func (v *Libravatar) startSpan(ctx context.Context, name string, kv ...string) (context.Context, span) {
+	if v.trace == nil {
+		return ctx, span{}
+	}
+	attrs := make(map[string]string, len(kv)/2+1)
+	for i := 0; i+1 < len(kv); i += 2 {
+		attrs[kv[i]] = kv[i+1]
+	}
+	ctx, end := v.trace.StartSpan(ctx, name, attrs)
+	return ctx, span{attrs: attrs, end: end}
+}
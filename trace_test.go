@@ -0,0 +1,188 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// recordedSpan is a span started by recordingTracer
+type recordedSpan struct {
+	id, parent int
+	name       string
+	attrs      map[string]string
+	ended      bool
+	err        error
+}
+
+// spanKey is the context key of the current span id
+type spanKey struct{}
+
+// spanOf returns the id of the span in ctx, 0 if none
+func spanOf(ctx context.Context) int {
+	id, _ := ctx.Value(spanKey{}).(int)
+	return id
+}
+
+// recordingTracer is a TraceHooks recording the spans started
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (r *recordingTracer) StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &recordedSpan{id: len(r.spans) + 1, parent: spanOf(ctx), name: name, attrs: attrs}
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s.id), func(err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if s.ended {
+			panic("span " + name + " ended twice")
+		}
+		s.ended, s.err = true, err
+	}
+}
+
+// reset returns the spans recorded so far, forgetting them
+func (r *recordingTracer) reset() []*recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := r.spans
+	r.spans = nil
+	return spans
+}
+
+func TestTraceHooks(t *testing.T) {
+
+	const root = 100
+	ctx := context.WithValue(context.Background(), spanKey{}, root)
+	tracer := &recordingTracer{}
+	avt := New()
+	avt.SetTraceHooks(tracer)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if id := spanOf(ctx); id != 2 {
+			t.Errorf("SRV lookup in span %d, expected 2", id)
+		}
+		return srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})(ctx, service, proto, name)
+	}
+	avt.SetHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if id := spanOf(req.Context()); id != 3 {
+			t.Errorf("request in span %d, expected 3", id)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"image/png"}},
+			Body:       io.NopCloser(bytes.NewReader(testPNG)),
+			Request:    req,
+		}, nil
+	})})
+
+	if _, err := avt.GetAvatar(ctx, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.reset()
+	expected := []struct {
+		name   string
+		parent int
+		attrs  map[string]string
+	}{
+		{SpanLookup, root, map[string]string{"domain": "example.org", "service": "avatars", "cache_hit": "false"}},
+		{SpanSRV, 1, map[string]string{"domain": "example.org", "service": "avatars"}},
+		{SpanFetch, root, map[string]string{"http.method": "GET", "http.status": "200"}},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("%d spans, expected %d", len(spans), len(expected))
+	}
+	for i, e := range expected {
+		s := spans[i]
+		if s.name != e.name || s.parent != e.parent {
+			t.Errorf("span %d is %s child of %d, expected %s child of %d", i+1, s.name, s.parent, e.name, e.parent)
+		}
+		for k, val := range e.attrs {
+			if s.attrs[k] != val {
+				t.Errorf("span %s has %s=%q, expected %q", s.name, k, s.attrs[k], val)
+			}
+		}
+		if !s.ended || s.err != nil {
+			t.Errorf("span %s ended %v with %v, expected nil error", s.name, s.ended, s.err)
+		}
+	}
+
+	// a cache hit has no SRV span
+	if _, err := avt.FromEmail("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	spans = tracer.reset()
+	if len(spans) != 1 || spans[0].name != SpanLookup || spans[0].attrs["cache_hit"] != "true" {
+		t.Errorf("spans for a cache hit: %+v", spans)
+	}
+}
+
+func TestTraceHooksErrors(t *testing.T) {
+
+	dnsErr := &net.DNSError{Err: "server misbehaving", Name: "example.org"}
+	httpErr := errors.New("connection refused")
+	tracer := &recordingTracer{}
+	avt := New()
+	avt.SetTraceHooks(tracer)
+	avt.SetDNSErrorPolicy(DNSErrorFail)
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name == "example.net" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return "", nil, dnsErr
+	}
+	avt.SetHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, httpErr
+	})})
+
+	_, err := avt.FromEmail("user@example.org")
+	if err == nil {
+		t.Fatal("no error for a failed lookup")
+	}
+	spans := tracer.reset()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, expected 2", len(spans))
+	}
+	if !errors.Is(spans[0].err, dnsErr) || spans[0].err.Error() != err.Error() {
+		t.Errorf("lookup span ended with %v, expected %v", spans[0].err, err)
+	}
+	if spans[1].err != dnsErr {
+		t.Errorf("SRV span ended with %v, expected %v", spans[1].err, dnsErr)
+	}
+
+	if _, err := avt.GetAvatar(context.Background(), "user@example.net"); err == nil {
+		t.Fatal("no error for a failed fetch")
+	}
+	spans = tracer.reset()
+	fetch := spans[len(spans)-1]
+	if fetch.name != SpanFetch || !fetch.ended || !errors.Is(fetch.err, httpErr) {
+		t.Errorf("fetch span %s ended %v with %v, expected %v", fetch.name, fetch.ended, fetch.err, httpErr)
+	}
+	if _, ok := fetch.attrs["http.status"]; ok {
+		t.Errorf("failed fetch span has http.status %s", fetch.attrs["http.status"])
+	}
+}
+
+func BenchmarkNoTraceHooks(b *testing.B) {
+
+	avt := New()
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, sp := avt.startSpan(ctx, SpanFetch, "http.method", "GET", "http.url", "https://example.org/")
+		sp.set("http.status", "200")
+		sp.finish(nil)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TTLLookuper looks up SRV records, also reporting their time-to-live.
+// A ttl of 0 means unknown.
+type TTLLookuper interface {
+	LookupSRVTTL(ctx context.Context, service, proto, name string) (addrs []*net.SRV, ttl time.Duration, err error)
+}
+
+// TTLPolicy tells how the TTL reported by a TTLLookuper is used to
+// decide how long to cache a lookup result
+type TTLPolicy int
+
+const (
+	// TTLCapped caches results for the TTL, but never longer than
+	// the cache duration (default)
+	TTLCapped TTLPolicy = iota
+	// TTLExact caches results for the TTL
+	TTLExact
+	// TTLIgnore always caches results for the cache duration
+	TTLIgnore
+)
+
+// SetTTLLookuper sets the implementation used for SRV lookups to one
+// able to report record TTLs, which will be honored according to the
+// policy set by SetTTLPolicy
+func (v *Libravatar) SetTTLLookuper(l TTLLookuper) {
+	v.ttlLookuper = l
+}
+
+// SetCacheDuration sets how long SRV lookups are cached, or at most
+// cached depending on the policy set by SetTTLPolicy (0 to disable
+// the cache). The default is 24 hours. It applies to the lookups made
+// afterwards, the SRV cache is purged if disabled.
+func (v *Libravatar) SetCacheDuration(d time.Duration) {
+	v.nameCacheDuration = d
+	if d <= 0 {
+		v.nameCache.purge()
+		v.urlCache.purge()
+	}
+}
+
+// SetNegativeCacheDuration sets how long to remember that a domain has
+// no SRV record, the common case, using the fallback host meanwhile
+// (0, the default, for the duration set by SetCacheDuration, negative
+// not to remember it).
+func (v *Libravatar) SetNegativeCacheDuration(d time.Duration) {
+	v.negativeCacheDuration = d
+}
+
+// SetTTLPolicy sets how record TTLs are used, either TTLCapped
+// (the default), TTLExact or TTLIgnore
+func (v *Libravatar) SetTTLPolicy(policy TTLPolicy) {
+	v.ttlPolicy = policy
+}
+
+// SetTTLBounds sets the shortest and longest record TTLs honored,
+// longer or shorter ones being raised or lowered to them (0 for no
+// bound, the default), protecting from records with TTLs of a few
+// seconds or of weeks. With TTLCapped, results are still never cached
+// longer than the cache duration.
+func (v *Libravatar) SetTTLBounds(min, max time.Duration) error {
+	if min < 0 || max < 0 || max > 0 && min > max {
+		return fmt.Errorf("%w: invalid TTL bounds [%v, %v]", ErrInvalidConfig, min, max)
+	}
+	v.minTTL, v.maxTTL = min, max
+	return nil
+}
+
+// querySRV sends an SRV query for service at host, returning the TTL
+// of the answer if known
+func (v *Libravatar) querySRV(ctx context.Context, service, host string) (addrs []*net.SRV, ttl time.Duration, err error) {
+	ctx, sp := v.startSpan(ctx, SpanSRV, "domain", host, "service", service)
+	defer func() { sp.finish(err) }()
+	if v.ttlLookuper != nil {
+		return v.ttlLookuper.LookupSRVTTL(ctx, service, "tcp", host)
+	}
+	_, addrs, err = v.lookupSRV(ctx, service, "tcp", host)
+	return addrs, 0, err
+}
+
+// cacheTTL returns how long to cache a result with the given ttl
+func (v *Libravatar) cacheTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || v.ttlPolicy == TTLIgnore {
+		return v.nameCacheDuration
+	}
+	if ttl < v.minTTL {
+		ttl = v.minTTL
+	}
+	if v.maxTTL > 0 && ttl > v.maxTTL {
+		ttl = v.maxTTL
+	}
+	if v.ttlPolicy == TTLCapped && ttl > v.nameCacheDuration {
+		return v.nameCacheDuration
+	}
+	return ttl
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// ttlResponder is a TTLLookuper answering every query with one record
+type ttlResponder struct {
+	ttl     time.Duration
+	lookups int
+}
+
+func (r *ttlResponder) LookupSRVTTL(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	r.lookups++
+	return []*net.SRV{{Target: "avatars." + name + ".", Port: 80}}, r.ttl, nil
+}
+
+func TestTTL(t *testing.T) {
+
+	cases := []struct {
+		ttl    time.Duration
+		policy TTLPolicy
+		want   time.Duration
+	}{
+		{300 * time.Second, TTLCapped, 300 * time.Second},
+		{7 * 24 * time.Hour, TTLCapped, 24 * time.Hour},
+		{0, TTLCapped, 24 * time.Hour},
+		{7 * 24 * time.Hour, TTLExact, 7 * 24 * time.Hour},
+		{300 * time.Second, TTLExact, 300 * time.Second},
+		{300 * time.Second, TTLIgnore, 24 * time.Hour},
+	}
+
+	for _, c := range cases {
+		r := &ttlResponder{ttl: c.ttl}
+		avt := New()
+		avt.SetTTLLookuper(r)
+		avt.SetTTLPolicy(c.policy)
+
+		if _, err := avt.FromEmail("user@example.org"); err != nil {
+			t.Fatalf("FromEmail: unexpected error %v", err)
+		}
+		val, _ := avt.nameCache.get(cacheKey{"avatars", "example.org"})
+		if val.ttl != c.want {
+			t.Errorf("TTL %v with policy %d cached for %v, expected %v", c.ttl, c.policy, val.ttl, c.want)
+		}
+
+		// just before expiry the cache is used, just after it is not
+		key := cacheKey{"avatars", "example.org"}
+		val.checkedAt = time.Now().Add(-c.want + time.Minute)
+		avt.nameCache.set(key, val)
+		avt.FromEmail("user@example.org")
+		if r.lookups != 1 {
+			t.Errorf("TTL %v with policy %d: %d lookups before expiry, expected 1", c.ttl, c.policy, r.lookups)
+		}
+		val.checkedAt = time.Now().Add(-c.want - time.Minute)
+		avt.nameCache.set(key, val)
+		avt.FromEmail("user@example.org")
+		if r.lookups != 2 {
+			t.Errorf("TTL %v with policy %d: %d lookups after expiry, expected 2", c.ttl, c.policy, r.lookups)
+		}
+	}
+}
+
+func TestCacheDuration(t *testing.T) {
+
+	r := &ttlResponder{}
+	avt := New()
+	avt.SetTTLLookuper(r)
+	avt.SetCacheDuration(time.Hour)
+	avt.FromEmail("user@example.org")
+	avt.FromEmail("user@example.org")
+	if val, _ := avt.nameCache.get(cacheKey{"avatars", "example.org"}); val.ttl != time.Hour || r.lookups != 1 {
+		t.Errorf("lookup cached for %v with %d lookups, expected 1h and 1", val.ttl, r.lookups)
+	}
+
+	avt.SetCacheDuration(0)
+	if n := avt.nameCache.len(); n != 0 {
+		t.Errorf("%d cache entries after disabling the cache, expected none", n)
+	}
+	avt.FromEmail("user@example.org")
+	avt.FromEmail("user@example.org")
+	if r.lookups != 3 || avt.nameCache.len() != 0 {
+		t.Errorf("%d lookups and %d cache entries with the cache disabled, expected 3 and none", r.lookups, avt.nameCache.len())
+	}
+}
+
+func TestNegativeCacheDuration(t *testing.T) {
+
+	lookups := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		if name == "nxdomain.example.org" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		if name == "records.example.org" {
+			return "", []*net.SRV{{Target: "avatars.example.org.", Port: 80}}, nil
+		}
+		return "", nil, nil
+	}
+
+	cases := []struct {
+		negative time.Duration
+		domain   string
+		want     time.Duration
+	}{
+		{0, "norecords.example.org", 24 * time.Hour},
+		{5 * time.Minute, "norecords.example.org", 5 * time.Minute},
+		{5 * time.Minute, "nxdomain.example.org", 5 * time.Minute},
+		{5 * time.Minute, "records.example.org", 24 * time.Hour},
+	}
+	for _, c := range cases {
+		avt.nameCache.purge()
+		avt.SetNegativeCacheDuration(c.negative)
+		avt.FromEmail("user@" + c.domain)
+		if val, _ := avt.nameCache.get(cacheKey{"avatars", c.domain}); val.ttl != c.want {
+			t.Errorf("%s cached for %v with a negative cache duration of %v, expected %v", c.domain, val.ttl, c.negative, c.want)
+		}
+	}
+
+	avt.nameCache.purge()
+	avt.SetNegativeCacheDuration(-1)
+	lookups = 0
+	avt.FromEmail("user@norecords.example.org")
+	avt.FromEmail("user@norecords.example.org")
+	if lookups != 2 || avt.nameCache.len() != 0 {
+		t.Errorf("%d lookups and %d cache entries without negative caching, expected 2 and none", lookups, avt.nameCache.len())
+	}
+}
+
+func TestTTLBounds(t *testing.T) {
+
+	cases := []struct {
+		ttl      time.Duration
+		policy   TTLPolicy
+		min, max time.Duration
+		want     time.Duration
+	}{
+		{5 * time.Second, TTLCapped, time.Minute, time.Hour, time.Minute},
+		{5 * time.Minute, TTLCapped, time.Minute, time.Hour, 5 * time.Minute},
+		{7 * 24 * time.Hour, TTLExact, time.Minute, 48 * time.Hour, 48 * time.Hour},
+		{7 * 24 * time.Hour, TTLExact, time.Minute, 0, 7 * 24 * time.Hour},
+		{7 * 24 * time.Hour, TTLCapped, 0, 48 * time.Hour, 24 * time.Hour},
+		{5 * time.Second, TTLCapped, 48 * time.Hour, 0, 24 * time.Hour},
+		{0, TTLExact, time.Minute, time.Hour, 24 * time.Hour},
+	}
+
+	for _, c := range cases {
+		avt := New()
+		avt.SetTTLLookuper(&ttlResponder{ttl: c.ttl})
+		avt.SetTTLPolicy(c.policy)
+		if err := avt.SetTTLBounds(c.min, c.max); err != nil {
+			t.Fatalf("SetTTLBounds(%v, %v): unexpected error %v", c.min, c.max, err)
+		}
+		avt.FromEmail("user@example.org")
+		if val, _ := avt.nameCache.get(cacheKey{"avatars", "example.org"}); val.ttl != c.want {
+			t.Errorf("TTL %v with policy %d and bounds [%v, %v] cached for %v, expected %v", c.ttl, c.policy, c.min, c.max, val.ttl, c.want)
+		}
+	}
+
+	avt := New()
+	for _, b := range [][2]time.Duration{{time.Hour, time.Minute}, {-time.Minute, 0}, {0, -time.Minute}} {
+		if err := avt.SetTTLBounds(b[0], b[1]); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("SetTTLBounds(%v, %v) returned %v, expected ErrInvalidConfig", b[0], b[1], err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import "time"
+
+// SetURLCache enables caching of up to maxEntries avatar URLs
+// computed by FromEmail, least recently used ones being evicted
+// first (0, the default, disables it). Cached URLs are dropped as
+// soon as the SRV records they were computed from expire, and on any
+// change to the fallback hosts, https usage or domain settings.
+func (v *Libravatar) SetURLCache(maxEntries int) {
+	if maxEntries <= 0 {
+		v.urlCache = nil
+		return
+	}
+	v.urlCache = &urlCache{newLRU[urlKey, urlEntry](maxEntries)}
+}
+
+// urlKey identifies an avatar URL in the URL cache
+type urlKey struct {
+	email    string // normalized
+	defURL   string
+	size     uint
+	rating   string
+	force    bool
+	gravatar string // gravatarDefault
+	favicon  string
+	extra    string
+	secure   bool
+}
+
+// urlDep is an SRV cache entry a cached URL was computed from
+type urlDep struct {
+	key       cacheKey
+	checkedAt time.Time
+	expires   time.Time
+}
+
+// urlEntry is an URL cache entry
+type urlEntry struct {
+	result Result
+	deps   []urlDep
+}
+
+// urlCache is an LRU cache of avatar URLs
+type urlCache struct {
+	*lru[urlKey, urlEntry]
+}
+
+// get returns the result cached for key, if it is still valid
+// according to valid
+func (c *urlCache) get(key urlKey, valid func([]urlDep) bool) (Result, bool) {
+	e, ok := c.lru.get(key)
+	if !ok {
+		return Result{}, false
+	}
+	if !valid(e.deps) {
+		c.remove(key)
+		return Result{}, false
+	}
+	return e.result, true
+}
+
+// add caches r for key, evicting the least recently used entry
+// if the cache is full
+func (c *urlCache) add(key urlKey, r Result, deps []urlDep) {
+	c.lru.add(key, urlEntry{r, deps})
+}
+
+// purge drops all cached URLs, it is a no-op on a nil cache
+func (c *urlCache) purge() {
+	if c == nil {
+		return
+	}
+	c.lru.purge()
+}
+
+// urlDeps returns the SRV cache entries the URL of an avatar at host,
+// over https if secure is set, depends on, or false if they are not
+// all cached
+func (v *Libravatar) urlDeps(host string, secure bool) ([]urlDep, bool) {
+	if !v.lookupNeeded(host) {
+		return nil, true
+	}
+	keys := []cacheKey{{v.serviceBase, host}}
+	if secure {
+		keys[0].service = v.secureServiceBase
+		if v.secureFallbackToPlainSRV {
+			keys = append(keys, cacheKey{v.serviceBase, host})
+		}
+	}
+
+	now := v.clock.Now()
+	var deps []urlDep
+	for i, k := range keys {
+		val, found := v.getCache(k)
+		if !found || now.Sub(val.checkedAt) > val.ttl {
+			return nil, false
+		}
+		deps = append(deps, urlDep{k, val.checkedAt, val.checkedAt.Add(val.ttl)})
+		if i == 0 && val.target != nil {
+			// no fallback to the plain record
+			break
+		}
+	}
+	return deps, true
+}
+
+// urlDepsValid tells whether the SRV cache entries in deps are still
+// the current ones, and not expired
+func (v *Libravatar) urlDepsValid(deps []urlDep) bool {
+	now := v.clock.Now()
+	for _, d := range deps {
+		val, found := v.getCache(d.key)
+		if !found || !val.checkedAt.Equal(d.checkedAt) || now.After(d.expires) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameDeps tells whether a and b list the same SRV cache entries
+func sameDeps(a, b []urlDep) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].key != b[i].key || !a[i].checkedAt.Equal(b[i].checkedAt) {
+			return false
+		}
+	}
+	return true
+}
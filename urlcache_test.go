@@ -0,0 +1,157 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// expireCache makes all SRV cache entries of v expired
+func expireCache(v *Libravatar) {
+	v.nameCache.update(func(_ cacheKey, val cacheValue) (cacheValue, bool) {
+		val.checkedAt = val.checkedAt.Add(-val.ttl - 1)
+		return val, true
+	})
+}
+
+func TestURLCache(t *testing.T) {
+
+	var target atomic.Value
+	target.Store("one.example.org.")
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if strings.HasPrefix(name, "nosrv") {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return "", []*net.SRV{{Target: target.Load().(string), Port: 80}}, nil
+	}
+	avt.SetURLCache(2)
+
+	mustFromEmail := func(email string) string {
+		t.Helper()
+		link, err := avt.FromEmail(email)
+		if err != nil {
+			t.Fatalf("FromEmail(%s): unexpected error %v", email, err)
+		}
+		return link
+	}
+
+	link := mustFromEmail("user@example.org")
+	if !strings.HasPrefix(link, "http://one.example.org/avatar/") {
+		t.Fatalf("FromEmail == %s", link)
+	}
+	if l := mustFromEmail(" User@example.org"); l != link {
+		t.Errorf("FromEmail == %s, expected %s", l, link)
+	}
+	if n := avt.urlCache.ll.Len(); n != 1 {
+		t.Errorf("%d cached URLs, expected 1", n)
+	}
+
+	// size and default image are part of the key
+	avt.SetAvatarSize(64)
+	if l := mustFromEmail("user@example.org"); l != link+"?s=64" {
+		t.Errorf("FromEmail with size == %s", l)
+	}
+	avt.SetAvatarSize(0)
+
+	// a federated host does not outlive its SRV record
+	target.Store("two.example.org.")
+	if l := mustFromEmail("user@example.org"); l != link {
+		t.Errorf("FromEmail with cached SRV record == %s, expected %s", l, link)
+	}
+	expireCache(avt)
+	if l := mustFromEmail("user@example.org"); !strings.HasPrefix(l, "http://two.example.org/avatar/") {
+		t.Errorf("FromEmail after SRV record expiry == %s", l)
+	}
+
+	// configuration changes drop cached URLs
+	mustFromEmail("user@nosrv.example.org")
+	mustFromEmail("user@nosrv.example.org")
+	avt.SetFallbackHost("fallback.example.org")
+	if l := mustFromEmail("user@nosrv.example.org"); !strings.HasPrefix(l, "http://fallback.example.org/avatar/") {
+		t.Errorf("FromEmail after SetFallbackHost == %s", l)
+	}
+	avt.SetDomainOverride("example.org", "override.example.org")
+	if l := mustFromEmail("user@example.org"); !strings.HasPrefix(l, "http://override.example.org/avatar/") {
+		t.Errorf("FromEmail after SetDomainOverride == %s", l)
+	}
+
+	for i := 0; i < 5; i++ {
+		mustFromEmail(fmt.Sprintf("user%d@example.org", i))
+	}
+	if n := avt.urlCache.ll.Len(); n != 2 {
+		t.Errorf("%d cached URLs, expected at most 2", n)
+	}
+}
+
+func TestURLCacheConcurrency(t *testing.T) {
+
+	var mu sync.Mutex
+	gen := 0
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return "", []*net.SRV{{Target: fmt.Sprintf("gen%d.example.org.", gen), Port: 80}}, nil
+	}
+	avt.SetURLCache(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := avt.FromEmail(fmt.Sprintf("user%d@example.org", j%20)); err != nil {
+					t.Error(err)
+					return
+				}
+				if i == 0 && j%10 == 0 {
+					mu.Lock()
+					gen++
+					mu.Unlock()
+					expireCache(avt)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// once the SRV record expires, no URL for the old target is left
+	mu.Lock()
+	gen++
+	want := fmt.Sprintf("http://gen%d.example.org/", gen)
+	mu.Unlock()
+	expireCache(avt)
+	for j := 0; j < 20; j++ {
+		link, err := avt.FromEmail(fmt.Sprintf("user%d@example.org", j))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(link, want) {
+			t.Errorf("FromEmail == %s, expected it to start with %s", link, want)
+		}
+	}
+}
+
+func BenchmarkFromEmailURLCache(b *testing.B) {
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.SetDefaultImage("https://example.org/default.png")
+	avt.SetAvatarSize(64)
+	avt.SetURLCache(100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := avt.FromEmail("user@example.org"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
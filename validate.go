@@ -0,0 +1,61 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"  // register GIF decoding
+	_ "image/jpeg" // register JPEG decoding
+	_ "image/png"  // register PNG decoding
+	"net/url"
+	"strconv"
+)
+
+// ErrNotAnImage is returned when the server sent something which is
+// not an image
+var ErrNotAnImage = errors.New("libravatar: not an image")
+
+// defaultAvatarSize is the size of avatars when none is requested
+const defaultAvatarSize = 80
+
+// SetValidateImages enables checking that fetched avatars are images
+// which can be decoded, filling their Format, Width and Height.
+// Images which cannot be decoded are rejected with ErrNotAnImage.
+// Images of a size other than the requested one are counted in Stats.
+func (v *Libravatar) SetValidateImages(enable bool) {
+	v.validateImages = enable
+}
+
+// buffered tells whether fetched images need to be read in memory
+// before being handed over
+func (v *Libravatar) buffered() bool {
+	return v.imageCacheDir != "" || v.validateImages
+}
+
+// validateImage checks a, fetched from link, is an image, if enabled
+func (v *Libravatar) validateImage(a *Avatar, link string) error {
+	if !v.validateImages || a.Degraded {
+		return nil
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(a.Data))
+	if err != nil {
+		v.metrics.IncError(ErrorKindInvalidImage)
+		return ErrNotAnImage
+	}
+	a.Format, a.Width, a.Height = format, cfg.Width, cfg.Height
+
+	size := defaultAvatarSize
+	if u, err := url.Parse(link); err == nil {
+		if s, err := strconv.Atoi(u.Query().Get("s")); err == nil {
+			size = s
+		}
+	}
+	if cfg.Width != size || cfg.Height != size {
+		v.stats.sizeMismatches.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// encodedImage returns a size x size image encoded with encode
+func encodedImage(t *testing.T, size int, encode func(*bytes.Buffer, image.Image) error) []byte {
+	var b bytes.Buffer
+	if err := encode(&b, image.NewRGBA(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestValidateImages(t *testing.T) {
+
+	validPNG := encodedImage(t, 80, func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) })
+	truncatedJPEG := encodedImage(t, 80, func(b *bytes.Buffer, img image.Image) error { return jpeg.Encode(b, img, nil) })[:10]
+	html := []byte("<!DOCTYPE html><html><body>Internal error</body></html>")
+
+	bodies := map[string][]byte{
+		hashOf("png@example.org"):  validPNG,
+		hashOf("jpeg@example.org"): truncatedJPEG,
+		hashOf("html@example.org"): html,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bodies[strings.TrimPrefix(r.URL.Path, "/avatar/")])
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	avt := New()
+	avt.lookupSRV = serverResponder(t, srv)
+	avt.SetImageCacheDir(dir)
+	ctx := context.Background()
+
+	// no validation by default, beyond the allowed content types
+	avt.SetAllowedContentTypes()
+	if _, err := avt.GetAvatar(ctx, "html@example.org"); err != nil {
+		t.Errorf("GetAvatar of HTML without validation: unexpected error %v", err)
+	}
+	avt.SetImageCacheDir(t.TempDir())
+	dir = avt.imageCacheDir
+
+	avt.SetValidateImages(true)
+	avt.SetAllowedContentTypes(defaultAllowedTypes...)
+
+	a, err := avt.GetAvatar(ctx, "png@example.org")
+	if err != nil || a.Format != "png" || a.Width != 80 || a.Height != 80 {
+		t.Errorf("GetAvatar of valid PNG == %+v, %v", a, err)
+	}
+	if avt.Stats().SizeMismatches != 0 {
+		t.Errorf("size mismatch reported for a default sized image")
+	}
+
+	for _, email := range []string{"jpeg@example.org", "html@example.org"} {
+		if _, err := avt.GetAvatar(ctx, email); !errors.Is(err, ErrNotAnImage) {
+			t.Errorf("GetAvatar(%q) returned %v, expected ErrNotAnImage", email, err)
+		}
+		if _, _, err := avt.WriteAvatar(ctx, &countingWriter{}, email); !errors.Is(err, ErrNotAnImage) {
+			t.Errorf("WriteAvatar(%q) returned %v, expected ErrNotAnImage", email, err)
+		}
+	}
+	if files := mustReadDir(t, dir); len(files) != 1 {
+		t.Errorf("image cache holds %v, expected only the valid image", files)
+	}
+
+	avt.SetAvatarSize(64)
+	avt.GetAvatar(ctx, "png@example.org")
+	if avt.Stats().SizeMismatches != 1 {
+		t.Errorf("size mismatch not reported for an 80px image requested at 64px")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeTimeout is the time allowed to connect to an SRV target
+// when verifying it
+const probeTimeout = 2 * time.Second
+
+// ErrTargetNoAddress is reported in LookupEvent.ProbeErr when an SRV
+// target does not resolve to any address, see SetVerifyTargetResolves
+var ErrTargetNoAddress = errors.New("libravatar: SRV target has no address")
+
+// SetVerifyTarget enables or disables checking that SRV targets
+// accept connections before using them, falling back to the fallback
+// host if they do not. The outcome is cached together with the SRV
+// record, so targets are probed once per cache lifetime.
+func (v *Libravatar) SetVerifyTarget(verify bool) {
+	v.verifyTarget = verify
+}
+
+// probeTarget checks a TCP connection can be opened to rr. Private
+// addresses are not probed, but refused, when blocked.
+func (v *Libravatar) probeTarget(ctx context.Context, rr *net.SRV) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(strings.TrimSuffix(rr.Target, "."), strconv.Itoa(int(rr.Port)))
+	guard := v.blockingPrivate(ctx) && !v.trustedAddr(addr)
+	if guard {
+		if err := v.checkTarget(ctx, addr); err != nil {
+			v.stats.probeFailures.Add(1)
+			return err
+		}
+	}
+	conn, err := v.dialProbe(ctx, "tcp", addr)
+	if err == nil && guard {
+		if err = checkConn(conn); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		v.stats.probeFailures.Add(1)
+		return err
+	}
+	return conn.Close()
+}
+
+// SetVerifyTargetResolves enables or disables checking that SRV
+// targets resolve to at least one address before using them, falling
+// back to the fallback host if they do not. Like SetVerifyTarget,
+// this costs an additional DNS lookup per cache lifetime. Targets
+// whose lookup fails for other reasons, like timeouts, are used.
+func (v *Libravatar) SetVerifyTargetResolves(verify bool) {
+	v.verifyResolves = verify
+}
+
+// resolveTarget checks the target of rr resolves to an address
+func (v *Libravatar) resolveTarget(ctx context.Context, rr *net.SRV) error {
+	host := strings.TrimSuffix(rr.Target, ".")
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	addrs, err := v.lookupHost(ctx, host)
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	if len(addrs) == 0 {
+		v.stats.probeFailures.Add(1)
+		return fmt.Errorf("%w: %s", ErrTargetNoAddress, host)
+	}
+	return nil
+}
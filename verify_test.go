@@ -0,0 +1,152 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyTarget(t *testing.T) {
+
+	healthy := httptest.NewServer(http.NotFoundHandler())
+	defer healthy.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedResponder := serverResponder(t, closed)
+	closed.Close()
+
+	var probes []string
+	var events []LookupEvent
+	avt := New()
+	avt.SetVerifyTarget(true)
+	dial := avt.dialProbe
+	avt.dialProbe = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		probes = append(probes, addr)
+		return dial(ctx, network, addr)
+	}
+	avt.SetLookupHook(func(ev LookupEvent) { events = append(events, ev) })
+
+	avt.lookupSRV = closedResponder
+	link, err := avt.FromEmail("user@closed.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link, "http://cdn.libravatar.org/avatar/") {
+		t.Errorf("FromEmail with unreachable target == %s, expected the fallback host", link)
+	}
+	if len(events) != 1 || events[0].ProbeErr == nil || events[0].Outcome != OutcomeFallback {
+		t.Errorf("unexpected lookup events %+v", events)
+	}
+	if n := avt.Stats().ProbeFailures; n != 1 {
+		t.Errorf("Stats().ProbeFailures == %d, expected 1", n)
+	}
+
+	avt.lookupSRV = serverResponder(t, healthy)
+	host := strings.TrimPrefix(healthy.URL, "http://")
+	probes = nil
+	for i := 0; i < 3; i++ {
+		link, err := avt.FromEmail("user@healthy.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(link, "http://"+host+"/avatar/") {
+			t.Errorf("FromEmail with healthy target == %s, expected it to use %s", link, host)
+		}
+	}
+	if len(probes) != 1 || probes[0] != host {
+		t.Errorf("healthy target probed %v, expected once", probes)
+	}
+
+	// the verdict expires with the cache entry
+	expireCache(avt)
+	if _, err := avt.FromEmail("user@healthy.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 2 {
+		t.Errorf("healthy target probed %d times after cache expiry, expected 2", len(probes))
+	}
+
+	// private targets are not probed when blocked
+	for _, block := range []func(avt *Libravatar) context.Context{
+		func(avt *Libravatar) context.Context {
+			avt.SetBlockPrivateTargets(true)
+			return context.Background()
+		},
+		func(avt *Libravatar) context.Context {
+			return withBlockPrivate(context.Background(), true)
+		},
+	} {
+		avt := New()
+		avt.SetVerifyTarget(true)
+		probes = nil
+		avt.dialProbe = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			probes = append(probes, addr)
+			return dial(ctx, network, addr)
+		}
+		avt.lookupSRV = serverResponder(t, healthy)
+		link, err := avt.FromEmailContext(block(avt), "user@healthy.example.org")
+		if err != nil || !strings.HasPrefix(link, "http://cdn.libravatar.org/avatar/") {
+			t.Errorf("FromEmail with blocked private target == %s, %v, expected the fallback host", link, err)
+		}
+		if len(probes) != 0 {
+			t.Errorf("blocked private target probed %v", probes)
+		}
+	}
+}
+
+func TestVerifyTargetResolves(t *testing.T) {
+
+	var lookups []string
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "leftover.example.org.", Port: 80})
+	avt.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups = append(lookups, host)
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	// off by default
+	link, err := avt.FromEmail("user@example.org")
+	if err != nil || !strings.HasPrefix(link, "http://leftover.example.org/avatar/") || len(lookups) != 0 {
+		t.Errorf("FromEmail without verification == %s, %v after host lookups %v", link, err, lookups)
+	}
+
+	var events []LookupEvent
+	avt = New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "leftover.example.org.", Port: 80})
+	avt.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups = append(lookups, host)
+		return nil, nil
+	}
+	avt.SetLookupHook(func(ev LookupEvent) { events = append(events, ev) })
+	avt.SetVerifyTargetResolves(true)
+	for i := 0; i < 2; i++ {
+		link, err := avt.FromEmail("user@example.org")
+		if err != nil || !strings.HasPrefix(link, "http://cdn.libravatar.org/avatar/") {
+			t.Errorf("FromEmail with target without addresses == %s, %v, expected the fallback host", link, err)
+		}
+	}
+	if len(lookups) != 1 || lookups[0] != "leftover.example.org" {
+		t.Errorf("host lookups %v, expected a single one for leftover.example.org", lookups)
+	}
+	if len(events) != 2 || !errors.Is(events[0].ProbeErr, ErrTargetNoAddress) || events[1].ProbeErr != nil || events[1].Target != nil {
+		t.Errorf("unexpected lookup events %+v", events)
+	}
+
+	// targets with addresses are used
+	avt = New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.org.", Port: 80})
+	avt.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	avt.SetVerifyTargetResolves(true)
+	if link, err := avt.FromEmail("user@example.org"); err != nil || !strings.HasPrefix(link, "http://avatars.example.org/avatar/") {
+		t.Errorf("FromEmail with resolving target == %s, %v", link, err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// warmCacheWorkers is the number of concurrent lookups performed by
+// WarmCache when no limit was set with SetMaxConcurrentLookups
+const warmCacheWorkers = 8
+
+// WarmCache resolves the given email domains concurrently, populating
+// the cache so that later lookups for them need no DNS query.
+// Failures for single domains do not stop the others, and are all
+// returned joined together.
+func (v *Libravatar) WarmCache(ctx context.Context, domains []string) error {
+	seen := make(map[string]bool, len(domains))
+	var todo []string
+	for _, d := range domains {
+		d, err := canonicalDomain(d)
+		if err != nil || seen[d] {
+			continue
+		}
+		seen[d] = true
+		if !v.lookupNeeded(d) {
+			continue
+		}
+		todo = append(todo, d)
+	}
+
+	var errs []error
+	failed := v.resolveDomains(ctx, todo)
+	for _, d := range todo {
+		if err := failed[d]; err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d, err))
+		}
+	}
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+
+	return errors.Join(errs...)
+}
+
+// resolveDomains looks up the SRV targets of the given domains
+// concurrently, returning the errors met by domain.
+// Concurrency is bounded by SetMaxConcurrentLookups, or by
+// warmCacheWorkers if no limit was set.
+func (v *Libravatar) resolveDomains(ctx context.Context, domains []string) map[string]error {
+	workers := warmCacheWorkers
+	if v.lookupSem != nil {
+		workers = cap(v.lookupSem)
+	}
+	if workers > len(domains) {
+		workers = len(domains)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = make(map[string]error)
+		jobs   = make(chan string)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				if _, err := v.srvTarget(ctx, d); err != nil {
+					mu.Lock()
+					failed[d] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, d := range domains {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- d:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return failed
+}
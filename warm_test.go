@@ -0,0 +1,75 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWarmCache(t *testing.T) {
+
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	avt := New()
+	avt.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		mu.Lock()
+		lookups[service+"/"+name]++
+		mu.Unlock()
+		if strings.HasPrefix(name, "broken") {
+			return "", nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return "", []*net.SRV{{Target: "avatars." + name + ".", Port: 443}}, nil
+	}
+	avt.SetUseHTTPS(true)
+
+	err := avt.WarmCache(context.Background(), []string{
+		"a.example.org", "b.example.org", "a.example.org", " b.example.org ",
+		"broken1.example.org", "broken2.example.org", "",
+	})
+	if err == nil {
+		t.Errorf("WarmCache: expected errors for the broken domains")
+	} else {
+		for _, d := range []string{"broken1.example.org", "broken2.example.org"} {
+			if !strings.Contains(err.Error(), d) {
+				t.Errorf("WarmCache error %q does not mention %q", err, d)
+			}
+		}
+	}
+
+	if len(lookups) != 4 {
+		t.Errorf("lookups %v, expected one per unique domain", lookups)
+	}
+	for k, n := range lookups {
+		if n != 1 || !strings.HasPrefix(k, "avatars-sec/") {
+			t.Errorf("%d lookups for %q, expected exactly one secure lookup", n, k)
+		}
+	}
+
+	before := len(lookups)
+	for _, email := range []string{"user@a.example.org", "user@b.example.org"} {
+		got, err := avt.FromEmail(email)
+		if err != nil {
+			t.Errorf("FromEmail(%q): unexpected error %v", email, err)
+		}
+		if !strings.HasPrefix(got, "https://avatars.") {
+			t.Errorf("FromEmail(%q) == %q, expected the federated host", email, got)
+		}
+	}
+	if len(lookups) != before || avt.Stats().Lookups != 4 {
+		t.Errorf("lookups performed after warming the cache: %v", lookups)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = avt.WarmCache(ctx, []string{"c.example.org"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WarmCache with canceled context returned %v, expected context.Canceled", err)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webFingerAvatarRel is the relation of avatar links in WebFinger
+	// documents
+	webFingerAvatarRel = "http://webfinger.net/rel/avatar"
+	// defaultWebFingerCacheTTL is how long WebFinger answers are
+	// remembered by default
+	defaultWebFingerCacheTTL = time.Hour
+	// webFingerCacheSize is the number of WebFinger answers remembered
+	webFingerCacheSize = 10000
+)
+
+// webFingerEntry is a WebFinger answer in the WebFinger cache
+type webFingerEntry struct {
+	link    string // the avatar link, empty if there is none
+	expires time.Time
+}
+
+// SetWebFinger sets whether FromAccount asks the instance of the
+// account, through WebFinger, for the avatar of the user, before
+// hashing the handle. An avatar link advertised there is returned
+// as is, provided it is an https one if https is used; if there is
+// none, or WebFinger cannot be queried, the avatar is looked up as
+// usual. It is disabled by default.
+//
+// As the instance is named by the handle, WebFinger requests always
+// refuse to connect to private addresses, whatever the setting of
+// SetBlockPrivateTargets.
+func (v *Libravatar) SetWebFinger(enable bool) {
+	v.webFinger = enable
+}
+
+// SetWebFingerCacheTTL sets how long WebFinger answers are remembered
+// (0 to disable). The default is 1 hour.
+func (v *Libravatar) SetWebFingerCacheTTL(ttl time.Duration) {
+	v.webFingerTTL = ttl
+	v.webFingerCache.purge()
+}
+
+// webFingerAvatar returns the avatar link advertised through WebFinger
+// for the account addr, if any, and an https one if secure is set
+func (v *Libravatar) webFingerAvatar(ctx context.Context, addr *mail.Address, secure bool) (string, bool) {
+	account := addr.Address
+	link, cached := "", false
+	if v.webFingerTTL > 0 {
+		if e, ok := v.webFingerCache.get(account); ok {
+			if v.clock.Now().Before(e.expires) {
+				link, cached = e.link, true
+			} else {
+				v.webFingerCache.remove(account)
+			}
+		}
+	}
+
+	if !cached {
+		var ok bool
+		link, ok = v.queryWebFinger(ctx, account)
+		if ok && v.webFingerTTL > 0 {
+			v.webFingerCache.add(account, webFingerEntry{link, v.clock.Now().Add(v.webFingerTTL)})
+		}
+	}
+	if link == "" || secure && !strings.HasPrefix(link, "https://") {
+		return "", false
+	}
+	return link, true
+}
+
+// queryWebFinger asks the instance of account for its avatar link,
+// ok is false if the instance could not answer
+func (v *Libravatar) queryWebFinger(ctx context.Context, account string) (link string, ok bool) {
+	_, host, _ := strings.Cut(account, "@")
+	resource := "acct:" + account
+	u := url.URL{Scheme: "https", Host: host, Path: "/.well-known/webfinger", RawQuery: "resource=" + url.QueryEscape(resource)}
+
+	// the host comes from the handle, it must not be an internal one
+	ctx = withBlockPrivate(ctx, true)
+	resp, err := v.send(ctx, http.MethodGet, u.String(), http.Header{"Accept": {"application/jrd+json, application/json"}})
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// no such account
+		return "", true
+	default:
+		return "", false
+	}
+
+	var doc struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.NewDecoder(limitBody(resp.Body, v.maxBodySize)).Decode(&doc); err != nil {
+		return "", false
+	}
+	for _, l := range doc.Links {
+		if l.Rel != webFingerAvatarRel {
+			continue
+		}
+		if u, err := url.Parse(l.Href); err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" {
+			return l.Href, true
+		}
+	}
+	return "", true
+}
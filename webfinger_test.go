@@ -0,0 +1,138 @@
+// Copyright 2016 by Sandro Santilli <strk@kbt.io>
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package libravatar
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebFinger(t *testing.T) {
+
+	docs := map[string]string{
+		"acct:alice@example.social": `{"subject":"acct:alice@example.social","aliases":[],"links":[
+			{"rel":"self","type":"application/activity+json","href":"https://example.social/users/alice"},
+			{"rel":"http://webfinger.net/rel/avatar","type":"image/png","href":"https://files.example.social/alice.png"}]}`,
+		"acct:bob@example.social":   `{"subject":"acct:bob@example.social","links":[{"rel":"self","href":"https://example.social/users/bob"}]}`,
+		"acct:carol@example.social": `{"links":[{"rel":"http://webfinger.net/rel/avatar","href":`,
+		"acct:dave@example.social":  `{"links":[{"rel":"http://webfinger.net/rel/avatar","href":"javascript:alert(1)"}]}`,
+		"acct:frank@example.social": `{"links":[{"rel":"http://webfinger.net/rel/avatar","href":"http://files.example.social/frank.png"}]}`,
+		"acct:alice@localhost":      `{"links":[{"rel":"http://webfinger.net/rel/avatar","href":"https://files.example.social/alice.png"}]}`,
+	}
+	var queries []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource := r.URL.Query().Get("resource")
+		queries = append(queries, resource)
+		if r.URL.Path != "/.well-known/webfinger" || r.Host != "example.social" && r.Host != "localhost" {
+			t.Errorf("unexpected WebFinger request %s for %s", r.URL, r.Host)
+		}
+		doc, ok := docs[resource]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jrd+json")
+		w.Write([]byte(doc))
+	}))
+	defer srv.Close()
+
+	// send all connections to the test server
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+
+	avt := New()
+	avt.lookupSRV = srvResponder(&net.SRV{Target: "avatars.example.social.", Port: 80})
+	avt.SetHTTPClient(&http.Client{Transport: transport})
+	// WebFinger requests refuse private addresses, like the one of the
+	// test server, unless configured
+	avt.SetSecureFallbackHosts("example.social")
+	clock := newFakeClock()
+	avt.SetClock(clock)
+	avt.SetWebFinger(true)
+
+	hashed := func(handle string) string {
+		return "http://avatars.example.social/avatar/" + hashOf(handle)
+	}
+	cases := []struct {
+		handle string
+		want   string
+	}{
+		{"@alice@example.social", "https://files.example.social/alice.png"}, // present
+		{"bob@example.social", hashed("bob@example.social")},                // absent
+		{"acct:carol@example.social", hashed("carol@example.social")},       // malformed
+		{"dave@example.social", hashed("dave@example.social")},              // not an http link
+		{"erin@example.social", hashed("erin@example.social")},              // unknown account
+	}
+	for _, c := range cases {
+		got, err := avt.FromAccount(c.handle)
+		if err != nil || got != c.want {
+			t.Errorf("FromAccount(%s) == %s, %v, expected %s", c.handle, got, err, c.want)
+		}
+	}
+
+	// disabled by default
+	queries = nil
+	plain := New()
+	plain.lookupSRV = avt.lookupSRV
+	plain.SetHTTPClient(&http.Client{Transport: transport})
+	if got, err := plain.FromAccount("alice@example.social"); err != nil || got != hashed("alice@example.social") || len(queries) != 0 {
+		t.Errorf("FromAccount without WebFinger == %s, %v, %d queries", got, err, len(queries))
+	}
+
+	// answers are cached, but not failures
+	queries = nil
+	for _, h := range []string{"alice@example.social", "bob@example.social", "carol@example.social", "erin@example.social"} {
+		avt.FromAccount(h)
+	}
+	if len(queries) != 1 || queries[0] != "acct:carol@example.social" {
+		t.Errorf("WebFinger queries for cached answers: %v, expected only the malformed one", queries)
+	}
+	clock.Advance(defaultWebFingerCacheTTL + time.Second)
+	queries = nil
+	if got, _ := avt.FromAccount("alice@example.social"); got != "https://files.example.social/alice.png" || len(queries) != 1 {
+		t.Errorf("FromAccount after the cache expired == %s, %d queries, expected 1", got, len(queries))
+	}
+	avt.SetWebFingerCacheTTL(0)
+	queries = nil
+	avt.FromAccount("alice@example.social")
+	avt.FromAccount("alice@example.social")
+	if len(queries) != 2 {
+		t.Errorf("%d WebFinger queries with the cache disabled, expected 2", len(queries))
+	}
+
+	// with https, http links are ignored
+	secure := New()
+	secure.lookupSRV = avt.lookupSRV
+	secure.SetHTTPClient(&http.Client{Transport: transport})
+	secure.SetSecureFallbackHosts("example.social")
+	secure.SetWebFinger(true)
+	if got, err := avt.FromAccount("frank@example.social"); err != nil || got != "http://files.example.social/frank.png" {
+		t.Errorf("FromAccount with an http link == %s, %v", got, err)
+	}
+	secure.SetUseHTTPS(true)
+	if got, err := secure.FromAccount("frank@example.social"); err != nil || got == "http://files.example.social/frank.png" {
+		t.Errorf("FromAccount with an http link and https == %s, %v, expected a hashed link", got, err)
+	}
+
+	// internal hosts are not queried, whatever SetBlockPrivateTargets
+	queries = nil
+	if got, err := avt.FromAccount("alice@localhost"); err != nil || got == "https://files.example.social/alice.png" || len(queries) != 0 {
+		t.Errorf("FromAccount of a local account == %s, %v after %d queries, expected no query", got, err, len(queries))
+	}
+
+	// unreachable instances fall back silently
+	srv.Close()
+	if got, err := avt.FromAccount("alice@example.social"); err != nil || got != hashed("alice@example.social") {
+		t.Errorf("FromAccount with WebFinger down == %s, %v", got, err)
+	}
+}